@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Clients closing the connection in the middle of the response, and what the
+// proxy does with the origin fetch then: eg, read_while_writer or background
+// fill let it complete
+
+package main
+
+import (
+	"time"
+)
+
+// Outcomes of origin fetches, see origin[$path].request[$n].outcome
+const (
+	// fetchCompleted means the handler sent the whole response
+	fetchCompleted = "completed"
+	// fetchAborted means the proxy closed the connection before
+	fetchAborted = "aborted"
+	// fetchInProgress means the handler was still sending the response
+	// after waiting for fetchOutcomeWait
+	fetchInProgress = "in-progress"
+)
+
+// fetchOutcomeWait is how long the outcome of an origin fetch is waited for
+// when checked, as the proxy may keep fetching after the client is done
+const fetchOutcomeWait = 5 * time.Second
+
+// outcome returns the outcome of the n-th hit, starting from 0, of the handler
+// for the given path, waiting up to timeout for the handler to be done. false
+// is returned if the handler was hit fewer times
+func (l *hitLog) outcome(path string, n int, timeout time.Duration) (string, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		hit, ok := l.nth(path, n)
+		if !ok {
+			return "", false
+		}
+		if hit.outcome != "" {
+			return hit.outcome, true
+		}
+		if time.Now().After(deadline) {
+			return fetchInProgress, true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxParseAbortAfter(t *testing.T) {
+	for input, n := range map[string]int{
+		`-abort-after 0`:      0,
+		`-abort-after 100`:    100,
+		`-abort-after 16KB`:   16 << 10,
+		`-abort-after "16KB"`: 16 << 10,
+	} {
+		req := TxReq{}
+		assert.Nil(t, req.Parse(newScanner(strings.NewReader(input))), input)
+		assert.True(t, req.abort, input)
+		assert.Equal(t, n, req.abortAfter, input)
+	}
+
+	for _, input := range []string{`-abort-after "half"`, `-abort-after`} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestHitLogOutcome(t *testing.T) {
+	l := newHitLog()
+	l.add("/a", hitRequest("a-0"))
+	l.add("/a", hitRequest("a-1"))
+	l.finish("/a", 1, fetchAborted)
+
+	outcome, ok := l.outcome("/a", 1, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, fetchAborted, outcome)
+
+	// Still sending the response
+	start := time.Now()
+	outcome, ok = l.outcome("/a", 0, 50*time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, fetchInProgress, outcome)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	_, ok = l.outcome("/a", 2, time.Second)
+	assert.False(t, ok)
+}
+
+func TestRunAbortAfter(t *testing.T) {
+	report := runDirect(t, fmt.Sprintf(`handle "/stream" {
+    tx -body "%s" -send-body-rate 4000
+}
+
+handle "/full" {
+    tx -body "Hello world!"
+}
+
+client "abort" {
+    tx -url "/stream" -abort-after 100
+    expect resp.status eq 200
+    expect resp.body eq "%s"
+}
+
+client "full" {
+    tx -url "/full" -abort-after 1KB
+    expect resp.body eq "Hello world!"
+}
+
+expect origin["/stream"].request[0].outcome eq "aborted"
+expect origin["/full"].request[0].outcome eq "completed"`, strings.Repeat("a", 4000), strings.Repeat("a", 100)))
+	assert.False(t, report.Failed(), report)
+
+	_, err := Parse(strings.NewReader(`client "a" {
+    pipeline
+    tx -url "/a" -abort-after 100
+    tx -url "/b"
+}`))
+	assert.Error(t, err)
+}
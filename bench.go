@@ -0,0 +1,137 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BenchResult holds the outcome of replaying the request of a client stanza
+// many times
+type BenchResult struct {
+	Client    string
+	Requests  int
+	Errors    int
+	Statuses  map[int]int
+	Latencies []time.Duration
+}
+
+// Percentile returns the latency below which the given percentage of
+// requests fall, eg: Percentile(99) for p99
+func (b BenchResult) Percentile(p float64) time.Duration {
+	if len(b.Latencies) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), b.Latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Print logs a summary of the benchmark
+func (b BenchResult) Print() {
+	statuses := make([]any, 0, len(b.Statuses))
+	for status, n := range b.Statuses {
+		statuses = append(statuses, slog.Int(strconv.Itoa(status), n))
+	}
+	slog.Info("Benchmark done", "client", b.Client, "requests", b.Requests, "errors", b.Errors,
+		slog.Group("latency", "p50", b.Percentile(50), "p90", b.Percentile(90), "p99", b.Percentile(99), "max", b.Percentile(100)),
+		slog.Group("statuses", statuses...))
+}
+
+// Bench sends the requests of the given client stanza to the proxy listening
+// on addr, controlled with proxy, at the given rate (per second) for the given duration, using up to concurrency workers at
+// the same time. Each worker sends the requests of all steps in order. They
+// are not sent when all workers are busy, so the actual rate might be lower
+// than the one requested. The results of requests sent during the initial
+// warmup period are discarded. Benchmarking stops early when ctx is done
+func Bench(ctx context.Context, cs ClientStanza, addr string, proxy proxyControl, rate, concurrency int, warmup, duration time.Duration) BenchResult {
+	result := BenchResult{Client: cs.Name, Statuses: make(map[int]int)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	steady := time.Now().Add(warmup)
+
+	jobs := make(chan struct{})
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				for _, step := range cs.Steps {
+					start := time.Now()
+					server, err := step.Request.server(addr, proxy)
+					var resp *ClientResponse
+					if err == nil {
+						resp, err = step.Request.Send(ctx, server)
+					}
+					latency := time.Since(start)
+
+					if start.Before(steady) {
+						// Still warming up
+						continue
+					}
+
+					mu.Lock()
+					result.Requests++
+					if err != nil {
+						result.Errors++
+					} else {
+						result.Statuses[resp.StatusCode]++
+						result.Latencies = append(result.Latencies, latency)
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	deadline := time.After(warmup + duration)
+
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			select {
+			case jobs <- struct{}{}:
+			default:
+				// All workers are busy
+			}
+		}
+	}
+
+	ticker.Stop()
+	close(jobs)
+	wg.Wait()
+
+	return result
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBenchResultPercentile(t *testing.T) {
+	var b BenchResult
+	assert.Equal(t, time.Duration(0), b.Percentile(99))
+
+	for i := 1; i <= 100; i++ {
+		b.Latencies = append(b.Latencies, time.Duration(101-i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, b.Percentile(50))
+	assert.Equal(t, 99*time.Millisecond, b.Percentile(99))
+	assert.Equal(t, 100*time.Millisecond, b.Percentile(100))
+	assert.Equal(t, 1*time.Millisecond, b.Percentile(0))
+}
+
+func TestBench(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	cs := ClientStanza{Name: "nemo", Steps: []ClientStep{{Request: TxReq{uri: "/", method: "GET"}}}}
+	b := Bench(context.Background(), cs, strings.TrimPrefix(server.URL, "http://"), nil, 100, 2, 100*time.Millisecond, 200*time.Millisecond)
+
+	assert.Equal(t, "nemo", b.Client)
+	assert.True(t, b.Requests > 0)
+	assert.Equal(t, 0, b.Errors)
+	assert.Equal(t, b.Requests, b.Statuses[404])
+	assert.Equal(t, b.Requests, len(b.Latencies))
+}
+
+func TestExpectBench(t *testing.T) {
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader("p99 lt 50ms"))))
+	assert.True(t, exp.bench())
+	assert.Equal(t, float64(99), exp.percentile)
+
+	b := BenchResult{Latencies: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}}
+	assert.Equal(t, "20ms", actual(exp.Bench(b)))
+	assert.True(t, passed(exp.Bench(b)))
+
+	b.Latencies = append(b.Latencies, time.Second)
+	assert.False(t, passed(exp.Bench(b)))
+
+	// Latencies can only be compared with lt and gt, to durations
+	for _, input := range []string{
+		`p99 lt "banana"`,
+		`p99 lt 50`,
+		`p99 eq 50ms`,
+		`p99 ne 50ms`,
+		`p99 ~ "ms$"`,
+		`p50 empty-for-head`,
+	} {
+		exp = Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader("p50 gt 1ms"))))
+}
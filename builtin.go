@@ -0,0 +1,130 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Endpoints served by the origin without any handle stanza, in the style of
+// httpbin, so that simple tests only need clients:
+//
+//	/echo        the request received, as JSON
+//	/status/404  an empty response with the given status
+//	/delay/2     a response sent after the given number of seconds
+//	/bytes/1024  the given number of pseudo-random bytes
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBuiltinDelay is the longest delay accepted by /delay
+	maxBuiltinDelay = time.Minute
+	// maxBuiltinBytes is the largest body sent by /bytes
+	maxBuiltinBytes = 100 << 20
+)
+
+// echoResponse is the body sent by /echo
+type echoResponse struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Host    string            `json:"host"`
+	Proto   string            `json:"proto"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// builtin returns the built-in handler serving the given request, or nil
+func builtin(req *http.Request) http.HandlerFunc {
+	path := req.URL.Path
+	if path == "/echo" {
+		return serveEcho
+	}
+
+	name, arg, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || arg == "" || strings.Contains(arg, "/") {
+		return nil
+	}
+	switch name {
+	case "status":
+		if code, err := strconv.Atoi(arg); err == nil && code >= 200 && code <= 599 {
+			return func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(code)
+			}
+		}
+	case "delay":
+		if d, err := parseDelay(arg); err == nil {
+			return func(w http.ResponseWriter, req *http.Request) {
+				select {
+				case <-req.Context().Done():
+				case <-time.After(d):
+					serveEcho(w, req)
+				}
+			}
+		}
+	case "bytes":
+		if n, err := strconv.Atoi(arg); err == nil && n >= 0 && n <= maxBuiltinBytes {
+			return func(w http.ResponseWriter, req *http.Request) {
+				// The same bytes every time, so that caching can be checked
+				body := make([]byte, n)
+				rand.New(rand.NewSource(int64(n))).Read(body)
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("Content-Length", strconv.Itoa(n))
+				w.Write(body)
+			}
+		}
+	}
+	return nil
+}
+
+// parseDelay parses the argument of /delay, a number of seconds or a
+// duration, eg: 2, 0.5 or 500ms, up to maxBuiltinDelay
+func parseDelay(arg string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(arg, 64); err == nil {
+		// Checked before converting, as larger numbers, infinities and
+		// NaN do not fit in a Duration
+		if !(seconds >= 0 && seconds <= maxBuiltinDelay.Seconds()) {
+			return 0, strconv.ErrRange
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err == nil && (d < 0 || d > maxBuiltinDelay) {
+		return 0, strconv.ErrRange
+	}
+	return d, err
+}
+
+// serveEcho sends the request received as JSON, see echoResponse
+func serveEcho(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	echo := echoResponse{
+		Method:  req.Method,
+		URL:     req.URL.RequestURI(),
+		Host:    req.Host,
+		Proto:   req.Proto,
+		Headers: make(map[string]string),
+		Body:    string(body),
+	}
+	for name, values := range req.Header {
+		echo.Headers[name] = strings.Join(values, ", ")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(echo)
+}
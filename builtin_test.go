@@ -0,0 +1,104 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltin(t *testing.T) {
+	for _, path := range []string{"/echo", "/status/503", "/delay/1", "/delay/0.5", "/delay/250ms", "/bytes/0", "/bytes/1024"} {
+		assert.NotNil(t, builtin(httptest.NewRequest("GET", path, nil)), path)
+	}
+	for _, path := range []string{"/", "/echo/1", "/status", "/status/", "/status/abc", "/status/99", "/status/600", "/status/200/1", "/delay/-1", "/delay/2h", "/delay/61", "/delay/Inf", "/delay/+Inf", "/delay/NaN", "/delay/1e300", "/delay/9223372037", "/bytes/-1", "/bytes/1GB", "/banana/1"} {
+		assert.Nil(t, builtin(httptest.NewRequest("GET", path, nil)), path)
+	}
+}
+
+func TestBuiltinEcho(t *testing.T) {
+	req := httptest.NewRequest("POST", "/echo?q=nemo", strings.NewReader("ping"))
+	req.Host = "www.example.org"
+	req.Header.Add("X-Fish", "clown")
+	req.Header.Add("X-Fish", "blue tang")
+	w := httptest.NewRecorder()
+	builtin(req)(w, req)
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var echo echoResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &echo))
+	assert.Equal(t, echoResponse{
+		Method:  "POST",
+		URL:     "/echo?q=nemo",
+		Host:    "www.example.org",
+		Proto:   "HTTP/1.1",
+		Headers: map[string]string{"X-Fish": "clown, blue tang"},
+		Body:    "ping",
+	}, echo)
+}
+
+func TestBuiltinBytes(t *testing.T) {
+	get := func() []byte {
+		req := httptest.NewRequest("GET", "/bytes/1000", nil)
+		w := httptest.NewRecorder()
+		builtin(req)(w, req)
+		assert.Equal(t, "1000", w.Header().Get("Content-Length"))
+		return w.Body.Bytes()
+	}
+	body := get()
+	assert.Len(t, body, 1000)
+	assert.Equal(t, body, get())
+}
+
+func TestRunBuiltin(t *testing.T) {
+	start := time.Now()
+	report := runDirect(t, `client "echo" {
+    tx -url "/echo" -header "X-Fish: nemo"
+    expect resp.body ~ "\"X-Fish\":\"nemo\""
+}
+
+client "status" {
+    tx -url "/status/503"
+    expect resp.status eq 503
+}
+
+client "delay" {
+    tx -url "/delay/200ms"
+    expect resp.status eq 200
+}
+
+client "bytes" {
+    tx -url "/bytes/10"
+    expect resp.headers["Content-Length"] eq "10"
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+
+	// Handlers take precedence
+	report = runDirect(t, `handle "/status/*" {
+    tx -status 200
+}
+
+client "status" {
+    tx -url "/status/503"
+    expect resp.status eq 200
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Diagnostic is a problem found in an HTC program, in a form suitable for
+// editors
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// diagnose parses the HTC program read from r and returns the problems found.
+// If filename is a local path, files referenced by the program are checked too
+func diagnose(filename string, r io.Reader) []Diagnostic {
+	p, err := Parse(r)
+	if err == nil && !strings.Contains(filename, "://") {
+		err = p.loadFiles(filepath.Dir(filename))
+	}
+	if err == nil {
+		return nil
+	}
+
+	d := Diagnostic{File: filename, Severity: "error", Message: err.Error()}
+	if perr, ok := err.(*ParseError); ok {
+		d.Line, d.Column, d.Message = perr.Line, perr.Column, perr.Err.Error()
+	}
+	return []Diagnostic{d}
+}
+
+// parseFile parses the HTC program in the given file, and reads the files it
+// references. Parse errors are prefixed with the name of the file
+func parseFile(filename string) (Program, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return Program{}, err
+	}
+	defer f.Close()
+
+	p, err := Parse(f)
+	if err == nil {
+		err = p.loadFiles(filepath.Dir(filename))
+	}
+	if perr, ok := err.(*ParseError); ok {
+		perr.File = filename
+	}
+	return p, err
+}
+
+// runCheck implements the 'check' subcommand: parse and validate the given HTC
+// files without starting the origin and the proxy
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	diagnosticsJSON := fs.Bool("diagnostics-json", false, "print problems as a JSON list of diagnostics")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check file...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(exitParseError)
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, filename := range fs.Args() {
+		f, err := os.Open(filename)
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{File: filename, Severity: "error", Message: err.Error()})
+			continue
+		}
+		diagnostics = append(diagnostics, diagnose(filename, f)...)
+		f.Close()
+	}
+
+	if *diagnosticsJSON {
+		json.NewEncoder(os.Stdout).Encode(diagnostics)
+	} else {
+		for _, d := range diagnostics {
+			if d.Line > 0 {
+				fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", d.File, d.Line, d.Column, d.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", d.File, d.Message)
+			}
+		}
+	}
+
+	if len(diagnostics) > 0 {
+		os.Exit(exitParseError)
+	}
+}
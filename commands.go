@@ -15,13 +15,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Command is the interface that must be implemented by all commands
@@ -40,19 +55,104 @@ type ExpectField int
 const (
 	EXPECT_METHOD ExpectField = iota
 	EXPECT_HEADERS
+	EXPECT_TRAILERS
+	EXPECT_PROTO
+	EXPECT_HINTS
+	EXPECT_PROXY_IP
+	EXPECT_REMOTE_IP
+	EXPECT_STATUSES
+	EXPECT_CONDITIONAL
+	EXPECT_FORWARDED_CHAIN
+	EXPECT_FORWARDED_LAST
+	EXPECT_XFF_CHAIN
+	EXPECT_XFF_LAST
 	EXPECT_BODY
 	EXPECT_STATUS
+	EXPECT_HITS
+	EXPECT_ORIGIN_METHOD
+	EXPECT_ORIGIN_URL
+	EXPECT_ORIGIN_HEADERS
+	EXPECT_PROXY_METRIC
+	EXPECT_MAXCONNS
+	EXPECT_ORDER
+	EXPECT_CONN_REUSED
+	EXPECT_REDIRECTS
+	EXPECT_REQUESTS
+	EXPECT_RETRIES
+	EXPECT_URL
+	EXPECT_AUTH_USER
+	EXPECT_AUTH_PASSWORD
+	EXPECT_AUTH_BEARER
+	EXPECT_TIME_DNS
+	EXPECT_TIME_CONNECT
+	EXPECT_TIME_TTFB
+	EXPECT_TIME_TOTAL
+	EXPECT_TLS_VERSION
+	EXPECT_TLS_CIPHER
+	EXPECT_TLS_ALPN
+	EXPECT_TLS_CERT_CN
+	EXPECT_TLS_CERT_ISSUER
+	EXPECT_TLS_CERT_SAN
+	EXPECT_TLS_HANDSHAKE
+	EXPECT_TLS_CERT_SERIAL
+	EXPECT_TLS_CERT_CURRENT
+	EXPECT_PERCENTILE
+	EXPECT_RAWHEADERS
+	EXPECT_CONN_END
+	EXPECT_CACHE_PERSISTS
+	EXPECT_STREAMED
+	EXPECT_ORIGIN_OUTCOME
+	EXPECT_ORIGIN_RECEIVED
+	EXPECT_DIGEST
+	EXPECT_ENCODING
+	EXPECT_TRANSFORM
+	EXPECT_VARY
+	EXPECT_CACHE_NEGATIVE
+	EXPECT_CACHE_INVALIDATED
 )
 
 // Expect is a command used to test a certain assumption. For example, the
 // command 'req.method eq "GET"' verifies that the request method is GET, and
 // fail if it is not
 type Expect struct {
-	verbatim   string
+	verbatim string
+	// subject is what the expectation is about, as written in the HTC
+	// program, eg: resp.headers[X-Cache]
+	subject    string
 	field      ExpectField
 	headerName string
-	operator   tokenType
-	expected   string
+	path       string
+	// hit is the index of the request received by the origin handler, eg: 0
+	// for 'expect origin["/"].request[0].method eq "GET"'
+	hit      int
+	operator tokenType
+	expected string
+	// step is the index of the tx command of the client whose response is
+	// checked, if indexed is true. Eg: 1 for 'expect resp[1].status eq 200'.
+	// Otherwise, the response to the preceding tx is checked
+	step    int
+	indexed bool
+	// clients is set by order expectations to the names of the two clients
+	// being compared, and by cache expectations and invalidations to the
+	// names of the clients they add
+	clients []string
+	// client is set by expectations about the response received by a
+	// client, evaluated once all clients are done. Eg: "nemo" for
+	// client["nemo"].resp.status
+	client string
+	// percentile is set by latency expectations in bench mode, eg: 99 for
+	// 'expect p99 lt 50ms'
+	percentile float64
+	// within is set by expectations on responses that should be retried,
+	// sending the request again, until they pass or the given time elapses.
+	// Eg: expect resp.status eq 200 within "5s"
+	within time.Duration
+	// captures are the names of the variables storing the text matched by
+	// the groups of the regular expression, if the expectation passes. Eg:
+	// expect resp.headers["X-Cache"] ~ "hit-(\w+)" capture $dc
+	captures []string
+	// pos is the position of the command in the HTC program, if known
+	pos position
 }
 
 // String pretty-prints an Expect
@@ -60,19 +160,90 @@ func (e Expect) String() string {
 	return fmt.Sprintf("%q", e.verbatim)
 }
 
-// Parse an expect command. Support both requests (expect req[...]) and
-// responses (expect resp[...])
+// Parse an expect command. Support requests (expect req[...]), responses
+// (expect resp[...]), origin handlers (expect origin[...]) and the order in
+// which clients reached the origin (expect order client ...)
 func (e *Expect) Parse(s *scanner) error {
+	// The expect keyword was the last token scanned
+	e.pos = s.last
+
 	// Get something like 'req.method'
 	token := s.ScanUseful()
 	// Start building up e.verbatim
 	e.verbatim = token.val
+	if token.typ == ORDER {
+		return e.parseOrder(s)
+	}
+	if token.typ == CACHE {
+		return e.parseCache(s)
+	}
+	if token.typ == PERCENTILE {
+		e.field = EXPECT_PERCENTILE
+		e.percentile, _ = strconv.ParseFloat(token.val[1:], 64)
+		if err := e.parseComparison(s); err != nil {
+			return err
+		}
+		// Latencies are never exactly the same from one run to the next
+		if e.operator != LESS && e.operator != GREATER {
+			return fmt.Errorf("Parse error in 'expect' command: latencies can only be compared with 'lt' or 'gt', got %s", e)
+		}
+		if _, err := time.ParseDuration(e.expected); err != nil {
+			return fmt.Errorf("Parse error in 'expect' command: expecting a duration to compare latencies with, got %s", e)
+		}
+		return nil
+	}
+	if token.typ == ORIGIN {
+		err := e.parseOrigin(s)
+		if err != nil {
+			return err
+		}
+		return e.parseComparison(s)
+	}
+	if token.typ == PROXY {
+		err := e.parseProxyMetric(s)
+		if err != nil {
+			return err
+		}
+		return e.parseComparison(s)
+	}
+
+	if token.typ == CLIENT {
+		err := e.parseClient(s)
+		if err != nil {
+			return err
+		}
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != RESP {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'client[$name].resp', got %q", token)
+		}
+	}
+
 	if token.typ != REQ && token.typ != RESP {
-		return fmt.Errorf("Parse error in 'expect' command: expecting {req,resp}, got %q", token)
+		return fmt.Errorf("Parse error in 'expect' command: expecting {req,resp,client,origin,proxy}, got %q", token)
 	}
+	isResp := token.typ == RESP
 
 	token = s.ScanUseful()
 	e.verbatim += token.val
+	if isResp && e.client == "" && token.typ == OPEN_BRACKET {
+		// Response to the given tx of the client, eg: resp[1].status
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		n, err := strconv.Atoi(token.val)
+		if token.typ != INTEGER || err != nil || n < 0 {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp[$index]', got %q", token)
+		}
+		e.step, e.indexed = n, true
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != CLOSE_BRACKET {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp[$index]', got %q", token)
+		}
+		token = s.ScanUseful()
+		e.verbatim += token.val
+	}
 	if token.typ != DOT {
 		return fmt.Errorf("Parse error in 'expect' command: expecting something like 'req.method', got %q", token)
 	}
@@ -86,20 +257,233 @@ func (e *Expect) Parse(s *scanner) error {
 		e.field = EXPECT_STATUS
 	} else if token.typ == BODY {
 		e.field = EXPECT_BODY
-	} else if token.typ == HEADERS {
+	} else if token.typ == RAWHEADERS && isResp {
+		if e.client != "" {
+			return fmt.Errorf("Parse error in 'expect' command: resp.rawheaders cannot be used with client[$name], got %q", e.verbatim)
+		}
+		e.field = EXPECT_RAWHEADERS
+	} else if token.typ == CORS && isResp {
+		// resp.cors.allow-origin and friends
+		if err := e.parseCORS(s); err != nil {
+			return err
+		}
+	} else if token.typ == CONN && isResp {
+		// resp.conn.{reused,end}
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != DOT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp.conn.{reused,end}', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		switch token.typ {
+		case REUSED:
+			e.field = EXPECT_CONN_REUSED
+		case END:
+			if e.client != "" {
+				return fmt.Errorf("Parse error in 'expect' command: resp.conn.end cannot be used with client[$name], got %q", e.verbatim)
+			}
+			e.field = EXPECT_CONN_END
+		default:
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp.conn.{reused,end}', got %q", token)
+		}
+	} else if token.typ == STREAMED && isResp {
+		e.field = EXPECT_STREAMED
+	} else if token.typ == DIGEST && isResp {
+		e.field = EXPECT_DIGEST
+	} else if token.typ == ENCODING && isResp {
+		e.field = EXPECT_ENCODING
+	} else if token.typ == TRANSFORM && isResp {
+		e.field = EXPECT_TRANSFORM
+	} else if token.typ == VARY && isResp {
+		e.field = EXPECT_VARY
+	} else if token.typ == REDIRECTS && isResp {
+		e.field = EXPECT_REDIRECTS
+	} else if token.typ == REQUESTS && isResp {
+		e.field = EXPECT_REQUESTS
+	} else if token.typ == RETRIES && isResp {
+		e.field = EXPECT_RETRIES
+	} else if token.typ == URL && isResp {
+		e.field = EXPECT_URL
+	} else if token.typ == AUTH && !isResp {
+		// req.auth.{user,password,bearer}
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != DOT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.auth.{user,password,bearer}', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		switch token.typ {
+		case USER:
+			e.field = EXPECT_AUTH_USER
+		case PASSWORD:
+			e.field = EXPECT_AUTH_PASSWORD
+		case BEARER:
+			e.field = EXPECT_AUTH_BEARER
+		default:
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.auth.{user,password,bearer}', got %q", token)
+		}
+	} else if token.typ == TIME && isResp {
+		// resp.time.{dns,connect,ttfb,total}
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != DOT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp.time.{dns,connect,ttfb,total}', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		switch token.typ {
+		case DNS:
+			e.field = EXPECT_TIME_DNS
+		case CONNECT:
+			e.field = EXPECT_TIME_CONNECT
+		case TTFB:
+			e.field = EXPECT_TIME_TTFB
+		case TOTAL:
+			e.field = EXPECT_TIME_TOTAL
+		default:
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp.time.{dns,connect,ttfb,total}', got %q", token)
+		}
+	} else if token.typ == TLS && isResp {
+		// resp.tls.{handshake,version,cipher,alpn} or
+		// resp.tls.cert.{cn,issuer,san,serial,current}
+		form := "resp.tls.{handshake,version,cipher,alpn,cert.cn,cert.issuer,cert.san,cert.serial,cert.current}"
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != DOT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		switch token.typ {
+		case HANDSHAKE:
+			e.field = EXPECT_TLS_HANDSHAKE
+		case VERSION:
+			e.field = EXPECT_TLS_VERSION
+		case CIPHER:
+			e.field = EXPECT_TLS_CIPHER
+		case ALPN:
+			e.field = EXPECT_TLS_ALPN
+		case CERT:
+			token = s.ScanUseful()
+			e.verbatim += token.val
+			if token.typ != DOT {
+				return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+			}
+
+			token = s.ScanUseful()
+			e.verbatim += token.val
+			switch token.typ {
+			case CN:
+				e.field = EXPECT_TLS_CERT_CN
+			case ISSUER:
+				e.field = EXPECT_TLS_CERT_ISSUER
+			case SAN:
+				e.field = EXPECT_TLS_CERT_SAN
+			case SERIAL:
+				e.field = EXPECT_TLS_CERT_SERIAL
+			case CURRENT:
+				e.field = EXPECT_TLS_CERT_CURRENT
+			default:
+				return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+			}
+		default:
+			return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+		}
+	} else if (token.typ == PROXY || token.typ == REMOTE) && !isResp {
+		// req.proxy.ip or req.remote.ip
+		e.field = EXPECT_PROXY_IP
+		if token.typ == REMOTE {
+			e.field = EXPECT_REMOTE_IP
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != DOT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.{proxy,remote}.ip', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != IP {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.{proxy,remote}.ip', got %q", token)
+		}
+	} else if (token.typ == FORWARDED || token.typ == XFF) && !isResp {
+		// req.{forwarded,xff}.{chain,last}
+		xff := token.typ == XFF
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != DOT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.{forwarded,xff}.{chain,last}', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		switch {
+		case token.typ == CHAIN && xff:
+			e.field = EXPECT_XFF_CHAIN
+		case token.typ == LAST && xff:
+			e.field = EXPECT_XFF_LAST
+		case token.typ == CHAIN:
+			e.field = EXPECT_FORWARDED_CHAIN
+		case token.typ == LAST:
+			e.field = EXPECT_FORWARDED_LAST
+		default:
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.{forwarded,xff}.{chain,last}', got %q", token)
+		}
+	} else if token.typ == STATUSES && isResp {
+		// resp.statuses["429"] or resp.statuses["2xx"]
+		e.field = EXPECT_STATUSES
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != OPEN_BRACKET {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp.statuses[$status]', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != STRING || !statusClass.MatchString(token.val) {
+			return fmt.Errorf("Parse error in 'expect' command: expecting a status like \"429\" or \"4xx\", got %q", token)
+		}
+		e.headerName = token.val
+
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != CLOSE_BRACKET {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'resp.statuses[$status]', got %q", token)
+		}
+	} else if token.typ == CONDITIONAL && !isResp {
+		e.field = EXPECT_CONDITIONAL
+	} else if token.typ == PROTO {
+		e.field = EXPECT_PROTO
+	} else if token.typ == HEADERS || token.typ == TRAILERS || (token.typ == HINTS && isResp) {
 		e.field = EXPECT_HEADERS
+		form := "req.headers[$hdr_name]"
+		if token.typ == TRAILERS {
+			e.field = EXPECT_TRAILERS
+			form = "req.trailers[$hdr_name]"
+		} else if token.typ == HINTS {
+			e.field = EXPECT_HINTS
+			form = "resp.hints[$hdr_name]"
+		}
 
 		// Get header name (open bracket, expect string, close bracket)
 		token = s.ScanUseful()
 		e.verbatim += token.val
 		if token.typ != OPEN_BRACKET {
-			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.headers[$hdr_name]', got %q", token)
+			return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
 		}
 
 		token = s.ScanUseful()
 		e.verbatim += token.val
 		if token.typ != STRING {
-			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.headers[$hdr_name]', got %q", token)
+			return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
 		}
 
 		// We've got something looking like a header name
@@ -108,61 +492,476 @@ func (e *Expect) Parse(s *scanner) error {
 		token = s.ScanUseful()
 		e.verbatim += token.val
 		if token.typ != CLOSE_BRACKET {
-			return fmt.Errorf("Parse error in 'expect' command: expecting 'req.headers[$hdr_name]', got %q", token)
+			return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
 		}
 	} else {
 		return fmt.Errorf("Parse error in 'expect' command: expecting 'req.{method,headers,body}', got %q", token)
 	}
 
-	// Get the operator
+	return e.parseComparison(s)
+}
+
+// parseOrigin parses the part of an expect command following 'origin', eg:
+// ["/endpoint/1"].hits, ["/endpoint/1"].request[0].headers["Host"] or
+// .maxconns
+func (e *Expect) parseOrigin(s *scanner) error {
+	token := s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ == DOT {
+		token = s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != MAXCONNS {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'origin.maxconns', got %q", token)
+		}
+		e.field = EXPECT_MAXCONNS
+		return nil
+	}
+	if token.typ != OPEN_BRACKET {
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'origin[$path].hits' or 'origin.maxconns', got %q", token)
+	}
+
 	token = s.ScanUseful()
-	e.verbatim += " " + token.val
-	if token.typ != EQUAL && token.typ != NOTEQUAL && token.typ != TILDE {
-		return fmt.Errorf("Parse error in 'expect' command: expecting operator to be '{eq,ne,~}', got %q", token)
+	e.verbatim += token.val
+	if token.typ != STRING {
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'origin[$path].hits', got %q", token)
+	}
+
+	e.path = token.val
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != CLOSE_BRACKET {
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'origin[$path].hits', got %q", token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != DOT {
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'origin[$path].hits', got %q", token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ == REQUEST {
+		return e.parseOriginRequest(s)
+	}
+	if token.typ != HITS {
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'origin[$path].{hits,request[$n]}', got %q", token)
+	}
+
+	e.field = EXPECT_HITS
+	return nil
+}
+
+// parseOriginRequest parses the part of an expect command following
+// 'origin[$path].request', eg: [0].headers["Host"]
+func (e *Expect) parseOriginRequest(s *scanner) error {
+	form := "origin[$path].request[$n].{method,url,outcome,received,headers[$hdr_name]}"
+
+	token := s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != OPEN_BRACKET {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != INTEGER {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+	e.hit, _ = strconv.Atoi(token.val)
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != CLOSE_BRACKET {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != DOT {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	switch token.typ {
+	case METHOD:
+		e.field = EXPECT_ORIGIN_METHOD
+		return nil
+	case URL:
+		e.field = EXPECT_ORIGIN_URL
+		return nil
+	case OUTCOME:
+		e.field = EXPECT_ORIGIN_OUTCOME
+		return nil
+	case RECEIVED:
+		e.field = EXPECT_ORIGIN_RECEIVED
+		return nil
+	case HEADERS:
+		e.field = EXPECT_ORIGIN_HEADERS
+	default:
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != OPEN_BRACKET {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != STRING {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
 	}
+	e.headerName = token.val
 
-	// TODO: if token.typ == TILDE, validate regexp with
-	// regexp.MustCompile(str)
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != CLOSE_BRACKET {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+	return nil
+}
+
+// parseProxyMetric parses the part of an expect command following 'proxy',
+// eg: .metric["proxy.process.http.cache_hit_fresh"]
+func (e *Expect) parseProxyMetric(s *scanner) error {
+	for _, typ := range []tokenType{DOT, METRIC, OPEN_BRACKET, STRING, CLOSE_BRACKET} {
+		token := s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != typ {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'proxy.metric[$name]', got %q", token)
+		}
+		if typ == STRING {
+			e.headerName = token.val
+		}
+	}
+
+	e.field = EXPECT_PROXY_METRIC
+	return nil
+}
+
+// parseClient parses the part of an expect command following 'client' and
+// preceding 'resp', eg: ["nemo"].
+func (e *Expect) parseClient(s *scanner) error {
+	for _, typ := range []tokenType{OPEN_BRACKET, STRING, CLOSE_BRACKET, DOT} {
+		token := s.ScanUseful()
+		e.verbatim += token.val
+		if token.typ != typ {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'client[$name].resp', got %q", token)
+		}
+		if typ == STRING {
+			e.client = token.val
+		}
+	}
+	return nil
+}
+
+// parseOrder parses the part of an expect command following 'order', eg:
+// client "a" before client "b"
+func (e *Expect) parseOrder(s *scanner) error {
+	e.field = EXPECT_ORDER
+	e.subject = e.verbatim
+
+	e.clients = make([]string, 2)
+	for i := range e.clients {
+		if i == 1 {
+			token := s.ScanUseful()
+			e.verbatim += " " + token.val
+			if token.typ != BEFORE && token.typ != AFTER {
+				return fmt.Errorf("Parse error in 'expect' command: expecting '{before,after}', got %q", token)
+			}
+			e.operator = token.typ
+		}
+
+		token := s.ScanUseful()
+		e.verbatim += " " + token.val
+		if token.typ != CLIENT {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'client $name', got %q", token)
+		}
+
+		token = s.ScanUseful()
+		e.verbatim += fmt.Sprintf(" %q", token.val)
+		if token.typ != STRING {
+			return fmt.Errorf("Parse error in 'expect' command: expecting 'client $name', got %q", token)
+		}
+		e.clients[i] = token.val
+	}
+
+	return nil
+}
+
+// operatorNames maps operators to their HTC representation
+var operatorNames = map[tokenType]string{
+	EQUAL:     "eq",
+	NOTEQUAL:  "ne",
+	TILDE:     "~",
+	LESS:      "lt",
+	GREATER:   "gt",
+	BEFORE:    "before",
+	AFTER:     "after",
+	EMPTYHEAD: "empty-for-head",
+}
+
+// condition returns what the expectation requires, eg: eq "GET"
+func (e Expect) condition() string {
+	if e.field == EXPECT_ORDER {
+		return fmt.Sprintf("client %q %s client %q", e.clients[0], operatorNames[e.operator], e.clients[1])
+	}
+	if e.field == EXPECT_CACHE_PERSISTS {
+		return persistsCondition
+	}
+	if e.field == EXPECT_CACHE_NEGATIVE {
+		return negativeCondition
+	}
+	if e.field == EXPECT_CACHE_INVALIDATED {
+		return invalidatedCondition
+	}
+	condition := fmt.Sprintf("%s %q", operatorNames[e.operator], e.expected)
+	if e.operator == EMPTYHEAD {
+		condition = operatorNames[e.operator]
+	}
+	if e.within > 0 {
+		return fmt.Sprintf("%s within %s", condition, e.within)
+	}
+	return condition
+}
+
+// global returns true if the expectation is about the whole run rather than a
+// single request or response, and must thus be evaluated once all clients are
+// done
+func (e Expect) global() bool {
+	return e.field == EXPECT_HITS || e.originRequest() || e.field == EXPECT_ORDER || e.field == EXPECT_PROXY_METRIC || e.field == EXPECT_MAXCONNS || e.cache() || e.field == EXPECT_CACHE_INVALIDATED || e.client != ""
+}
+
+// originRequest returns true if the expectation is about a request received
+// by an origin handler, eg: origin["/"].request[0].method
+func (e Expect) originRequest() bool {
+	return e.field == EXPECT_ORIGIN_METHOD || e.field == EXPECT_ORIGIN_URL || e.field == EXPECT_ORIGIN_HEADERS || e.field == EXPECT_ORIGIN_OUTCOME || e.field == EXPECT_ORIGIN_RECEIVED
+}
+
+// bench returns true if the expectation is about the latencies measured in
+// bench mode, in which case it is ignored otherwise
+func (e Expect) bench() bool {
+	return e.field == EXPECT_PERCENTILE
+}
+
+// parseComparison parses the operator and the expected value of an expect
+// command, eg: eq "GET"
+func (e *Expect) parseComparison(s *scanner) error {
+	e.subject = e.verbatim
+
+	// Get the operator
+	token := s.ScanUseful()
+	e.verbatim += " " + token.val
+	if token.typ != EQUAL && token.typ != NOTEQUAL && token.typ != TILDE && token.typ != LESS && token.typ != GREATER && token.typ != EMPTYHEAD {
+		return fmt.Errorf("Parse error in 'expect' command: expecting operator to be '{eq,ne,~,lt,gt,empty-for-head}', got %q", token)
+	}
 
 	e.operator = token.typ
 
-	// Get the value eg: "^(chrome|curl)"
+	if e.operator == EMPTYHEAD {
+		// No value to compare with
+		if e.field != EXPECT_BODY || !strings.HasPrefix(e.subject, "resp") {
+			return fmt.Errorf("Parse error in 'expect' command: 'empty-for-head' can only be used with 'resp.body', got %q", e.subject)
+		}
+	} else {
+		// Get the value eg: "^(chrome|curl)"
+		token = s.ScanUseful()
+		e.verbatim += fmt.Sprintf(" %q", token.val)
+
+		if token.typ != STRING && token.typ != INTEGER && token.typ != DURATION {
+			return fmt.Errorf("Parse error in 'expect' command: expecting a string/integer/duration, got %q", token)
+		}
+
+		if (e.operator == LESS || e.operator == GREATER) && token.typ == STRING {
+			return fmt.Errorf("Parse error in 'expect' command: expecting an integer/duration after %q, got %q", operatorNames[e.operator], token)
+		}
+
+		if e.operator == TILDE {
+			if _, err := regexp.Compile(token.val); err != nil {
+				return fmt.Errorf("Parse error in 'expect' command: invalid regular expression %q: %s", token.val, err)
+			}
+		}
+
+		e.expected = token.val
+	}
+
+	// Optionally, how long to retry for
 	token = s.ScanUseful()
-	e.verbatim += fmt.Sprintf(" %q", token.val)
+	if token.typ == WITHIN {
+		e.verbatim += " " + token.val
 
-	if token.typ != STRING && token.typ != INTEGER {
-		return fmt.Errorf("Parse error in 'expect' command: expecting a string/integer, got %q", token)
+		token = s.ScanUseful()
+		e.verbatim += fmt.Sprintf(" %q", token.val)
+		if token.typ != STRING && token.typ != DURATION {
+			return fmt.Errorf("Parse error in 'expect' command: expecting a duration after 'within', got %q", token)
+		}
+
+		d, err := time.ParseDuration(token.val)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Parse error in 'expect' command: expecting a positive duration after 'within', got %q", token)
+		}
+		e.within = d
+
+		token = s.ScanUseful()
 	}
 
-	e.expected = token.val
+	// Optionally, the variables storing what the regular expression matched
+	if token.typ != CAPTURE {
+		s.unscan(token)
+		return nil
+	}
+	return e.parseCapture(s)
+}
 
+// parseCapture parses the variables following the capture keyword, one for
+// each group of the regular expression, eg: capture $dc $node
+func (e *Expect) parseCapture(s *scanner) error {
+	e.verbatim += " capture"
+
+	if e.operator != TILDE {
+		return fmt.Errorf("Parse error in 'expect' command: 'capture' can only be used with '~'")
+	}
+	groups := regexp.MustCompile(e.expected).NumSubexp()
+
+	for {
+		token := s.ScanUseful()
+		if token.typ != VARIABLE {
+			s.unscan(token)
+			break
+		}
+		e.verbatim += " " + token.val
+		e.captures = append(e.captures, token.val[1:])
+	}
+
+	if len(e.captures) == 0 {
+		return fmt.Errorf("Parse error in 'expect' command: expecting variables after 'capture', eg: $name")
+	}
+	if len(e.captures) > groups {
+		return fmt.Errorf("Parse error in 'expect' command: %d variables given to 'capture', but the regular expression has %d groups", len(e.captures), groups)
+	}
 	return nil
 }
 
-// expectThing returns true if what we expect is true given the value of
-// 'actual'
-func (e Expect) expectThing(actual string) bool {
+// compare returns -1, 0 or 1 depending on whether actual is less than, equal
+// to or greater than expected. Both values are compared as numbers if
+// possible, or as durations otherwise
+func compare(actual, expected string) (int, error) {
+	var a, b float64
+	var err error
+
+	if a, err = strconv.ParseFloat(actual, 64); err == nil {
+		b, err = strconv.ParseFloat(expected, 64)
+	} else {
+		var da, db time.Duration
+		if da, err = time.ParseDuration(actual); err == nil {
+			db, err = time.ParseDuration(expected)
+		}
+		a, b = float64(da), float64(db)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("cannot compare %q and %q", actual, expected)
+	}
+
+	if a < b {
+		return -1, nil
+	} else if a > b {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Evaluation is the outcome of an expect command, telling whether it passed
+// and why
+type Evaluation struct {
+	// Subject is what the expectation is about, eg: resp.headers[X-Cache]
+	Subject string
+	// Operator is the HTC representation of the operator, eg: eq
+	Operator string
+	Expected string
+	Actual   string
+	Passed   bool
+	// Reason explains why the expectation is not met, when the actual value
+	// alone does not tell. Eg: the header is missing, or the value is not a
+	// number
+	Reason string
+	// Submatches holds the text matched by the regular expression of ~
+	// followed by the text matched by its groups, if any
+	Submatches []string
+	// Err is the error preventing the evaluation, if any. Evaluations with
+	// an error never pass
+	Err error
+}
+
+// newEvaluation returns the Evaluation of e, not passed yet
+func (e Expect) newEvaluation() Evaluation {
+	return Evaluation{Subject: e.subject, Operator: operatorNames[e.operator], Expected: e.expected}
+}
+
+// evaluate checks what we expect given the value of 'actual'. err is the
+// error obtaining the actual value, if any
+func (e Expect) evaluate(actual string, err error) Evaluation {
+	ev := e.newEvaluation()
+	ev.Actual, ev.Err = actual, err
+	if err != nil {
+		return ev
+	}
+
 	switch e.operator {
 	case EQUAL:
-		return e.expected == actual
+		ev.Passed = e.expected == actual
 	case NOTEQUAL:
-		return e.expected != actual
+		ev.Passed = e.expected != actual
 	case TILDE:
-		ret, err := regexp.Match(e.expected, []byte(actual))
+		re, err := regexp.Compile(e.expected)
 		if err != nil {
-			log.Panic("regexp.Match error: ", err)
+			ev.Err = err
+			break
 		}
-		return ret
+		ev.Submatches = re.FindStringSubmatch(actual)
+		ev.Passed = ev.Submatches != nil
+	case LESS, GREATER:
+		cmp, err := compare(actual, e.expected)
+		if err != nil {
+			ev.Reason = err.Error()
+			break
+		}
+		if e.operator == LESS {
+			ev.Passed = cmp < 0
+		} else {
+			ev.Passed = cmp > 0
+		}
+	default:
+		ev.Err = fmt.Errorf("unknown operator %q", e.operator)
 	}
 
-	log.Panic("Unknown operator: ", e.operator)
-	return false
+	return ev
+}
+
+// missingHeader sets the reason of a failed evaluation about the given header
+// or trailer, if missing
+func (e Expect) missingHeader(ev Evaluation, h http.Header) Evaluation {
+	if ev.Passed || ev.Err != nil || (e.field != EXPECT_HEADERS && e.field != EXPECT_TRAILERS) {
+		return ev
+	}
+	if _, ok := h[http.CanonicalHeaderKey(e.headerName)]; !ok {
+		what := "header"
+		if e.field == EXPECT_TRAILERS {
+			what = "trailer"
+		}
+		ev.Reason = fmt.Sprintf("no %s %s", e.headerName, what)
+	}
+	return ev
 }
 
 // ActualRequest returns the value in the given http.Request object
 // corresponding to this Expect. For instance, if we are expecting something
 // about the request method, here we return the actual request method sent
-func (e Expect) ActualRequest(req http.Request) string {
+func (e Expect) ActualRequest(req http.Request) (string, error) {
 	var actual string
 
 	switch e.field {
@@ -170,77 +969,641 @@ func (e Expect) ActualRequest(req http.Request) string {
 		actual = req.Method
 	case EXPECT_HEADERS:
 		actual = req.Header.Get(e.headerName)
+	case EXPECT_TRAILERS:
+		actual = req.Trailer.Get(e.headerName)
+	case EXPECT_PROTO:
+		actual = req.Proto
+	case EXPECT_PROXY_IP:
+		actual = proxySource(req.Context())
+	case EXPECT_CONDITIONAL:
+		actual = strconv.FormatBool(conditional(req))
+	case EXPECT_REMOTE_IP:
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			actual = host
+		}
+	case EXPECT_FORWARDED_CHAIN:
+		actual = strings.Join(forwardedFor(req.Header), ", ")
+	case EXPECT_FORWARDED_LAST:
+		actual = lastHop(forwardedFor(req.Header))
+	case EXPECT_XFF_CHAIN:
+		actual = strings.Join(xForwardedFor(req.Header), ", ")
+	case EXPECT_XFF_LAST:
+		actual = lastHop(xForwardedFor(req.Header))
 	case EXPECT_BODY:
 		if req.Body == nil {
-			return ""
+			return "", nil
 		}
 		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			log.Panic(err)
+			return "", fmt.Errorf("reading the request body: %s", err)
+		}
+		if int64(len(body)) < req.ContentLength {
+			return "", fmt.Errorf("the body of %d bytes is too large to be checked", req.ContentLength)
+		}
+		actual = string(body)
+	case EXPECT_AUTH_USER:
+		actual, _, _ = req.BasicAuth()
+	case EXPECT_AUTH_PASSWORD:
+		_, actual, _ = req.BasicAuth()
+	case EXPECT_AUTH_BEARER:
+		auth := req.Header.Get("Authorization")
+		if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+			actual = auth[len("Bearer "):]
+		}
+	case EXPECT_STATUS:
+		return "", fmt.Errorf("requests have no status")
+	}
+
+	return actual, nil
+}
+
+// Request checks the expectations regarding the given request
+func (e Expect) Request(req http.Request) Evaluation {
+	h := req.Header
+	if e.field == EXPECT_TRAILERS {
+		h = req.Trailer
+	}
+	return e.missingHeader(e.evaluate(e.ActualRequest(req)), h)
+}
+
+// ClientResponse is the http.Response received by a client, along with
+// information about how it was obtained
+type ClientResponse struct {
+	http.Response
+	// body is the whole response body, read by TxReq.Send, or its first
+	// maxBufferedBody bytes if bodySize is larger
+	body     []byte
+	bodySize int64
+	// connReused is true if the request was sent on a previously used
+	// connection
+	connReused bool
+	// redirects is the number of redirects followed, see -follow-redirects
+	redirects int
+	// requests is the number of requests sent by the client, including
+	// those following redirects and those sent again with within or burst
+	requests int
+	// retries is the number of times the request was sent again because of
+	// an expectation using within
+	retries int
+	// url is the URL of the last request sent. Requests to the proxy are
+	// shown as path and query only, like -url
+	url string
+	// hints holds the headers of all 103 Early Hints responses received
+	hints http.Header
+	// statuses counts the responses received by status code, when the
+	// request was sent multiple times with burst
+	statuses map[int]int
+	timing   timing
+	// handshakeErr is set if the proxy refused the TLS handshake, in which
+	// case there is no response but resp.tls.handshake can be checked
+	handshakeErr error
+	// rawHeaders are the status line and headers as received, if the
+	// request was sent with rawHeaders or emptyForHead, and rawBody what
+	// was received after them
+	rawHeaders []byte
+	rawBody    []byte
+	// getSize is the size of the body of the response to a GET of the same
+	// URL, if the request was sent with HEAD and emptyForHead
+	getSize *int64
+	// connEnd is how the connection of the response ended, if the request
+	// was sent with connEnd. See connClosed, connReset and connTimeout
+	connEnd string
+	// unanswered is set if the request was pipelined, and the proxy closed
+	// the connection without responding to it
+	unanswered bool
+	// firstBody is when the first body byte was received. originLastChunk
+	// is when the origin started sending the last chunk of the body, if it
+	// streamed it with -send-body-rate
+	firstBody       time.Time
+	originLastChunk time.Time
+	// originSent is the body sent by the origin for the request, if any
+	originSent *sentBody
+}
+
+// statusClass matches the keys of resp.statuses, eg: 429 or 4xx
+var statusClass = regexp.MustCompile(`^[1-5]([0-9][0-9]|xx)$`)
+
+// countStatuses returns how many responses matched the given status, or
+// class of statuses such as 4xx
+func (r ClientResponse) countStatuses(status string) int {
+	statuses := r.statuses
+	if statuses == nil {
+		statuses = map[int]int{r.StatusCode: 1}
+	}
+
+	n := 0
+	for code, count := range statuses {
+		s := strconv.Itoa(code)
+		if s == status || (strings.HasSuffix(status, "xx") && s[:1] == status[:1]) {
+			n += count
+		}
+	}
+	return n
+}
+
+// timing holds the duration of the various phases of a request, measured with
+// httptrace
+type timing struct {
+	dns     time.Duration
+	connect time.Duration
+	// ttfb is the time between sending the request and receiving the first
+	// response byte
+	ttfb time.Duration
+	// total is the time between sending the request and receiving the whole
+	// response body
+	total time.Duration
+}
+
+// bodyExcerptLength is the maximum number of body bytes shown when printing a
+// ClientResponse
+const bodyExcerptLength = 256
+
+// String returns a representation of the response: status, headers sorted by
+// name and the beginning of the body
+func (r ClientResponse) String() string {
+	if r.handshakeErr != nil {
+		return fmt.Sprintf("TLS handshake failed: %s\n", r.handshakeErr)
+	}
+	if r.unanswered {
+		return "No response, the proxy closed the connection\n"
+	}
+	s := fmt.Sprintf("HTTP %d\n", r.StatusCode)
+
+	var names []string
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range r.Header[name] {
+			s += fmt.Sprintf("%s: %s\n", name, value)
+		}
+	}
+
+	if len(r.body) > 0 && !utf8.Valid(r.body) {
+		s += fmt.Sprintf("\n(%d bytes of binary data)\n", len(r.body))
+	} else if len(r.body) > 0 {
+		s += "\n"
+		if len(r.body) > bodyExcerptLength {
+			s += fmt.Sprintf("%s... (%d bytes)\n", r.body[:bodyExcerptLength], len(r.body))
 		} else {
-			actual = string(body)
+			s += string(r.body) + "\n"
+		}
+	}
+	return s
+}
+
+// ActualResponse returns the value in the given ClientResponse object
+// corresponding to this Expect. For instance, if we are expecting something
+// about the response status, here we return the actual response status
+func (e Expect) ActualResponse(resp ClientResponse) (string, error) {
+	var actual string
+
+	if resp.handshakeErr != nil {
+		if e.field == EXPECT_TLS_HANDSHAKE {
+			return "failed", nil
+		}
+		return "", fmt.Errorf("the TLS handshake failed: %s", resp.handshakeErr)
+	}
+
+	switch e.field {
+	case EXPECT_CONN_REUSED:
+		actual = strconv.FormatBool(resp.connReused)
+	case EXPECT_CONN_END:
+		actual = resp.connEnd
+	case EXPECT_STREAMED:
+		if resp.originLastChunk.IsZero() {
+			return "", fmt.Errorf("the origin did not stream the response, see -send-body-rate")
+		}
+		// Bodies buffered by the proxy are received once the origin
+		// is done sending them
+		actual = strconv.FormatBool(!resp.firstBody.IsZero() && resp.firstBody.Before(resp.originLastChunk))
+	case EXPECT_DIGEST:
+		return verifyDigest(resp)
+	case EXPECT_ENCODING:
+		actual = resp.encoding()
+	case EXPECT_TRANSFORM:
+		return transform(resp)
+	case EXPECT_VARY:
+		actual = resp.vary()
+	case EXPECT_REDIRECTS:
+		actual = strconv.Itoa(resp.redirects)
+	case EXPECT_REQUESTS:
+		actual = strconv.Itoa(resp.requests)
+	case EXPECT_RETRIES:
+		actual = strconv.Itoa(resp.retries)
+	case EXPECT_URL:
+		actual = resp.url
+	case EXPECT_TIME_DNS:
+		actual = resp.timing.dns.String()
+	case EXPECT_TIME_CONNECT:
+		actual = resp.timing.connect.String()
+	case EXPECT_TIME_TTFB:
+		actual = resp.timing.ttfb.String()
+	case EXPECT_TIME_TOTAL:
+		actual = resp.timing.total.String()
+	case EXPECT_TLS_HANDSHAKE, EXPECT_TLS_VERSION, EXPECT_TLS_CIPHER, EXPECT_TLS_ALPN, EXPECT_TLS_CERT_CN, EXPECT_TLS_CERT_ISSUER, EXPECT_TLS_CERT_SAN, EXPECT_TLS_CERT_SERIAL, EXPECT_TLS_CERT_CURRENT:
+		return e.actualTLS(resp.TLS)
+	case EXPECT_STATUS:
+		actual = strconv.Itoa(resp.StatusCode)
+	case EXPECT_HEADERS:
+		actual = resp.Header.Get(e.headerName)
+	case EXPECT_TRAILERS:
+		actual = resp.Trailer.Get(e.headerName)
+	case EXPECT_RAWHEADERS:
+		actual = string(resp.rawHeaders)
+	case EXPECT_STATUSES:
+		actual = strconv.Itoa(resp.countStatuses(e.headerName))
+	case EXPECT_HINTS:
+		actual = strings.Join(resp.hints[http.CanonicalHeaderKey(e.headerName)], ", ")
+	case EXPECT_PROTO:
+		actual = resp.Proto
+	case EXPECT_BODY:
+		if resp.truncated() {
+			return "", fmt.Errorf("the body of %d bytes is too large to be checked", resp.bodySize)
+		}
+		actual = string(resp.body)
+	}
+
+	return actual, nil
+}
+
+// Response checks the expectations regarding the given response
+func (e Expect) Response(resp ClientResponse) Evaluation {
+	if e.operator == EMPTYHEAD {
+		return e.emptyForHead(resp)
+	}
+	h := resp.Header
+	if e.field == EXPECT_TRAILERS {
+		h = resp.Trailer
+	}
+	return e.missingHeader(e.evaluate(e.ActualResponse(resp)), h)
+}
+
+// bodyless returns true if responses with the given status code to requests
+// with the given method have no body, as required by RFC 9110
+func bodyless(method string, status int) bool {
+	return method == http.MethodHead || status/100 == 1 || status == http.StatusNoContent || status == http.StatusNotModified
+}
+
+// emptyForHead checks that the response has no body if it must have none:
+// those to HEAD requests and those with status 1xx, 204 or 304. The bytes
+// received after the headers are counted too, as Go discards the body of such
+// responses. The Content-Length of responses to HEAD requests, if any, must
+// be the size of the body of the response to a GET of the same URL. Other
+// responses must have as many bytes as their Content-Length says, if any
+func (e Expect) emptyForHead(resp ClientResponse) Evaluation {
+	ev := e.newEvaluation()
+	ev.Actual = fmt.Sprintf("%d bytes", resp.size())
+
+	method := http.MethodGet
+	if resp.Request != nil {
+		method = resp.Request.Method
+	}
+	length := resp.Header.Get("Content-Length")
+	if bodyless(method, resp.StatusCode) {
+		size := max(resp.size(), int64(len(resp.rawBody)))
+		ev.Actual = fmt.Sprintf("%d bytes", size)
+		if size > 0 {
+			ev.Reason = fmt.Sprintf("%s response with status %d must have no body", method, resp.StatusCode)
+			return ev
+		}
+		if resp.getSize != nil && length != "" && length != strconv.FormatInt(*resp.getSize, 10) {
+			ev.Actual = fmt.Sprintf("Content-Length %s", length)
+			ev.Reason = fmt.Sprintf("the body of the response to GET has %d bytes", *resp.getSize)
+			return ev
+		}
+		ev.Passed = true
+		return ev
+	}
+
+	// The body of gRPC responses is the message, without its framing
+	grpc := strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc")
+	ev.Passed = length == "" || grpc || length == strconv.FormatInt(resp.size(), 10)
+	if !ev.Passed {
+		ev.Reason = fmt.Sprintf("Content-Length is %s", length)
+	}
+	return ev
+}
+
+// Client checks the expectations regarding the response received by a client,
+// once all clients are done. resp is nil if the client received none
+func (e Expect) Client(resp *ClientResponse) Evaluation {
+	if resp == nil {
+		ev := e.newEvaluation()
+		ev.Reason = fmt.Sprintf("client %q received no response", e.client)
+		return ev
+	}
+	return e.Response(*resp)
+}
+
+// ActualOrigin returns the value corresponding to this Expect among the
+// information collected by the origin, for instance the number of hits of a
+// handler, or the metrics of the proxy. ids maps client names to the IDs of
+// the requests they sent
+func (e Expect) ActualOrigin(o *Origin, ids map[string]string) (string, error) {
+	var actual string
+
+	switch e.field {
+	case EXPECT_HITS:
+		actual = strconv.Itoa(o.hits.count(e.path))
+	case EXPECT_MAXCONNS:
+		actual = strconv.Itoa(o.conns.max())
+	case EXPECT_ORIGIN_OUTCOME:
+		// Empty if the handler was not hit that many times
+		actual, _ = o.hits.outcome(e.path, e.hit, fetchOutcomeWait)
+	case EXPECT_ORIGIN_METHOD, EXPECT_ORIGIN_URL, EXPECT_ORIGIN_HEADERS, EXPECT_ORIGIN_RECEIVED:
+		// Empty if the handler was not hit that many times
+		hit, ok := o.hits.nth(e.path, e.hit)
+		if !ok {
+			break
+		}
+		switch e.field {
+		case EXPECT_ORIGIN_METHOD:
+			actual = hit.method
+		case EXPECT_ORIGIN_URL:
+			actual = hit.url
+		case EXPECT_ORIGIN_HEADERS:
+			actual = hit.headers.Get(e.headerName)
+		case EXPECT_ORIGIN_RECEIVED:
+			actual = strconv.Itoa(hit.received)
+		}
+	case EXPECT_ORDER:
+		// Sequence numbers of the first origin fetch caused by each client, 0
+		// meaning never
+		actual = fmt.Sprintf("%s=%d %s=%d",
+			e.clients[0], o.hits.seq(ids[e.clients[0]]),
+			e.clients[1], o.hits.seq(ids[e.clients[1]]))
+	}
+
+	return actual, nil
+}
+
+// Origin checks the expectations regarding the given origin. ids maps client
+// names to the IDs of the requests they sent
+func (e Expect) Origin(o *Origin, ids map[string]string) Evaluation {
+	if e.field != EXPECT_ORDER {
+		ev := e.evaluate(e.ActualOrigin(o, ids))
+		if !ev.Passed && e.originRequest() && ev.Err == nil {
+			if _, ok := o.hits.nth(e.path, e.hit); !ok {
+				ev.Reason = fmt.Sprintf("handler %q received %d requests", e.path, o.hits.count(e.path))
+			}
+		}
+		return ev
+	}
+
+	ev := e.newEvaluation()
+	ev.Expected = e.condition()
+	ev.Actual, ev.Err = e.ActualOrigin(o, ids)
+	first, second := o.hits.seq(ids[e.clients[0]]), o.hits.seq(ids[e.clients[1]])
+	for i, seq := range []int{first, second} {
+		if seq == 0 {
+			ev.Reason = fmt.Sprintf("client %q never reached the origin", e.clients[i])
+			return ev
+		}
+	}
+
+	if e.operator == BEFORE {
+		ev.Passed = first < second
+	} else {
+		ev.Passed = first > second
+	}
+	return ev
+}
+
+// Proxy checks the expectations regarding the metrics of the given proxy
+func (e Expect) Proxy(proxy proxyControl) Evaluation {
+	if proxy == nil {
+		return e.evaluate("", fmt.Errorf("proxy metrics are not available"))
+	}
+	return e.evaluate(proxy.metric(e.headerName))
+}
+
+// ActualBench returns the value corresponding to this Expect in the given
+// BenchResult, for instance the p99 latency
+func (e Expect) ActualBench(b BenchResult) (string, error) {
+	var actual string
+
+	switch e.field {
+	case EXPECT_PERCENTILE:
+		actual = b.Percentile(e.percentile).String()
+	}
+
+	return actual, nil
+}
+
+// Bench checks the expectations regarding the given benchmark
+func (e Expect) Bench(b BenchResult) Evaluation {
+	return e.evaluate(e.ActualBench(b))
+}
+
+// validToken returns true if s is a token as defined by RFC 7230, as needed
+// for header field names and methods. Any token is a valid method, including
+// extension methods such as PURGE, PUSH and BAN
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		if !isLetter(ch) && !isDigit(ch) && !strings.ContainsRune("!#$%&'*+-.^_`|~", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileArg is a file name given as argument to a command, eg: -body-file. The
+// file is read once the whole program is parsed, see Program.loadFiles
+type fileArg struct {
+	path string
+	pos  position
+	// size is set for files larger than maxBufferedBody, which are not read
+	// in memory but streamed when sending
+	size int64
+}
+
+// parseFileArg parses the file name following an argument such as -body-file
+func parseFileArg(s *scanner) (fileArg, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING || token.val == "" {
+		return fileArg{}, fmt.Errorf("Parse error in 'tx' command: expecting a file name, got %q", token)
+	}
+	return fileArg{path: token.val, pos: token.pos}, nil
+}
+
+// parseBody parses the value following a body argument: -body takes a string,
+// while -body-base64 and -body-hex take a string holding encoded bytes, eg:
+// -body-hex "00ff"
+func parseBody(s *scanner, arg token) ([]byte, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING {
+		return nil, fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+	}
+
+	var body []byte
+	var err error
+	switch arg.typ {
+	case BODYBASE64_ARG:
+		body, err = base64.StdEncoding.DecodeString(token.val)
+	case BODYHEX_ARG:
+		body, err = hex.DecodeString(token.val)
+	default:
+		body = []byte(token.val)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Parse error in 'tx' command: invalid %s value %q: %s", arg.val, token.val, err)
+	}
+	return body, nil
+}
+
+// TxResp is the command used to make origin servers return an HTTP response.
+// An example is:
+// tx -body "Hello world!" -header "X-HTC-Origin: true" -status 200
+type TxResp struct {
+	statusCode int
+	headers    map[string]string
+	// trailers are sent after the body, see -trailer
+	trailers map[string]string
+	// earlyHints are sent in a 103 Early Hints response before the final
+	// one, see -early-hint
+	earlyHints map[string]string
+	body       []byte
+	// bodyFile is the file to read body from, if given with -body-file
+	bodyFile fileArg
+	// grpc makes the response a gRPC one, framing body as a gRPC message.
+	// If no body is given, the message received is echoed back
+	grpc bool
+	// dateOffset shifts the Date header from the current time, simulating
+	// an origin with a skewed clock. expiresOffset sets the Expires header
+	// relative to Date
+	dateOffset    time.Duration
+	expiresOffset time.Duration
+	// etag is sent in the ETag header, and requests with a matching
+	// If-None-Match get a 304 response. With -etag auto, it is derived from
+	// the body
+	etag     string
+	etagAuto bool
+	// sendBodyRate streams the body at the given bytes per second, see
+	// streamBody. lastChunk is called right before its last chunk is
+	// written
+	sendBodyRate int
+	lastChunk    func()
+	// digests are the algorithms of the digests of the body sent, see
+	// -digest. fileDigests holds the headers computed for a body file
+	// streamed from disk
+	digests     []string
+	fileDigests map[string]string
+}
+
+// entityTag returns the ETag of the response, or ""
+func (r TxResp) entityTag() string {
+	if r.etagAuto {
+		sum := sha256.Sum256(r.body)
+		return fmt.Sprintf("\"%x\"", sum[:8])
+	}
+	return r.etag
+}
+
+// conditional returns the response to send to the given request: a 304 Not
+// Modified if the request has an If-None-Match header matching the ETag of
+// the response, r itself otherwise
+func (r TxResp) conditional(req *http.Request) TxResp {
+	etag := r.entityTag()
+	inm := req.Header.Get("If-None-Match")
+	if etag == "" || inm == "" {
+		return r
+	}
+
+	// Weak comparison, as required for If-None-Match
+	strip := func(tag string) string {
+		return strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		if strings.TrimSpace(tag) == "*" || strip(tag) == strip(etag) {
+			notModified := r
+			notModified.statusCode = http.StatusNotModified
+			notModified.etag, notModified.etagAuto = etag, false
+			notModified.body = nil
+			notModified.bodyFile = fileArg{}
+			notModified.digests = nil
+			notModified.trailers = nil
+			notModified.grpc = false
+			return notModified
 		}
-	case EXPECT_STATUS:
-		log.Fatal("Requests have no status")
 	}
-
-	return actual
+	return r
 }
 
-// Request returns true if the expectations regarding the given request are
-// met, false otherwise
-func (e Expect) Request(req http.Request) bool {
-	return e.expectThing(e.ActualRequest(req))
+// head returns the response to send to a HEAD request: r with the
+// Content-Length of the body that a GET request would get, which the server
+// only sets by itself for small bodies. The body is then left out by the
+// server
+func (r TxResp) head() TxResp {
+	if r.grpc || len(r.trailers) > 0 || bodyless(http.MethodGet, r.statusCode) {
+		return r
+	}
+	for name := range r.headers {
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding") {
+			return r
+		}
+	}
+
+	headers := make(map[string]string, len(r.headers)+1)
+	for name, value := range r.headers {
+		headers[name] = value
+	}
+	headers["Content-Length"] = strconv.FormatInt(r.bodySize(), 10)
+	r.headers = headers
+	return r
 }
 
-// StringResponse returns a string representation of the given http.Response
-func (e Expect) StringResponse(resp http.Response) string {
-	s := fmt.Sprintf("HTTP %d\n", resp.StatusCode)
-	for key, value := range resp.Header {
-		s += fmt.Sprintf("%s: %s\n", key, value)
+// bodySize returns the size of the body, streamed from a file or not
+func (r TxResp) bodySize() int64 {
+	if r.bodyFile.streamed() {
+		return r.bodyFile.size
 	}
-	return s
+	return int64(len(r.body))
 }
 
-// ActualResponse returns the value in the given http.Response object
-// corresponding to this Expect. For instance, if we are expecting something
-// about the response status, here we return the actual response status
-func (e Expect) ActualResponse(resp http.Response) string {
-	var actual string
+// conditionalHeaders are the headers making a request conditional
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
 
-	switch e.field {
-	case EXPECT_STATUS:
-		actual = strconv.Itoa(resp.StatusCode)
-	case EXPECT_HEADERS:
-		actual = resp.Header.Get(e.headerName)
-	case EXPECT_BODY:
-		if resp.Body == nil {
-			return ""
-		}
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Panic(err)
-		} else {
-			actual = string(body)
+// conditional returns true if the request has any conditional header
+func conditional(req http.Request) bool {
+	for _, name := range conditionalHeaders {
+		if req.Header.Get(name) != "" {
+			return true
 		}
 	}
-
-	return actual
+	return false
 }
 
-// Response returns true if the expectations regarding the given response are
-// met, false otherwise
-func (e Expect) Response(resp http.Response) bool {
-	return e.expectThing(e.ActualResponse(resp))
+// parseOffset parses the argument of -date-offset and -expires-offset, a
+// possibly negative duration, eg: "-1h"
+func parseOffset(s *scanner) (time.Duration, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING && token.typ != DURATION {
+		return 0, fmt.Errorf("Parse error in 'tx' command: expecting a duration, got %q", token)
+	}
+	d, err := time.ParseDuration(token.val)
+	if err != nil {
+		return 0, fmt.Errorf("Parse error in 'tx' command: expecting a duration, got %q", token)
+	}
+	return d, nil
 }
 
-// TxResp is the command used to make origin servers return an HTTP response.
-// An example is:
-// tx -body "Hello world!" -header "X-HTC-Origin: true" -status 200
-type TxResp struct {
-	statusCode int
-	headers    map[string]string
-	body       string
+// parseHeaderArg parses the argument of -header or -trailer, eg:
+// "Cache-Control: s-maxage=120"
+func parseHeaderArg(s *scanner) (string, string, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING {
+		return "", "", fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+	}
+	splitted := strings.SplitN(token.val, ":", 2)
+	if len(splitted) != 2 || !validToken(splitted[0]) {
+		return "", "", fmt.Errorf("Parse error in 'tx' command: expecting a header, got %q", token)
+	}
+	return splitted[0], strings.TrimSpace(splitted[1]), nil
 }
 
 // String pretty-prints a TxResp
@@ -253,29 +1616,84 @@ func (r TxResp) String() string {
 func (r *TxResp) Parse(s *scanner) error {
 	r.statusCode = 200
 	r.headers = make(map[string]string)
+	r.trailers = make(map[string]string)
+	r.earlyHints = make(map[string]string)
+	bodies := 0
 
 	for {
 		token := s.ScanUseful()
 		if token.typ == EOF || token.typ == CLOSE_CURLY || token.typ == NEWLINE {
-			s.unread()
+			s.unscan(token)
 			break
 		}
-		if token.typ == BODY_ARG {
-			token := s.ScanUseful()
-			if token.typ != STRING {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+		if token.typ == BODY_ARG || token.typ == BODYBASE64_ARG || token.typ == BODYHEX_ARG {
+			var err error
+			if r.body, err = parseBody(s, token); err != nil {
+				return err
 			}
-			r.body = token.val
+			bodies++
+		} else if token.typ == BODYFILE_ARG {
+			var err error
+			if r.bodyFile, err = parseFileArg(s); err != nil {
+				return err
+			}
+			bodies++
 		} else if token.typ == HEADER_ARG {
+			name, value, err := parseHeaderArg(s)
+			if err != nil {
+				return err
+			}
+			r.headers[name] = value
+		} else if token.typ == TRAILER_ARG {
+			name, value, err := parseHeaderArg(s)
+			if err != nil {
+				return err
+			}
+			r.trailers[name] = value
+		} else if token.typ == EARLYHINT_ARG {
+			name, value, err := parseHeaderArg(s)
+			if err != nil {
+				return err
+			}
+			r.earlyHints[name] = value
+		} else if token.typ == GRPC_ARG {
+			r.grpc = true
+		} else if token.typ == SENDBODYRATE_ARG {
 			token := s.ScanUseful()
-			if token.typ != STRING {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+			if token.typ != INTEGER {
+				return fmt.Errorf("Parse error in 'tx' command: expecting an integer, got %q", token)
+			}
+			if r.sendBodyRate, _ = strconv.Atoi(token.val); r.sendBodyRate <= 0 {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a positive rate, got %q", token)
+			}
+		} else if token.typ == DIGEST_ARG {
+			algorithm, err := parseDigestArg(s)
+			if err != nil {
+				return err
+			}
+			r.digests = append(r.digests, algorithm)
+		} else if token.typ == ETAG_ARG {
+			token := s.ScanUseful()
+			if token.typ == AUTO {
+				r.etagAuto = true
+			} else if token.typ == STRING && token.val != "" {
+				r.etag = token.val
+				if !strings.HasSuffix(r.etag, `"`) {
+					r.etag = strconv.Quote(r.etag)
+				}
+			} else {
+				return fmt.Errorf("Parse error in 'tx' command: expecting 'auto' or an entity tag, got %q", token)
+			}
+		} else if token.typ == DATEOFFSET_ARG {
+			var err error
+			if r.dateOffset, err = parseOffset(s); err != nil {
+				return err
 			}
-			splitted := strings.SplitN(token.val, ":", 2)
-			if len(splitted) != 2 {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a header, got %q", token)
+		} else if token.typ == EXPIRESOFFSET_ARG {
+			var err error
+			if r.expiresOffset, err = parseOffset(s); err != nil {
+				return err
 			}
-			r.headers[splitted[0]] = splitted[1]
 		} else if token.typ == STATUS_ARG {
 			token := s.ScanUseful()
 			if token.typ != INTEGER {
@@ -284,7 +1702,31 @@ func (r *TxResp) Parse(s *scanner) error {
 
 			r.statusCode, _ = strconv.Atoi(token.val)
 		} else {
-			return fmt.Errorf("Parse error in 'tx' command: expecting -body, -header, or -status, got %q", token)
+			return fmt.Errorf("Parse error in 'tx' command: expecting -body, -body-base64, -body-hex, -body-file, -header, -trailer, -early-hint, -grpc, -send-body-rate, -digest, -date-offset, -expires-offset, -etag, or -status, got %q", token)
+		}
+	}
+
+	if bodies > 1 {
+		return fmt.Errorf("Parse error in 'tx' command: only one of -body, -body-base64, -body-hex, or -body-file can be used")
+	}
+	if r.grpc && (r.sendBodyRate > 0 || len(r.digests) > 0) {
+		return fmt.Errorf("Parse error in 'tx' command: -send-body-rate and -digest cannot be used with -grpc")
+	}
+
+	if err := r.checkReferences(); err != nil {
+		return err
+	}
+
+	if r.grpc {
+		if _, ok := r.headers["Content-Type"]; !ok {
+			r.headers["Content-Type"] = grpcContentType
+		}
+		status := false
+		for name := range r.trailers {
+			status = status || http.CanonicalHeaderKey(name) == grpcStatusTrailer
+		}
+		if !status {
+			r.trailers[grpcStatusTrailer] = "0"
 		}
 	}
 
@@ -293,15 +1735,75 @@ func (r *TxResp) Parse(s *scanner) error {
 
 // Send writes TxResp to the http.ResponseWriter 'writer'
 func (r TxResp) Send(writer http.ResponseWriter) bool {
-	// Add all headers
+	var body io.Reader = bytes.NewReader(r.body)
+	if r.bodyFile.streamed() {
+		file, err := r.bodyFile.open()
+		if err != nil {
+			slog.Warn("Opening body file failed", "err", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		defer file.Close()
+		body = file
+		// Go only sets Content-Length by itself for small bodies
+		r = r.head()
+	}
+
+	// Send early hints first, so that their headers are not repeated in the
+	// final response unless given with -header too
+	if len(r.earlyHints) > 0 {
+		for key, value := range r.earlyHints {
+			writer.Header().Add(key, value)
+		}
+		writer.WriteHeader(http.StatusEarlyHints)
+		for key := range r.earlyHints {
+			writer.Header().Del(key)
+		}
+	}
+
+	// Add all headers, announcing trailers
 	for key, value := range r.headers {
 		writer.Header().Add(key, value)
 	}
+	if etag := r.entityTag(); etag != "" {
+		writer.Header().Set("ETag", etag)
+	}
+	if len(r.digests) > 0 {
+		digests, err := r.digestHeaders()
+		if err != nil {
+			slog.Warn("Computing body digests failed", "err", err)
+		}
+		for key, value := range digests {
+			writer.Header().Set(key, value)
+		}
+	}
+	if r.dateOffset != 0 || r.expiresOffset != 0 {
+		date := time.Now().Add(r.dateOffset).UTC()
+		if r.dateOffset != 0 {
+			writer.Header().Set("Date", date.Format(http.TimeFormat))
+		}
+		if r.expiresOffset != 0 {
+			writer.Header().Set("Expires", date.Add(r.expiresOffset).Format(http.TimeFormat))
+		}
+	}
+	for key := range r.trailers {
+		writer.Header().Add("Trailer", key)
+	}
 	// Send the status code
 	writer.WriteHeader(r.statusCode)
 
 	// Write body
-	fmt.Fprintf(writer, r.body)
+	if r.grpc {
+		writer.Write(grpcFrame(r.body))
+	} else if r.sendBodyRate > 0 {
+		streamBody(writer, body, r.bodySize(), r.sendBodyRate, r.lastChunk)
+	} else {
+		io.Copy(writer, body)
+	}
+
+	for key, value := range r.trailers {
+		writer.Header().Set(key, value)
+	}
 	return true
 }
 
@@ -309,15 +1811,96 @@ func (r TxResp) Send(writer http.ResponseWriter) bool {
 // An example is:
 // tx -url "/hello/world" -header "X-HTC-Origin: true" -method "HEAD"
 type TxReq struct {
-	uri     string
+	uri string
+	// signing signs uri when the request is sent, if set with -url sign(...)
+	signing *urlSigning
+	// host overrides the Host header, if set with -host
+	host    string
 	method  string
 	headers map[string]string
-	body    string
+	body    []byte
+	// bodyFile is the file to read body from, if given with -body-file
+	bodyFile fileArg
+	// noKeepAlive disables connection reuse, sending 'Connection: close'
+	noKeepAlive bool
+	// noRequestID leaves out the requestIDHeader added by the runner, for
+	// proxies or handlers that must not see it
+	noRequestID bool
+	// noDefaults leaves out the options of the defaults stanza
+	noDefaults bool
+	// followRedirects makes the client follow redirects, instead of
+	// returning the 3xx response sent by the proxy
+	followRedirects bool
+	// forward sends uri, an absolute URL, to the proxy acting as a forward
+	// proxy. tunnel sends it through a tunnel opened with CONNECT instead
+	forward bool
+	tunnel  bool
+	// grpc sends body as a gRPC message over HTTP/2 without TLS, and reads
+	// the response body as a gRPC message
+	grpc bool
+	// timeout is how long to wait for the whole response, if set with
+	// -timeout. timeoutPos is where it was set
+	timeout    time.Duration
+	timeoutPos position
+	// sendBodyRate throttles the body to the given bytes per second
+	sendBodyRate int
+	// readRate throttles reading the response body to the given bytes per
+	// second, making the client a slow consumer
+	readRate int
+	// abortAfter is how many bytes of the response body are read before
+	// closing the connection, if abort is set with -abort-after
+	abort      bool
+	abortAfter int
+	// chunked sends the body with chunked transfer encoding rather than
+	// with Content-Length
+	chunked bool
+	// proxyProtocol is the version of the PROXY protocol header sent at the
+	// beginning of connections, if any. proxySrc overrides the source
+	// address it advertises
+	proxyProtocol int
+	proxySrc      net.IP
+	// bind is the local address of client connections, if set with -bind
+	bind net.IP
+	// tls sends the request to the TLS port of the proxy, see TxReq.server.
+	// tlsMin and tlsMax restrict the TLS versions offered, if set with
+	// -tls-min and -tls-max, and sni overrides the server name sent
+	tls    bool
+	tlsMin uint16
+	tlsMax uint16
+	sni    string
+	// clientCert is the common name of the certificate presented by the
+	// client, see clientCert
+	clientCert string
+	// jar keeps the cookies received by the client, if it was given the
+	// cookies command. It is shared by all the requests of the client only
+	jar http.CookieJar
+	// proto is the version of HTTP used, if set with -proto. Only http10 is
+	// handled differently from the default
+	proto string
+	// rawHeaders records the response as received, for resp.rawheaders.
+	// Set by the parser if the response is checked by such expectations
+	rawHeaders bool
+	// connEnd finds out how the connection ended after the response, for
+	// resp.conn.end. Set by the parser like rawHeaders
+	connEnd bool
+	// emptyForHead records the response as received, and follows HEAD
+	// requests with a GET of the same URL, for empty-for-head. Set by the
+	// parser like rawHeaders
+	emptyForHead bool
+}
+
+// absolute returns true if the request is sent to an absolute URL, as
+// required by -forward and -tunnel
+func (r TxReq) absolute() bool {
+	return r.forward || r.tunnel
 }
 
 // String pretty-prints a TxReq
 func (r TxReq) String() string {
 	s := fmt.Sprintf("%s %s\n", r.method, r.uri)
+	if r.host != "" {
+		s += fmt.Sprintf("Host: %s\n", r.host)
+	}
 	for key, value := range r.headers {
 		s += fmt.Sprintf("%s: %s\n", key, value)
 	}
@@ -329,66 +1912,616 @@ func (r TxReq) String() string {
 func (r *TxReq) Parse(s *scanner) error {
 	r.method = "GET"
 	r.headers = make(map[string]string)
+	bodies := 0
 
 	for {
 		token := s.ScanUseful()
 		// Only "expect" is allowed after "tx" in the client stanza
 		if token.typ == EOF || token.typ == CLOSE_CURLY || token.typ == NEWLINE {
-			s.unread()
+			s.unscan(token)
 			break
 		}
-		if token.typ == BODY_ARG {
-			token := s.ScanUseful()
-			if token.typ != STRING {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+		if token.typ == BODY_ARG || token.typ == BODYBASE64_ARG || token.typ == BODYHEX_ARG {
+			var err error
+			if r.body, err = parseBody(s, token); err != nil {
+				return err
 			}
-			r.body = token.val
-		} else if token.typ == HEADER_ARG {
-			token := s.ScanUseful()
-			if token.typ != STRING {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+			bodies++
+		} else if token.typ == BODYFILE_ARG {
+			var err error
+			if r.bodyFile, err = parseFileArg(s); err != nil {
+				return err
 			}
-			splitted := strings.SplitN(token.val, ":", 2)
-			if len(splitted) != 2 {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a header, got %q", token)
+			bodies++
+		} else if token.typ == HEADER_ARG {
+			name, value, err := parseHeaderArg(s)
+			if err != nil {
+				return err
 			}
-			r.headers[splitted[0]] = splitted[1]
+			r.headers[name] = value
+		} else if token.typ == GRPC_ARG {
+			r.grpc = true
 		} else if token.typ == METHOD_ARG {
 			token := s.ScanUseful()
-			if token.typ != STRING {
-				return fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+			if token.typ != STRING || !validToken(token.val) {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a method, got %q", token)
 			}
 
-			// XXX: check that method isn't "banana"
 			r.method = token.val
 		} else if token.typ == URL_ARG {
 			token := s.ScanUseful()
-			if token.typ != STRING {
+			if token.typ == SIGN {
+				var err error
+				if r.uri, r.signing, err = parseSign(s); err != nil {
+					return err
+				}
+			} else if token.typ != STRING {
 				return fmt.Errorf("Parse error in 'tx' command: expecting a string, got %q", token)
+			} else {
+				// XXX: check that url isn't "banana"
+				r.uri = token.val
 			}
-
-			// XXX: check that url isn't "banana"
-			r.uri = token.val
+		} else if token.typ == HOST_ARG {
+			token := s.ScanUseful()
+			if token.typ != STRING || token.val == "" || strings.ContainsAny(token.val, " \t/") {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a host, got %q", token)
+			}
+			r.host = token.val
+		} else if token.typ == NOKEEPALIVE_ARG {
+			r.noKeepAlive = true
+		} else if token.typ == CHUNKED_ARG {
+			r.chunked = true
+		} else if token.typ == NOREQUESTID_ARG {
+			r.noRequestID = true
+		} else if token.typ == NODEFAULTS_ARG {
+			r.noDefaults = true
+		} else if token.typ == FOLLOWREDIRECTS_ARG {
+			r.followRedirects = true
+		} else if token.typ == FORWARD_ARG {
+			r.forward = true
+		} else if token.typ == TUNNEL_ARG {
+			r.tunnel = true
+		} else if token.typ == TIMEOUT_ARG {
+			r.timeoutPos = token.pos
+			token := s.ScanUseful()
+			if token.typ != STRING && token.typ != DURATION {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a duration, got %q", token)
+			}
+			d, err := time.ParseDuration(token.val)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a positive duration, got %q", token)
+			}
+			r.timeout = d
+		} else if token.typ == PROXYPROTOCOL_ARG {
+			token := s.ScanUseful()
+			if token.val != "1" && token.val != "2" {
+				return fmt.Errorf("Parse error in 'tx' command: expecting PROXY protocol version 1 or 2, got %q", token)
+			}
+			r.proxyProtocol, _ = strconv.Atoi(token.val)
+		} else if token.typ == PROXYSRC_ARG {
+			token := s.ScanUseful()
+			if r.proxySrc = net.ParseIP(token.val); token.typ != STRING || r.proxySrc == nil {
+				return fmt.Errorf("Parse error in 'tx' command: expecting an IP address, got %q", token)
+			}
+		} else if token.typ == BIND_ARG {
+			token := s.ScanUseful()
+			if r.bind = net.ParseIP(token.val); token.typ != STRING || r.bind == nil {
+				return fmt.Errorf("Parse error in 'tx' command: expecting an IP address, got %q", token)
+			}
+		} else if token.typ == TLS_ARG {
+			r.tls = true
+		} else if token.typ == TLSMIN_ARG || token.typ == TLSMAX_ARG {
+			v, err := parseTLSVersion(s, token)
+			if err != nil {
+				return err
+			}
+			if token.typ == TLSMIN_ARG {
+				r.tlsMin = v
+			} else {
+				r.tlsMax = v
+			}
+		} else if token.typ == SNI_ARG {
+			token := s.ScanUseful()
+			if token.typ != STRING || token.val == "" || strings.ContainsAny(token.val, " \t/:") {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a server name, got %q", token)
+			}
+			r.sni = token.val
+		} else if token.typ == CLIENTCERT_ARG {
+			token := s.ScanUseful()
+			if token.typ != STRING || token.val == "" {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a common name, got %q", token)
+			}
+			r.clientCert = token.val
+		} else if token.typ == SENDBODYRATE_ARG {
+			token := s.ScanUseful()
+			if token.typ != INTEGER {
+				return fmt.Errorf("Parse error in 'tx' command: expecting an integer, got %q", token)
+			}
+			if r.sendBodyRate, _ = strconv.Atoi(token.val); r.sendBodyRate <= 0 {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a positive rate, got %q", token)
+			}
+		} else if token.typ == READRATE_ARG {
+			token := s.ScanUseful()
+			var ok bool
+			if r.readRate, ok = parseRate(token); !ok || r.readRate <= 0 {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a positive rate like \"10KB/s\", got %q", token)
+			}
+		} else if token.typ == ABORTAFTER_ARG {
+			token := s.ScanUseful()
+			var ok bool
+			switch token.typ {
+			case INTEGER:
+				r.abortAfter, _ = strconv.Atoi(token.val)
+				ok = true
+			case SIZE, STRING:
+				r.abortAfter, ok = parseSize(token.val)
+			}
+			if !ok {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a size like \"16KB\", got %q", token)
+			}
+			r.abort = true
+		} else if token.typ == BASICAUTH_ARG {
+			token := s.ScanUseful()
+			if token.typ != STRING || !strings.Contains(token.val, ":") {
+				return fmt.Errorf("Parse error in 'tx' command: expecting \"user:password\", got %q", token)
+			}
+			r.headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(token.val))
+		} else if token.typ == PROTO_ARG {
+			token := s.ScanUseful()
+			if token.val != http10 && token.val != "HTTP/1.1" {
+				return fmt.Errorf("Parse error in 'tx' command: expecting \"HTTP/1.0\" or \"HTTP/1.1\", got %q", token)
+			}
+			r.proto = token.val
+		} else if token.typ == BEARER_ARG {
+			token := s.ScanUseful()
+			if token.typ != STRING || token.val == "" {
+				return fmt.Errorf("Parse error in 'tx' command: expecting a token, got %q", token)
+			}
+			r.headers["Authorization"] = "Bearer " + token.val
 		} else {
-			return fmt.Errorf("Parse error in 'tx' command: expecting -url, -header, method, or -body, got %q", token)
+			return fmt.Errorf("Parse error in 'tx' command: expecting -url, -host, -header, -method, -body, -body-base64, -body-hex, -body-file, -basic-auth, -bearer, -no-keepalive, -no-request-id, -no-defaults, -follow-redirects, -forward, -tunnel, -grpc, -proto, -timeout, -send-body-rate, -read-rate, -proxy-protocol, -proxy-src, -bind, -tls, -tls-min, -tls-max, -sni, or -client-cert, got %q", token)
+		}
+	}
+
+	if r.proxySrc != nil && r.proxyProtocol == 0 {
+		return fmt.Errorf("Parse error in 'tx' command: -proxy-src needs -proxy-protocol")
+	}
+
+	if r.grpc {
+		r.method = "POST"
+		r.headers["Content-Type"] = grpcContentType
+		r.headers["TE"] = "trailers"
+	}
+
+	if bodies > 1 {
+		return fmt.Errorf("Parse error in 'tx' command: only one of -body, -body-base64, -body-hex, or -body-file can be used")
+	}
+
+	return r.check()
+}
+
+// check returns an error if the options of the request cannot be used
+// together. Parse calls it, and so does the parser again once the defaults
+// are applied
+func (r TxReq) check() error {
+	if r.forward && r.tunnel {
+		return fmt.Errorf("Parse error in 'tx' command: only one of -forward or -tunnel can be used")
+	}
+	if !r.tls && (r.tlsMin != 0 || r.tlsMax != 0 || r.sni != "" || r.clientCert != "") {
+		return fmt.Errorf("Parse error in 'tx' command: -tls-min, -tls-max, -sni and -client-cert need -tls")
+	}
+	if r.tls && (r.absolute() || r.grpc) {
+		return fmt.Errorf("Parse error in 'tx' command: -tls cannot be used with -forward, -tunnel or -grpc")
+	}
+	if r.proto == http10 && (r.tls || r.grpc || r.absolute() || r.followRedirects) {
+		return fmt.Errorf("Parse error in 'tx' command: -proto \"HTTP/1.0\" cannot be used with -tls, -grpc, -forward, -tunnel or -follow-redirects")
+	}
+	if r.chunked && (r.tls || r.grpc || r.proto == http10) {
+		return fmt.Errorf("Parse error in 'tx' command: -chunked cannot be used with -tls, -grpc or -proto \"HTTP/1.0\"")
+	}
+	if r.tlsMin != 0 && r.tlsMax != 0 && r.tlsMin > r.tlsMax {
+		return fmt.Errorf("Parse error in 'tx' command: -tls-min cannot be greater than -tls-max")
+	}
+	if r.absolute() {
+		if u, err := url.Parse(r.uri); err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("Parse error in 'tx' command: -forward and -tunnel need an absolute http:// URL, got %q", r.uri)
+		} else if r.tunnel && !loopback(u.Hostname()) {
+			// Unlike requests, tunnels are not remapped to the origin:
+			// the proxy would reach out to any other host
+			return fmt.Errorf("Parse error in 'tx' command: -tunnel needs a localhost target, got %q", u.Host)
 		}
 	}
 
 	return nil
 }
 
-// Send the TxReq to the given server
-func (r TxReq) Send(server string) (*http.Response, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest(r.method, fmt.Sprintf("http://%s%s", server, r.uri), strings.NewReader(r.body))
+// maxRedirects is the maximum number of redirects followed by clients using
+// -follow-redirects
+const maxRedirects = 10
+
+// errClientTimeout is returned by TxReq.Send when no response is received
+// within the time set with -timeout
+var errClientTimeout = errors.New("no response within the time set with -timeout")
+
+// Send the TxReq to the given server, the TLS port of the proxy for requests
+// using -tls, see TxReq.server. The request is aborted when ctx is done or the
+// time set with -timeout elapses
+func (r TxReq) Send(ctx context.Context, server string) (*ClientResponse, error) {
+	parent := ctx
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	// fail tells a client timeout apart from ctx being done
+	fail := func(err error) (*ClientResponse, error) {
+		if r.timeout > 0 && ctx.Err() != nil && parent.Err() == nil {
+			return nil, errClientTimeout
+		}
+		return nil, err
+	}
+
+	scheme := "http"
+	if r.tls {
+		scheme = "https"
+	}
+
+	redirects := 0
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !r.followRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			redirects++
+			return nil
+		},
+		Jar: r.jar,
+	}
+	var raw *rawRecorder
+	var dial dialFunc
+	if r.noKeepAlive || r.absolute() || r.grpc || r.proxyProtocol > 0 || r.bind != nil || r.tls || r.rawHeaders || r.emptyForHead || r.connEnd || r.proto == http10 || r.readRate > 0 || r.abort {
+		transport := &http.Transport{DisableKeepAlives: r.noKeepAlive}
+		if r.grpc {
+			transport.Protocols = grpcProtocols()
+		}
+		if r.tls {
+			transport.TLSClientConfig = r.tlsConfig()
+			transport.ForceAttemptHTTP2 = true
+		}
+
+		dial = r.dialer(server)
+		if r.forward {
+			transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: server})
+		}
+		// The bytes of TLS and HTTP/2 connections say nothing about
+		// bodies
+		if r.rawHeaders || (r.emptyForHead && !r.tls && !r.grpc) {
+			raw = &rawRecorder{}
+			dial = raw.dial(dial)
+		}
+		if r.connEnd {
+			dial = endDialer(dial)
+			defer transport.CloseIdleConnections()
+		}
+		transport.DialContext = dial
+		client.Transport = transport
+	}
+
+	target := fmt.Sprintf("%s://%s%s", scheme, server, r.uri)
+	if r.absolute() {
+		target = r.uri
+	}
+
+	body := r.body
+	if r.grpc {
+		body = grpcFrame(body)
+	}
+
+	req, err := http.NewRequest(r.method, target, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
+	if err := r.setFileBody(req); err != nil {
+		return nil, err
+	}
+	if r.sendBodyRate > 0 && req.Body != http.NoBody {
+		req.Body = readCloser{&slowReader{ctx: ctx, r: req.Body, rate: r.sendBodyRate}, req.Body}
+		req.GetBody = nil
+	}
+	if r.chunked {
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+	}
 
 	// Add all headers
 	for key, value := range r.headers {
 		req.Header.Add(key, value)
 	}
+	if r.host != "" {
+		req.Host = r.host
+	}
+
+	var t timing
+	var connReused bool
+	var conn net.Conn
+	hints := make(http.Header)
+	var dnsStart, connectStart time.Time
+	start := time.Now()
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.dns = time.Since(dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.connect = time.Since(connectStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			connReused, conn = info.Reused, info.Conn
+			if raw != nil {
+				raw.reset()
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.ttfb = time.Since(start)
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				for key, values := range header {
+					hints[key] = append(hints[key], values...)
+				}
+			}
+			return nil
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	var resp *http.Response
+	if r.proto == http10 {
+		if !r.bodyFile.streamed() {
+			req.ContentLength = int64(len(body))
+		}
+		resp, err = doHTTP10(req.Context(), req, r.host, r.jar, dial, server)
+	} else {
+		resp, err = client.Do(req)
+	}
+	if err != nil && r.tls && handshakeFailed(err) {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			err = opErr
+		}
+		return &ClientResponse{handshakeErr: err, requests: 1, timing: t}, nil
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	// Read the whole body so that it can be checked by multiple
+	// expectations, and the connection can be reused
+	defer resp.Body.Close()
+	fb := &firstByteReader{r: resp.Body}
+	if r.readRate > 0 {
+		fb.r = &slowReader{ctx: ctx, r: resp.Body, rate: r.readRate}
+	}
+	var size int64
+	if r.abort {
+		// Closing the body before the end closes the connection too
+		body, size, err = readBody(io.LimitReader(fb, int64(r.abortAfter)))
+		resp.Body.Close()
+	} else {
+		body, size, err = readBody(fb)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	t.total = time.Since(start)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Malformed gRPC responses are kept as they are, so that they can be
+	// seen in failures
+	if r.grpc {
+		if msgs, err := grpcMessages(body); err == nil {
+			body, size = msgs, int64(len(msgs))
+		}
+	}
+
+	final := resp.Request.URL.String()
+	if resp.Request.URL.Host == server {
+		final = resp.Request.URL.RequestURI()
+	}
+
+	cr := &ClientResponse{Response: *resp, body: body, bodySize: size, connReused: connReused, redirects: redirects, requests: redirects + 1, url: final, hints: hints, timing: t, firstBody: fb.at}
+	if r.emptyForHead && r.method == http.MethodHead {
+		// Also gives time to a body sent after the headers to reach the
+		// recorder
+		getSize, err := r.getSize(ctx, server, target)
+		if err != nil {
+			return fail(fmt.Errorf("GET of the same URL for empty-for-head: %w", err))
+		}
+		cr.getSize = &getSize
+	}
+	if raw != nil {
+		cr.rawHeaders, cr.rawBody = raw.split()
+	}
+	if c, ok := conn.(*endConn); ok {
+		cr.connEnd = c.wait()
+	}
+	return cr, nil
+}
+
+// getSize sends a GET of target with the headers of r to the proxy listening
+// on server, returning the size of the body of the response. The body is not
+// decompressed, so that it can be compared with the Content-Length of the
+// response to a HEAD of the same URL
+func (r TxReq) getSize(ctx context.Context, server, target string) (int64, error) {
+	transport := &http.Transport{DisableKeepAlives: true, DisableCompression: true, DialContext: r.dialer(server)}
+	if r.tls {
+		transport.TLSClientConfig = r.tlsConfig()
+	}
+	if r.forward {
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: server})
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Jar: r.jar,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	for key, value := range r.headers {
+		req.Header.Add(key, value)
+	}
+	if r.host != "" {
+		req.Host = r.host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(io.Discard, resp.Body)
+}
+
+// dialer returns the function opening the connections of the request to the
+// proxy listening on server, see -bind, -proxy-protocol and -tunnel
+func (r TxReq) dialer(server string) dialFunc {
+	var d net.Dialer
+	if r.bind != nil {
+		d.LocalAddr = &net.TCPAddr{IP: r.bind}
+	}
+	dial := dialFunc(d.DialContext)
+	if r.proxyProtocol > 0 {
+		dial = proxyProtocolDialer(dial, r.proxyProtocol, r.proxySrc)
+	}
+	if r.tunnel {
+		dial = tunnelDialer(server, dial)
+	}
+	if r.readRate > 0 {
+		dial = slowReadDialer(dial)
+	}
+	return dial
+}
+
+// slowReadBuffer is the size of the receive buffer of connections reading at
+// a limited rate, so that the proxy soon notices the client is slow rather
+// than filling the buffers of the kernel
+const slowReadBuffer = 4 << 10
+
+// slowReadDialer returns a function opening connections with dial, shrinking
+// their receive buffer, see -read-rate
+func slowReadDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+			c.SetReadBuffer(slowReadBuffer)
+		}
+		return conn, nil
+	}
+}
+
+// parseRate returns the bytes per second given by token, either an integer
+// or a size optionally followed by /s, eg: 10KB/s. ok is false if token is
+// not a rate
+func parseRate(token token) (rate int, ok bool) {
+	switch token.typ {
+	case INTEGER:
+		rate, err := strconv.Atoi(token.val)
+		return rate, err == nil
+	case SIZE, STRING:
+		return parseSize(strings.TrimSuffix(token.val, "/s"))
+	}
+	return 0, false
+}
+
+// slowReader reads from r at most rate bytes per second, in chunks sent every
+// 100ms or more. Reading stops with an error when ctx is done
+type slowReader struct {
+	ctx  context.Context
+	r    io.Reader
+	rate int
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	chunk := s.rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	select {
+	case <-s.ctx.Done():
+		return 0, s.ctx.Err()
+	case <-time.After(time.Duration(len(p)) * time.Second / time.Duration(s.rate)):
+	}
+	return s.r.Read(p)
+}
+
+// loopback returns true if host is localhost or a loopback address
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// tunnelDialer returns a function opening connections through a tunnel
+// established with CONNECT by the proxy listening on the given address,
+// dialed with dial
+func tunnelDialer(proxy string, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, proxy)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
 
-	return client.Do(req)
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		// Nothing is sent through the tunnel before the request, so the
+		// reader cannot buffer more than the response to CONNECT. Its body,
+		// if any, is not read: the connection is either closed or used for
+		// the tunnel
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("CONNECT %s failed: %s", addr, resp.Status)
+		}
+
+		return conn, nil
+	}
 }
@@ -15,11 +15,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -49,16 +54,224 @@ func TestExpectParseFail(t *testing.T) {
 	exp = Expect{}
 	err = exp.Parse(s)
 	assert.Error(t, err)
+
+	// Invalid regular expression
+	s = newScanner(strings.NewReader("req.method ~ \"(GET\""))
+	exp = Expect{}
+	err = exp.Parse(s)
+	assert.Error(t, err)
+
+	// Strings compared with lt
+	s = newScanner(strings.NewReader("resp.status lt \"a\""))
+	exp = Expect{}
+	err = exp.Parse(s)
+	assert.EqualError(t, err, `Parse error in 'expect' command: expecting an integer/duration after "lt", got "STRING: a"`)
+}
+
+func TestExpectParseWithin(t *testing.T) {
+	s := newScanner(strings.NewReader("resp.status eq 200 within \"5s\""))
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(s))
+	assert.Equal(t, 5*time.Second, exp.within)
+	assert.Equal(t, `resp.status eq "200" within "5s"`, exp.verbatim)
+	assert.Equal(t, `eq "200" within 5s`, exp.condition())
+
+	for _, input := range []string{
+		"resp.status eq 200 within",
+		"resp.status eq 200 within \"banana\"",
+		"resp.status eq 200 within 0s",
+	} {
+		exp := Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestExpectParseIndexed(t *testing.T) {
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`resp[1].headers["X-Cache"] eq "hit"`))))
+	assert.True(t, exp.indexed)
+	assert.Equal(t, 1, exp.step)
+	assert.Equal(t, EXPECT_HEADERS, exp.field)
+	assert.Equal(t, `resp[1].headers[X-Cache] eq "hit"`, exp.verbatim)
+
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`resp.status eq 200`))))
+	assert.False(t, exp.indexed)
+
+	for _, input := range []string{
+		`resp[].status eq 200`,
+		`resp["a"].status eq 200`,
+		`resp[-1].status eq 200`,
+		`resp[1.status eq 200`,
+		`req[0].method eq "GET"`,
+		`client["a"].resp[0].status eq 200`,
+	} {
+		exp := Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTxParseBody(t *testing.T) {
+	for input, expected := range map[string][]byte{
+		`-body "\x00\xff"`:        {0x00, 0xff},
+		`-body-base64 "AP8="`:     {0x00, 0xff},
+		`-body-hex "00ff"`:        {0x00, 0xff},
+		`-body-hex "48656c6c6f"`:  []byte("Hello"),
+		`-body-base64 "SGVsbG8="`: []byte("Hello"),
+	} {
+		req := TxReq{}
+		assert.Nil(t, req.Parse(newScanner(strings.NewReader(input))), input)
+		assert.Equal(t, expected, req.body, input)
+		resp := TxResp{}
+		assert.Nil(t, resp.Parse(newScanner(strings.NewReader(input))), input)
+		assert.Equal(t, expected, resp.body, input)
+	}
+
+	for _, input := range []string{
+		`-body-base64 "not base64!"`,
+		`-body-hex "0"`,
+		`-body-hex 42`,
+		`-body "a" -body-hex "00"`,
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTxParseHeaderFail(t *testing.T) {
+	for _, input := range []string{
+		"-header \"no colon\"",
+		"-header \": no name\"",
+		"-header \"Bad Name: value\"",
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+		resp := TxResp{}
+		assert.Error(t, resp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+
+	assert.True(t, validToken("X-Cache"))
+	assert.False(t, validToken("X Cache"))
+}
+
+func TestTxParseMethod(t *testing.T) {
+	for _, method := range []string{"GET", "POST", "PURGE", "PUSH", "BAN", "x-custom"} {
+		req := TxReq{}
+		assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-method "`+method+`"`))), method)
+		assert.Equal(t, method, req.method)
+	}
+
+	for _, method := range []string{"", "GET /", "BAN\\n", "(GET)"} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(`-method "`+method+`"`))), method)
+	}
+}
+
+func TestTxParseAuth(t *testing.T) {
+	req := TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-basic-auth "Aladdin:open sesame"`))))
+	assert.Equal(t, "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==", req.headers["Authorization"])
+
+	req = TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-bearer "abc.def"`))))
+	assert.Equal(t, "Bearer abc.def", req.headers["Authorization"])
+
+	for _, input := range []string{
+		`-basic-auth "nocolon"`,
+		`-basic-auth 42`,
+		`-bearer ""`,
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+
+	exp := Expect{}
+	assert.Error(t, exp.Parse(newScanner(strings.NewReader(`resp.auth.user eq "nemo"`))))
+}
+
+func TestTxParseForward(t *testing.T) {
+	for _, input := range []string{
+		`-url "http://www.example.org/" -forward`,
+		`-tunnel -url "http://localhost:8080/a"`,
+		`-tunnel -url "http://127.0.0.1:8080/a"`,
+		`-tunnel -url "http://[::1]:8080/a"`,
+	} {
+		req := TxReq{}
+		assert.Nil(t, req.Parse(newScanner(strings.NewReader(input))), input)
+		assert.True(t, req.absolute(), input)
+	}
+
+	for _, input := range []string{
+		`-url "/" -forward`,
+		`-url "https://www.example.org/" -tunnel`,
+		`-url "http://www.example.org/" -forward -tunnel`,
+		`-tunnel -url "http://www.example.org:8080/a"`,
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTxParseTimeout(t *testing.T) {
+	req := TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-timeout "2s" -send-body-rate 1024`))))
+	assert.Equal(t, 2*time.Second, req.timeout)
+	assert.Equal(t, 1024, req.sendBodyRate)
+
+	for input, rate := range map[string]int{
+		`-read-rate 100`:      100,
+		`-read-rate 10KB`:     10 << 10,
+		`-read-rate "10KB/s"`: 10 << 10,
+		`-read-rate "1MB"`:    1 << 20,
+	} {
+		req := TxReq{}
+		assert.Nil(t, req.Parse(newScanner(strings.NewReader(input))), input)
+		assert.Equal(t, rate, req.readRate, input)
+	}
+
+	for _, input := range []string{
+		`-timeout "banana"`,
+		`-timeout 0s`,
+		`-send-body-rate 0`,
+		`-send-body-rate "fast"`,
+		`-read-rate 0`,
+		`-read-rate "10KB/h"`,
+		`-read-rate "fast"`,
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTxParseBind(t *testing.T) {
+	req := TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-bind "127.0.0.2"`))))
+	assert.Equal(t, "127.0.0.2", req.bind.String())
+
+	for _, input := range []string{`-bind "localhost"`, `-bind 42`, `-proxy-src "::1"`} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
 }
 
 func TestExpectRequestMethod(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	exp := Expect{field: EXPECT_METHOD, operator: EQUAL, expected: "GET"}
 
-	assert.Equal(t, true, exp.Request(*req))
+	assert.Equal(t, true, passed(exp.Request(*req)))
 }
 
-func TestExpectRequestPanic(t *testing.T) {
+// passed returns whether an expectation was met and could be evaluated
+func passed(ev Evaluation) bool {
+	return ev.Passed && ev.Err == nil
+}
+
+// actual returns the actual value an expectation was evaluated against
+func actual(ev Evaluation) string {
+	return ev.Actual
+}
+
+func TestExpectRequestError(t *testing.T) {
 	var exp Expect
 	var r http.Request
 
@@ -68,7 +281,9 @@ func TestExpectRequestPanic(t *testing.T) {
 		operator: TILDE,
 		expected: "(invalid-regular-expression",
 	}
-	assert.Panics(t, func() { exp.Request(r) })
+	ev := exp.Request(r)
+	assert.False(t, ev.Passed)
+	assert.Error(t, ev.Err)
 
 	// Invalid operator (42)
 	exp = Expect{
@@ -76,8 +291,15 @@ func TestExpectRequestPanic(t *testing.T) {
 		operator: 42,
 		expected: "",
 	}
+	ev = exp.Request(r)
+	assert.False(t, ev.Passed)
+	assert.Error(t, ev.Err)
 
-	assert.Panics(t, func() { exp.Request(r) })
+	// Requests have no status
+	exp = Expect{field: EXPECT_STATUS, operator: EQUAL, expected: "200"}
+	ev = exp.Request(r)
+	assert.False(t, ev.Passed)
+	assert.Error(t, ev.Err)
 }
 
 func TestExpectResponseStatus(t *testing.T) {
@@ -86,13 +308,98 @@ func TestExpectResponseStatus(t *testing.T) {
 	err := exp.Parse(s)
 	assert.Equal(t, nil, err)
 
-	resp := http.Response{
-		StatusCode: 404,
+	resp := ClientResponse{
+		Response: http.Response{
+			StatusCode: 404,
+		},
 	}
-	assert.Equal(t, true, exp.Response(resp))
+	assert.Equal(t, true, passed(exp.Response(resp)))
 
 	resp.StatusCode = 200
-	assert.Equal(t, false, exp.Response(resp))
+	assert.Equal(t, false, passed(exp.Response(resp)))
+}
+
+func TestExpectEmptyForHead(t *testing.T) {
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader("resp.body empty-for-head"))))
+	assert.Equal(t, "resp.body empty-for-head", exp.verbatim)
+	assert.Equal(t, "empty-for-head", exp.condition())
+
+	for _, input := range []string{
+		"resp.status empty-for-head",
+		"req.body empty-for-head",
+	} {
+		exp := Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+
+	response := func(method string, status int, length string, body string) ClientResponse {
+		resp := ClientResponse{
+			Response: http.Response{
+				StatusCode: status,
+				Header:     make(http.Header),
+				Request:    httptest.NewRequest(method, "/", nil),
+			},
+			body: []byte(body),
+		}
+		if length != "" {
+			resp.Header.Set("Content-Length", length)
+		}
+		return resp
+	}
+
+	for _, resp := range []ClientResponse{
+		response("HEAD", 200, "5", ""),
+		response("GET", 304, "", ""),
+		response("GET", 204, "", ""),
+		response("GET", 200, "5", "hello"),
+		response("GET", 200, "", "hello"),
+	} {
+		assert.True(t, passed(exp.Response(resp)), resp.Request.Method, resp.StatusCode)
+	}
+	withGet := func(resp ClientResponse, size int64) ClientResponse {
+		resp.getSize = &size
+		return resp
+	}
+	withRaw := func(resp ClientResponse, raw string) ClientResponse {
+		resp.rawBody = []byte(raw)
+		return resp
+	}
+
+	for _, resp := range []ClientResponse{
+		response("HEAD", 200, "5", ""),
+		response("GET", 304, "", ""),
+		response("GET", 204, "", ""),
+		response("GET", 200, "5", "hello"),
+		response("GET", 200, "", "hello"),
+		withGet(response("HEAD", 200, "5", ""), 5),
+		withGet(response("HEAD", 200, "", ""), 5),
+	} {
+		assert.True(t, passed(exp.Response(resp)), resp.Request.Method, resp.StatusCode)
+	}
+	for _, resp := range []ClientResponse{
+		response("HEAD", 200, "5", "hello"),
+		response("GET", 304, "", "hello"),
+		response("GET", 200, "4", "hello"),
+		withRaw(response("HEAD", 200, "5", ""), "hello"),
+		withGet(response("HEAD", 200, "5", ""), 4),
+	} {
+		ev := exp.Response(resp)
+		assert.False(t, ev.Passed, resp.Request.Method, resp.StatusCode)
+		assert.NotEmpty(t, ev.Reason)
+	}
+}
+
+func TestTxRespHead(t *testing.T) {
+	r := TxResp{statusCode: 200, body: []byte("hello"), headers: map[string]string{"X-A": "a"}}
+	assert.Equal(t, map[string]string{"X-A": "a", "Content-Length": "5"}, r.head().headers)
+	assert.Equal(t, map[string]string{"X-A": "a"}, r.headers)
+
+	r.headers = map[string]string{"content-length": "10"}
+	assert.Equal(t, map[string]string{"content-length": "10"}, r.head().headers)
+
+	r = TxResp{statusCode: 304, headers: map[string]string{}}
+	assert.Empty(t, r.head().headers)
 }
 
 func TestTxRespToString(t *testing.T) {
@@ -112,7 +419,7 @@ func TestTxRespSend(t *testing.T) {
 	r := TxResp{
 		statusCode: 200,
 		headers:    h,
-		body:       "Hello world!",
+		body:       []byte("Hello world!"),
 	}
 
 	assert.True(t, r.Send(w))
@@ -128,5 +435,390 @@ func TestTxRespSend(t *testing.T) {
 
 	// Check the response body
 	body, _ := ioutil.ReadAll(resp.Body)
-	assert.Equal(t, r.body, string(body))
+	assert.Equal(t, r.body, body)
+}
+
+func TestTxRespDateOffset(t *testing.T) {
+	r := TxResp{}
+	assert.Nil(t, r.Parse(newScanner(strings.NewReader(`-date-offset "-1h" -expires-offset "2h"`))))
+	assert.Equal(t, -time.Hour, r.dateOffset)
+	assert.Equal(t, 2*time.Hour, r.expiresOffset)
+
+	w := httptest.NewRecorder()
+	r.Send(w)
+	resp := w.Result()
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), date, 2*time.Second)
+
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Hour, expires.Sub(date))
+
+	for _, input := range []string{`-date-offset "banana"`, `-expires-offset 42`} {
+		r := TxResp{}
+		assert.Error(t, r.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestExpectOriginHits(t *testing.T) {
+	s := newScanner(strings.NewReader("origin[\"/endpoint/1\"].hits eq 1"))
+	exp := Expect{}
+	err := exp.Parse(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, EXPECT_HITS, exp.field)
+	assert.Equal(t, "/endpoint/1", exp.path)
+
+	o := NewOrigin(0)
+	assert.Equal(t, false, passed(exp.Origin(o, nil)))
+
+	o.hits.add("/endpoint/1", hitRequest("nemo-0"))
+	assert.Equal(t, "1", actual(exp.Origin(o, nil)))
+	assert.Equal(t, true, passed(exp.Origin(o, nil)))
+
+	s = newScanner(strings.NewReader("origin[\"/endpoint/1\"].status eq 1"))
+	exp = Expect{}
+	assert.Error(t, exp.Parse(s))
+}
+
+func TestExpectOriginMaxConns(t *testing.T) {
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader("origin.maxconns lt 3"))))
+	assert.Equal(t, EXPECT_MAXCONNS, exp.field)
+	assert.True(t, exp.global())
+
+	o := NewOrigin(0)
+	assert.Equal(t, "0", actual(exp.Origin(o, nil)))
+	for _, state := range []http.ConnState{http.StateNew, http.StateNew, http.StateClosed, http.StateNew, http.StateNew} {
+		o.conns.track(nil, state)
+	}
+	assert.Equal(t, "3", actual(exp.Origin(o, nil)))
+	assert.False(t, passed(exp.Origin(o, nil)))
+
+	// Connections still open count after a reset
+	o.reset()
+	assert.Equal(t, "3", actual(exp.Origin(o, nil)))
+	o.conns.track(nil, http.StateHijacked)
+	o.reset()
+	assert.Equal(t, "2", actual(exp.Origin(o, nil)))
+	assert.True(t, passed(exp.Origin(o, nil)))
+
+	for _, input := range []string{
+		"origin.hits eq 1",
+		"origin.maxconns.total eq 1",
+		"origin maxconns eq 1",
+	} {
+		exp = Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestExpectOriginRequest(t *testing.T) {
+	s := newScanner(strings.NewReader(`origin["/endpoint/1"].request[1].headers["Host"] eq "example.org"`))
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(s))
+	assert.Equal(t, EXPECT_ORIGIN_HEADERS, exp.field)
+	assert.Equal(t, 1, exp.hit)
+	assert.Equal(t, "Host", exp.headerName)
+	assert.True(t, exp.global())
+
+	o := NewOrigin(0)
+	o.hits.add("/endpoint/1", hitRequest("nemo-0"))
+	// The handler was hit only once
+	assert.Equal(t, "", actual(exp.Origin(o, nil)))
+	assert.False(t, passed(exp.Origin(o, nil)))
+
+	req := hitRequest("nemo-1")
+	req.Host = "example.org"
+	req.Method = "POST"
+	req.URL.RawQuery = "a=1"
+	o.hits.add("/other", hitRequest("dory-2"))
+	o.hits.add("/endpoint/1", req)
+	assert.Equal(t, "example.org", actual(exp.Origin(o, nil)))
+	assert.True(t, passed(exp.Origin(o, nil)))
+
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`origin["/endpoint/1"].request[1].method eq "POST"`))))
+	assert.True(t, passed(exp.Origin(o, nil)))
+
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`origin["/endpoint/1"].request[1].url eq "/endpoint/1?a=1"`))))
+	assert.True(t, passed(exp.Origin(o, nil)))
+
+	for _, input := range []string{
+		`origin["/"].request.method eq "GET"`,
+		`origin["/"].request["0"].method eq "GET"`,
+		`origin["/"].request[0].body eq "GET"`,
+		`origin["/"].request[0].headers eq "GET"`,
+	} {
+		exp = Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+// hitRequest returns a request to the origin sent by the given request ID
+func hitRequest(id string) *http.Request {
+	req := httptest.NewRequest("GET", "/endpoint/1", nil)
+	req.Header.Set(requestIDHeader, id)
+	return req
+}
+
+func TestExpectProxyMetric(t *testing.T) {
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`proxy.metric["proxy.process.http.cache_hit_fresh"] gt 0`))))
+	assert.Equal(t, EXPECT_PROXY_METRIC, exp.field)
+	assert.Equal(t, "proxy.process.http.cache_hit_fresh", exp.headerName)
+	assert.True(t, exp.global())
+
+	// Metrics not available
+	ev := exp.Proxy(nil)
+	assert.False(t, ev.Passed)
+	assert.Error(t, ev.Err)
+
+	proxy := &fakeProxy{metricFunc: func(name string) (string, error) {
+		assert.Equal(t, "proxy.process.http.cache_hit_fresh", name)
+		return "3", nil
+	}}
+	assert.Equal(t, "3", actual(exp.Proxy(proxy)))
+	assert.True(t, passed(exp.Proxy(proxy)))
+
+	for _, input := range []string{
+		`proxy.metric gt 0`,
+		`proxy.metrics["a"] gt 0`,
+		`proxy["a"] gt 0`,
+	} {
+		exp = Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestExpectOrder(t *testing.T) {
+	s := newScanner(strings.NewReader("order client \"a\" before client \"b\""))
+	exp := Expect{}
+	err := exp.Parse(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, EXPECT_ORDER, exp.field)
+	assert.Equal(t, []string{"a", "b"}, exp.clients)
+	assert.Equal(t, "\"order client \\\"a\\\" before client \\\"b\\\"\"", exp.String())
+
+	ids := map[string]string{"a": "a-0", "b": "b-1", "c": "c-2"}
+	o := NewOrigin(0)
+
+	// Neither a nor b reached the origin yet
+	assert.Equal(t, false, passed(exp.Origin(o, ids)))
+	assert.Equal(t, `client "a" never reached the origin`, exp.Origin(o, ids).Reason)
+
+	o.hits.add("/", hitRequest("b-1"))
+	o.hits.add("/", hitRequest("a-0"))
+	o.hits.add("/", hitRequest("c-2"))
+	assert.Equal(t, false, passed(exp.Origin(o, ids)))
+	assert.Equal(t, "a=2 b=1", actual(exp.Origin(o, ids)))
+
+	exp.operator = AFTER
+	assert.Equal(t, true, passed(exp.Origin(o, ids)))
+
+	s = newScanner(strings.NewReader("order client \"a\" eq client \"b\""))
+	exp = Expect{}
+	assert.Error(t, exp.Parse(s))
+}
+
+func TestExpectEvaluation(t *testing.T) {
+	resp := ClientResponse{Response: http.Response{StatusCode: 200, Header: http.Header{"X-Cache": {"hit-fra"}}}}
+
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`resp.headers["X-Cache"] ~ "hit-(\\w+)"`))))
+	ev := exp.Response(resp)
+	assert.True(t, ev.Passed)
+	assert.Equal(t, "resp.headers[X-Cache]", ev.Subject)
+	assert.Equal(t, "~", ev.Operator)
+	assert.Equal(t, `hit-(\w+)`, ev.Expected)
+	assert.Equal(t, "hit-fra", ev.Actual)
+	assert.Equal(t, []string{"hit-fra", "fra"}, ev.Submatches)
+
+	// Missing header
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`resp.headers["Age"] eq ""`))))
+	assert.True(t, exp.Response(resp).Passed)
+	exp.operator = NOTEQUAL
+	ev = exp.Response(resp)
+	assert.False(t, ev.Passed)
+	assert.Equal(t, "no Age header", ev.Reason)
+
+	// Values that cannot be compared
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`resp.headers["X-Cache"] gt 10`))))
+	ev = exp.Response(resp)
+	assert.False(t, ev.Passed)
+	assert.Nil(t, ev.Err)
+	assert.Equal(t, `cannot compare "hit-fra" and "10"`, ev.Reason)
+
+	// Requests not received by the origin
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`origin["/endpoint/1"].request[1].method eq "GET"`))))
+	o := NewOrigin(0)
+	o.hits.add("/endpoint/1", hitRequest("a-0"))
+	ev = exp.Origin(o, nil)
+	assert.False(t, ev.Passed)
+	assert.Equal(t, `handler "/endpoint/1" received 1 requests`, ev.Reason)
+}
+
+func TestTxReqSendConnReused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "Hello world!")
+	}))
+	defer server.Close()
+
+	s := newScanner(strings.NewReader("resp.conn.reused eq \"true\""))
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(s))
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	for i, keepAlive := range []bool{true, true, false} {
+		r := TxReq{uri: "/", method: "GET", noKeepAlive: !keepAlive}
+		resp, err := r.Send(context.Background(), addr)
+		assert.Nil(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// Only the second request can reuse the connection of the first one
+		assert.Equal(t, i == 1, passed(exp.Response(*resp)))
+	}
+
+	s = newScanner(strings.NewReader("req.conn.reused eq \"true\""))
+	exp = Expect{}
+	assert.Error(t, exp.Parse(s))
+}
+
+func TestCompare(t *testing.T) {
+	cmp, err := compare("1", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, -1, cmp)
+
+	cmp, err = compare("1.5s", "100ms")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cmp)
+
+	cmp, err = compare("0s", "0")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cmp)
+
+	_, err = compare("banana", "100ms")
+	assert.Error(t, err)
+}
+
+func TestExpectResponseTiming(t *testing.T) {
+	s := newScanner(strings.NewReader("resp.time.ttfb lt 100ms"))
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(s))
+	assert.Equal(t, EXPECT_TIME_TTFB, exp.field)
+
+	resp := ClientResponse{timing: timing{ttfb: 20 * time.Millisecond}}
+	assert.Equal(t, "20ms", actual(exp.Response(resp)))
+	assert.Equal(t, true, passed(exp.Response(resp)))
+
+	resp.timing.ttfb = 2 * time.Second
+	assert.Equal(t, false, passed(exp.Response(resp)))
+
+	for _, input := range []string{
+		"resp.time.banana lt 100ms",
+		"req.time.ttfb lt 100ms",
+		"resp.time.total gt \"banana\"",
+	} {
+		exp = Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTxReqSendRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/old":
+			http.Redirect(w, req, "/older", http.StatusMovedPermanently)
+		case "/older":
+			http.Redirect(w, req, "/new?x=1", http.StatusFound)
+		default:
+			fmt.Fprintf(w, "Hello world!")
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	r := TxReq{uri: "/old", method: "GET"}
+	resp, err := r.Send(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "/older", resp.Header.Get("Location"))
+	assert.Equal(t, 0, resp.redirects)
+	assert.Equal(t, "/old", resp.url)
+
+	r.followRedirects = true
+	resp, err = r.Send(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for input, expected := range map[string]string{
+		"resp.redirects eq 2":    "2",
+		"resp.requests eq 3":     "3",
+		"resp.retries eq 0":      "0",
+		`resp.url eq "/new?x=1"`: "/new?x=1",
+	} {
+		exp := Expect{}
+		assert.Nil(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+		assert.Equal(t, expected, actual(exp.Response(*resp)), input)
+		assert.True(t, passed(exp.Response(*resp)), input)
+	}
+
+	for _, input := range []string{"req.redirects eq 1", `req.url eq "/"`, "req.requests eq 1", "req.retries eq 0"} {
+		exp := Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTxReqSendTunnel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "Hello %s", req.Host)
+	}))
+	defer server.Close()
+	target := strings.TrimPrefix(server.URL, "http://")
+
+	// A proxy tunneling CONNECT requests for target only
+	var tunnels []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" || req.Host != target {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		tunnels = append(tunnels, req.Host)
+
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	addr := strings.TrimPrefix(proxy.URL, "http://")
+
+	r := TxReq{uri: server.URL + "/", method: "GET", tunnel: true}
+	resp, err := r.Send(context.Background(), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello "+target, string(resp.body))
+	assert.Equal(t, []string{target}, tunnels)
+
+	r.uri = "http://www.example.org/"
+	_, err = r.Send(context.Background(), addr)
+	assert.Error(t, err)
 }
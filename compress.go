@@ -0,0 +1,200 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Telling apart responses sent by the proxy as the origin sent them from
+// those it compressed, or decompressed, on the fly
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Outcomes of resp.transform
+const (
+	transformIdentity     = "identity"
+	transformCompressed   = "compressed"
+	transformDecompressed = "decompressed"
+	transformModified     = "modified"
+)
+
+// sentBody is the body of a response sent by the origin, along with its
+// content codings
+type sentBody struct {
+	body     []byte
+	encoding string
+	// streamed is set for bodies sent from large files, which are not
+	// kept, see fileArg.streamed
+	streamed bool
+}
+
+// sentLog records, by request ID, the last body sent by handlers
+type sentLog struct {
+	mu     sync.Mutex
+	bodies map[string]sentBody
+}
+
+func newSentLog() *sentLog {
+	return &sentLog{bodies: make(map[string]sentBody)}
+}
+
+// add records the body of the response r, about to be sent to the request
+// with the given ID. Requests sent with -no-request-id are left out
+func (l *sentLog) add(requestID string, r TxResp) {
+	if requestID == "" {
+		return
+	}
+	sent := sentBody{body: r.body, streamed: r.bodyFile.streamed()}
+	for name, value := range r.headers {
+		if strings.EqualFold(name, "Content-Encoding") {
+			sent.encoding = value
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bodies[requestID] = sent
+}
+
+// take returns the body sent to the request with the given ID, and forgets
+// it like streamLog.take. nil is returned if the origin sent none, or if the
+// request has no ID
+func (l *sentLog) take(requestID string) *sentBody {
+	if requestID == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sent, ok := l.bodies[requestID]
+	if !ok {
+		return nil
+	}
+	delete(l.bodies, requestID)
+	return &sent
+}
+
+// contentCodings returns the content codings listed in a Content-Encoding
+// header, in the order they were applied, without identity
+func contentCodings(header string) []string {
+	var codings []string
+	for _, coding := range strings.Split(header, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	return codings
+}
+
+// decodeBody removes the given content codings from body. Only gzip and
+// deflate are supported
+func decodeBody(body []byte, codings []string) ([]byte, error) {
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.ReadCloser
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			r, err = zlib.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("cannot decode content coding %q", codings[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %s", codings[i], err)
+		}
+		body, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %s", codings[i], err)
+		}
+	}
+	return body, nil
+}
+
+// codings returns the content codings of the response as received, even if
+// the client decompressed it transparently
+func (r ClientResponse) codings() []string {
+	codings := contentCodings(r.Header.Get("Content-Encoding"))
+	if r.Uncompressed {
+		// Go removes Content-Encoding after decompressing gzip bodies
+		codings = append(codings, "gzip")
+	}
+	return codings
+}
+
+// encoding returns the content codings of the response, see codings, or
+// identity
+func (r ClientResponse) encoding() string {
+	if codings := r.codings(); len(codings) > 0 {
+		return strings.Join(codings, ", ")
+	}
+	return "identity"
+}
+
+// transform compares the body of resp with the one the origin sent, once
+// both are decoded, telling whether the proxy forwarded it unchanged,
+// compressed or decompressed it, or modified it
+func transform(resp ClientResponse) (string, error) {
+	method := http.MethodGet
+	if resp.Request != nil {
+		method = resp.Request.Method
+	}
+	sent := resp.originSent
+	switch {
+	case bodyless(method, resp.StatusCode):
+		return "", fmt.Errorf("%s response with status %d has no body to compare", method, resp.StatusCode)
+	case sent == nil:
+		return "", fmt.Errorf("no handle stanza sent a response to this request, as for cache hits")
+	case sent.streamed || resp.truncated():
+		return "", fmt.Errorf("the body is too large to be compared")
+	}
+
+	origin, err := decodeBody(sent.body, contentCodings(sent.encoding))
+	if err != nil {
+		return "", fmt.Errorf("the body sent by the origin: %s", err)
+	}
+	// Bodies decompressed by the client are decoded already
+	received := contentCodings(resp.Header.Get("Content-Encoding"))
+	body, err := decodeBody(resp.body, received)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(body, origin) {
+		return transformModified, nil
+	}
+
+	// Recompressing with another coding counts as compressing
+	before, after := contentCodings(sent.encoding), resp.codings()
+	switch {
+	case strings.Join(before, ",") == strings.Join(after, ","):
+		return transformIdentity, nil
+	case len(after) < len(before):
+		return transformDecompressed, nil
+	default:
+		return transformCompressed, nil
+	}
+}
+
+// vary returns the values of all the Vary headers of the response
+func (r ClientResponse) vary() string {
+	return strings.Join(r.Header.Values("Vary"), ", ")
+}
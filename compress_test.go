@@ -0,0 +1,177 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gzipped returns s compressed with gzip
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	var deflated bytes.Buffer
+	w := zlib.NewWriter(&deflated)
+	w.Write(gzipped("Hello world!"))
+	w.Close()
+
+	body, err := decodeBody(deflated.Bytes(), contentCodings("gzip, identity, Deflate"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello world!", string(body))
+
+	body, err = decodeBody([]byte("Hello world!"), contentCodings(""))
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello world!", string(body))
+
+	_, err = decodeBody([]byte("Hello world!"), []string{"br"})
+	assert.Error(t, err)
+	_, err = decodeBody([]byte("Hello world!"), []string{"gzip"})
+	assert.Error(t, err)
+}
+
+// compressingProxy returns a reverse proxy to the given origin compressing
+// responses with gzip if the client accepts it, and corrupting those to
+// /modified
+func compressingProxy(origin string) http.Handler {
+	u, _ := url.Parse(origin)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.Request.URL.Path == "/modified" {
+			body = append(body, '!')
+		}
+		if resp.Header.Get("Content-Encoding") == "" && strings.Contains(resp.Request.Header.Get("Accept-Encoding"), "gzip") {
+			body = gzipped(string(body))
+			resp.Header.Set("Content-Encoding", "gzip")
+			resp.Header.Add("Vary", "Accept-Encoding")
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	return proxy
+}
+
+func TestSentLog(t *testing.T) {
+	l := newSentLog()
+	l.add("1", TxResp{body: []byte("one"), headers: map[string]string{"content-encoding": "gzip"}})
+	assert.Equal(t, &sentBody{body: []byte("one"), encoding: "gzip"}, l.take("1"))
+	assert.Nil(t, l.take("1"))
+
+	// Requests without ID cannot be told apart
+	l.add("", TxResp{body: []byte("two")})
+	assert.Nil(t, l.take(""))
+}
+
+func TestRunTransform(t *testing.T) {
+	input := fmt.Sprintf(`handle "/plain" {
+    tx -body "Hello world!" -header "Vary: Origin"
+}
+
+handle "/gzipped" {
+    tx -body-base64 "%s" -header "Content-Encoding: gzip"
+}
+
+handle "/modified" {
+    tx -body "Hello world!"
+}
+
+client "plain" {
+    tx -url "/plain"
+    expect resp.body eq "Hello world!"
+    expect resp.encoding eq "{encoding}"
+    expect resp.transform eq "{transform}"
+}
+
+client "accept" {
+    tx -url "/plain" -header "Accept-Encoding: gzip"
+    expect resp.encoding eq "{encoding}"
+    expect resp.transform eq "{transform}"
+}
+
+client "identity" {
+    tx -url "/plain" -header "Accept-Encoding: identity"
+    expect resp.encoding eq "identity"
+    expect resp.transform eq "identity"
+}
+
+client "gzipped" {
+    tx -url "/gzipped"
+    expect resp.body eq "Hello world!"
+    expect resp.encoding eq "gzip"
+    expect resp.transform eq "identity"
+}
+
+client "modified" {
+    tx -url "/modified"
+    expect resp.transform eq "{modified}"
+}
+
+client "vary" {
+    tx -url "/plain"
+    expect resp.vary eq "{vary}"
+}`, base64.StdEncoding.EncodeToString(gzipped("Hello world!")))
+
+	// Straight to the origin
+	direct := strings.NewReplacer("{encoding}", "identity", "{transform}", "identity", "{modified}", "identity", "{vary}", "Origin")
+	report := runDirect(t, direct.Replace(input))
+	assert.False(t, report.Failed(), report)
+
+	// Through a proxy compressing responses
+	proxied := strings.NewReplacer("{encoding}", "gzip", "{transform}", "compressed", "{modified}", "modified", "{vary}", "Origin, Accept-Encoding")
+	p, err := Parse(strings.NewReader(proxied.Replace(input)))
+	assert.Nil(t, err)
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+	proxy := httptest.NewServer(compressingProxy(server.URL))
+	defer proxy.Close()
+
+	report, err = run(t.Context(), p, origin, strings.TrimPrefix(proxy.URL, "http://"), nil)
+	assert.Nil(t, err)
+	assert.False(t, report.Failed(), report)
+
+	_, err = Parse(strings.NewReader(`client "a" {
+    tx -url "/"
+    expect resp.transform eq "identity" within "1s"
+}`))
+	assert.Error(t, err)
+}
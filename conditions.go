@@ -0,0 +1,136 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Conditional execution of HTC programs, so that a single test suite can
+// include scenarios specific to a proxy or environment. Eg:
+//
+//	skip-if proxy eq "ingress"
+//	only-if env["CI"]
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Proxies that can be tested, as named in conditions
+const (
+	proxyATS     = "ats"
+	proxyIngress = "ingress"
+)
+
+// proxyName returns the name of the proxy being tested, see -ingress
+func proxyName() string {
+	if *ingressAddr != "" {
+		return proxyIngress
+	}
+	return proxyATS
+}
+
+// Condition is a skip-if or only-if directive
+type Condition struct {
+	verbatim string
+	// skip is true for skip-if, false for only-if
+	skip bool
+	// env is the name of the environment variable checked, or empty if the
+	// condition is about the proxy
+	env string
+	// exp compares the value of the proxy name or of the variable. Its
+	// operator is ILLEGAL if the variable only needs to be set
+	exp Expect
+}
+
+// String returns the directive as written in the HTC program
+func (c Condition) String() string {
+	return c.verbatim
+}
+
+// parseCondition parses the condition following skip-if or only-if, eg:
+// proxy ne "ats", env["CI"] or env["CI"] eq "true"
+func parseCondition(s *scanner, directive token) (Condition, error) {
+	c := Condition{verbatim: directive.val, skip: directive.typ == SKIPIF}
+	form := fmt.Sprintf("'%s proxy {eq,ne,~} $name' or '%s env[$name] [{eq,ne,~} $value]'", directive.val, directive.val)
+
+	token := s.ScanUseful()
+	c.verbatim += " " + token.val
+	switch token.typ {
+	case PROXY:
+	case ENV:
+		for _, typ := range []tokenType{OPEN_BRACKET, STRING, CLOSE_BRACKET} {
+			token := s.ScanUseful()
+			if token.typ != typ || (typ == STRING && token.val == "") {
+				return c, fmt.Errorf("Parse error in '%s' directive: expecting %s, got %q", directive.val, form, token)
+			}
+			if typ == STRING {
+				c.env = token.val
+				c.verbatim += fmt.Sprintf("%q", token.val)
+			} else {
+				c.verbatim += token.val
+			}
+		}
+	default:
+		return c, fmt.Errorf("Parse error in '%s' directive: expecting %s, got %q", directive.val, form, token)
+	}
+
+	token = s.ScanUseful()
+	if c.env != "" && (token.typ == NEWLINE || token.typ == EOF) {
+		// Only checking whether the variable is set
+		s.unscan(token)
+		return c, nil
+	}
+	if token.typ != EQUAL && token.typ != NOTEQUAL && token.typ != TILDE {
+		return c, fmt.Errorf("Parse error in '%s' directive: expecting %s, got %q", directive.val, form, token)
+	}
+	c.exp.operator = token.typ
+	c.verbatim += " " + token.val
+
+	token = s.ScanUseful()
+	if token.typ != STRING {
+		return c, fmt.Errorf("Parse error in '%s' directive: expecting %s, got %q", directive.val, form, token)
+	}
+	c.exp.expected = token.val
+	c.verbatim += fmt.Sprintf(" %q", token.val)
+	if c.exp.operator == TILDE {
+		if _, err := regexp.Compile(token.val); err != nil {
+			return c, fmt.Errorf("Parse error in '%s' directive: invalid regular expression %q: %s", directive.val, token.val, err)
+		}
+	}
+	return c, nil
+}
+
+// holds returns true if the condition is true in the current environment
+func (c Condition) holds() bool {
+	if c.env == "" {
+		return c.exp.evaluate(proxyName(), nil).Passed
+	}
+
+	value := os.Getenv(c.env)
+	if c.exp.operator == ILLEGAL {
+		return value != ""
+	}
+	return c.exp.evaluate(value, nil).Passed
+}
+
+// skipped returns the directive causing the program to be skipped, if any:
+// a skip-if whose condition holds, or an only-if whose condition does not
+func (p Program) skipped() (Condition, bool) {
+	for _, c := range p.Conditions {
+		if c.holds() == c.skip {
+			return c, true
+		}
+	}
+	return Condition{}, false
+}
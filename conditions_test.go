@@ -0,0 +1,97 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCondition(t *testing.T) {
+	p, err := Parse(strings.NewReader(`skip-if proxy ne "ats"
+only-if env["CI"]
+only-if env["HTTPTESTER_SUITE"] ~ "^(full|cache)$"
+
+client "nemo" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(p.Conditions))
+	assert.Equal(t, `skip-if proxy ne "ats"`, p.Conditions[0].String())
+	assert.True(t, p.Conditions[0].skip)
+	assert.Equal(t, `only-if env["CI"]`, p.Conditions[1].String())
+	assert.Equal(t, "CI", p.Conditions[1].env)
+	assert.Equal(t, `only-if env["HTTPTESTER_SUITE"] ~ "^(full|cache)$"`, p.Conditions[2].String())
+
+	for _, input := range []string{
+		`skip-if proxy`,
+		`skip-if proxy eq 1`,
+		`skip-if origin eq "ats"`,
+		`only-if env[""]`,
+		`only-if env["CI"] lt "1"`,
+		`only-if env["CI"] ~ "("`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"nemo\" {\n    tx -url \"/\"\n}"))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestConditionHolds(t *testing.T) {
+	parse := func(input string) Condition {
+		s := newScanner(strings.NewReader(input))
+		c, err := parseCondition(s, s.ScanUseful())
+		assert.Nil(t, err, input)
+		return c
+	}
+
+	assert.True(t, parse(`skip-if proxy eq "ats"`).holds())
+	defer func() { *ingressAddr = "" }()
+	*ingressAddr = "127.0.0.1:80"
+	assert.False(t, parse(`skip-if proxy eq "ats"`).holds())
+	assert.True(t, parse(`skip-if proxy eq "ingress"`).holds())
+
+	t.Setenv("CI", "")
+	assert.False(t, parse(`only-if env["CI"]`).holds())
+	t.Setenv("CI", "true")
+	assert.True(t, parse(`only-if env["CI"]`).holds())
+	assert.True(t, parse(`only-if env["CI"] eq "true"`).holds())
+	assert.False(t, parse(`only-if env["CI"] ne "true"`).holds())
+}
+
+func TestRunSkipped(t *testing.T) {
+	t.Setenv("CI", "")
+	p, err := Parse(strings.NewReader(`only-if env["CI"]
+
+client "nemo" {
+    tx -url "/"
+    expect resp.status eq 200
+}`))
+	assert.Nil(t, err)
+
+	// Nothing is listening on addr, the client would fail
+	report, err := run(context.Background(), p, NewOrigin(0), "127.0.0.1:1", nil)
+	assert.Nil(t, err)
+	assert.False(t, report.Failed())
+	assert.Equal(t, `only-if env["CI"]`, report.Skipped)
+
+	var out bytes.Buffer
+	report.File = "ci.htc"
+	report.Summary(&out)
+	assert.Equal(t, "ci.htc skipped (only-if env[\"CI\"])\n", out.String())
+}
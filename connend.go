@@ -0,0 +1,117 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How a connection to the proxy ended, see resp.conn.end
+const (
+	// connClosed means that the proxy closed the connection gracefully
+	connClosed = "close"
+	// connReset means that the proxy reset the connection
+	connReset = "reset"
+	// connTimeout means that the proxy kept the connection open for
+	// -conn-end-wait after the response
+	connTimeout = "timeout"
+)
+
+// connEnd classifies the error returned by reading a connection
+func connEnd(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return connClosed
+	case errors.Is(err, syscall.ECONNRESET):
+		return connReset
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return connTimeout
+	}
+	return err.Error()
+}
+
+// endConn is a net.Conn telling how it ended. It is still read after it is
+// closed by the client, until the proxy ends it too or -conn-end-wait elapses
+type endConn struct {
+	net.Conn
+	once  sync.Once
+	ended chan struct{}
+	end   string
+	// endWait is -conn-end-wait when the connection was opened, so that it
+	// is not read again by the goroutine of Close
+	endWait time.Duration
+}
+
+// endDialer returns a function opening connections with dial, which tell
+// how they ended
+func endDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &endConn{Conn: conn, ended: make(chan struct{}), endWait: *connEndWait}, nil
+	}
+}
+
+// finish records how the connection ended, once
+func (c *endConn) finish(end string) {
+	c.once.Do(func() {
+		c.end = end
+		close(c.ended)
+	})
+}
+
+func (c *endConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.finish(connEnd(err))
+	}
+	return n, err
+}
+
+// Close keeps reading in the background, discarding what is received, to
+// find out how the proxy ends the connection
+func (c *endConn) Close() error {
+	go func() {
+		defer c.Conn.Close()
+		c.Conn.SetReadDeadline(time.Now().Add(c.endWait))
+		buf := make([]byte, 4096)
+		for {
+			if _, err := c.Conn.Read(buf); err != nil {
+				c.finish(connEnd(err))
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// wait returns how the connection ended, waiting at most -conn-end-wait
+func (c *endConn) wait() string {
+	select {
+	case <-c.ended:
+		return c.end
+	case <-time.After(c.endWait):
+		return connTimeout
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnEnd(t *testing.T) {
+	assert.Equal(t, connClosed, connEnd(io.EOF))
+	assert.Equal(t, connReset, connEnd(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}))
+	assert.Equal(t, connTimeout, connEnd(fmt.Errorf("read: %w", os.ErrDeadlineExceeded)))
+	assert.Equal(t, "banana", connEnd(fmt.Errorf("banana")))
+}
+
+func TestParseConnEnd(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "a" {
+    tx -url "/"
+    tx -url "/other"
+    expect resp[0].conn.end eq "close"
+}`))
+	assert.Nil(t, err)
+	assert.True(t, p.Clients[0].Steps[0].Request.connEnd)
+	assert.False(t, p.Clients[0].Steps[1].Request.connEnd)
+
+	for _, input := range []string{
+		`client "a" {
+    tx -url "/"
+    expect resp.conn.banana eq "close"
+}`,
+		`client "a" {
+    tx -url "/"
+}
+expect client["a"].resp.conn.end eq "close"`,
+		`client "a" {
+    pipeline
+    tx -url "/"
+    tx -url "/"
+    expect resp.conn.end eq "close"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestRunConnEnd(t *testing.T) {
+	defer func(wait time.Duration) { *connEndWait = wait }(*connEndWait)
+	*connEndWait = 200 * time.Millisecond
+
+	report := runDirect(t, `handle "/close" {
+    tx -header "Connection: close"
+}
+
+handle "/keepalive" {
+    tx -status 200
+}
+
+client "a" {
+    tx -url "/close"
+    expect resp.conn.end eq "close"
+    tx -url "/keepalive"
+    expect resp.conn.end eq "timeout"
+    tx -url "/keepalive" -header "Connection: close"
+    expect resp.conn.end eq "close"
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+}
+
+func TestSendConnReset(t *testing.T) {
+	defer func(wait time.Duration) { *connEndWait = wait }(*connEndWait)
+	*connEndWait = time.Second
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		http.ReadRequest(bufio.NewReader(conn))
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		time.Sleep(100 * time.Millisecond)
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+
+	r := TxReq{method: "GET", uri: "/", headers: make(map[string]string), connEnd: true}
+	resp, err := r.Send(context.Background(), l.Addr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, connReset, resp.connEnd)
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// CORS preflight requests and expectations on the response to them, eg:
+//
+//	client "preflight" {
+//	    preflight -url "/api" -origin "https://app.example.org" -request-method "PUT"
+//	    expect resp.cors.allow-origin eq "https://app.example.org"
+//	    expect resp.cors.allow-methods ~ "PUT"
+//	}
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// corsHeaders maps the fields of resp.cors to the response headers they refer
+// to
+var corsHeaders = map[string]string{
+	"allow-origin":      "Access-Control-Allow-Origin",
+	"allow-methods":     "Access-Control-Allow-Methods",
+	"allow-headers":     "Access-Control-Allow-Headers",
+	"allow-credentials": "Access-Control-Allow-Credentials",
+	"expose-headers":    "Access-Control-Expose-Headers",
+	"max-age":           "Access-Control-Max-Age",
+}
+
+// parsePreflight parses a preflight command in the client stanza, returning
+// the OPTIONS request it sends. Eg:
+// preflight -url "/api" -origin "https://app.example.org" -request-method "PUT" -request-headers "X-Fish"
+func parsePreflight(s *scanner) (TxReq, error) {
+	r := TxReq{method: "OPTIONS", uri: "/", headers: make(map[string]string)}
+
+	for {
+		token := s.ScanUseful()
+		if token.typ == EOF || token.typ == CLOSE_CURLY || token.typ == NEWLINE {
+			s.unscan(token)
+			break
+		}
+
+		switch token.typ {
+		case URL_ARG:
+			token = s.ScanUseful()
+			if token.typ != STRING {
+				return r, fmt.Errorf("Parse error in 'preflight' command: expecting a string, got %q", token)
+			}
+			r.uri = token.val
+		case HOST_ARG:
+			token = s.ScanUseful()
+			if token.typ != STRING || token.val == "" || strings.ContainsAny(token.val, " \t/") {
+				return r, fmt.Errorf("Parse error in 'preflight' command: expecting a host, got %q", token)
+			}
+			r.host = token.val
+		case HEADER_ARG:
+			name, value, err := parseHeaderArg(s)
+			if err != nil {
+				return r, err
+			}
+			r.headers[name] = value
+		case ORIGIN_ARG:
+			token = s.ScanUseful()
+			if token.typ != STRING || token.val == "" {
+				return r, fmt.Errorf("Parse error in 'preflight' command: expecting an origin, got %q", token)
+			}
+			r.headers["Origin"] = token.val
+		case REQUESTMETHOD_ARG:
+			token = s.ScanUseful()
+			if token.typ != STRING || !validToken(token.val) {
+				return r, fmt.Errorf("Parse error in 'preflight' command: expecting a method, got %q", token)
+			}
+			r.headers["Access-Control-Request-Method"] = token.val
+		case REQUESTHEADERS_ARG:
+			token = s.ScanUseful()
+			if token.typ != STRING || token.val == "" {
+				return r, fmt.Errorf("Parse error in 'preflight' command: expecting a list of headers, got %q", token)
+			}
+			r.headers["Access-Control-Request-Headers"] = token.val
+		default:
+			return r, fmt.Errorf("Parse error in 'preflight' command: expecting -url, -host, -header, -origin, -request-method, or -request-headers, got %q", token)
+		}
+	}
+
+	if r.headers["Origin"] == "" || r.headers["Access-Control-Request-Method"] == "" {
+		return r, fmt.Errorf("Parse error in 'preflight' command: -origin and -request-method are required")
+	}
+	return r, nil
+}
+
+// parseCORS parses the part of an expect command following 'resp.cors', eg:
+// .allow-origin
+func (e *Expect) parseCORS(s *scanner) error {
+	form := "resp.cors.{allow-origin,allow-methods,allow-headers,allow-credentials,expose-headers,max-age}"
+
+	token := s.ScanUseful()
+	e.verbatim += token.val
+	if token.typ != DOT {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	token = s.ScanUseful()
+	e.verbatim += token.val
+	name, ok := corsHeaders[token.val]
+	if !ok {
+		return fmt.Errorf("Parse error in 'expect' command: expecting '%s', got %q", form, token)
+	}
+
+	// Same as resp.headers[name]
+	e.field = EXPECT_HEADERS
+	e.headerName = name
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePreflight(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "a" {
+    preflight -url "/api" -origin "https://app.example.org" -request-method "PUT" -request-headers "X-Fish, Content-Type"
+    expect resp.cors.allow-origin eq "https://app.example.org"
+    expect resp.cors.max-age eq "600"
+    tx -url "/api" -method "PUT"
+}`))
+	assert.Nil(t, err)
+	steps := p.Clients[0].Steps
+	assert.Len(t, steps, 2)
+
+	req := steps[0].Request
+	assert.Equal(t, "OPTIONS", req.method)
+	assert.Equal(t, "/api", req.uri)
+	assert.Equal(t, map[string]string{
+		"Origin":                         "https://app.example.org",
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "X-Fish, Content-Type",
+	}, req.headers)
+
+	exp := steps[0].Expectations
+	assert.Len(t, exp, 2)
+	assert.Equal(t, EXPECT_HEADERS, exp[0].field)
+	assert.Equal(t, "Access-Control-Allow-Origin", exp[0].headerName)
+	assert.Equal(t, `"resp.cors.allow-origin eq \"https://app.example.org\""`, exp[0].String())
+	assert.Equal(t, "Access-Control-Max-Age", exp[1].headerName)
+
+	for _, input := range []string{
+		`preflight -url "/api" -request-method "PUT"`,
+		`preflight -url "/api" -origin "https://app.example.org"`,
+		`preflight -origin "" -request-method "PUT"`,
+		`preflight -origin "https://app.example.org" -request-method "P U T"`,
+		`preflight -origin "https://app.example.org" -request-method "PUT" -body "x"`,
+		`preflight -origin "https://app.example.org" -request-method "PUT"
+    expect resp.cors.allow-banana eq "1"`,
+		`preflight -origin "https://app.example.org" -request-method "PUT"
+    expect resp.cors eq "1"`,
+	} {
+		_, err := Parse(strings.NewReader("client \"a\" {\n    " + input + "\n}"))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	report := runDirect(t, `handle "/api" -method "OPTIONS" {
+    expect req.headers["Origin"] eq "https://app.example.org"
+    expect req.headers["Access-Control-Request-Method"] eq "PUT"
+    tx -status 204 -header "Access-Control-Allow-Origin: https://app.example.org" -header "Access-Control-Allow-Methods: GET, PUT"
+}
+
+client "a" {
+    preflight -url "/api" -origin "https://app.example.org" -request-method "PUT"
+    expect resp.status eq 204
+    expect resp.cors.allow-origin eq "https://app.example.org"
+    expect resp.cors.allow-methods ~ "PUT"
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+
+	report = runDirect(t, `handle "/api" -method "OPTIONS" {
+    tx -status 204
+}
+
+client "a" {
+    preflight -url "/api" -origin "https://app.example.org" -request-method "PUT"
+    expect resp.cors.allow-origin eq "https://app.example.org"
+}`)
+	assert.True(t, report.Failed())
+}
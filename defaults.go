@@ -0,0 +1,116 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Options shared by the tx commands of all clients, eg:
+//
+//	defaults {
+//	    header "User-Agent: htc"
+//	    follow-redirects true
+//	    timeout 5s
+//	}
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Defaults are the options applied to the tx commands of all clients, unless
+// given by the commands themselves or left out with -no-defaults
+type Defaults struct {
+	// pos is where the defaults stanza is
+	pos position
+	// Headers are added to requests not setting them already
+	Headers map[string]string
+	// FollowRedirects makes all clients follow redirects, see
+	// -follow-redirects
+	FollowRedirects bool
+	// Timeout is used by requests not given one with -timeout. timeoutPos is
+	// where it was set
+	Timeout    time.Duration
+	timeoutPos position
+}
+
+// parseDefaults parses the block following the defaults keyword
+func parseDefaults(s *scanner) (Defaults, error) {
+	d := Defaults{Headers: make(map[string]string)}
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		return d, fmt.Errorf("Parse error in 'defaults' stanza: expecting '{', got %q", token)
+	}
+
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case NEWLINE:
+		case CLOSE_CURLY:
+			return d, nil
+		case HEADER:
+			token = s.ScanUseful()
+			name, value, ok := strings.Cut(token.val, ":")
+			if token.typ != STRING || !ok || !validToken(name) {
+				return d, fmt.Errorf("Parse error in 'defaults' stanza: expecting a header like \"User-Agent: htc\" after 'header', got %q", token)
+			}
+			d.Headers[name] = strings.TrimSpace(value)
+		case FOLLOW:
+			token = s.ScanUseful()
+			if token.val != "true" && token.val != "false" {
+				return d, fmt.Errorf("Parse error in 'defaults' stanza: expecting true or false after 'follow-redirects', got %q", token)
+			}
+			d.FollowRedirects = token.val == "true"
+		case TIMEOUT:
+			d.timeoutPos = token.pos
+			token = s.ScanUseful()
+			timeout, err := time.ParseDuration(token.val)
+			if (token.typ != STRING && token.typ != DURATION) || err != nil || timeout <= 0 {
+				return d, fmt.Errorf("Parse error in 'defaults' stanza: expecting a positive duration after 'timeout', got %q", token)
+			}
+			d.Timeout = timeout
+		default:
+			return d, fmt.Errorf("Parse error in 'defaults' stanza: expecting 'header', 'follow-redirects', 'timeout' or '}', got %q", token)
+		}
+	}
+}
+
+// apply returns req with the defaults it does not override, if any
+func (d Defaults) apply(req TxReq) TxReq {
+	if req.noDefaults {
+		return req
+	}
+	headers := make(map[string]string, len(req.headers)+len(d.Headers))
+	for name, value := range d.Headers {
+		headers[name] = value
+	}
+	for name, value := range req.headers {
+		// Header names are case-insensitive
+		for other := range headers {
+			if strings.EqualFold(name, other) {
+				delete(headers, other)
+			}
+		}
+		headers[name] = value
+	}
+	req.headers = headers
+
+	if d.FollowRedirects {
+		req.followRedirects = true
+	}
+	if req.timeout == 0 && d.Timeout > 0 {
+		req.timeout, req.timeoutPos = d.Timeout, d.timeoutPos
+	}
+	return req
+}
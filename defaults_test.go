@@ -0,0 +1,142 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDefaults(t *testing.T) {
+	p, err := Parse(strings.NewReader(`defaults {
+    header "User-Agent: htc"
+    header "X-Suite: cache"
+    follow-redirects true
+    timeout 5s
+}
+
+client "a" {
+    tx -url "/"
+}
+
+client "b" {
+    tx -url "/" -header "user-agent: custom" -timeout 1s
+    tx -url "/other"
+}
+
+client "c" {
+    tx -url "/" -proto "HTTP/1.0" -no-defaults
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"User-Agent": "htc", "X-Suite": "cache"}, p.Defaults.Headers)
+
+	a := p.Clients[0].Steps[0].Request
+	assert.Equal(t, map[string]string{"User-Agent": "htc", "X-Suite": "cache"}, a.headers)
+	assert.True(t, a.followRedirects)
+	assert.Equal(t, 5*time.Second, a.timeout)
+	assert.Equal(t, 5, a.timeoutPos.line)
+
+	// Requests override defaults
+	b := p.Clients[1].Steps[0].Request
+	assert.Equal(t, map[string]string{"user-agent": "custom", "X-Suite": "cache"}, b.headers)
+	assert.Equal(t, time.Second, b.timeout)
+	assert.Equal(t, "htc", p.Clients[1].Steps[1].Request.headers["User-Agent"])
+
+	// Unless they leave them out
+	c := p.Clients[2].Steps[0].Request
+	assert.Empty(t, c.headers)
+	assert.False(t, c.followRedirects)
+	assert.Zero(t, c.timeout)
+
+	// Requests are checked with the defaults, wherever the stanza is
+	for _, tc := range []struct {
+		input string
+		line  int
+	}{
+		{`client "a" {
+    tx -url "/" -proto "HTTP/1.0"
+}
+defaults {
+    follow-redirects true
+}`, 4},
+		{`defaults {
+    follow-redirects true
+}
+client "a" {
+    pipeline
+    tx -url "/1"
+    tx -url "/2"
+}`, 1},
+	} {
+		_, err := Parse(strings.NewReader(tc.input))
+		if perr, ok := err.(*ParseError); assert.True(t, ok, tc.input) {
+			assert.Equal(t, tc.line, perr.Line, tc.input)
+			assert.Contains(t, perr.Error(), "-no-defaults", tc.input)
+		}
+	}
+
+	for _, input := range []string{
+		`defaults header "User-Agent: htc"`,
+		`defaults {
+    header "User-Agent"
+}`,
+		`defaults {
+    header
+}`,
+		`defaults {
+    follow-redirects yes
+}`,
+		`defaults {
+    timeout "banana"
+}`,
+		`defaults {
+    method "POST"
+}`,
+		`defaults {
+    header "User-Agent: htc"
+}
+defaults {
+    header "User-Agent: htc"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestRunDefaults(t *testing.T) {
+	report := runDirect(t, `defaults {
+    header "User-Agent: htc"
+    follow-redirects true
+}
+
+handle "/old" {
+    tx -status 301 -header "Location: /new"
+}
+
+handle "/new" {
+    expect req.headers["User-Agent"] eq "htc"
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/old"
+    expect resp.status eq 200
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+}
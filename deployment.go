@@ -0,0 +1,152 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+)
+
+// deploymentConfig is the part of a program determining how the proxy is
+// configured, and what is deployed around it
+type deploymentConfig struct {
+	hosts           []string
+	clientCerts     string
+	proxyProtocol   bool
+	parents         *ParentProxies
+	topology        Topology
+	headerRewrite   []HeaderRewrite
+	negativeCaching *NegativeCaching
+}
+
+// deploymentConfig returns the deployment configuration of the program
+func (p Program) deploymentConfig() deploymentConfig {
+	c := deploymentConfig{
+		hosts:           p.hosts(),
+		clientCerts:     p.ClientCerts,
+		proxyProtocol:   p.proxyProtocol(),
+		topology:        p.Topology,
+		headerRewrite:   p.HeaderRewrite,
+		negativeCaching: p.NegativeCaching,
+	}
+	if p.Parents != nil {
+		// Copied without the ports, which are set once the parents are
+		// started
+		parents := ParentProxies{Count: p.Parents.Count, Params: p.Parents.Params}
+		c.parents = &parents
+	}
+	return c
+}
+
+// equal returns true if both configurations deploy the same proxy
+func (c deploymentConfig) equal(other deploymentConfig) bool {
+	return reflect.DeepEqual(c, other)
+}
+
+// checkDeployment returns an error if the program configures a deployment
+// that cannot be started, such as parents in front of an ingress
+func checkDeployment(p Program) error {
+	if *ingressAddr != "" && (p.Parents != nil || p.Topology != nil || len(p.HeaderRewrite) > 0 || p.NegativeCaching != nil) {
+		return fmt.Errorf("parent-proxy, topology, header-rewrite and negative-caching cannot be used with -ingress")
+	}
+	return nil
+}
+
+// deployment is what clients send requests to: the proxy along with its
+// parents and the hops around it, or the ingress given with -ingress
+type deployment struct {
+	// addr is where clients send requests to, empty if not started
+	addr string
+	// proxy controls the proxy, nil for an ingress
+	proxy  proxyControl
+	config deploymentConfig
+	// stop stops the proxy or removes the ingress, see cleanupProxy
+	stop func(failed bool)
+}
+
+// startDeployment starts the deployment configured by the program, reaching
+// the origin on originPort. What was started is stopped on error
+func startDeployment(ctx context.Context, p Program, install proxyInstall, originPort int) (deployment, error) {
+	d := deployment{config: p.deploymentConfig()}
+
+	span := tracer.start("proxy start", spanKindInternal, nil)
+	defer span.finish()
+
+	if *ingressAddr != "" {
+		ingress := NewIngress(*kubeNamespace, *ingressClass, *originIP, originPort, d.config.hosts)
+		stop := func(bool) {
+			defer tracer.start("proxy stop", spanKindInternal, nil).finish()
+			ingress.stop()
+		}
+		if err := ingress.start(ctx, *ingressAddr); err != nil {
+			span.fail()
+			stop(true)
+			return deployment{}, err
+		}
+		d.addr, d.stop = *ingressAddr, stop
+		return d, nil
+	}
+
+	// Hops are started from the origin backwards, each one forwarding
+	// requests to the one started before: the nginx hops following the
+	// proxy, the parents, the proxy, then the nginx hops preceding it
+	before, after := p.Topology.split()
+	hops, next, err := startHops(ctx, after, originPort)
+	template := Proxy{install: install, originPort: next, hosts: d.config.hosts}
+	var parents []Proxy
+	if err == nil && p.Parents != nil {
+		parents, err = startParents(ctx, template, p.Parents)
+	}
+	var proxy Proxy
+	if err == nil {
+		template.clientCerts, template.parents = p.ClientCerts, p.Parents
+		template.headerRewrite, template.negativeCaching = p.HeaderRewrite, p.NegativeCaching
+		// Clients only reach the proxy directly without nginx hops before
+		// it
+		template.proxyProtocol = len(before) == 0 && d.config.proxyProtocol
+		proxy, err = startProxy(ctx, template)
+	}
+	var front []Nginx
+	first := proxy.port
+	if err == nil {
+		front, first, err = startHops(ctx, before, proxy.port)
+	}
+	stop := func(failed bool) {
+		defer tracer.start("proxy stop", spanKindInternal, nil).finish()
+		for _, n := range append(front, hops...) {
+			n.stop()
+			if !failed || !*keepArtifacts {
+				n.cleanup()
+			}
+		}
+		for _, running := range append(parents, proxy) {
+			running.stop()
+			cleanupProxy(running, failed)
+		}
+	}
+	if err != nil {
+		span.fail()
+		stop(true)
+		return deployment{}, err
+	}
+	slog.Debug("Proxy started", "dir", proxy.tmpDir)
+
+	// stop sees the changes restarts make to proxy, controlled through a
+	// pointer
+	d.addr, d.proxy, d.stop = fmt.Sprintf("127.0.0.1:%d", first), &proxy, stop
+	return d, nil
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentConfig(t *testing.T) {
+	config := func(input string) deploymentConfig {
+		p, err := Parse(strings.NewReader(input))
+		assert.Nil(t, err, input)
+		return p.deploymentConfig()
+	}
+
+	base := config(`parent-proxy
+handle "www.example.org/" {
+    tx -status 200
+}
+client "a" {
+    tx -url "/" -host "www.example.org"
+}`)
+
+	// Clients and handlers of known hosts do not change the deployment
+	assert.True(t, base.equal(config(`parent-proxy
+handle "www.example.org/" {
+    tx -status 404
+}
+handle "/other" {
+    tx -status 200
+}
+client "b" {
+    tx -url "/other"
+    expect resp.status eq 200
+}`)))
+
+	// Starting the parents does not either
+	p, err := Parse(strings.NewReader(`parent-proxy
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	started := p.deploymentConfig()
+	p.Parents.ports = []int{8080}
+	assert.True(t, started.equal(p.deploymentConfig()))
+
+	for _, input := range []string{
+		// New virtual host
+		`parent-proxy
+handle "www.example.org/" {
+    tx -status 200
+}
+handle "static.example.org/" {
+    tx -status 200
+}`,
+		// Parents configured differently
+		`parent-proxy {
+    parents 2
+}
+handle "www.example.org/" {
+    tx -status 200
+}`,
+		// No parents
+		`handle "www.example.org/" {
+    tx -status 200
+}`,
+		// PROXY protocol
+		`parent-proxy
+handle "www.example.org/" {
+    tx -status 200
+}
+client "a" {
+    tx -url "/" -proxy-protocol 1
+}`,
+	} {
+		assert.False(t, base.equal(config(input)), input)
+	}
+}
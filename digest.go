@@ -0,0 +1,157 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Digests of response bodies: computed by the origin with -digest, and
+// verified by clients with resp.digest, to catch proxies corrupting or
+// transforming bodies
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Algorithms accepted by -digest. Content-MD5 is sent in its own header, the
+// others in Repr-Digest as defined by RFC 9530
+const (
+	digestMD5    = "content-md5"
+	digestSHA256 = "sha-256"
+	digestSHA512 = "sha-512"
+)
+
+// Outcomes of resp.digest
+const (
+	digestValid   = "valid"
+	digestInvalid = "invalid"
+	digestMissing = "missing"
+)
+
+// newDigestHash returns the hash used by the given algorithm, or nil
+func newDigestHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case digestMD5:
+		return md5.New()
+	case digestSHA256:
+		return sha256.New()
+	case digestSHA512:
+		return sha512.New()
+	}
+	return nil
+}
+
+// parseDigestArg parses the argument of -digest, eg: "sha-256"
+func parseDigestArg(s *scanner) (string, error) {
+	token := s.ScanUseful()
+	algorithm := strings.ToLower(token.val)
+	if token.typ != STRING || newDigestHash(algorithm) == nil {
+		return "", fmt.Errorf("Parse error in 'tx' command: expecting one of %q, %q or %q, got %q", digestMD5, digestSHA256, digestSHA512, token)
+	}
+	return algorithm, nil
+}
+
+// digestHeaders returns the headers carrying the digests of body computed
+// with the given algorithms, reading body once
+func digestHeaders(algorithms []string, body io.Reader) (map[string]string, error) {
+	hashes := make([]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, len(algorithms))
+	for i, algorithm := range algorithms {
+		hashes[i] = newDigestHash(algorithm)
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), body); err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string)
+	var repr []string
+	for i, algorithm := range algorithms {
+		sum := base64.StdEncoding.EncodeToString(hashes[i].Sum(nil))
+		if algorithm == digestMD5 {
+			headers["Content-MD5"] = sum
+		} else {
+			repr = append(repr, fmt.Sprintf("%s=:%s:", algorithm, sum))
+		}
+	}
+	if len(repr) > 0 {
+		headers["Repr-Digest"] = strings.Join(repr, ", ")
+	}
+	return headers, nil
+}
+
+// digestHeaders returns the headers carrying the digests of the body asked
+// for with -digest. Those of files streamed from disk are computed once, see
+// Program.loadFiles
+func (r TxResp) digestHeaders() (map[string]string, error) {
+	if r.bodyFile.streamed() {
+		return r.fileDigests, nil
+	}
+	return digestHeaders(r.digests, bytes.NewReader(r.body))
+}
+
+// verifyDigest checks the body of resp against the digests in its Content-MD5
+// and Repr-Digest headers, returning digestValid if all those with a known
+// algorithm match, digestMissing if there is none
+func verifyDigest(resp ClientResponse) (string, error) {
+	method := http.MethodGet
+	if resp.Request != nil {
+		method = resp.Request.Method
+	}
+	switch {
+	case bodyless(method, resp.StatusCode):
+		return "", fmt.Errorf("%s response with status %d has no body to verify", method, resp.StatusCode)
+	case resp.truncated():
+		return "", fmt.Errorf("the body of %d bytes is too large to be checked", resp.bodySize)
+	case resp.Uncompressed:
+		return "", fmt.Errorf("the body was compressed, and decompressed by the client")
+	}
+
+	expected := make(map[string]string)
+	if sum := resp.Header.Get("Content-MD5"); sum != "" {
+		expected[digestMD5] = sum
+	}
+	if repr := resp.Header.Get("Repr-Digest"); repr != "" {
+		if resp.StatusCode == http.StatusPartialContent {
+			return "", fmt.Errorf("Repr-Digest is about the whole representation, and cannot be verified on a partial response")
+		}
+		// Dictionary of byte sequences, eg: sha-256=:base64:
+		for _, member := range strings.Split(repr, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok || newDigestHash(name) == nil || name == digestMD5 {
+				continue
+			}
+			expected[name] = strings.Trim(value, ":")
+		}
+	}
+	if len(expected) == 0 {
+		return digestMissing, nil
+	}
+
+	for algorithm, sum := range expected {
+		h := newDigestHash(algorithm)
+		h.Write(resp.body)
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != sum {
+			return digestInvalid, nil
+		}
+	}
+	return digestValid, nil
+}
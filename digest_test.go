@@ -0,0 +1,111 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestHeaders(t *testing.T) {
+	headers, err := digestHeaders([]string{digestMD5, digestSHA256}, strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"Content-MD5": "1B2M2Y8AsgTpgAmY7PhCfg==",
+		"Repr-Digest": "sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:",
+	}, headers)
+
+	headers, err = digestHeaders([]string{digestSHA256, digestSHA512}, strings.NewReader("Hello world!"))
+	assert.Nil(t, err)
+	assert.Len(t, headers, 1)
+	assert.Contains(t, headers["Repr-Digest"], "sha-256=:")
+	assert.Contains(t, headers["Repr-Digest"], ", sha-512=:")
+
+	for _, input := range []string{`-digest "md5"`, `-digest sha-256`, `-digest`} {
+		resp := TxResp{}
+		assert.Error(t, resp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+	resp := TxResp{}
+	assert.Error(t, resp.Parse(newScanner(strings.NewReader(`-grpc -digest "sha-256"`))))
+}
+
+func TestVerifyDigest(t *testing.T) {
+	response := func(status int, header string) ClientResponse {
+		resp := ClientResponse{Response: http.Response{StatusCode: status, Header: make(http.Header)}, body: []byte("")}
+		if name, value, ok := strings.Cut(header, ": "); ok {
+			resp.Header.Set(name, value)
+		}
+		return resp
+	}
+
+	for header, expected := range map[string]string{
+		"":                                      digestMissing,
+		"Content-MD5: 1B2M2Y8AsgTpgAmY7PhCfg==": digestValid,
+		"Content-MD5: AAAA":                     digestInvalid,
+		"Repr-Digest: sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:":                 digestValid,
+		"Repr-Digest: unixsum=:AAAA:, sha-256=:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=:": digestValid,
+		"Repr-Digest: sha-256=:AAAA:": digestInvalid,
+		"Repr-Digest: unixsum=:AAAA:": digestMissing,
+	} {
+		actual, err := verifyDigest(response(200, header))
+		assert.Nil(t, err, header)
+		assert.Equal(t, expected, actual, header)
+	}
+
+	// Nothing to verify
+	_, err := verifyDigest(response(304, "Content-MD5: AAAA"))
+	assert.Error(t, err)
+	_, err = verifyDigest(response(206, "Repr-Digest: sha-256=:AAAA:"))
+	assert.Error(t, err)
+}
+
+func TestRunDigest(t *testing.T) {
+	report := runDirect(t, `handle "/digest" {
+    tx -body "Hello world!" -digest "sha-256" -digest "content-md5"
+}
+
+handle "/corrupted" {
+    tx -body "Hello world?" -header "Repr-Digest: sha-256=:wFNeS+K3n/2TKRMFQ2v4iTFOSj+uwF7P/Lt98xrZ5Ro=:"
+}
+
+handle "/plain" {
+    tx -body "Hello world!"
+}
+
+client "digest" {
+    tx -url "/digest"
+    expect resp.headers["Repr-Digest"] eq "sha-256=:wFNeS+K3n/2TKRMFQ2v4iTFOSj+uwF7P/Lt98xrZ5Ro=:"
+    expect resp.digest eq "valid"
+}
+
+client "corrupted" {
+    tx -url "/corrupted"
+    expect resp.digest eq "invalid"
+}
+
+client "plain" {
+    tx -url "/plain"
+    expect resp.digest eq "missing"
+}
+
+client "head" {
+    tx -url "/digest" -method "HEAD"
+    expect resp.headers["Content-MD5"] eq "hvsmnRkNLIX24EaM7KQqIA=="
+}`)
+	assert.False(t, report.Failed(), report)
+}
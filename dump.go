@@ -0,0 +1,161 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Capture of the requests and responses exchanged during a run, written to a
+// dump directory on failure
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// capture holds a request and the corresponding response, written out again
+// in HTTP/1.1 format from what was parsed, rather than the bytes exchanged
+type capture struct {
+	request  []byte
+	response []byte
+}
+
+// bytes returns the request followed by the response
+func (c capture) bytes() []byte {
+	return append(append(append([]byte(nil), c.request...), '\n'), c.response...)
+}
+
+// captureClient returns the capture of the exchange between a client and the
+// proxy. body is the request body, already consumed when sending it
+func captureClient(resp *ClientResponse, body []byte) capture {
+	var c capture
+	if resp.handshakeErr != nil || resp.unanswered {
+		// Nothing was exchanged over HTTP, or the response is missing
+		return c
+	}
+
+	// Detach the request from the httptrace hooks set by TxReq.Send
+	req := resp.Request.WithContext(context.Background())
+	if dump, err := httputil.DumpRequestOut(req, false); err == nil {
+		c.request = append(dump, body...)
+	}
+
+	r := resp.Response
+	r.Body = ioutil.NopCloser(bytes.NewReader(resp.body))
+	if dump, err := httputil.DumpResponse(&r, true); err == nil {
+		c.response = dump
+	}
+
+	return c
+}
+
+// captureOrigin returns the capture of the exchange between the proxy and a
+// handler, given the request received and what was written to w
+func captureOrigin(req *http.Request, w *captureWriter) capture {
+	var c capture
+
+	if dump, err := httputil.DumpRequest(req, true); err == nil {
+		c.request = dump
+	}
+
+	resp := http.Response{
+		StatusCode: w.status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     w.Header(),
+		Body:       ioutil.NopCloser(bytes.NewReader(w.body.Bytes())),
+	}
+	if dump, err := httputil.DumpResponse(&resp, true); err == nil {
+		c.response = dump
+	}
+
+	return c
+}
+
+// captureLog collects the captures of the exchanges seen by handlers, which
+// run concurrently in their own goroutines
+type captureLog struct {
+	mu sync.Mutex
+	// captures maps request IDs to the exchanges triggered by the
+	// corresponding requests. Requests without an ID are stored under ""
+	captures map[string][]capture
+}
+
+func newCaptureLog() *captureLog {
+	return &captureLog{captures: make(map[string][]capture)}
+}
+
+// add records an exchange triggered by the request with the given ID
+func (l *captureLog) add(id string, c capture) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.captures[id] = append(l.captures[id], c)
+}
+
+// all returns a copy of all captures recorded so far, by request ID
+func (l *captureLog) all() map[string][]capture {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	captures := make(map[string][]capture, len(l.captures))
+	for id, c := range l.captures {
+		captures[id] = append([]capture(nil), c...)
+	}
+	return captures
+}
+
+// Dump writes the exchanges of the run to dir, one subdirectory per request
+// ID. Each subdirectory holds client-proxy.http, with what the client sent
+// and received, and proxy-origin-N.http for each request that the proxy sent
+// to the origin. Requests reaching the origin without an ID are stored in
+// the "unknown" subdirectory, along with the exchanges of clients which did
+// not send one, in client-proxy-$name.http
+func (r Report) Dump(dir string) error {
+	write := func(id, name string, data []byte) error {
+		if id == "" {
+			id = "unknown"
+		}
+		sub := filepath.Join(dir, strings.Replace(id, string(filepath.Separator), "_", -1))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(sub, name), data, 0644)
+	}
+
+	for _, c := range r.Clients {
+		name := "client-proxy.http"
+		if c.RequestID == "" {
+			name = fmt.Sprintf("client-proxy-%s.http", strings.Replace(c.Name, string(filepath.Separator), "_", -1))
+		}
+		if err := write(c.RequestID, name, c.capture.bytes()); err != nil {
+			return err
+		}
+	}
+
+	for id, captures := range r.originCaptures {
+		for i, c := range captures {
+			if err := write(id, fmt.Sprintf("proxy-origin-%d.http", i+1), c.bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportDump(t *testing.T) {
+	report := runDirect(t, `handle "/endpoint/1" {
+    expect req.body eq "ping"
+    expect req.body eq "pong"
+    tx -body "Hello world!" -header "X-HTC-Origin: true" -status 200
+}
+
+client "nemo" {
+    tx -url "/endpoint/1" -method "POST" -body "ping"
+    expect resp.status eq 404
+}
+
+client "dory" {
+    tx -url "/endpoint/1" -method "POST" -body "pong" -no-request-id
+}`)
+	assert.True(t, report.Failed())
+
+	// Both body expectations see the whole body
+	assert.Equal(t, 1, len(report.Clients[0].OriginFailures))
+
+	dir, err := ioutil.TempDir("", "httptester-dump")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, report.Dump(dir))
+
+	client, err := ioutil.ReadFile(filepath.Join(dir, "nemo-0", "client-proxy.http"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(client), "POST /endpoint/1 HTTP/1.1\r\n")
+	assert.Contains(t, string(client), "X-Httptester-Id: nemo-0\r\n")
+	assert.Contains(t, string(client), "\r\n\r\nping\n")
+	assert.Contains(t, string(client), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(client), "X-Htc-Origin: true\r\n")
+	assert.Contains(t, string(client), "Hello world!")
+
+	origin, err := ioutil.ReadFile(filepath.Join(dir, "nemo-0", "proxy-origin-1.http"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(origin), "POST /endpoint/1 HTTP/1.1\r\n")
+	assert.Contains(t, string(origin), "\r\n\r\nping\n")
+	assert.Contains(t, string(origin), "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, string(origin), "Hello world!")
+
+	// Requests sent without ID are stored apart
+	client, err = ioutil.ReadFile(filepath.Join(dir, "unknown", "client-proxy-dory.http"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(client), "X-Httptester-Id")
+	origin, err = ioutil.ReadFile(filepath.Join(dir, "unknown", "proxy-origin-1.http"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(origin), "\r\n\r\npong\n")
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// HTC formatter, reprinting programs in canonical style
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// indent is used for each level of nesting
+const indent = "    "
+
+// argOrder is the canonical order of tx arguments. Arguments not listed here
+// follow, in the order in which they were written
+var argOrder = map[tokenType]int{
+	URL_ARG:        1,
+	HOST_ARG:       2,
+	METHOD_ARG:     3,
+	BODY_ARG:       4,
+	BODYFILE_ARG:   4,
+	BODYBASE64_ARG: 4,
+	BODYHEX_ARG:    4,
+	HEADER_ARG:     5,
+	BASICAUTH_ARG:  5,
+	BEARER_ARG:     5,
+	TRAILER_ARG:    5,
+	EARLYHINT_ARG:  5,
+	STATUS_ARG:     6,
+}
+
+// isArg returns true if the token is a command argument, eg: -url
+func isArg(t token) bool {
+	return t.typ != STRING && t.typ != INTEGER && t.typ != DURATION && strings.HasPrefix(t.val, "-")
+}
+
+// formatToken returns the canonical representation of a token. Strings are
+// kept as written, escape sequences included
+func formatToken(t token) string {
+	if t.typ == STRING {
+		if t.raw != "" {
+			return t.raw
+		}
+		return quote(t.val)
+	}
+	return t.val
+}
+
+// formatLine joins the given tokens, separating them with a space except
+// around the characters used to access fields, eg: req.headers["Host"], and
+// in function calls, eg: sign("/video/seg1.ts", "cdn", 1h)
+func formatLine(tokens []token) string {
+	var b strings.Builder
+
+	for i, t := range tokens {
+		if i > 0 {
+			prev := tokens[i-1]
+			call := t.typ == OPEN_PAREN || t.typ == CLOSE_PAREN || t.typ == COMMA || prev.typ == OPEN_PAREN
+			if prev.typ != DOT && prev.typ != OPEN_BRACKET && t.typ != DOT && t.typ != OPEN_BRACKET && t.typ != CLOSE_BRACKET && !call {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(formatToken(t))
+	}
+
+	return b.String()
+}
+
+// sortArgs returns the tokens of a tx command with arguments sorted in
+// canonical order
+func sortArgs(tokens []token) []token {
+	// Group each argument with its value, if any
+	var args [][]token
+	for _, t := range tokens[1:] {
+		if isArg(t) || len(args) == 0 {
+			args = append(args, []token{t})
+		} else {
+			args[len(args)-1] = append(args[len(args)-1], t)
+		}
+	}
+
+	rank := func(arg []token) int {
+		if r, ok := argOrder[arg[0].typ]; ok {
+			return r
+		}
+		return len(argOrder) + 1
+	}
+	sort.SliceStable(args, func(i, j int) bool { return rank(args[i]) < rank(args[j]) })
+
+	sorted := []token{tokens[0]}
+	for _, arg := range args {
+		sorted = append(sorted, arg...)
+	}
+	return sorted
+}
+
+// Format reprints the HTC program read from r in canonical style: one command
+// per line, indented by nesting level, with tx arguments sorted and at most one
+// blank line in a row. Comments are preserved. The program must be valid
+func Format(r io.Reader, w io.Writer) error {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := Parse(bytes.NewReader(src)); err != nil {
+		return err
+	}
+
+	s := newCommentScanner(bytes.NewReader(src))
+
+	depth := 0
+	blank := false
+	written := false
+	var line []token
+	var comment string
+	prev := newToken(NEWLINE, "\n")
+
+	flush := func() {
+		if len(line) == 0 && comment == "" {
+			return
+		}
+
+		// Blank lines are kept if they separate two lines of the same block
+		if blank && written && (len(line) == 0 || line[0].typ != CLOSE_CURLY) {
+			fmt.Fprintln(w)
+		}
+
+		if len(line) > 0 && line[0].typ == CLOSE_CURLY && depth > 0 {
+			depth--
+		}
+
+		if len(line) > 0 && line[0].typ == TX {
+			line = sortArgs(line)
+		}
+
+		text := formatLine(line)
+		if comment != "" {
+			if text != "" {
+				text += " "
+			}
+			text += comment
+		}
+		fmt.Fprintln(w, strings.Repeat(indent, depth)+text)
+
+		if len(line) > 0 && line[len(line)-1].typ == OPEN_CURLY {
+			depth++
+			// No blank lines at the beginning of a block
+			written = false
+		} else {
+			written = true
+		}
+
+		blank = false
+		line = nil
+		comment = ""
+	}
+
+	for {
+		t := s.scan()
+
+		if t.typ == WS {
+			continue
+		}
+
+		// Keep else on the line closing the if block: } else {
+		if len(line) == 1 && line[0].typ == CLOSE_CURLY && t.typ != ELSE {
+			flush()
+		}
+
+		switch t.typ {
+		case EOF:
+			flush()
+			return nil
+		case NEWLINE:
+			if prev.typ == NEWLINE {
+				blank = true
+			}
+			flush()
+		case COMMENT:
+			comment = t.val
+		case OPEN_CURLY:
+			line = append(line, t)
+			flush()
+		case CLOSE_CURLY:
+			flush()
+			line = append(line, t)
+		default:
+			line = append(line, t)
+		}
+
+		prev = t
+	}
+}
+
+// runFmt implements the 'fmt' subcommand
+func runFmt(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write result to the source file instead of stdout")
+	list := fs.Bool("l", false, "list files whose formatting differs from the canonical one")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s fmt [options] file...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, filename := range fs.Args() {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+
+		var out bytes.Buffer
+		if err := Format(bytes.NewReader(src), &out); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			failed = true
+			continue
+		}
+
+		if *list && !bytes.Equal(src, out.Bytes()) {
+			fmt.Println(filename)
+		}
+
+		if *write {
+			if err := ioutil.WriteFile(filename, out.Bytes(), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+		} else if !*list {
+			os.Stdout.Write(out.Bytes())
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	input := `
+
+# Test a basic get request
+handle   "/endpoint/1" {
+
+	expect req.headers [ "User-Agent" ]   ~ "chrome" # a comment
+  tx -body "Hello world!" -status 200 -header "X-HTC-Origin: true"
+
+
+}
+client "nemo" { tx -header "User-Agent: chrome" -url "/endpoint/1"
+    expect resp.status ne 404 }
+
+
+
+expect origin["/endpoint/1"].hits eq 1
+`
+
+	expected := `# Test a basic get request
+handle "/endpoint/1" {
+    expect req.headers["User-Agent"] ~ "chrome" # a comment
+    tx -body "Hello world!" -header "X-HTC-Origin: true" -status 200
+}
+client "nemo" {
+    tx -url "/endpoint/1" -header "User-Agent: chrome"
+    expect resp.status ne 404
+}
+
+expect origin["/endpoint/1"].hits eq 1
+`
+
+	var out bytes.Buffer
+	assert.Nil(t, Format(strings.NewReader(input), &out))
+	assert.Equal(t, expected, out.String())
+
+	// Formatting is idempotent
+	var again bytes.Buffer
+	assert.Nil(t, Format(strings.NewReader(expected), &again))
+	assert.Equal(t, expected, again.String())
+
+	// Invalid programs are not formatted
+	assert.Error(t, Format(strings.NewReader("handle {"), &out))
+}
+
+func TestFormatSimple(t *testing.T) {
+	src, err := ioutil.ReadFile("simple.htc")
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	assert.Nil(t, Format(bytes.NewReader(src), &out))
+	assert.Equal(t, string(src), out.String())
+}
+
+func TestFormatBranches(t *testing.T) {
+	input := `handle "/" {
+if hits eq 1 { tx -status 200 }   else if hits lt 4 {
+  tx -status 304
+} else {
+tx -status 503 }
+}
+`
+
+	expected := `handle "/" {
+    if hits eq 1 {
+        tx -status 200
+    } else if hits lt 4 {
+        tx -status 304
+    } else {
+        tx -status 503
+    }
+}
+`
+
+	var out bytes.Buffer
+	assert.Nil(t, Format(strings.NewReader(input), &out))
+	assert.Equal(t, expected, out.String())
+}
+
+func TestFormatStrings(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200 -body """
+{"message": "Hello world!"}
+    indentation is kept
+"""   -header "X-Quote: \"\x41\""
+}
+`
+
+	expected := `handle "/" {
+    tx -body """
+{"message": "Hello world!"}
+    indentation is kept
+""" -header "X-Quote: \"\x41\"" -status 200
+}
+`
+
+	var out bytes.Buffer
+	assert.Nil(t, Format(strings.NewReader(input), &out))
+	assert.Equal(t, expected, out.String())
+}
+
+func TestFormatHandleMethod(t *testing.T) {
+	input := `handle   "/endpoint"   -method "POST"   {
+tx -status 201
+}
+`
+
+	expected := `handle "/endpoint" -method "POST" {
+    tx -status 201
+}
+`
+
+	var out bytes.Buffer
+	assert.Nil(t, Format(strings.NewReader(input), &out))
+	assert.Equal(t, expected, out.String())
+}
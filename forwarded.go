@@ -0,0 +1,99 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Chains of client addresses added by proxies in the Forwarded (RFC 7239)
+// and X-Forwarded-For headers
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// xForwardedFor returns the addresses listed in all X-Forwarded-For headers,
+// in order
+func xForwardedFor(h http.Header) []string {
+	var chain []string
+	for _, value := range h[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, addr := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	return chain
+}
+
+// forwardedFor returns the nodes identified by the "for" parameters of all
+// Forwarded headers, in order. Quotes, brackets and ports are removed, so
+// that IP addresses can be compared with those in X-Forwarded-For. Elements
+// without a "for" parameter are returned as empty strings
+func forwardedFor(h http.Header) []string {
+	var chain []string
+	for _, value := range h[http.CanonicalHeaderKey("Forwarded")] {
+		for _, element := range splitQuoted(value, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					node = nodeName(strings.Trim(kv[1], `"`))
+				}
+			}
+			chain = append(chain, node)
+		}
+	}
+	return chain
+}
+
+// splitQuoted splits s around sep, except when sep is within a quoted string
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// nodeName returns the name of a Forwarded node without its port, eg:
+// "[2001:db8::1]:4711" becomes "2001:db8::1"
+func nodeName(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// lastHop returns the last address of a chain, added by the proxy closest to
+// the origin, or ""
+func lastHop(chain []string) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[len(chain)-1]
+}
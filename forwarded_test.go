@@ -0,0 +1,43 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXForwardedFor(t *testing.T) {
+	h := http.Header{}
+	assert.Nil(t, xForwardedFor(h))
+	assert.Equal(t, "", lastHop(xForwardedFor(h)))
+
+	h.Add("X-Forwarded-For", "203.0.113.7,198.51.100.1")
+	h.Add("X-Forwarded-For", " 127.0.0.1 ")
+	assert.Equal(t, []string{"203.0.113.7", "198.51.100.1", "127.0.0.1"}, xForwardedFor(h))
+	assert.Equal(t, "127.0.0.1", lastHop(xForwardedFor(h)))
+}
+
+func TestForwardedFor(t *testing.T) {
+	h := http.Header{}
+	h.Add("Forwarded", `for=192.0.2.43:47011;proto=http, For="[2001:db8:cafe::17]:4711"`)
+	h.Add("Forwarded", `by=203.0.113.60, for=unknown;host="a;b,c", for=_hidden`)
+	assert.Equal(t, []string{"192.0.2.43", "2001:db8:cafe::17", "", "unknown", "_hidden"}, forwardedFor(h))
+	assert.Equal(t, "_hidden", lastHop(forwardedFor(h)))
+
+	assert.Equal(t, []string{`a="x,y"`, " b"}, splitQuoted(`a="x,y", b`, ','))
+}
@@ -0,0 +1,229 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Fuzz mode: clients sending randomized requests for the paths served by the
+// handlers, checking only that the proxy neither fails with a 5xx nor hangs
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// fuzzTimeout is how long to wait for the response to each fuzzed
+	// request, unless set with -timeout
+	fuzzTimeout = 5 * time.Second
+	// maxFuzzFailures is the maximum number of failures reported by each
+	// fuzzing client
+	maxFuzzFailures = 10
+	// maxFuzzHeaders is the maximum number of random headers added to each
+	// request
+	maxFuzzHeaders = 8
+	// maxFuzzLength is the maximum length of random header values and query
+	// strings
+	maxFuzzLength = 4096
+)
+
+// tchars are the characters allowed in header names, see validToken
+const tchars = "!#$%&'*+-.^_`|~0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// fuzzSkipHeaders are not generated at random, as the client handles them
+// itself and would refuse to send invalid values
+var fuzzSkipHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// newRand returns the source of all randomness in a run, seeded with -seed
+// unless 0. The seed is returned too, to be printed in the report
+func newRand() (*rand.Rand, int64) {
+	seed := *randSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed)), seed
+}
+
+// random returns true if the program sends random requests
+func (p Program) random() bool {
+	for _, c := range p.Clients {
+		if c.Fuzz > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzer generates random variations of the request of a client
+type fuzzer struct {
+	rng *rand.Rand
+	// targets are the handlers whose paths are requested
+	targets []HandleStanza
+}
+
+// newFuzzer returns a fuzzer requesting the paths served by the given
+// handlers. Default handlers and those matching regular expressions are left
+// out, as there is no telling which paths they serve: / is requested if no
+// handler is left
+func newFuzzer(rng *rand.Rand, handlers []HandleStanza) fuzzer {
+	f := fuzzer{rng: rng}
+	for _, h := range handlers {
+		if h.Default || (h.match != nil && !strings.Contains(h.URIPath, "*")) {
+			continue
+		}
+		f.targets = append(f.targets, h)
+	}
+	if len(f.targets) == 0 {
+		f.targets = []HandleStanza{{URIPath: "/"}}
+	}
+	return f
+}
+
+// length returns a random length, usually short but up to maxFuzzLength
+func (f fuzzer) length() int {
+	if f.rng.Intn(10) == 0 {
+		return f.rng.Intn(maxFuzzLength + 1)
+	}
+	return f.rng.Intn(32)
+}
+
+// token returns a random non-empty string of tchars
+func (f fuzzer) token() string {
+	b := make([]byte, 1+f.rng.Intn(24))
+	for i := range b {
+		b[i] = tchars[f.rng.Intn(len(tchars))]
+	}
+	return string(b)
+}
+
+// value returns a random header value made of visible ASCII characters and
+// spaces, without leading or trailing ones
+func (f fuzzer) value() string {
+	b := make([]byte, f.length())
+	for i := range b {
+		b[i] = byte(' ' + f.rng.Intn('~'-' '+1))
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// bytes returns random bytes, any value included
+func (f fuzzer) bytes() string {
+	b := make([]byte, f.length())
+	f.rng.Read(b)
+	return string(b)
+}
+
+// uri returns the path of the given handler with random segments in place of
+// wildcards, followed by a random query string
+func (f fuzzer) uri(h HandleStanza) string {
+	path := h.URIPath
+	for strings.Contains(path, "*") {
+		path = strings.Replace(path, "*", url.PathEscape(f.bytes()), 1)
+	}
+
+	var query []string
+	for i := f.rng.Intn(4); i > 0; i-- {
+		query = append(query, url.QueryEscape(f.bytes())+"="+url.QueryEscape(f.bytes()))
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + strings.Join(query, "&")
+}
+
+// request returns a random variation of req: the URL of one of the targets,
+// signed as req is and requested for its virtual host unless req sets one,
+// with random headers added
+func (f fuzzer) request(req TxReq) TxReq {
+	h := f.targets[f.rng.Intn(len(f.targets))]
+	req.uri = f.uri(h)
+	if req.signing != nil {
+		req.uri = req.signing.sign(req.uri, time.Now())
+	}
+	if req.host == "" {
+		req.host = h.Host
+	}
+	if req.timeout == 0 {
+		req.timeout = fuzzTimeout
+	}
+
+	headers := make(map[string]string, len(req.headers))
+	for name, value := range req.headers {
+		headers[name] = value
+	}
+	for i := f.rng.Intn(maxFuzzHeaders + 1); i > 0; i-- {
+		name := f.token()
+		if fuzzSkipHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		if _, ok := headers[name]; !ok {
+			headers[name] = f.value()
+		}
+	}
+	req.headers = headers
+	return req
+}
+
+// fuzzFailure returns the failure of a fuzzed request, answered with a 5xx or
+// not at all
+func fuzzFailure(cs ClientStanza, req TxReq, actual string) Failure {
+	return Failure{
+		Context:  fmt.Sprintf("%s %s", req.method, req.uri),
+		Expect:   fmt.Sprintf("fuzz %d", cs.Fuzz),
+		Line:     cs.fuzzPos.line,
+		Expected: fmt.Sprintf("a response with status below 500 within %s", req.timeout),
+		Actual:   actual,
+	}
+}
+
+// fuzz sends cs.Fuzz random variations of req, the request of the given
+// client ready to be sent, to addr, returning the failures of those answered
+// with a 5xx or not at all
+func fuzz(ctx context.Context, f fuzzer, cs ClientStanza, req TxReq, addr string) ([]Failure, error) {
+	var failures []Failure
+
+	for i := 0; i < cs.Fuzz && len(failures) < maxFuzzFailures; i++ {
+		req := f.request(req)
+
+		resp, err := req.Send(ctx, addr)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == errClientTimeout {
+			failures = append(failures, fuzzFailure(cs, req, "timeout"))
+		} else if err != nil {
+			f := fuzzFailure(cs, req, "")
+			f.Error = err.Error()
+			failures = append(failures, f)
+		} else if resp.StatusCode >= 500 {
+			failures = append(failures, fuzzFailure(cs, req, fmt.Sprintf("%q", resp.Status)))
+		}
+	}
+
+	return failures, nil
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzerRequest(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "www.example.org/static/*" {
+    tx -status 200
+}
+
+handle ~ "^/api/" {
+    tx -status 200
+}
+
+handle default {
+    tx -status 404
+}`))
+	assert.Nil(t, err)
+
+	f := newFuzzer(rand.New(rand.NewSource(1)), p.Handlers)
+	assert.Len(t, f.targets, 1)
+
+	template := TxReq{method: "PUT", headers: map[string]string{requestIDHeader: "fuzzer-0"}}
+	for i := 0; i < 100; i++ {
+		req := f.request(template)
+		assert.Equal(t, "PUT", req.method)
+		assert.Equal(t, "www.example.org", req.host)
+		assert.Equal(t, fuzzTimeout, req.timeout)
+		assert.True(t, strings.HasPrefix(req.uri, "/static/"), req.uri)
+
+		u, err := url.ParseRequestURI(req.uri)
+		assert.Nil(t, err, req.uri)
+		_, err = url.ParseQuery(u.RawQuery)
+		assert.Nil(t, err, req.uri)
+
+		assert.Equal(t, "fuzzer-0", req.headers[requestIDHeader])
+		for name, value := range req.headers {
+			assert.True(t, validToken(name), name)
+			assert.False(t, fuzzSkipHeaders[http.CanonicalHeaderKey(name)], name)
+			assert.Equal(t, strings.TrimSpace(value), value)
+		}
+	}
+	// The template is left untouched
+	assert.Len(t, template.headers, 1)
+
+	// Without handlers serving known paths, / is requested
+	f = newFuzzer(rand.New(rand.NewSource(1)), p.Handlers[1:])
+	template.timeout = time.Second
+	req := f.request(template)
+	assert.True(t, req.uri == "/" || strings.HasPrefix(req.uri, "/?"), req.uri)
+	assert.Equal(t, "", req.host)
+	assert.Equal(t, time.Second, req.timeout)
+
+	// Signed requests are signed again for each URL
+	key := SigningKey{Scheme: hmacScheme, Secret: "s3cret"}
+	template.signing = &urlSigning{name: "cdn", key: key, expiry: time.Hour}
+	f = newFuzzer(rand.New(rand.NewSource(1)), p.Handlers)
+	for i := 0; i < 10; i++ {
+		req = f.request(template)
+		u, err := url.ParseRequestURI(req.uri)
+		assert.Nil(t, err, req.uri)
+		assert.Nil(t, key.verify("", u, time.Now()), req.uri)
+	}
+}
+
+func TestNewRand(t *testing.T) {
+	defer func(seed int64) { *randSeed = seed }(*randSeed)
+
+	handlers := []HandleStanza{{URIPath: "/static/*"}}
+	template := TxReq{method: "GET", headers: map[string]string{}}
+
+	*randSeed = 42
+	rng, seed := newRand()
+	assert.Equal(t, int64(42), seed)
+	first := newFuzzer(rng, handlers).request(template)
+
+	// The same seed gives the same requests
+	rng, _ = newRand()
+	assert.Equal(t, first, newFuzzer(rng, handlers).request(template))
+
+	*randSeed = 0
+	_, seed = newRand()
+	assert.NotEqual(t, int64(0), seed)
+}
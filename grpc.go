@@ -0,0 +1,74 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Minimal gRPC support: unary calls over HTTP/2 without TLS, with messages
+// sent as they are instead of being encoded with protobuf
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+)
+
+// grpcContentType is the Content-Type of gRPC requests and responses
+const grpcContentType = "application/grpc"
+
+// grpcStatusTrailer is the trailer holding the status of a gRPC call
+const grpcStatusTrailer = "Grpc-Status"
+
+// grpcFrame returns msg as a length-prefixed, uncompressed gRPC message
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcMessages returns the concatenation of the messages in the body of a
+// gRPC request or response
+func grpcMessages(body []byte) ([]byte, error) {
+	msgs := []byte{}
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, fmt.Errorf("truncated gRPC message prefix")
+		}
+		if body[0] != 0 {
+			return nil, fmt.Errorf("compressed gRPC messages are not supported")
+		}
+		n := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(n) {
+			return nil, fmt.Errorf("truncated gRPC message")
+		}
+		msgs = append(msgs, body[5:5+n]...)
+		body = body[5+n:]
+	}
+	return msgs, nil
+}
+
+// grpcProtocols returns the protocols used by gRPC clients: HTTP/2 with prior
+// knowledge, without TLS
+func grpcProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// originProtocols returns the protocols accepted by the origin: HTTP/1.1, and
+// HTTP/2 without TLS for gRPC
+func originProtocols() *http.Protocols {
+	p := grpcProtocols()
+	p.SetHTTP1(true)
+	return p
+}
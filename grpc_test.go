@@ -0,0 +1,43 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGRPCFrame(t *testing.T) {
+	assert.Equal(t, []byte{0, 0, 0, 0, 2, 'h', 'i'}, grpcFrame([]byte("hi")))
+
+	body := append(grpcFrame([]byte("hello ")), grpcFrame([]byte("world"))...)
+	msgs, err := grpcMessages(body)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), msgs)
+
+	msgs, err = grpcMessages(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, msgs)
+
+	for _, body := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 0, 0, 3, 'h', 'i'},
+		{1, 0, 0, 0, 2, 'h', 'i'},
+	} {
+		_, err := grpcMessages(body)
+		assert.Error(t, err, body)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// http10 is the value of -proto sending requests like legacy clients do
+const http10 = "HTTP/1.0"
+
+// doHTTP10 sends req as an HTTP/1.0 request on a new connection opened with
+// dial, and reads the response. Go clients only speak HTTP/1.1 and later, so
+// the request is written by hand: no Host header is sent unless given with
+// -host, and the connection is closed once the response is read. The hooks of
+// the httptrace.ClientTrace of req are called as http.Client would
+func doHTTP10(ctx context.Context, req *http.Request, host string, jar http.CookieJar, dial dialFunc, server string) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace == nil {
+		trace = &httptrace.ClientTrace{}
+	}
+	if jar != nil {
+		for _, c := range jar.Cookies(req.URL) {
+			req.AddCookie(c)
+		}
+	}
+
+	if trace.ConnectStart != nil {
+		trace.ConnectStart("tcp", server)
+	}
+	conn, err := dial(ctx, "tcp", server)
+	if trace.ConnectDone != nil {
+		trace.ConnectDone("tcp", server, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+	// Unblock reads and writes once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s %s\r\n", req.Method, req.URL.RequestURI(), http10)
+	if host != "" {
+		fmt.Fprintf(w, "Host: %s\r\n", host)
+	}
+	req.Header.Write(w)
+	if req.ContentLength > 0 {
+		fmt.Fprintf(w, "Content-Length: %d\r\n", req.ContentLength)
+	}
+	fmt.Fprintf(w, "\r\n")
+	if req.Body != nil {
+		if _, err := io.Copy(w, req.Body); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	if _, err := br.Peek(1); err == nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if jar != nil {
+		jar.SetCookies(req.URL, resp.Cookies())
+	}
+
+	// The connection is not reused, and closed along with the body
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{resp.Body, conn}
+	return resp, nil
+}
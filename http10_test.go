@@ -0,0 +1,70 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProto(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "a" {
+    tx -url "/" -proto "HTTP/1.0"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, http10, p.Clients[0].Steps[0].Request.proto)
+
+	for _, args := range []string{
+		`-proto "HTTP/2"`,
+		`-proto`,
+		`-proto "HTTP/1.0" -tls`,
+		`-proto "HTTP/1.0" -grpc`,
+		`-proto "HTTP/1.0" -follow-redirects`,
+	} {
+		_, err := Parse(strings.NewReader("client \"a\" {\n    tx -url \"/\" " + args + "\n}"))
+		assert.NotNil(t, err, args)
+	}
+}
+
+func TestRunHTTP10(t *testing.T) {
+	report := runDirect(t, `handle "/legacy" {
+    expect req.proto eq "HTTP/1.0"
+    expect req.method eq "POST"
+    expect req.body eq "ping"
+    tx -body "pong" -header "Set-Cookie: fish=nemo"
+}
+
+handle "/host" {
+    expect req.proto eq "HTTP/1.0"
+    expect req.headers["Cookie"] eq "fish=nemo"
+    tx -body "ok"
+}
+
+client "a" {
+    cookies
+    tx -url "/legacy" -method "POST" -body "ping" -proto "HTTP/1.0"
+    expect resp.proto eq "HTTP/1.0"
+    expect resp.body eq "pong"
+    expect resp.rawheaders ~ "^HTTP/1.0 200 OK\r\n"
+    tx -url "/host" -host "www.example.org" -proto "HTTP/1.0"
+    expect resp.body eq "ok"
+}
+
+expect origin["/legacy"].request[0].headers["Host"] eq ""
+expect origin["/host"].request[0].headers["Host"] eq "www.example.org"`)
+	assert.False(t, report.Failed(), report.Clients)
+}
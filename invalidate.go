@@ -0,0 +1,103 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Invalidating objects in the cache of the proxy, checking that they were
+// cached and that they are fetched from the origin again, eg:
+//
+//	invalidate "/object"
+//
+// Objects are invalidated one by one with PURGE requests, the only way ATS
+// invalidates objects on demand
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// invalidatedCondition is what invalidations require
+const invalidatedCondition = "fetched from the origin after invalidating it"
+
+// purgeMethod is how objects are invalidated in the cache of ATS, which
+// allows it for the addresses in ip_allow
+const purgeMethod = "PURGE"
+
+// parseInvalidate parses the invalidate directive, returning the expectation
+// it implies and the clients checking it: the object is fetched twice to
+// make sure that it is cached, purged, then fetched again. pos is the
+// position of the directive
+func parseInvalidate(s *scanner, pos position) (Expect, []ClientStanza, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING || len(token.val) == 0 || token.val[0] != '/' {
+		return Expect{}, nil, fmt.Errorf("Parse error in 'invalidate' directive: expecting a path, got %q", token)
+	}
+
+	path := token.val
+	e := invalidation(pos, "", path, []string{"fill " + path, "invalidate " + path, "refetch " + path})
+	purge := fetchClient(e.clients[1], "", path, 1)
+	purge.Steps[0].Request.method = purgeMethod
+	return e, []ClientStanza{fetchClient(e.clients[0], "", path, 2), purge, fetchClient(e.clients[2], "", path, 1)}, nil
+}
+
+// invalidation returns the expectation about invalidating the object at path
+// for the given host, if any, checked by the clients with the given names,
+// see CacheInvalidated
+func invalidation(pos position, host, path string, names []string) Expect {
+	e := Expect{pos: pos, field: EXPECT_CACHE_INVALIDATED, path: path, clients: names}
+	e.subject = "cache invalidated"
+	e.verbatim = fmt.Sprintf("%s %q", e.subject, host+path)
+	return e
+}
+
+// fetchClient returns a client named name fetching path n times, from the
+// given host if set
+func fetchClient(name, host, path string, n int) ClientStanza {
+	cs := ClientStanza{Name: name}
+	for range n {
+		req := TxReq{method: "GET", uri: path, host: host, headers: make(map[string]string)}
+		cs.Steps = append(cs.Steps, ClientStep{Request: req})
+	}
+	return cs
+}
+
+// CacheInvalidated checks an invalidation once all clients are done. The
+// clients fill the cache fetching the object twice, invalidate it and fetch
+// it again: the second fetch must have been served from the cache, the proxy
+// must accept the invalidation request, then fetch the object from the origin
+// again. ids and responses map client names to the IDs of the requests they
+// sent and to the responses they received
+func (e Expect) CacheInvalidated(o *Origin, ids map[string]string, responses map[string]*ClientResponse) Evaluation {
+	ev := e.newEvaluation()
+	ev.Expected = e.condition()
+
+	fill, invalidate, refetch := responses[e.clients[0]], responses[e.clients[1]], responses[e.clients[2]]
+	switch {
+	case fill == nil || invalidate == nil || refetch == nil:
+		ev.Reason = "the proxy sent no response"
+	case len(o.hits.caused(ids[e.clients[0]])) > 1:
+		ev.Actual = "not cached before invalidating it"
+		ev.Reason = fmt.Sprintf("both requests of client %q reached the origin", e.clients[0])
+	case invalidate.StatusCode < http.StatusOK || invalidate.StatusCode >= http.StatusMultipleChoices:
+		ev.Actual = fmt.Sprintf("status %d to the invalidation request", invalidate.StatusCode)
+		if invalidate.StatusCode == http.StatusNotFound {
+			ev.Reason = "the object was not in the cache"
+		}
+	case len(o.hits.caused(ids[e.clients[2]])) == 0:
+		ev.Actual = "served from the cache after invalidating it"
+	default:
+		ev.Actual, ev.Passed = invalidatedCondition, true
+	}
+	return ev
+}
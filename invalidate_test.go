@@ -0,0 +1,123 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInvalidate(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/object" {
+    tx -header "Cache-Control: max-age=60" -body "Hello world!"
+}
+
+invalidate "/object"`))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Clients, 3) {
+		assert.Equal(t, "fill /object", p.Clients[0].Name)
+		assert.Len(t, p.Clients[0].Steps, 2)
+		assert.Equal(t, "invalidate /object", p.Clients[1].Name)
+		assert.Equal(t, "PURGE", p.Clients[1].Steps[0].Request.method)
+		assert.Equal(t, "/object", p.Clients[1].Steps[0].Request.uri)
+		assert.Equal(t, "refetch /object", p.Clients[2].Name)
+		assert.Equal(t, "GET", p.Clients[2].Steps[0].Request.method)
+	}
+	if assert.Len(t, p.Expectations, 1) {
+		assert.Equal(t, EXPECT_CACHE_INVALIDATED, p.Expectations[0].field)
+		assert.Equal(t, `"cache invalidated \"/object\""`, p.Expectations[0].String())
+	}
+
+	for _, input := range []string{
+		`invalidate`,
+		`invalidate "object"`,
+		`invalidate -method "BAN" "/object"`,
+		`invalidate "/object"
+invalidate "/object"`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+// purgingProxy is a cachingProxy removing objects from its cache upon PURGE
+// requests
+type purgingProxy struct {
+	*cachingProxy
+}
+
+func (c purgingProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PURGE" {
+		c.cachingProxy.ServeHTTP(w, req)
+		return
+	}
+	c.mu.Lock()
+	_, ok := c.objects[req.URL.Path]
+	delete(c.objects, req.URL.Path)
+	c.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRunInvalidate(t *testing.T) {
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	newProxy := func() *cachingProxy {
+		return &cachingProxy{objects: make(map[string][]byte), proxy: httputil.NewSingleHostReverseProxy(u)}
+	}
+
+	runInvalidate := func(handler http.Handler, src string) Report {
+		front := httptest.NewServer(handler)
+		defer front.Close()
+		p, err := Parse(strings.NewReader(src))
+		assert.Nil(t, err)
+		report, err := run(t.Context(), p, origin, strings.TrimPrefix(front.URL, "http://"), nil)
+		assert.Nil(t, err)
+		return report
+	}
+
+	src := `handle "/object" {
+    tx -body "Hello world!"
+}
+
+invalidate "/object"`
+	report := runInvalidate(purgingProxy{newProxy()}, src)
+	assert.False(t, report.Failed(), report.Failures)
+
+	// The proxy ignores the invalidation request
+	report = runInvalidate(newProxy(), src)
+	if assert.Len(t, report.Failures, 1) {
+		assert.Equal(t, `expect cache invalidated "/object"`, report.Failures[0].Expect)
+		assert.Equal(t, `"served from the cache after invalidating it"`, report.Failures[0].Actual)
+	}
+
+	// The object is not cached in the first place
+	report = runInvalidate(httputil.NewSingleHostReverseProxy(u), src)
+	if assert.Len(t, report.Failures, 1) {
+		assert.Equal(t, `"not cached before invalidating it"`, report.Failures[0].Actual)
+		assert.Equal(t, `both requests of client "fill /object" reached the origin`, report.Failures[0].Reason)
+	}
+}
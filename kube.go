@@ -0,0 +1,149 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Testing Kubernetes ingress controllers instead of ATS. The origin keeps
+// running within httptester, and is exposed to the cluster through a Service
+// without selector pointing to the address of the host
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ingressName is the name of the Kubernetes objects created by httptester
+const ingressName = "httptester"
+
+// Ingress routes requests from an ingress controller running in a Kubernetes
+// cluster to the origin
+type Ingress struct {
+	namespace string
+	// class is the IngressClass of the controller to test, eg: nginx
+	class string
+	// originIP is the address at which pods reach the origin, eg: the
+	// address of the host on the Docker network used by kind
+	originIP   string
+	originPort int
+	// hosts are the virtual hosts handled by the origin, see Program.hosts
+	hosts []string
+}
+
+func NewIngress(namespace, class, originIP string, originPort int, hosts []string) Ingress {
+	return Ingress{namespace: namespace, class: class, originIP: originIP, originPort: originPort, hosts: hosts}
+}
+
+// manifest returns the Kubernetes objects routing all requests to the origin:
+// a Service, its Endpoints and an Ingress with a rule for each virtual host
+func (i Ingress) manifest() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `apiVersion: v1
+kind: Service
+metadata:
+  name: %s
+  namespace: %s
+spec:
+  ports:
+  - port: 80
+    targetPort: %d
+---
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: %s
+  namespace: %s
+subsets:
+- addresses:
+  - ip: %s
+  ports:
+  - port: %d
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: %s
+  namespace: %s
+spec:
+`, ingressName, i.namespace, i.originPort, ingressName, i.namespace, i.originIP, i.originPort, ingressName, i.namespace)
+
+	if i.class != "" {
+		fmt.Fprintf(&b, "  ingressClassName: %s\n", i.class)
+	}
+
+	backend := fmt.Sprintf(`service:
+      name: %s
+      port:
+        number: 80`, ingressName)
+	fmt.Fprintf(&b, "  defaultBackend:\n    %s\n", backend)
+
+	if len(i.hosts) > 0 {
+		b.WriteString("  rules:\n")
+	}
+	for _, host := range i.hosts {
+		fmt.Fprintf(&b, `  - host: %q
+    http:
+      paths:
+      - path: /
+        pathType: Prefix
+        backend:
+          %s
+`, host, strings.ReplaceAll(backend, "\n", "\n      "))
+	}
+
+	return b.String()
+}
+
+// kubectl runs kubectl with the given arguments, passing the manifest on stdin
+func (i Ingress) kubectl(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "kubectl", append(args, "-f", "-")...)
+	cmd.Stdin = strings.NewReader(i.manifest())
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kubectl %s failed: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// start creates the Kubernetes objects, returning once requests sent to addr
+// reach the origin or ctx is done
+func (i Ingress) start(ctx context.Context, addr string) error {
+	if err := i.kubectl(ctx, "apply"); err != nil {
+		return timeoutError(ctx, err, "while creating the ingress")
+	}
+
+	// Requests fail until the controller picks up the Ingress
+	var p probe = httpProbe{fmt.Sprintf("http://%s/httpTesterInternalCheck", addr)}
+	if *probeKind == "tcp" {
+		p = tcpProbe{addr}
+	}
+	return waitReady(ctx, p, *startupTimeout)
+}
+
+// stop deletes the Kubernetes objects
+func (i Ingress) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := i.kubectl(ctx, "delete", "--ignore-not-found"); err != nil {
+		slog.Error("Deleting the ingress failed", "err", err)
+	}
+}
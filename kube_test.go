@@ -0,0 +1,74 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngressManifest(t *testing.T) {
+	i := NewIngress("tests", "nginx", "172.18.0.1", 8000, []string{"www.example.org"})
+	assert.Equal(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: httptester
+  namespace: tests
+spec:
+  ports:
+  - port: 80
+    targetPort: 8000
+---
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: httptester
+  namespace: tests
+subsets:
+- addresses:
+  - ip: 172.18.0.1
+  ports:
+  - port: 8000
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: httptester
+  namespace: tests
+spec:
+  ingressClassName: nginx
+  defaultBackend:
+    service:
+      name: httptester
+      port:
+        number: 80
+  rules:
+  - host: "www.example.org"
+    http:
+      paths:
+      - path: /
+        pathType: Prefix
+        backend:
+          service:
+            name: httptester
+            port:
+              number: 80
+`, i.manifest())
+
+	i = NewIngress("default", "", "172.18.0.1", 8000, nil)
+	assert.NotContains(t, i.manifest(), "ingressClassName")
+	assert.NotContains(t, i.manifest(), "rules")
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Bodies too large to be held in memory: files given with -body-file are
+// streamed from disk, and received bodies are only counted past a limit
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// maxBufferedBody is the size above which bodies are not held in memory.
+// Larger files given with -body-file are sent straight from disk, and only
+// the first maxBufferedBody bytes of larger bodies received are kept
+const maxBufferedBody = 16 << 20
+
+// streamed returns true if the file is too large to be loaded in memory, and
+// is read while sending instead, see Program.loadFiles
+func (f fileArg) streamed() bool {
+	return f.size > 0
+}
+
+// open opens the file for reading, once its path was resolved by
+// Program.loadFiles
+func (f fileArg) open() (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+// entityTag returns the ETag that -etag auto derives from the contents of the
+// file, like TxResp.entityTag does for bodies held in memory
+func (f fileArg) entityTag() (string, error) {
+	file, err := f.open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\"%x\"", h.Sum(nil)[:8]), nil
+}
+
+// readBody reads r until EOF, keeping at most maxBufferedBody bytes. size is
+// the number of bytes read, those not kept included
+func readBody(r io.Reader) (body []byte, size int64, err error) {
+	var buf bytes.Buffer
+	size, err = io.Copy(&buf, io.LimitReader(r, maxBufferedBody))
+	if err == nil && size == maxBufferedBody {
+		var rest int64
+		rest, err = io.Copy(io.Discard, r)
+		size += rest
+	}
+	return buf.Bytes(), size, err
+}
+
+// readCloser reads with a Reader wrapping the body, and closes the body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// setFileBody makes req send the file given with -body-file as body, if it is
+// too large to be loaded in memory
+func (r TxReq) setFileBody(req *http.Request) error {
+	if !r.bodyFile.streamed() {
+		return nil
+	}
+	file, err := r.bodyFile.open()
+	if err != nil {
+		return err
+	}
+	req.Body, req.ContentLength = file, r.bodyFile.size
+	req.GetBody = r.bodyFile.open
+	return nil
+}
+
+// size returns the size of the whole body of the response
+func (r ClientResponse) size() int64 {
+	return max(r.bodySize, int64(len(r.body)))
+}
+
+// truncated returns true if the body of the response was too large to be
+// kept whole, see readBody
+func (r ClientResponse) truncated() bool {
+	return r.bodySize > int64(len(r.body))
+}
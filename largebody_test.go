@@ -0,0 +1,107 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBody(t *testing.T) {
+	body, size, err := readBody(strings.NewReader("Hello world!"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello world!", string(body))
+	assert.Equal(t, int64(12), size)
+
+	large := bytes.Repeat([]byte("a"), maxBufferedBody+10)
+	body, size, err = readBody(bytes.NewReader(large))
+	assert.Nil(t, err)
+	assert.Len(t, body, maxBufferedBody)
+	assert.Equal(t, int64(maxBufferedBody+10), size)
+}
+
+func TestRunLargeBodyFile(t *testing.T) {
+	dir := t.TempDir()
+	size := maxBufferedBody + 1024
+	large := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "large.bin"), large, 0644))
+
+	input := fmt.Sprintf(`handle "/upload" {
+    expect req.headers["Content-Length"] eq "%[1]d"
+    tx -status 201
+}
+
+handle "/download" {
+    tx -body-file "large.bin" -etag auto -digest "sha-256"
+}
+
+client "upload" {
+    tx -url "/upload" -method "POST" -body-file "large.bin"
+    expect resp.status eq 201
+}
+
+client "download" {
+    tx -url "/download"
+    expect resp.headers["Content-Length"] eq "%[1]d"
+    expect resp.headers["ETag"] ne ""
+    expect resp.headers["Repr-Digest"] ~ "^sha-256=:"
+    expect resp.body empty-for-head
+}
+
+client "check" {
+    tx -url "/download"
+    expect resp.body eq ""
+}
+
+expect origin["/upload"].request[0].received eq %[1]d`, size)
+	filename := filepath.Join(dir, "large.htc")
+	assert.Nil(t, os.WriteFile(filename, []byte(input), 0644))
+
+	p, err := parseFile(filename)
+	assert.Nil(t, err)
+	// The file is left on disk
+	assert.Nil(t, p.Handlers[1].Response.body)
+	assert.True(t, p.Handlers[1].Response.bodyFile.streamed())
+
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+
+	report, err := run(t.Context(), p, origin, strings.TrimPrefix(server.URL, "http://"), nil)
+	assert.Nil(t, err)
+	assert.Len(t, report.Failures, 0, report.Failures)
+	assert.False(t, report.Clients[0].Failed(), report.Clients[0])
+	assert.False(t, report.Clients[1].Failed(), report.Clients[1])
+	// Bodies not held whole cannot be compared
+	if assert.Len(t, report.Clients[2].ClientFailures, 1) {
+		assert.Contains(t, report.Clients[2].ClientFailures[0].Error, "too large to be checked")
+	}
+
+	// gRPC messages are framed in memory
+	assert.Nil(t, os.WriteFile(filename, []byte(`client "grpc" {
+    tx -url "/" -grpc -body-file "large.bin"
+}`), 0644))
+	_, err = parseFile(filename)
+	assert.Error(t, err)
+}
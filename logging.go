@@ -0,0 +1,49 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Leveled, structured logging of what httptester is doing, as opposed to the
+// report of the run
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// levelQuiet is above all levels used, discarding all log lines
+const levelQuiet = slog.LevelError + 4
+
+// parseLogLevel returns the level with the given name: debug, info, warn or
+// error
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil || strings.ContainsAny(name, "+-") {
+		return 0, fmt.Errorf("Unknown log level %q, expecting debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// setupLogging sends log lines of at least the given level to w, as text or
+// as JSON objects
+func setupLogging(w io.Writer, level slog.Level, json bool) {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for name, level := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"info":  slog.LevelInfo,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		actual, err := parseLogLevel(name)
+		assert.Nil(t, err)
+		assert.Equal(t, level, actual)
+	}
+
+	for _, name := range []string{"", "verbose", "info+2"} {
+		_, err := parseLogLevel(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var out bytes.Buffer
+	setupLogging(&out, slog.LevelInfo, true)
+	slog.Debug("Expecting", "expect", "req.method eq GET")
+	slog.Warn("Reading request body failed", "err", "unexpected EOF")
+
+	var line map[string]string
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "WARN", line["level"])
+	assert.Equal(t, "Reading request body failed", line["msg"])
+	assert.Equal(t, "unexpected EOF", line["err"])
+
+	out.Reset()
+	setupLogging(&out, levelQuiet, false)
+	slog.Error("Deleting the ingress failed")
+	assert.Equal(t, "", out.String())
+}
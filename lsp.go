@@ -0,0 +1,213 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A minimal Language Server Protocol implementation, publishing parse errors
+// as diagnostics
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lspMessage is a JSON-RPC request, response or notification
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspDiagnostic struct {
+	Range struct {
+		Start lspPosition `json:"start"`
+		End   lspPosition `json:"end"`
+	} `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// lspDocument holds the parameters of the textDocument notifications we care
+// about: didOpen, didChange and didClose
+type lspDocument struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+// maxLSPMessage is the size of the largest LSP message read, well above that
+// of any test file
+const maxLSPMessage = 64 << 20
+
+// readLSPMessage reads a message framed by a Content-Length header
+func readLSPMessage(r *bufio.Reader) (lspMessage, error) {
+	var msg lspMessage
+
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return msg, err
+	}
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return msg, fmt.Errorf("Invalid Content-Length: %s", err)
+	}
+	if length < 0 || length > maxLSPMessage {
+		return msg, fmt.Errorf("Invalid Content-Length: %d is not between 0 and %d", length, maxLSPMessage)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return msg, err
+	}
+
+	return msg, json.Unmarshal(body, &msg)
+}
+
+// writeLSPMessage writes a message framed by a Content-Length header
+func writeLSPMessage(w io.Writer, msg lspMessage) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// lspDiagnostics converts the problems found in the given text to LSP
+// diagnostics, whose lines and characters start from 0
+func lspDiagnostics(uri, text string) []lspDiagnostic {
+	diagnostics := []lspDiagnostic{}
+
+	for _, d := range diagnose(uri, strings.NewReader(text)) {
+		var ld lspDiagnostic
+		if d.Line > 0 {
+			ld.Range.Start = lspPosition{Line: d.Line - 1, Character: d.Column - 1}
+		}
+		ld.Range.End = lspPosition{Line: ld.Range.Start.Line + 1}
+		ld.Severity = 1
+		ld.Source = "httptester"
+		ld.Message = d.Message
+		diagnostics = append(diagnostics, ld)
+	}
+
+	return diagnostics
+}
+
+// serveLSP handles LSP messages read from r until the exit notification or
+// EOF, writing responses and diagnostics to w
+func serveLSP(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	for {
+		msg, err := readLSPMessage(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var doc lspDocument
+		switch msg.Method {
+		case "initialize":
+			err = writeLSPMessage(w, lspMessage{ID: msg.ID, Result: map[string]interface{}{
+				"capabilities": map[string]interface{}{
+					// Full document sync
+					"textDocumentSync": 1,
+				},
+				"serverInfo": map[string]string{"name": "httptester"},
+			}})
+		case "shutdown":
+			err = writeLSPMessage(w, lspMessage{ID: msg.ID, Result: json.RawMessage("null")})
+		case "exit":
+			return nil
+		case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+			// Notifications cannot be answered with an error, and a
+			// broken one should not stop the server
+			if err := json.Unmarshal(msg.Params, &doc); err != nil {
+				slog.Warn("Ignoring invalid LSP notification", "method", msg.Method, "err", err)
+				continue
+			}
+
+			text := doc.TextDocument.Text
+			if n := len(doc.ContentChanges); n > 0 {
+				text = doc.ContentChanges[n-1].Text
+			}
+
+			diagnostics := []lspDiagnostic{}
+			if msg.Method != "textDocument/didClose" {
+				diagnostics = lspDiagnostics(doc.TextDocument.URI, text)
+			}
+
+			err = writeLSPMessage(w, lspMessage{Method: "textDocument/publishDiagnostics", Params: mustMarshal(map[string]interface{}{
+				"uri":         doc.TextDocument.URI,
+				"diagnostics": diagnostics,
+			})})
+		default:
+			// Requests must be answered, notifications can be ignored
+			if msg.ID != nil {
+				err = writeLSPMessage(w, lspMessage{ID: msg.ID, Error: &lspError{Code: -32601, Message: "Method not found: " + msg.Method}})
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mustMarshal returns the JSON encoding of v, which cannot fail for the maps
+// of plain values used here
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// runLSP implements the 'lsp' subcommand, serving LSP on stdin and stdout
+func runLSP(args []string) {
+	if err := serveLSP(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
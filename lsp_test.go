@@ -0,0 +1,92 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnose(t *testing.T) {
+	assert.Nil(t, diagnose("ok.htc", strings.NewReader("client \"a\" {\n tx -url \"/\"\n}")))
+
+	d := diagnose("bad.htc", strings.NewReader("client \"a\" {\n tx -banana\n}"))
+	assert.Equal(t, 1, len(d))
+	assert.Equal(t, "bad.htc", d[0].File)
+	assert.Equal(t, 2, d[0].Line)
+	assert.Equal(t, 5, d[0].Column)
+	assert.Equal(t, "error", d[0].Severity)
+}
+
+func TestServeLSP(t *testing.T) {
+	var in bytes.Buffer
+	id := json.RawMessage("1")
+	writeLSPMessage(&in, lspMessage{ID: &id, Method: "initialize", Params: json.RawMessage("{}")})
+	// Invalid notifications are skipped
+	writeLSPMessage(&in, lspMessage{Method: "textDocument/didOpen", Params: json.RawMessage("[]")})
+	writeLSPMessage(&in, lspMessage{Method: "textDocument/didOpen", Params: mustMarshal(map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///bad.htc", "text": "client \"a\" {\n tx -banana\n}"},
+	})})
+	id2 := json.RawMessage("2")
+	writeLSPMessage(&in, lspMessage{ID: &id2, Method: "textDocument/hover", Params: json.RawMessage("{}")})
+	writeLSPMessage(&in, lspMessage{Method: "exit"})
+
+	var out bytes.Buffer
+	assert.Nil(t, serveLSP(&in, &out))
+
+	r := bufio.NewReader(&out)
+
+	msg, err := readLSPMessage(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(*msg.ID))
+
+	msg, err = readLSPMessage(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "textDocument/publishDiagnostics", msg.Method)
+
+	var params struct {
+		URI         string          `json:"uri"`
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	assert.Nil(t, json.Unmarshal(msg.Params, &params))
+	assert.Equal(t, "file:///bad.htc", params.URI)
+	assert.Equal(t, 1, len(params.Diagnostics))
+	assert.Equal(t, lspPosition{Line: 1, Character: 4}, params.Diagnostics[0].Range.Start)
+
+	// Unknown requests get an error
+	msg, err = readLSPMessage(r)
+	assert.Nil(t, err)
+	assert.Equal(t, -32601, msg.Error.Code)
+}
+
+func TestReadLSPMessage(t *testing.T) {
+	for _, input := range []string{
+		"Content-Length: -1\r\n\r\n",
+		"Content-Length: 1099511627776\r\n\r\n",
+		"Content-Length: banana\r\n\r\n",
+	} {
+		_, err := readLSPMessage(bufio.NewReader(strings.NewReader(input)))
+		assert.Error(t, err, input)
+	}
+
+	msg, err := readLSPMessage(bufio.NewReader(strings.NewReader("Content-Length: 17\r\n\r\n{\"method\":\"exit\"}")))
+	assert.Nil(t, err)
+	assert.Equal(t, "exit", msg.Method)
+}
@@ -19,127 +19,309 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"net/http"
 	"os"
 	"time"
 )
 
-var verbose = flag.Bool("verbose", false, "enable verbose mode")
+var verbose = flag.Bool("verbose", false, "enable verbose mode, same as -log-level debug")
+var logLevel = flag.String("log-level", "info", "only log messages of at least this level: debug, info, warn or error")
+var logJSON = flag.Bool("log-json", false, "log messages as JSON objects")
+var quiet = flag.Bool("q", false, "quiet mode: only print the summary of the run, and errors preventing it from completing")
+var strict = flag.Bool("strict", false, "fail if the origin receives requests not served by any handle stanza")
+var checkOnly = flag.Bool("n", false, "only check the syntax of the given file, like the check subcommand")
+var watch = flag.Bool("watch", false, "run the given file again whenever it changes, keeping the proxy running")
+var timeout = flag.Duration("timeout", 5*time.Minute, "maximum duration of the run, including waiting for the proxy to start. 0 means no limit")
 var shutdownDelay = flag.Int("shutdownDelay", 0, "how many seconds to wait before exiting")
+var noColor = flag.Bool("no-color", false, "do not color failures, even when writing to a terminal")
+var dumpDir = flag.String("dump-dir", "", "on failure, write the requests and responses exchanged to this directory")
+var notifyURL = flag.String("notify-url", "", "POST the JSON report to this URL on completion")
+var bench = flag.Bool("bench", false, "replay client requests and report latencies instead of checking expectations")
+var benchRate = flag.Int("rate", 100, "requests per second sent by each client in bench mode")
+var benchConcurrency = flag.Int("concurrency", 10, "maximum number of requests in flight for each client in bench mode")
+var benchDuration = flag.Duration("duration", 10*time.Second, "how long to replay each client in bench mode")
+var workDir = flag.String("workdir", os.TempDir(), "directory where the runroot of the proxy is created, eg: /dev/shm for a RAM-backed one")
+var keepArtifacts = flag.Bool("keep-artifacts", false, "on failure, keep the runroot of the proxy, with its configuration and logs")
+var atsPath = flag.String("ats-path", "", "directory holding the Apache Traffic Server programs, found in $PATH by default")
+var proxyBin = flag.String("proxy-bin", "", "program starting the proxy, run instead of traffic_manager, or traffic_server for ATS 10, of the installation")
+var proxyVersion = flag.Int("proxy-version", 0, "major version of Apache Traffic Server, determining the format of its configuration. 0 means detecting it")
+var ingressAddr = flag.String("ingress", "", "test the Kubernetes ingress controller listening on this address instead of ATS, eg: 127.0.0.1:80")
+var ingressClass = flag.String("ingress-class", "", "IngressClass of the ingress controller to test, eg: nginx")
+var kubeNamespace = flag.String("kube-namespace", "default", "Kubernetes namespace where the objects routing requests to the origin are created")
+var originIP = flag.String("origin-ip", "", "address at which Kubernetes pods reach the origin, eg: the address of the host on the network of the cluster")
+var probeKind = flag.String("probe", "http", "how to check whether the proxy is ready: http, tcp or traffic_ctl")
+var startupTimeout = flag.Duration("startup-timeout", time.Minute, "maximum time to wait for the origin and the proxy to be ready. 0 means no limit")
+var otlpEndpoint = flag.String("otlp-endpoint", "", "send OpenTelemetry traces of the run to this OTLP/HTTP endpoint, eg: http://localhost:4318")
+var randSeed = flag.Int64("seed", 0, "seed of the random requests sent in fuzz mode, printed in the report to reproduce a run. 0 means picking one at random")
+var benchWarmup = flag.Duration("warmup", 0, "how long to replay each client before measuring latencies in bench mode")
+var connEndWait = flag.Duration("conn-end-wait", 2*time.Second, "how long clients wait for the proxy to close the connection after the response, for resp.conn.end")
+var nginxPath = flag.String("nginx-path", "nginx", "nginx program run by the topology stanza, found in $PATH by default")
 
-func waitForGET(url string) {
-	for {
-		time.Sleep(200 * time.Millisecond)
+// Exit codes, so that wrapper scripts can tell failing tests from broken
+// programs and environments
+const (
+	exitPass = 0
+	// exitFailure is used when expectations are not met, or when the run
+	// could not complete, for instance because the proxy did not respond
+	exitFailure = 1
+	// exitParseError is used for invalid HTC programs and command lines
+	exitParseError = 2
+	// exitEnvironment is used when the origin or the proxy cannot be started
+	exitEnvironment = 3
+)
 
-		resp, err := http.Get(url)
-		if err == nil {
-			if resp.StatusCode != 200 {
-				log.Fatalf("Unexpected status code received from url %s: %d\n", url, resp.StatusCode)
-			} else {
-				break
-			}
-		}
+// notify sends the report to the webhook given with -notify-url, if any
+func notify(report Report) {
+	if *notifyURL == "" {
+		return
 	}
 
-	if *verbose {
-		log.Println("Finished waiting for", url)
+	if err := report.Notify(*notifyURL); err != nil {
+		slog.Warn("Webhook notification failed", "err", err)
 	}
 }
 
-func freePortOrDie() int {
-	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-	if err != nil {
-		log.Fatal(err)
+// dump writes the exchanges of a failed run to the directory given with
+// -dump-dir, if any
+func dump(report Report) {
+	if *dumpDir == "" {
+		return
+	}
+
+	if err := report.Dump(*dumpDir); err != nil {
+		slog.Error("Writing dump failed", "err", err)
+	} else {
+		slog.Info("Requests and responses written", "dir", *dumpDir)
 	}
+}
+
+// cleanupProxy removes the runroot of the proxy, unless the run failed and
+// -keep-artifacts was given. In that case, the artifacts kept are listed
+func cleanupProxy(proxy Proxy, failed bool) {
+	if !failed || !*keepArtifacts {
+		proxy.cleanup()
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Proxy artifacts kept in %s:\n", proxy.tmpDir)
+	for _, fname := range proxy.artifacts() {
+		fmt.Fprintf(os.Stderr, "  %s\n", fname)
+	}
+}
+
+// fatal notifies the webhook about an error preventing the run from
+// completing, and exits with the given code. The error is printed even in
+// quiet mode
+func fatal(code int, err error) {
+	notify(Report{File: flag.Arg(0), Error: err.Error()})
+	fmt.Fprintln(os.Stderr, err)
+	exit(code)
+}
 
-	l, err := net.ListenTCP("tcp", addr)
+// exit sends the trace of the run to the endpoint given with -otlp-endpoint,
+// if any, and exits with the given code
+func exit(code int) {
+	if err := tracer.export(); err != nil {
+		slog.Warn("Exporting the trace failed", "err", err)
+	}
+	os.Exit(code)
+}
+
+// globalContext returns a context expiring after the time given with
+// -timeout, if any
+func globalContext() (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(context.Background(), *timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// freePort returns a port which was free when this function was called
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 
 	defer l.Close()
-	return l.Addr().(*net.TCPAddr).Port
+	return l.Addr().(*net.TCPAddr).Port, nil
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "record":
+			runRecord(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "fmt":
+			runFmt(os.Args[2:])
+			return
+		case "lsp":
+			runLSP(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] file\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s check file...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s fmt [options] file...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s lsp\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s record [options]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	// Start origin server and proxy
-	originPort := freePortOrDie()
-	proxyPort := freePortOrDie()
-
-	origin := NewOrigin(originPort, *verbose)
-	origin.start()
+	if *bench && (*benchRate <= 0 || *benchConcurrency <= 0) {
+		fatal(exitParseError, fmt.Errorf("-rate and -concurrency must be positive"))
+	}
 
-	proxy := NewProxy(proxyPort, originPort)
-	proxy.start()
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		fatal(exitParseError, err)
+	}
 	if *verbose {
-		log.Println("Proxy started using temporary directory", proxy.tmpDir)
+		level = slog.LevelDebug
 	}
+	if *quiet {
+		level = levelQuiet
+	}
+	setupLogging(os.Stderr, level, *logJSON)
 
-	f, err := os.Open(flag.Arg(0))
-	if err != nil {
-		log.Fatal(err)
+	// Parse the program first, there is no point in starting anything if it
+	// is invalid, unless it may be fixed in watch mode
+	p, err := parseFile(flag.Arg(0))
+	if err != nil && (!*watch || *checkOnly) {
+		fatal(exitParseError, err)
 	}
 
-	h, c, err := Parse(f)
-	if err != nil {
-		log.Fatal(err)
+	if *checkOnly {
+		os.Exit(exitPass)
 	}
 
-	// Iterate over HandleStanzas
-	for _, hs := range h {
-		origin.addHandler(hs)
+	if err := validProbe(*probeKind, *ingressAddr != ""); err != nil {
+		fatal(exitParseError, err)
 	}
 
-	// Start clients
-	for _, cs := range c {
-		addr := fmt.Sprintf("127.0.0.1:%d", proxyPort)
-		resp, err := cs.Request.Send(addr)
-		if *verbose {
-			log.Println("Sending", cs.Request)
+	// There is no point in starting anything either if the program is to be
+	// skipped, unless it may change in watch mode
+	if c, skip := p.skipped(); skip && !*watch {
+		report := Report{File: flag.Arg(0), Skipped: c.String()}
+		report.Summary(os.Stdout)
+		notify(report)
+		os.Exit(exitPass)
+	}
+
+	// Find the proxy before starting anything
+	var install proxyInstall
+	if *ingressAddr == "" {
+		install, err = findProxy(*atsPath, *proxyBin, *proxyVersion)
+		if err != nil {
+			fatal(exitEnvironment, err)
 		}
+	} else if *originIP == "" {
+		fatal(exitParseError, fmt.Errorf("-ingress requires -origin-ip"))
+	} else if err := checkDeployment(p); err != nil {
+		fatal(exitParseError, err)
+	}
 
+	if *otlpEndpoint != "" {
+		tracer = NewTracer(*otlpEndpoint, "httptester "+flag.Arg(0))
+	}
+
+	// Start origin server and proxy
+	ctx, cancel := globalContext()
+	defer cancel()
+
+	span := tracer.start("origin start", spanKindInternal, nil)
+	origin := NewOrigin(0)
+	origin.strict = *strict
+	if err := origin.start(ctx); err != nil {
+		span.fail()
+		fatal(exitEnvironment, err)
+	}
+	span.finish()
+
+	// The proxy reaches the origin through the relay simulating network
+	// conditions, if any. In watch mode the relay is always there, as the
+	// conditions may change
+	originPort := origin.port
+	var network *relay
+	if p.Network.enabled() || *watch {
+		network, err = startRelay(p.Network, fmt.Sprintf("127.0.0.1:%d", origin.port))
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitEnvironment, err)
+		}
+		originPort = network.port
+	}
+
+	// stop stops the deployment, and the relay if any
+	d, err := startDeployment(ctx, p, install, originPort)
+	if err != nil {
+		fatal(exitEnvironment, err)
+	}
+	addr, stop := d.addr, d.stop
+	if network != nil {
+		stop = func(failed bool) {
+			d.stop(failed)
+			network.close()
 		}
+	}
 
-		for _, exp := range cs.Expectations {
-			if *verbose {
-				log.Println("Expecting", exp)
-			}
-			if exp.Response(*resp) == false {
-				proxy.stop()
-				log.Println(cs.Request)
-				log.Println(exp.StringResponse(*resp))
-				log.Fatalf("FAILED: %s (actual=%q)", exp, exp.ActualResponse(*resp))
+	if *watch {
+		start := func(ctx context.Context, p Program) (deployment, error) {
+			if err := checkDeployment(p); err != nil {
+				return deployment{}, err
 			}
+			return startDeployment(ctx, p, install, originPort)
+		}
+		watchFile(flag.Arg(0), origin, network, &d, start)
+		if d.addr != "" {
+			d.stop(false)
 		}
+		network.close()
+		exit(exitPass)
 	}
 
-	if *verbose {
-		log.Printf("Exiting in %d seconds\n", *shutdownDelay)
+	var report Report
+	if *bench {
+		report, err = runBench(ctx, p, origin, addr, d.proxy)
+	} else {
+		report, err = run(ctx, p, origin, addr, d.proxy)
+	}
+	if err != nil {
+		stop(true)
+		fatal(exitFailure, err)
 	}
 
-	time.Sleep(time.Second * time.Duration(*shutdownDelay))
+	slog.Debug("Exiting", "delay", time.Second*time.Duration(*shutdownDelay))
 
-	proxy.stop()
+	time.Sleep(time.Second * time.Duration(*shutdownDelay))
 
-	if len(origin.errors) > 0 {
-		log.Fatal(origin.errors[0])
+	report.File = flag.Arg(0)
+	if !*bench {
+		report.Summary(os.Stdout)
 	}
+	notify(report)
 
-	// Remove temporary directory only if tests passed
-	proxy.cleanup()
+	if report.Failed() {
+		if !*quiet {
+			report.Print()
+		}
+		dump(report)
+		stop(true)
+		exit(exitFailure)
+	}
 
-	os.Exit(0)
+	stop(false)
+	exit(exitPass)
 }
@@ -0,0 +1,216 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Negative caching: the proxy caching error responses from the origin, eg:
+//
+//	negative-caching {
+//	    lifetime "30s"
+//	    statuses 404 503
+//	}
+//
+//	expect cache negative "/missing"
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// negativeCondition is what expectations about negative caching require
+const negativeCondition = "cached as configured by negative-caching"
+
+// Defaults of ATS for negative caching
+var (
+	defaultNegativeLifetime = 1800 * time.Second
+	defaultNegativeStatuses = []int{204, 305, 403, 404, 405, 414, 500, 501, 502, 503, 504}
+)
+
+// NegativeCaching is the configuration of the proxy about caching error
+// responses, set with the negative-caching stanza
+type NegativeCaching struct {
+	// Lifetime is how long error responses are cached when they do not
+	// say how long they are fresh for
+	Lifetime time.Duration
+	// Statuses are the status codes of the responses cached
+	Statuses []int
+}
+
+// parseNegativeCaching parses the negative-caching stanza, where options not
+// given take the default values of the proxy
+func parseNegativeCaching(s *scanner) (NegativeCaching, error) {
+	n := NegativeCaching{Lifetime: defaultNegativeLifetime, Statuses: defaultNegativeStatuses}
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		return n, fmt.Errorf("Parse error in 'negative-caching' stanza: expecting '{', got %q", token)
+	}
+
+	var statuses []int
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case NEWLINE:
+		case CLOSE_CURLY:
+			if statuses != nil {
+				n.Statuses = statuses
+			}
+			return n, nil
+		case LIFETIME:
+			token = s.ScanUseful()
+			d, err := time.ParseDuration(token.val)
+			if (token.typ != STRING && token.typ != DURATION) || err != nil || d < time.Second || d%time.Second != 0 {
+				return n, fmt.Errorf("Parse error in 'negative-caching' stanza: expecting a whole number of seconds after 'lifetime', got %q", token)
+			}
+			n.Lifetime = d
+		case STATUSES:
+			for token = s.ScanUseful(); token.typ == INTEGER; token = s.ScanUseful() {
+				status, _ := strconv.Atoi(token.val)
+				if status < 100 || status > 599 {
+					return n, fmt.Errorf("Parse error in 'negative-caching' stanza: expecting a status code, got %q", token)
+				}
+				statuses = append(statuses, status)
+			}
+			if token.typ != NEWLINE || len(statuses) == 0 {
+				return n, fmt.Errorf("Parse error in 'negative-caching' stanza: expecting status codes after 'statuses', got %q", token)
+			}
+		default:
+			return n, fmt.Errorf("Parse error in 'negative-caching' stanza: expecting 'lifetime', 'statuses' or '}', got %q", token)
+		}
+	}
+}
+
+// list returns the statuses separated by spaces, as in the records of the
+// proxy
+func (n NegativeCaching) list() string {
+	statuses := make([]string, len(n.Statuses))
+	for i, status := range n.Statuses {
+		statuses[i] = strconv.Itoa(status)
+	}
+	return strings.Join(statuses, " ")
+}
+
+// records returns the records enabling negative caching, in the http section
+// of records.yaml or, if yaml is false, as records.config lines. Empty if n
+// is nil, negative caching being disabled by default
+func (n *NegativeCaching) records(yaml bool) string {
+	if n == nil {
+		return ""
+	}
+	lifetime := int(n.Lifetime / time.Second)
+	if yaml {
+		return fmt.Sprintf(`    negative_caching_enabled: 1
+    negative_caching_lifetime: %d
+    negative_caching_list: "%s"
+`, lifetime, n.list())
+	}
+	return fmt.Sprintf(`CONFIG proxy.config.http.negative_caching_enabled INT 1
+CONFIG proxy.config.http.negative_caching_lifetime INT %d
+CONFIG proxy.config.http.negative_caching_list STRING %s
+`, lifetime, n.list())
+}
+
+// freshness returns whether the headers h of a response say how long it is
+// fresh for, and whether it is fresh at all. As for shared caches, s-maxage
+// takes precedence over max-age, and both over Expires. Invalid values mean
+// that the response is stale
+func freshness(h http.Header) (explicit, fresh bool) {
+	ages := make(map[string]int)
+	for _, directive := range strings.Split(strings.Join(h.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name = strings.ToLower(name); name == "s-maxage" || name == "max-age" {
+			// Atoi returns 0 for invalid values, and the largest int for
+			// values out of range
+			ages[name], _ = strconv.Atoi(strings.Trim(value, `"`))
+		}
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if age, ok := ages[name]; ok {
+			return true, age > 0
+		}
+	}
+
+	if len(h.Values("Expires")) == 0 {
+		return false, false
+	}
+	expires, err := http.ParseTime(h.Get("Expires"))
+	date, dateErr := http.ParseTime(h.Get("Date"))
+	if dateErr != nil {
+		date = time.Now()
+	}
+	return true, err == nil && expires.After(date)
+}
+
+// caches returns whether the proxy caches resp, and why. Responses saying
+// how long they are fresh for are cached whether negative caching is enabled
+// or not, the others only if their status is in the statuses of n
+func (n *NegativeCaching) caches(resp *ClientResponse) (bool, string) {
+	for _, directive := range strings.Split(strings.Join(resp.Header.Values("Cache-Control"), ","), ",") {
+		switch directive = strings.ToLower(strings.TrimSpace(directive)); directive {
+		case "no-store", "no-cache", "private":
+			return false, fmt.Sprintf("Cache-Control: %s prevents serving it from the cache", directive)
+		}
+	}
+	switch explicit, fresh := freshness(resp.Header); {
+	case explicit && !fresh:
+		return false, "its Cache-Control or Expires header says that it is stale"
+	case explicit:
+		return true, "its Cache-Control or Expires header says how long it is fresh for"
+	case n == nil:
+		return false, "negative caching is not enabled"
+	case !slices.Contains(n.Statuses, resp.StatusCode):
+		return false, fmt.Sprintf("status %d is not in the statuses of negative-caching", resp.StatusCode)
+	}
+	return true, fmt.Sprintf("status %d is in the statuses of negative-caching", resp.StatusCode)
+}
+
+// CacheNegative checks an expectation about negative caching, once all
+// clients are done: the error response fetched again must be served from the
+// cache if n caches it, and fetched from the origin again otherwise. ids and
+// responses map client names to the IDs of the requests they sent and to the
+// responses they received
+func (e Expect) CacheNegative(n *NegativeCaching, o *Origin, ids map[string]string, responses map[string]*ClientResponse) Evaluation {
+	ev := e.newEvaluation()
+	ev.Expected = e.condition()
+
+	fill, hit := responses[e.clients[0]], responses[e.clients[1]]
+	if fill == nil || hit == nil {
+		ev.Reason = "the proxy sent no response"
+		return ev
+	}
+	if fill.StatusCode < http.StatusBadRequest && (n == nil || !slices.Contains(n.Statuses, fill.StatusCode)) {
+		ev.Actual = fmt.Sprintf("status %d", fill.StatusCode)
+		ev.Reason = "the origin sent no error response"
+		return ev
+	}
+
+	cached, why := n.caches(fill)
+	switch {
+	case len(o.hits.caused(ids[e.clients[1]])) > 0:
+		ev.Actual, ev.Passed = "fetched from the origin again", !cached
+	case hit.StatusCode != fill.StatusCode:
+		ev.Actual = fmt.Sprintf("status %d from the cache, was %d", hit.StatusCode, fill.StatusCode)
+		return ev
+	default:
+		ev.Actual, ev.Passed = "served from the cache", cached
+	}
+	if !ev.Passed {
+		ev.Reason = why
+	}
+	return ev
+}
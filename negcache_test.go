@@ -0,0 +1,247 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNegativeCaching(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/missing" {
+    tx -status 404
+}
+
+negative-caching {
+    lifetime "30s"
+    statuses 404 503
+}
+
+expect cache negative "/missing"`))
+	assert.Nil(t, err)
+	if assert.NotNil(t, p.NegativeCaching) {
+		assert.Equal(t, 30*time.Second, p.NegativeCaching.Lifetime)
+		assert.Equal(t, []int{404, 503}, p.NegativeCaching.Statuses)
+	}
+	if assert.Len(t, p.Clients, 2) {
+		assert.Equal(t, "negative-fill /missing", p.Clients[0].Name)
+		assert.Equal(t, "negative-hit /missing", p.Clients[1].Name)
+		assert.False(t, p.Clients[1].RestartProxy)
+	}
+	if assert.Len(t, p.Expectations, 1) {
+		assert.Equal(t, EXPECT_CACHE_NEGATIVE, p.Expectations[0].field)
+	}
+
+	p, err = Parse(strings.NewReader(`negative-caching {
+}
+
+expect cache negative "/missing"`))
+	assert.Nil(t, err)
+	if assert.NotNil(t, p.NegativeCaching) {
+		assert.Equal(t, defaultNegativeLifetime, p.NegativeCaching.Lifetime)
+		assert.Equal(t, defaultNegativeStatuses, p.NegativeCaching.Statuses)
+	}
+
+	for _, input := range []string{
+		`negative-caching`,
+		`negative-caching {
+    lifetime "500ms"
+}`,
+		`negative-caching {
+    lifetime 30
+}`,
+		`negative-caching {
+    statuses
+}`,
+		`negative-caching {
+    statuses 404 42
+}`,
+		`negative-caching {
+    ttl "30s"
+}`,
+		`negative-caching {
+}
+
+negative-caching {
+}`,
+		`expect cache negative`,
+		`expect cache negative "missing"`,
+		`assert {
+    expect cache negative "/missing"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\n\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestNegativeCachingRecords(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	_, config := p.recordsConfig()
+	assert.NotContains(t, config, "negative_caching")
+
+	p.negativeCaching = &NegativeCaching{Lifetime: time.Minute, Statuses: []int{404, 503}}
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "CONFIG proxy.config.http.negative_caching_enabled INT 1\n")
+	assert.Contains(t, config, "CONFIG proxy.config.http.negative_caching_lifetime INT 60\n")
+	assert.Contains(t, config, "CONFIG proxy.config.http.negative_caching_list STRING 404 503\n")
+
+	p.install.version = 10
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "    connect_ports: \"1-65535\"\n    negative_caching_enabled: 1\n")
+	assert.Contains(t, config, "    negative_caching_lifetime: 60\n")
+	assert.Contains(t, config, "    negative_caching_list: \"404 503\"\n")
+}
+
+func TestNegativeCachingCaches(t *testing.T) {
+	n := &NegativeCaching{Lifetime: time.Minute, Statuses: []int{404}}
+	date := time.Now().UTC()
+	for _, tc := range []struct {
+		n      *NegativeCaching
+		status int
+		header http.Header
+		cached bool
+	}{
+		{n, 404, http.Header{}, true},
+		{n, 500, http.Header{}, false},
+		{nil, 404, http.Header{}, false},
+		{nil, 404, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{nil, 500, http.Header{"Cache-Control": {"public, s-maxage=60"}}, true},
+		{n, 404, http.Header{"Cache-Control": {"max-age=00"}}, false},
+		{n, 404, http.Header{"Cache-Control": {"max-age=-1"}}, false},
+		{n, 404, http.Header{"Cache-Control": {"max-age=soon"}}, false},
+		{n, 404, http.Header{"Cache-Control": {`max-age="60"`}}, true},
+		{n, 404, http.Header{"Cache-Control": {"s-maxage=0, max-age=60"}}, false},
+		{nil, 404, http.Header{"Cache-Control": {"max-age=0", "s-maxage=60"}}, true},
+		{nil, 404, http.Header{"Cache-Control": {"max-age=60, no-store"}}, false},
+		{nil, 404, http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, true},
+		{nil, 404, http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}, "Date": {date.Add(2 * time.Hour).Format(http.TimeFormat)}}, false},
+		{n, 404, http.Header{"Expires": {"0"}}, false},
+		{n, 404, http.Header{"Expires": {"0"}, "Cache-Control": {"max-age=60"}}, true},
+	} {
+		cached, why := tc.n.caches(&ClientResponse{Response: http.Response{StatusCode: tc.status, Header: tc.header}})
+		assert.Equal(t, tc.cached, cached, "%d %v: %s", tc.status, tc.header, why)
+	}
+}
+
+// negativeProxy is a reverse proxy to the given origin caching the status and
+// the body of all responses in memory, unless they have Cache-Control:
+// no-store
+type negativeProxy struct {
+	mu      sync.Mutex
+	objects map[string]*httptest.ResponseRecorder
+	proxy   *httputil.ReverseProxy
+}
+
+func (c *negativeProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	rec, ok := c.objects[req.URL.Path]
+	c.mu.Unlock()
+	if !ok {
+		rec = httptest.NewRecorder()
+		c.proxy.ServeHTTP(rec, req)
+		if rec.Header().Get("Cache-Control") != "no-store" {
+			c.mu.Lock()
+			c.objects[req.URL.Path] = rec
+			c.mu.Unlock()
+		}
+	}
+	maps.Copy(w.Header(), rec.Header())
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+func TestRunCacheNegative(t *testing.T) {
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	front := httptest.NewServer(&negativeProxy{objects: make(map[string]*httptest.ResponseRecorder), proxy: httputil.NewSingleHostReverseProxy(u)})
+	defer front.Close()
+	addr := strings.TrimPrefix(front.URL, "http://")
+
+	runNegative := func(src string) Report {
+		p, err := Parse(strings.NewReader(src))
+		assert.Nil(t, err)
+		report, err := run(t.Context(), p, origin, addr, nil)
+		assert.Nil(t, err)
+		return report
+	}
+
+	report := runNegative(`handle "/missing" {
+    tx -status 404
+}
+
+negative-caching {
+    statuses 404
+}
+
+expect cache negative "/missing"`)
+	assert.False(t, report.Failed(), report.Failures)
+
+	report = runNegative(`handle "/unavailable" {
+    tx -status 503 -header "Cache-Control: no-store"
+}
+
+negative-caching {
+}
+
+expect cache negative "/unavailable"`)
+	assert.False(t, report.Failed(), report.Failures)
+
+	// Negative caching is not enabled, yet the response was cached
+	report = runNegative(`handle "/gone" {
+    tx -status 404
+}
+
+expect cache negative "/gone"`)
+	if assert.Len(t, report.Failures, 1) {
+		assert.Equal(t, `"served from the cache"`, report.Failures[0].Actual)
+		assert.Equal(t, "negative caching is not enabled", report.Failures[0].Reason)
+	}
+
+	// Responses saying how long they are fresh for are cached anyway
+	report = runNegative(`handle "/forbidden" {
+    tx -status 403 -header "Cache-Control: max-age=60"
+}
+
+expect cache negative "/forbidden"`)
+	assert.False(t, report.Failed(), report.Failures)
+
+	// 500 is not listed, yet the response was cached
+	report = runNegative(`handle "/error" {
+    tx -status 500
+}
+
+negative-caching {
+    statuses 404
+}
+
+expect cache negative "/error"`)
+	if assert.Len(t, report.Failures, 1) {
+		assert.Equal(t, "status 500 is not in the statuses of negative-caching", report.Failures[0].Reason)
+	}
+}
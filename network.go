@@ -0,0 +1,290 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Simulated network conditions between the proxy and the origin, eg:
+//
+//	network {
+//	    latency 100ms
+//	    reset-after 64KB
+//	}
+//
+// The proxy then reaches the origin through a TCP relay run by httptester,
+// which needs none of the privileges required by tc and netem
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Network are the conditions of the network between the proxy and the origin
+type Network struct {
+	// Latency delays the data relayed in each direction
+	Latency time.Duration
+	// Bandwidth is the maximum number of bytes relayed per second in each
+	// direction, 0 if unlimited
+	Bandwidth int
+	// ResetAfter is the number of bytes sent by the origin on each
+	// connection, after which the connection is reset. 0 if never
+	ResetAfter int
+}
+
+// enabled returns true if any condition is set, requiring a relay
+func (n Network) enabled() bool {
+	return n != Network{}
+}
+
+// sizeUnits are the suffixes of sizes, largest first
+var sizeUnits = []struct {
+	suffix string
+	bytes  int
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize returns the number of bytes in the given size, eg: 64KB. ok is
+// false if s is not a size
+func parseSize(s string) (n int, ok bool) {
+	for _, unit := range sizeUnits {
+		if !strings.HasSuffix(s, unit.suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, unit.suffix))
+		return n * unit.bytes, err == nil && n >= 0
+	}
+	return 0, false
+}
+
+// parseNetwork parses the block following the network keyword
+func parseNetwork(s *scanner) (Network, error) {
+	var n Network
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		return n, fmt.Errorf("Parse error in 'network' stanza: expecting '{', got %q", token)
+	}
+
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case NEWLINE:
+		case CLOSE_CURLY:
+			if !n.enabled() {
+				return n, fmt.Errorf("Parse error in 'network' stanza: expecting at least one of 'latency', 'bandwidth' or 'reset-after'")
+			}
+			return n, nil
+		case LATENCY:
+			token = s.ScanUseful()
+			d, err := time.ParseDuration(token.val)
+			if (token.typ != STRING && token.typ != DURATION) || err != nil || d <= 0 {
+				return n, fmt.Errorf("Parse error in 'network' stanza: expecting a positive duration after 'latency', got %q", token)
+			}
+			n.Latency = d
+		case BANDWIDTH, RESETAFTER:
+			keyword := token.val
+			token = s.ScanUseful()
+			size, ok := parseSize(token.val)
+			if token.typ == INTEGER {
+				size, _ = strconv.Atoi(token.val)
+				ok = true
+			}
+			if (token.typ != STRING && token.typ != SIZE && token.typ != INTEGER) || !ok || size <= 0 {
+				return n, fmt.Errorf("Parse error in 'network' stanza: expecting a positive size like 64KB after '%s', got %q", keyword, token)
+			}
+			if keyword == "bandwidth" {
+				n.Bandwidth = size
+			} else {
+				n.ResetAfter = size
+			}
+		default:
+			return n, fmt.Errorf("Parse error in 'network' stanza: expecting 'latency', 'bandwidth', 'reset-after' or '}', got %q", token)
+		}
+	}
+}
+
+// relay forwards the connections it accepts to target, under the given
+// network conditions. Those can be changed while the relay runs, see set
+type relay struct {
+	mu       sync.Mutex
+	network  Network
+	target   string
+	listener *net.TCPListener
+	// port is where the relay listens, on all interfaces like the origin
+	port int
+}
+
+// startRelay starts a relay to target, which the proxy reaches in place of
+// the origin
+func startRelay(n Network, target string) (*relay, error) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("starting the network relay failed: %w", err)
+	}
+
+	r := &relay{network: n, target: target, listener: l, port: l.Addr().(*net.TCPAddr).Port}
+	go r.serve()
+	return r, nil
+}
+
+// close stops accepting connections
+func (r *relay) close() {
+	r.listener.Close()
+}
+
+// set changes the network conditions of the connections accepted from now
+// on, eg: once the program changed in watch mode. Those already relayed keep
+// the previous ones
+func (r *relay) set(n Network) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.network = n
+}
+
+// conditions returns the current network conditions, see set
+func (r *relay) conditions() Network {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.network
+}
+
+func (r *relay) serve() {
+	for {
+		conn, err := r.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+// handle relays data between the given connection from the proxy and a new
+// one to the origin, until both directions are closed or the connections are
+// reset
+func (r *relay) handle(proxy *net.TCPConn) {
+	defer proxy.Close()
+
+	conn, err := net.DialTimeout("tcp", r.target, 5*time.Second)
+	if err != nil {
+		slog.Debug("Relay cannot reach the origin", "err", err)
+		return
+	}
+	origin := conn.(*net.TCPConn)
+	defer origin.Close()
+
+	n := r.conditions()
+	done := make(chan struct{})
+	go func() {
+		r.pipe(origin, proxy, n, 0)
+		close(done)
+	}()
+	r.pipe(proxy, origin, n, n.ResetAfter)
+	<-done
+}
+
+// chunk is data read from one side of the relay, to be written to the other
+// once the latency has elapsed
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// pipe copies data from src to dst under the network conditions n, resetting
+// both connections after limit bytes unless 0. A clean close of src is
+// forwarded as such, while errors reset both connections
+func (r *relay) pipe(dst, src *net.TCPConn, n Network, limit int) {
+	var readErr error
+	chunks := make(chan chunk, 64)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			read, err := src.Read(buf)
+			if read > 0 {
+				chunks <- chunk{data: buf[:read], at: time.Now().Add(n.Latency)}
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+	// Unblock the reader if writing stops early
+	defer func() {
+		for range chunks {
+		}
+	}()
+
+	sent := 0
+	for c := range chunks {
+		time.Sleep(time.Until(c.at))
+
+		data, reset := c.data, false
+		if limit > 0 && sent+len(data) >= limit {
+			data, reset = data[:limit-sent], true
+		}
+		if err := r.write(dst, data, n.Bandwidth); err != nil {
+			reset = true
+		}
+		sent += len(data)
+
+		if reset {
+			resetConn(dst)
+			resetConn(src)
+			return
+		}
+	}
+
+	if errors.Is(readErr, io.EOF) {
+		dst.CloseWrite()
+	} else {
+		resetConn(dst)
+	}
+}
+
+// write writes data to dst, at most rate bytes per second unless 0, in chunks
+// sent every 100ms or more, like slowReader
+func (r *relay) write(dst *net.TCPConn, data []byte, rate int) error {
+	if rate <= 0 {
+		_, err := dst.Write(data)
+		return err
+	}
+
+	chunk := max(rate/10, 1)
+	for len(data) > 0 {
+		n := min(len(data), chunk)
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(rate))
+		if _, err := dst.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// resetConn closes c sending a TCP reset instead of a FIN
+func resetConn(c *net.TCPConn) {
+	c.SetLinger(0)
+	c.Close()
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for input, expected := range map[string]int{
+		"0B":   0,
+		"512B": 512,
+		"64KB": 64 << 10,
+		"2MB":  2 << 20,
+		"1GB":  1 << 30,
+	} {
+		n, ok := parseSize(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, n, input)
+	}
+
+	for _, input := range []string{"", "B", "KB", "-1KB", "64kb", "64", "1.5MB", "64KiB"} {
+		_, ok := parseSize(input)
+		assert.False(t, ok, input)
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	p, err := Parse(strings.NewReader(`network {
+    latency 100ms
+    bandwidth "1MB"
+    reset-after 64KB
+}
+
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Network{Latency: 100 * time.Millisecond, Bandwidth: 1 << 20, ResetAfter: 64 << 10}, p.Network)
+
+	p, err = Parse(strings.NewReader(`network { reset-after 1000 }
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Network{ResetAfter: 1000}, p.Network)
+
+	for _, input := range []string{
+		`network {}`,
+		`network latency 100ms`,
+		`network {
+    latency "banana"
+}`,
+		`network {
+    latency 0s
+}`,
+		`network {
+    bandwidth 0B
+}`,
+		`network {
+    reset-after 100ms
+}`,
+		`network {
+    jitter 10ms
+}`,
+		`network {
+    latency 100ms
+}
+network {
+    latency 200ms
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.Error(t, err, input)
+	}
+}
+
+// startTestRelay starts a relay to a server answering with a body of the
+// given size, returning the URL at which the server is reached through the
+// relay
+func startTestRelay(t *testing.T, n Network, size int) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", size)))
+	}))
+	t.Cleanup(server.Close)
+
+	r, err := startRelay(n, server.Listener.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(r.close)
+	return fmt.Sprintf("http://127.0.0.1:%d/", r.port)
+}
+
+func TestRelay(t *testing.T) {
+	url := startTestRelay(t, Network{ResetAfter: 1 << 20}, 1000)
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(url)
+		assert.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, len(body))
+	}
+}
+
+func TestRelayLatency(t *testing.T) {
+	url := startTestRelay(t, Network{Latency: 100 * time.Millisecond}, 10)
+
+	start := time.Now()
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	// Both the request and the response are delayed
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 200*time.Millisecond, elapsed)
+}
+
+func TestRelayBandwidth(t *testing.T) {
+	url := startTestRelay(t, Network{Bandwidth: 10 << 10}, 5<<10)
+
+	start := time.Now()
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 500*time.Millisecond, elapsed)
+}
+
+func TestRelayResetAfter(t *testing.T) {
+	url := startTestRelay(t, Network{ResetAfter: 64 << 10}, 1<<20)
+
+	resp, err := http.Get(url)
+	if err == nil {
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.True(t, len(body) < 64<<10, len(body))
+	}
+	assert.Error(t, err)
+}
+
+func TestRelaySet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1<<20)))
+	}))
+	defer server.Close()
+	r, err := startRelay(Network{}, server.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer r.close()
+	url := fmt.Sprintf("http://127.0.0.1:%d/", r.port)
+	// New connections only get the conditions set
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	resp, err := client.Get(url)
+	if assert.Nil(t, err) {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, 1<<20, len(body))
+	}
+
+	r.set(Network{ResetAfter: 64 << 10})
+	resp, err = client.Get(url)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+}
@@ -15,43 +15,455 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 )
 
+// requestIDHeader is added to every request sent by clients, so that failures
+// detected by the origin can be associated with the client that caused them
+const requestIDHeader = "X-Httptester-Id"
+
+// failureRecorder collects the failures detected by handlers, which run
+// concurrently in their own goroutines
+type failureRecorder struct {
+	mu sync.Mutex
+	// failures maps request IDs to the failures detected while handling the
+	// corresponding requests. Requests without an ID are stored under ""
+	failures map[string][]Failure
+}
+
+func newFailureRecorder() *failureRecorder {
+	return &failureRecorder{failures: make(map[string][]Failure)}
+}
+
+// add records a failure detected while handling the request with the given ID
+func (r *failureRecorder) add(id string, f Failure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[id] = append(r.failures[id], f)
+}
+
+// all returns a copy of all failures recorded so far, by request ID
+func (r *failureRecorder) all() map[string][]Failure {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failures := make(map[string][]Failure, len(r.failures))
+	for id, f := range r.failures {
+		failures[id] = append([]Failure(nil), f...)
+	}
+	return failures
+}
+
+// originHit is a request received by a handler
+type originHit struct {
+	path      string
+	requestID string
+	// method, url and headers are those of the request as sent by the proxy
+	method  string
+	url     string
+	headers http.Header
+	// outcome tells whether the handler sent the whole response, see
+	// hitLog.finish. Empty while it is in progress
+	outcome string
+	// received is the size of the request body read by the handler
+	received int
+}
+
+// hitLog records, in order, the requests received by all handlers
+type hitLog struct {
+	mu   sync.Mutex
+	hits []originHit
+}
+
+func newHitLog() *hitLog {
+	return &hitLog{}
+}
+
+// add records a hit of the handler for the given path, returning the hits of
+// the handler so far, this one included
+func (l *hitLog) add(path string, req *http.Request) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	headers := req.Header.Clone()
+	if req.Host != "" {
+		// Go moves the Host header out of req.Header
+		headers.Set("Host", req.Host)
+	}
+	l.hits = append(l.hits, originHit{
+		path:      path,
+		requestID: req.Header.Get(requestIDHeader),
+		method:    req.Method,
+		url:       req.URL.RequestURI(),
+		headers:   headers,
+	})
+	return l.countLocked(path)
+}
+
+// count returns the hits of the handler for the given path
+func (l *hitLog) count(path string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.countLocked(path)
+}
+
+// countLocked is count, called with l.mu held
+func (l *hitLog) countLocked(path string) int {
+	n := 0
+	for _, hit := range l.hits {
+		if hit.path == path {
+			n++
+		}
+	}
+	return n
+}
+
+// finish records the outcome of the n-th hit, starting from 0, of the handler
+// for the given path: fetchCompleted or fetchAborted
+func (l *hitLog) finish(path string, n int, outcome string) {
+	l.update(path, n, func(hit *originHit) { hit.outcome = outcome })
+}
+
+// receive records the size of the request body of the n-th hit, starting
+// from 0, of the handler for the given path
+func (l *hitLog) receive(path string, n int, size int) {
+	l.update(path, n, func(hit *originHit) { hit.received = size })
+}
+
+// update calls f with the n-th hit, starting from 0, of the handler for the
+// given path, if any
+func (l *hitLog) update(path string, n int, f func(*originHit)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.hits {
+		if l.hits[i].path != path {
+			continue
+		}
+		if n == 0 {
+			f(&l.hits[i])
+			return
+		}
+		n--
+	}
+}
+
+// nth returns the n-th hit, starting from 0, of the handler for the given
+// path. false is returned if the handler was hit fewer times
+func (l *hitLog) nth(path string, n int) (originHit, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, hit := range l.hits {
+		if hit.path != path {
+			continue
+		}
+		if n == 0 {
+			return hit, true
+		}
+		n--
+	}
+	return originHit{}, false
+}
+
+// seq returns the sequence number, starting from 1, of the first hit caused
+// by the request with the given ID. 0 is returned if the request never
+// reached the origin, or was sent without ID
+func (l *hitLog) seq(requestID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, hit := range l.hits {
+		if hit.requestID == requestID && requestID != "" {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// caused returns the handlers hit by the request with the given ID, in order,
+// eg: the same one twice if the proxy retried the request
+func (l *hitLog) caused(requestID string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var paths []string
+	for _, hit := range l.hits {
+		if hit.requestID == requestID && requestID != "" {
+			paths = append(paths, hit.path)
+		}
+	}
+	return paths
+}
+
+// connCounter keeps track of the connections open to the origin, see
+// http.Server.ConnState
+type connCounter struct {
+	mu   sync.Mutex
+	open int
+	// peak is the maximum number of connections open at the same time
+	// since the last reset
+	peak int
+}
+
+// track updates the count when a connection is opened or closed. Hijacked
+// connections are no longer tracked by the server, and count as closed
+func (c *connCounter) track(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		c.open++
+		c.peak = max(c.peak, c.open)
+	case http.StateClosed, http.StateHijacked:
+		c.open--
+	}
+}
+
+// max returns the maximum number of connections open at the same time since
+// the last reset
+func (c *connCounter) max() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peak
+}
+
+// reset starts counting from the connections currently open
+func (c *connCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peak = c.open
+}
+
 type Origin struct {
-	errors  []error
-	port    int
-	verbose bool
+	failures *failureRecorder
+	hits     *hitLog
+	captures *captureLog
+	// streams records when the origin started sending the last chunk of
+	// streamed bodies, for resp.streamed
+	streams *streamLog
+	// sent records the last body sent to each request, for resp.transform
+	sent *sentLog
+	// conns counts the connections opened by the proxy, for origin.maxconns
+	conns *connCounter
+	port  int
+	// strict makes requests not served by any handler fail the run
+	strict bool
+
+	// routes holds the handlers of the current run, cleared by reset
+	mu     sync.RWMutex
+	routes []route
+}
+
+// route is a handler installed on the origin, along with the handle stanza
+// describing which requests it serves
+type route struct {
+	hs      HandleStanza
+	handler http.HandlerFunc
+}
+
+func NewOrigin(port int) *Origin {
+	o := &Origin{port: port, conns: &connCounter{}}
+	o.reset()
+	return o
+}
+
+// reset removes all handlers, failures, hits and captures, so that the
+// origin can be reused for another run
+func (o *Origin) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.conns.reset()
+	o.routes = nil
+	o.failures = newFailureRecorder()
+	o.hits = newHitLog()
+	o.captures = newCaptureLog()
+	o.streams = newStreamLog()
+	o.sent = newSentLog()
 }
 
-func NewOrigin(port int, verbose bool) Origin {
-	return Origin{port: port, verbose: verbose}
+// ServeHTTP dispatches the request to the handler serving it, see route
+func (o *Origin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/httpTesterInternalCheck" {
+		fmt.Fprintf(w, "UP!")
+		return
+	}
+
+	// Go moves the Transfer-Encoding header out of req.Header: put it back,
+	// so that it can be checked like the other headers
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+
+	o.mu.RLock()
+	handler := o.route(req)
+	failures, hits := o.failures, o.hits
+	o.mu.RUnlock()
+
+	// Handlers take precedence over built-in endpoints, whose hits are
+	// recorded by path
+	if handler == nil {
+		if handler = builtin(req); handler != nil {
+			hits.add(req.URL.Path, req)
+		}
+	}
+	if handler == nil {
+		if o.strict {
+			failures.add(req.Header.Get(requestIDHeader), Failure{
+				Context:  "strict mode",
+				Expect:   fmt.Sprintf("%s %s", req.Method, req.URL.RequestURI()),
+				Expected: "a handle stanza serving the request",
+				Actual:   "none",
+			})
+		}
+		http.NotFound(w, req)
+		return
+	}
+	handler(w, req)
+}
+
+// route returns the handler serving the given request, or nil. Handlers for
+// exact paths take precedence over those for families of paths, then handlers
+// for the method of the request, those for GET serving HEAD requests and those
+// for a virtual host over generic ones. The default handler comes last.
+// Otherwise, the first handler defined wins
+func (o *Origin) route(req *http.Request) http.HandlerFunc {
+	var best *route
+	rank := func(hs HandleStanza) int {
+		r := 0
+		if hs.Default {
+			r -= 16
+		} else if hs.match == nil {
+			r += 8
+		}
+		if hs.Method == req.Method {
+			r += 4
+		} else if hs.Method != "" {
+			r += 2
+		}
+		if hs.Host != "" {
+			r++
+		}
+		return r
+	}
+
+	for i := range o.routes {
+		r := &o.routes[i]
+		if r.hs.matches(req) && (best == nil || rank(r.hs) > rank(best.hs)) {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return best.handler
 }
 
 func (o *Origin) addHandler(hs HandleStanza) {
-	http.HandleFunc(hs.URIPath, func(w http.ResponseWriter, req *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	failures, hits, captures, streams, sent := o.failures, o.hits, o.captures, o.streams, o.sent
+	o.routes = append(o.routes, route{hs: hs, handler: func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		count := hits.add(hs.pattern(), req)
+		outcome := fetchCompleted
+		defer func() { hits.finish(hs.pattern(), count-1, outcome) }()
+		span := tracer.startRemote(hs.String(), spanKindServer, req.Header.Get(traceparentHeader))
+		defer span.finish()
+		span.setAttr("http.request.method", req.Method)
+		span.setAttr("url.path", req.URL.Path)
+		span.setAttr("httptester.request_id", id)
+
+		// Read the body once, so that it can be checked by multiple
+		// expectations and captured
+		body, size, err := readBody(req.Body)
+		if err != nil {
+			slog.Warn("Reading request body failed", "err", err)
+		}
+		hits.receive(hs.pattern(), count-1, int(size))
+		rewind := func() {
+			// ContentLength tells if body is only the beginning
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = size
+		}
+
+		// Requests without a valid token are rejected before being
+		// checked, see verifySignedURL
+		if hs.rejectUnsigned(w, req) {
+			return
+		}
+
 		// Expect things
 		for _, exp := range hs.Expectations {
-			if o.verbose {
-				log.Println("Expecting", exp)
+			slog.Debug("Expecting", "handler", hs.String(), "expect", exp.String())
+			rewind()
+			if ev := exp.Request(*req); !ev.Passed {
+				span.fail()
+				failures.add(id, newFailure(hs.String(), exp, ev))
 			}
-			if exp.Request(*req) == false {
-				o.errors = append(o.errors, fmt.Errorf("FAILED: %s (actual=%q)", exp, exp.ActualRequest(*req)))
+		}
+
+		// Fill in the values of the request referred to by the response.
+		// gRPC handlers without a body echo the message received
+		resp := hs.response(count).expand(req, body)
+		if resp.grpc && resp.body == nil {
+			if resp.body, err = grpcMessages(body); err != nil {
+				slog.Warn("Reading gRPC request failed", "err", err)
+			}
+		}
+		if hs.Script != nil {
+			if resp, err = hs.Script.run(resp, req, body, count); err != nil {
+				span.fail()
+				failures.add(id, Failure{Context: hs.String(), Expect: "script", Expected: "script completes", Error: err.Error()})
+				resp = TxResp{statusCode: http.StatusInternalServerError}
 			}
 		}
+		resp = resp.conditional(req)
+		if req.Method == http.MethodHead {
+			resp = resp.head()
+		}
+		resp.lastChunk = func() { streams.add(id) }
+		sent.add(id, resp)
 
-		// return response
-		hs.Response.Send(w)
-	})
+		// return response, keeping a copy of what was received and sent
+		cw := &captureWriter{ResponseWriter: w, limit: maxBufferedBody}
+		resp.Send(cw)
+		if cw.err != nil {
+			outcome = fetchAborted
+		}
+		rewind()
+		captures.add(id, captureOrigin(req, cw))
+	}})
 }
 
-func (o Origin) start() {
-	http.HandleFunc("/httpTesterInternalCheck", func(w http.ResponseWriter, req *http.Request) {
-		fmt.Fprintf(w, "UP!")
-	})
-	go http.ListenAndServe(fmt.Sprintf(":%d", o.port), nil)
+// newServer returns the server of the origin, accepting HTTP/2 without TLS
+// for gRPC and connections starting with a PROXY protocol header, and
+// counting connections
+func (o *Origin) newServer() *http.Server {
+	return &http.Server{Handler: o, Protocols: originProtocols(), ConnContext: proxyConnContext, ConnState: o.conns.track}
+}
+
+// start serves requests in the background, returning once the origin is up
+// or ctx is done. If the port of the origin is 0, a free one is chosen and
+// the origin keeps listening on it, so that no other process can take it
+func (o *Origin) start(ctx context.Context) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", o.port))
+	if err != nil {
+		return err
+	}
+	o.port = l.Addr().(*net.TCPAddr).Port
+	go o.newServer().Serve(proxyListener{l})
 
-	waitForGET(fmt.Sprintf("http://localhost:%d/httpTesterInternalCheck", o.port))
+	return waitReady(ctx, httpProbe{fmt.Sprintf("http://localhost:%d/httpTesterInternalCheck", o.port)}, *startupTimeout)
 }
@@ -0,0 +1,68 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureRecorder(t *testing.T) {
+	r := newFailureRecorder()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.add(fmt.Sprintf("client-%d", i%5), Failure{Actual: fmt.Sprint(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	failures := r.all()
+	assert.Equal(t, 5, len(failures))
+	for _, f := range failures {
+		assert.Equal(t, 10, len(f))
+	}
+
+	// all() returns a copy
+	failures["client-0"] = nil
+	assert.Equal(t, 10, len(r.all()["client-0"]))
+}
+
+func TestOriginStartFreePort(t *testing.T) {
+	o := NewOrigin(0)
+	assert.Nil(t, o.start(context.Background()))
+	assert.NotEqual(t, 0, o.port)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/httpTesterInternalCheck", o.port))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestWildcardRegexp(t *testing.T) {
+	re := wildcardRegexp("/static/*.css")
+	assert.True(t, re.MatchString("/static/a.css"))
+	assert.True(t, re.MatchString("/static/themes/a.css"))
+	assert.False(t, re.MatchString("/static/a.css.map"))
+	assert.False(t, re.MatchString("/staticXa.css"))
+}
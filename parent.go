@@ -0,0 +1,135 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Parent proxies standing between the proxy and the origin, for multi-tier
+// caching, eg:
+//
+//	parent-proxy {
+//	    parents 2
+//	    set "round_robin" "strict"
+//	    set "parent_retry" "simple_retry"
+//	}
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ParentProxies are the parents of the proxy, set with the parent-proxy
+// stanza. They are proxies themselves, forwarding requests to the origin,
+// and the proxy forwards all requests to them as configured in parent.config
+type ParentProxies struct {
+	// Count is how many parents are started, 1 by default
+	Count int
+	// Params are the names and values of the parameters added to the
+	// parent.config rule, in order. Eg: round_robin=strict
+	Params [][2]string
+	// ports are those of the parents, once started
+	ports []int
+}
+
+// parentParamRegexp matches the names of parent.config parameters
+var parentParamRegexp = regexp.MustCompile(`^[a-z_]+$`)
+
+// parentReserved are the parent.config parameters set by httptester
+var parentReserved = map[string]bool{"dest_domain": true, "dest_host": true, "dest_ip": true, "url_regex": true, "parent": true}
+
+// parseParentProxy parses the optional block following the parent-proxy
+// keyword
+func parseParentProxy(s *scanner) (ParentProxies, error) {
+	pp := ParentProxies{Count: 1}
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		s.unscan(token)
+		return pp, nil
+	}
+
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case NEWLINE:
+		case CLOSE_CURLY:
+			return pp, nil
+		case PARENTS:
+			count := s.ScanUseful()
+			if count.typ != INTEGER {
+				return pp, fmt.Errorf("Parse error in 'parent-proxy' stanza: expecting the number of parents after 'parents', got %q", count)
+			}
+			fmt.Sscan(count.val, &pp.Count)
+			if pp.Count < 1 || pp.Count > 8 {
+				return pp, fmt.Errorf("Parse error in 'parent-proxy' stanza: expecting between 1 and 8 parents, got %d", pp.Count)
+			}
+		case SET:
+			name := s.ScanUseful()
+			if name.typ != STRING || !parentParamRegexp.MatchString(name.val) || parentReserved[name.val] {
+				return pp, fmt.Errorf("Parse error in 'parent-proxy' stanza: expecting a parent.config parameter like \"round_robin\" after 'set', got %q", name)
+			}
+			value := s.ScanUseful()
+			if (value.typ != STRING && value.typ != INTEGER) || value.val == "" || strings.ContainsAny(value.val, " \t\n\"") {
+				return pp, fmt.Errorf("Parse error in 'parent-proxy' stanza: expecting the value of %s, got %q", name.val, value)
+			}
+			pp.Params = append(pp.Params, [2]string{name.val, value.val})
+		default:
+			return pp, fmt.Errorf("Parse error in 'parent-proxy' stanza: expecting 'parents', 'set' or '}', got %q", token)
+		}
+	}
+}
+
+// parentName returns the name of the i-th parent, starting from 0, which is
+// found in the Via headers it adds. Eg: parent-1
+func parentName(i int) string {
+	return fmt.Sprintf("parent-%d", i+1)
+}
+
+// startParents starts the parents given by pp, see startProxy, recording
+// their ports. The parents are returned even on error, so that they can be
+// stopped
+func startParents(ctx context.Context, template Proxy, pp *ParentProxies) ([]Proxy, error) {
+	var parents []Proxy
+	for i := 0; i < pp.Count; i++ {
+		template.name = parentName(i)
+		parent, err := startProxy(ctx, template)
+		parents = append(parents, parent)
+		if err != nil {
+			return parents, fmt.Errorf("Starting %s failed: %w", template.name, err)
+		}
+		pp.ports = append(pp.ports, parent.port)
+	}
+	return parents, nil
+}
+
+// parentConfig returns the contents of parent.config: all requests go to the
+// parents, and never directly to the origin unless go_direct is set
+func (p Proxy) parentConfig() string {
+	var parents []string
+	for _, port := range p.parents.ports {
+		parents = append(parents, fmt.Sprintf("localhost:%d", port))
+	}
+	rule := fmt.Sprintf("dest_domain=. parent=\"%s\"", strings.Join(parents, ";"))
+
+	direct := false
+	for _, param := range p.parents.Params {
+		direct = direct || param[0] == "go_direct"
+		rule += fmt.Sprintf(" %s=%s", param[0], param[1])
+	}
+	if !direct {
+		rule += " go_direct=false"
+	}
+	return rule + "\n"
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseParentProxy(t *testing.T) {
+	p, err := Parse(strings.NewReader(`parent-proxy
+
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &ParentProxies{Count: 1}, p.Parents)
+
+	p, err = Parse(strings.NewReader(`parent-proxy # comment
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &ParentProxies{Count: 1}, p.Parents)
+	assert.Len(t, p.Clients, 1)
+
+	p, err = Parse(strings.NewReader(`parent-proxy {
+    parents 2
+    set "round_robin" "strict"
+    set "parent_retry" "simple_retry"
+    set "max_simple_retries" 2
+}
+
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &ParentProxies{Count: 2, Params: [][2]string{
+		{"round_robin", "strict"},
+		{"parent_retry", "simple_retry"},
+		{"max_simple_retries", "2"},
+	}}, p.Parents)
+
+	for _, input := range []string{
+		`parent-proxy {
+    parents 0
+}`,
+		`parent-proxy {
+    parents "two"
+}`,
+		`parent-proxy {
+    set "parent" "localhost:8080"
+}`,
+		`parent-proxy {
+    set "round_robin" "strict go_direct=true"
+}`,
+		`parent-proxy {
+    set "Round Robin" "strict"
+}`,
+		`parent-proxy {
+    file "parent.config" ""
+}`,
+		`parent-proxy
+parent-proxy`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestParentConfig(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	p.parents = &ParentProxies{Count: 2, ports: []int{8081, 8082}}
+	assert.Equal(t, "dest_domain=. parent=\"localhost:8081;localhost:8082\" go_direct=false\n", p.parentConfig())
+
+	p.parents.Params = [][2]string{{"round_robin", "strict"}, {"go_direct", "true"}}
+	assert.Equal(t, "dest_domain=. parent=\"localhost:8081;localhost:8082\" round_robin=strict go_direct=true\n", p.parentConfig())
+
+	// Parents are told apart by their name
+	p.name = parentName(0)
+	_, config := p.recordsConfig()
+	assert.Contains(t, config, "CONFIG proxy.config.proxy_name STRING parent-1\n")
+	p.install.version = 10
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "  proxy_name: \"parent-1\"\n")
+}
@@ -19,33 +19,321 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type HandleStanza struct {
-	URIPath      string
+	// Host restricts the handler to requests for the given virtual host, if
+	// set. Eg: handle "www.example.org/endpoint/1"
+	Host    string
+	URIPath string
+	// Method restricts the handler to requests with the given method, if set.
+	// Eg: handle "/endpoint/1" -method "POST"
+	Method string
+	// Signed is the name of the signing key of the URLs served by the
+	// handler, if set. Requests without a valid signature get a 401
+	// response. Eg: handle "/video/*" -signed "cdn"
+	Signed string
+	// signingKey is the signing key named Signed
+	signingKey *SigningKey
+	// Default is true for the fallback handler, serving requests not served
+	// by any other handler: handle default
+	Default bool
+	// match is set for handlers serving a family of paths, either given as
+	// a regular expression (handle ~ "^/api/") or with wildcards (handle
+	// "/static/*"). Otherwise, only requests for URIPath are served
+	match        *regexp.Regexp
 	Expectations []Expect
 	Response     TxResp
+	// Branches are responses sent instead of Response depending on the
+	// number of requests received by the handler, see hitsBranch
+	Branches []hitsBranch
+	// Script computes the response from the request, starting from Response.
+	// Eg: script """ resp.status = 500 if hits % 2 == 0 else 200 """
+	Script *script
 }
 
 type ClientStanza struct {
-	Name         string
+	Name string
+	// Cookies makes the client keep the cookies it receives in a jar of its
+	// own, sending them back with its later requests, redirects included
+	Cookies bool
+	// Steps are the requests sent by the client, in order, each followed by
+	// the expectations regarding its response
+	Steps []ClientStep
+	// Burst is how many times the request is sent, evenly spread over
+	// BurstWithin. Eg: burst 20 within "1s"
+	Burst       int
+	BurstWithin time.Duration
+	// Fuzz is how many random variations of the request are sent, see
+	// fuzzer. Eg: fuzz 1000. fuzzPos is where it was set
+	Fuzz    int
+	fuzzPos position
+	// Pipeline makes the client send the requests of all steps back-to-back
+	// on one connection, before reading the responses
+	Pipeline bool
+	// RestartProxy restarts the proxy before the client starts, set by a
+	// restart-proxy directive preceding the client stanza
+	RestartProxy bool
+	// ReloadConfig changes the configuration of the proxy before the client
+	// starts, after restarting it if needed. Set by a reload-proxy-config
+	// stanza preceding the client stanza
+	ReloadConfig *ConfigReload
+	// InFlight makes the client run in the background once its request
+	// reached the origin, while the following clients restart or reload
+	// the proxy for instance
+	InFlight bool
+}
+
+// ClientStep is a tx command of a client stanza, along with the commands
+// preceding it up to the previous tx and the expect commands following it
+type ClientStep struct {
+	// Wait is how long to wait before sending the request. Eg: wait "3s"
+	Wait time.Duration
+	// RotateCert replaces the certificate of the proxy before sending the
+	// request, see Proxy.rotateCert
+	RotateCert   bool
 	Request      TxReq
 	Expectations []Expect
 }
 
+// expectations returns the expectations of all steps of the client
+func (c ClientStanza) expectations() []Expect {
+	var expectations []Expect
+	for _, step := range c.Steps {
+		expectations = append(expectations, step.Expectations...)
+	}
+	return expectations
+}
+
+// ParseError is an error found while parsing an HTC program, along with its
+// position, and the file it is in if read from one, see parseFile
+type ParseError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Err)
+}
+
+func newParseError(pos position, err error) *ParseError {
+	return &ParseError{Line: pos.line, Column: pos.col, Err: err}
+}
+
+// Program is a parsed HTC program
+type Program struct {
+	Handlers []HandleStanza
+	Clients  []ClientStanza
+	// Expectations are evaluated once all clients are done, eg:
+	// expect origin["/endpoint/1"].hits eq 1
+	// expect order client "a" before client "b"
+	Expectations []Expect
+	// Timeout is the maximum duration of the run, set with eg: timeout "30s".
+	// 0 if not set
+	Timeout time.Duration
+	// Conditions are the skip-if and only-if directives, telling whether the
+	// program must be run at all
+	Conditions []Condition
+	// ClientCerts makes the proxy ask clients for certificates on TLS
+	// connections, either "optional" or "required". Eg: client-certs
+	// "required"
+	ClientCerts string
+	// Network are the conditions of the network between the proxy and the
+	// origin, set with the network stanza
+	Network Network
+	// Defaults are the options of the tx commands of all clients, set with
+	// the defaults stanza. They are applied to Clients by Parse
+	Defaults *Defaults
+	// Parents are the parent proxies started between the proxy and the
+	// origin, set with the parent-proxy stanza
+	Parents *ParentProxies
+	// Topology are the hops between clients and the origin, the proxy
+	// included, set with the topology stanza. nil if the proxy is the only
+	// one
+	Topology Topology
+	// HeaderRewrite are the header_rewrite rules installed in the proxy by
+	// header-rewrite stanzas, in order
+	HeaderRewrite []HeaderRewrite
+	// SigningKeys are the keys signing URLs by name, set with signing-key
+	// directives
+	SigningKeys map[string]SigningKey
+	// NegativeCaching makes the proxy cache error responses, set with the
+	// negative-caching stanza. nil if disabled
+	NegativeCaching *NegativeCaching
+}
+
+// hitsBranch is the response in an if block of a handle stanza, sent when
+// the number of requests received by the handler satisfies the condition, eg:
+// if hits gt 2 { tx -status 304 }
+type hitsBranch struct {
+	// op is EQUAL, NOTEQUAL, LESS or GREATER
+	op       tokenType
+	hits     int
+	Response TxResp
+}
+
+// holds returns true if the condition of the branch holds for the given
+// number of hits
+func (b hitsBranch) holds(hits int) bool {
+	switch b.op {
+	case EQUAL:
+		return hits == b.hits
+	case NOTEQUAL:
+		return hits != b.hits
+	case LESS:
+		return hits < b.hits
+	case GREATER:
+		return hits > b.hits
+	}
+	return false
+}
+
+// response returns the response to send after the given number of hits,
+// including the current request: that of the first branch whose condition
+// holds, or Response
+func (h HandleStanza) response(hits int) TxResp {
+	for _, b := range h.Branches {
+		if b.holds(hits) {
+			return b.Response
+		}
+	}
+	return h.Response
+}
+
+// pattern returns what the handler matches, as written in the handle stanza:
+// the URI path, preceded by the host if any, or the regular expression
+func (h HandleStanza) pattern() string {
+	if h.Default {
+		return "default"
+	}
+	return h.Host + h.URIPath
+}
+
+// String returns the beginning of the handle stanza, eg:
+// handle "/endpoint/1" -method "POST"
+func (h HandleStanza) String() string {
+	s := fmt.Sprintf("handle %q", h.pattern())
+	if h.Default {
+		s = "handle default"
+	} else if h.match != nil && !strings.Contains(h.URIPath, "*") {
+		s = fmt.Sprintf("handle ~ %q", h.pattern())
+	}
+	if h.Method != "" {
+		s += fmt.Sprintf(" -method %q", h.Method)
+	}
+	if h.Signed != "" {
+		s += fmt.Sprintf(" -signed %q", h.Signed)
+	}
+	return s
+}
+
+// matches returns true if the handler serves the given request. Handlers for
+// GET serve HEAD too
+func (h HandleStanza) matches(req *http.Request) bool {
+	if h.Method != "" && req.Method != h.Method && (h.Method != http.MethodGet || req.Method != http.MethodHead) {
+		return false
+	}
+
+	if h.Default {
+		return true
+	}
+
+	if h.Host != "" {
+		host := req.Host
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+		if !strings.EqualFold(host, h.Host) {
+			return false
+		}
+	}
+
+	if h.match != nil {
+		return h.match.MatchString(req.URL.Path)
+	}
+	return req.URL.Path == h.URIPath
+}
+
+// wildcardRegexp returns a regular expression matching the given path, where
+// '*' stands for any sequence of characters
+func wildcardRegexp(path string) *regexp.Regexp {
+	parts := strings.Split(path, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
 func parseHandle(s *scanner) (HandleStanza, error) {
 	var h HandleStanza
 
-	// URIPath
 	token := s.ScanUseful()
-	if token.typ != STRING || token.val[0] != '/' {
-		return h, fmt.Errorf("Parse error in 'handle' stanza: expecting a URI path starting with '/', got %q", token)
+	if token.typ == DEFAULT {
+		h.Default = true
+	} else if token.typ == TILDE {
+		// Regular expression
+		token = s.ScanUseful()
+		if token.typ != STRING {
+			return h, fmt.Errorf("Parse error in 'handle' stanza: expecting a regular expression, got %q", token)
+		}
+		re, err := regexp.Compile(token.val)
+		if err != nil {
+			return h, fmt.Errorf("Parse error in 'handle' stanza: invalid regular expression %q: %s", token.val, err)
+		}
+		h.URIPath = token.val
+		h.match = re
+	} else {
+		// Optional host, followed by URIPath
+		i := strings.IndexByte(token.val, '/')
+		if token.typ != STRING || i < 0 || strings.ContainsAny(token.val[:i], " \t") {
+			return h, fmt.Errorf("Parse error in 'handle' stanza: expecting a URI path starting with '/', optionally preceded by a host, got %q", token)
+		}
+
+		h.Host = token.val[:i]
+		h.URIPath = token.val[i:]
+		if strings.Contains(h.URIPath, "*") {
+			h.match = wildcardRegexp(h.URIPath)
+		}
+	}
+
+	// Optional method
+	token = s.ScanUseful()
+	if token.typ == METHOD_ARG {
+		token = s.ScanUseful()
+		if token.typ != STRING || !validToken(token.val) {
+			return h, fmt.Errorf("Parse error in 'handle' stanza: expecting a method, got %q", token)
+		}
+		h.Method = token.val
+		token = s.ScanUseful()
 	}
 
-	h.URIPath = token.val
+	// Optional signing key, see verifySignedURL
+	if token.typ == SIGNED_ARG {
+		token = s.ScanUseful()
+		if token.typ != STRING || token.val == "" {
+			return h, fmt.Errorf("Parse error in 'handle' stanza: expecting the name of a signing key, got %q", token)
+		}
+		h.Signed = token.val
+		token = s.ScanUseful()
+	}
 
 	// Begin block
-	token = s.ScanUseful()
 	if token.typ != OPEN_CURLY {
 		return h, fmt.Errorf("Parse error in 'handle' stanza: expecting '{', got %q", token)
 	}
@@ -62,12 +350,38 @@ func parseHandle(s *scanner) (HandleStanza, error) {
 			if err != nil {
 				return h, err
 			}
+			if exp.global() {
+				return h, fmt.Errorf("Parse error in 'handle' stanza: %s can only be used outside of stanzas or in 'assert' stanzas", exp)
+			}
+			if exp.bench() || exp.within > 0 || len(exp.captures) > 0 {
+				return h, fmt.Errorf("Parse error in 'handle' stanza: %s can only be used in 'client' stanzas", exp)
+			}
 			h.Expectations = append(h.Expectations, exp)
 		}
 
-		if token.typ == TX {
-			h.Response = TxResp{}
-			err := h.Response.Parse(s)
+		if token.typ == SCRIPT {
+			if h.Script != nil {
+				return h, fmt.Errorf("Parse error in 'handle' stanza: only one 'script' allowed")
+			}
+			token = s.ScanUseful()
+			if token.typ != STRING {
+				return h, fmt.Errorf("Parse error in 'handle' stanza: expecting a script after 'script', got %q", token)
+			}
+			sc, err := parseScript(token.val)
+			if err != nil {
+				return h, fmt.Errorf("Parse error in 'handle' stanza: invalid script: %s", err)
+			}
+			h.Script = sc
+		}
+
+		if token.typ == TX || token.typ == IF {
+			var err error
+			if token.typ == TX {
+				h.Response = TxResp{}
+				err = h.Response.Parse(s)
+			} else {
+				err = parseBranches(s, &h)
+			}
 			if err != nil {
 				return h, err
 			}
@@ -75,13 +389,13 @@ func parseHandle(s *scanner) (HandleStanza, error) {
 			// block
 			token = s.ScanUseful()
 
-			// Skip newline
-			if token.typ == NEWLINE {
+			// Skip newlines
+			for token.typ == NEWLINE {
 				token = s.ScanUseful()
 			}
 
 			if token.typ != CLOSE_CURLY {
-				return h, fmt.Errorf("Parse error in 'handle' stanza: expecting '}' after 'tx' command, got %q", token)
+				return h, fmt.Errorf("Parse error in 'handle' stanza: expecting '}' after the response, got %q", token)
 			} else {
 				// End block
 				break
@@ -92,9 +406,83 @@ func parseHandle(s *scanner) (HandleStanza, error) {
 	return h, nil
 }
 
+// parseBranches parses the if blocks following the if keyword in a handle
+// stanza, eg:
+//
+//	if hits eq 1 {
+//	    tx -status 200
+//	} else if hits lt 4 {
+//	    tx -status 304
+//	} else {
+//	    tx -status 503
+//	}
+//
+// The response in the else block, if any, is stored in Response. Without
+// else, it is an empty 200 response
+func parseBranches(s *scanner, h *HandleStanza) error {
+	// block parses a block with a single tx command
+	block := func(r *TxResp) error {
+		if token := s.ScanUseful(); token.typ != OPEN_CURLY {
+			return fmt.Errorf("Parse error in 'handle' stanza: expecting '{' after the condition, got %q", token)
+		}
+		token := s.ScanUseful()
+		for token.typ == NEWLINE {
+			token = s.ScanUseful()
+		}
+		if token.typ != TX {
+			return fmt.Errorf("Parse error in 'handle' stanza: expecting 'tx' in the if block, got %q", token)
+		}
+		if err := r.Parse(s); err != nil {
+			return err
+		}
+		token = s.ScanUseful()
+		for token.typ == NEWLINE {
+			token = s.ScanUseful()
+		}
+		if token.typ != CLOSE_CURLY {
+			return fmt.Errorf("Parse error in 'handle' stanza: expecting '}' after 'tx' command, got %q", token)
+		}
+		return nil
+	}
+
+	h.Response = TxResp{statusCode: http.StatusOK}
+	for {
+		b := hitsBranch{}
+		if token := s.ScanUseful(); token.typ != HITS {
+			return fmt.Errorf("Parse error in 'handle' stanza: expecting 'hits' after 'if', got %q", token)
+		}
+		token := s.ScanUseful()
+		if token.typ != EQUAL && token.typ != NOTEQUAL && token.typ != LESS && token.typ != GREATER {
+			return fmt.Errorf("Parse error in 'handle' stanza: expecting one of eq, ne, lt or gt after 'hits', got %q", token)
+		}
+		b.op = token.typ
+		token = s.ScanUseful()
+		n, err := strconv.Atoi(token.val)
+		if token.typ != INTEGER || err != nil {
+			return fmt.Errorf("Parse error in 'handle' stanza: expecting a number of hits, got %q", token)
+		}
+		b.hits = n
+		if err := block(&b.Response); err != nil {
+			return err
+		}
+		h.Branches = append(h.Branches, b)
+
+		token = s.ScanUseful()
+		if token.typ != ELSE {
+			// NEWLINE or '}', read again by the caller
+			s.unscan(token)
+			return nil
+		}
+		if token = s.ScanUseful(); token.typ == IF {
+			continue
+		}
+		s.unscan(token)
+		return block(&h.Response)
+	}
+}
+
 func parseClient(s *scanner) (ClientStanza, error) {
 	var c ClientStanza
-	var err error
 
 	// Client name
 	token := s.ScanUseful()
@@ -103,24 +491,73 @@ func parseClient(s *scanner) (ClientStanza, error) {
 	}
 
 	c.Name = token.val
+	return parseClientBlock(s, c)
+}
+
+// parseClientBlock parses the block of a client stanza, from '{', filling in
+// c
+func parseClientBlock(s *scanner, c ClientStanza) (ClientStanza, error) {
+	var err error
 
 	// Begin block
-	token = s.ScanUseful()
+	token := s.ScanUseful()
 	if token.typ != OPEN_CURLY {
 		return c, fmt.Errorf("Parse error in 'client' stanza: expecting '{', got %q", token)
 	}
 
+	// step is the one being parsed, whose tx command is still to come if
+	// pending is true
+	var step ClientStep
+	pending := false
 	for {
 		token = s.ScanUseful()
 		if token.typ == CLOSE_CURLY {
 			break
 		}
-		if token.typ == TX {
-			c.Request = TxReq{}
-			err = c.Request.Parse(s)
+		if token.typ == TX || token.typ == PREFLIGHT {
+			if !pending {
+				step = ClientStep{}
+			}
+			if token.typ == PREFLIGHT {
+				step.Request, err = parsePreflight(s)
+			} else {
+				err = step.Request.Parse(s)
+			}
 			if err != nil {
 				return c, err
 			}
+			c.Steps = append(c.Steps, step)
+			pending = false
+		}
+		if token.typ == WAIT || token.typ == ROTATECERT {
+			if !pending {
+				step, pending = ClientStep{}, true
+			}
+			if token.typ == ROTATECERT {
+				step.RotateCert = true
+			} else if step.Wait, err = parseWait(s); err != nil {
+				return c, err
+			}
+		}
+		if token.typ == COOKIES {
+			c.Cookies = true
+		}
+		if token.typ == PIPELINE {
+			c.Pipeline = true
+		}
+		if token.typ == INFLIGHT {
+			c.InFlight = true
+		}
+		if token.typ == BURST {
+			if c.Burst, c.BurstWithin, err = parseBurst(s); err != nil {
+				return c, err
+			}
+		}
+		if token.typ == FUZZ {
+			c.fuzzPos = token.pos
+			if c.Fuzz, err = parseFuzz(s); err != nil {
+				return c, err
+			}
 		}
 		if token.typ == EXPECT {
 			exp := Expect{}
@@ -128,19 +565,270 @@ func parseClient(s *scanner) (ClientStanza, error) {
 			if err != nil {
 				return c, err
 			}
-			c.Expectations = append(c.Expectations, exp)
+			if exp.global() {
+				return c, fmt.Errorf("Parse error in 'client' stanza: %s can only be used outside of stanzas or in 'assert' stanzas", exp)
+			}
+			if exp.bench() && exp.within > 0 {
+				return c, fmt.Errorf("Parse error in 'client' stanza: 'within' cannot be used with latency expectations, got %s", exp)
+			}
+			if (exp.field == EXPECT_STREAMED || exp.field == EXPECT_TRANSFORM) && exp.within > 0 {
+				return c, fmt.Errorf("Parse error in 'client' stanza: 'within' cannot be used with resp.streamed or resp.transform, got %s", exp)
+			}
+			if len(c.Steps) == 0 || pending {
+				return c, fmt.Errorf("Parse error in 'client' stanza: %s must follow the 'tx' command sending the request", exp)
+			}
+			if exp.indexed && exp.step >= len(c.Steps) {
+				return c, fmt.Errorf("Parse error in 'client' stanza: %s refers to the response to a 'tx' command not sent yet, there are %d so far", exp, len(c.Steps))
+			}
+			if exp.indexed && (exp.within > 0 || exp.bench()) {
+				return c, fmt.Errorf("Parse error in 'client' stanza: 'within' cannot be used with 'resp[$index]', got %s", exp)
+			}
+			// Some expectations need the request to be sent in a
+			// special way
+			req := &c.Steps[len(c.Steps)-1].Request
+			if exp.indexed {
+				req = &c.Steps[exp.step].Request
+			}
+			if exp.field == EXPECT_RAWHEADERS {
+				if req.tls || req.grpc {
+					return c, fmt.Errorf("Parse error in 'client' stanza: %s cannot be used with -tls or -grpc", exp)
+				}
+				req.rawHeaders = true
+			}
+			if exp.field == EXPECT_CONN_END {
+				req.connEnd = true
+			}
+			if exp.operator == EMPTYHEAD {
+				req.emptyForHead = true
+			}
+			last := &c.Steps[len(c.Steps)-1]
+			last.Expectations = append(last.Expectations, exp)
+		}
+	}
+
+	if pending {
+		return c, fmt.Errorf("Parse error in 'client' stanza: 'wait' and 'rotate-cert' must precede 'tx'")
+	}
+	if len(c.Steps) > 1 && (c.Burst > 0 || c.Fuzz > 0) {
+		return c, fmt.Errorf("Parse error in 'client' stanza: 'burst' and 'fuzz' cannot be used with multiple 'tx' commands")
+	}
+
+	if c.Fuzz > 0 {
+		if c.Burst > 0 {
+			return c, fmt.Errorf("Parse error in 'client' stanza: 'fuzz' cannot be used with 'burst'")
+		}
+		if expectations := c.expectations(); len(expectations) > 0 {
+			return c, fmt.Errorf("Parse error in 'client' stanza: 'fuzz' cannot be used with 'expect', got %s", expectations[0])
+		}
+		if len(c.Steps) == 0 {
+			// tx is optional, fuzzing GET requests by default
+			c.Steps = []ClientStep{{Request: TxReq{method: "GET", headers: make(map[string]string)}}}
+		}
+	}
+	if len(c.Steps) == 0 {
+		return c, fmt.Errorf("Parse error in 'client' stanza: expecting at least one 'tx' command")
+	}
+
+	for _, exp := range c.expectations() {
+		if c.Burst > 0 && exp.within > 0 {
+			return c, fmt.Errorf("Parse error in 'client' stanza: 'within' cannot be used with 'burst', got %s", exp)
 		}
 	}
+	if c.InFlight {
+		if err := c.checkInFlight(); err != nil {
+			return c, err
+		}
+	}
+	if c.Pipeline {
+		return c, c.checkPipeline()
+	}
 	return c, nil
 }
 
-// Parse returns a list of handlers and clients upon successful parsing of the
-// given HTC program passed as a io.Reader
-func Parse(r io.Reader) ([]HandleStanza, []ClientStanza, error) {
-	var h []HandleStanza
-	var c []ClientStanza
+// checkInFlight returns an error if the client cannot run in the background:
+// its request must be recognizable by the origin, and it cannot affect the
+// clients following it
+func (c ClientStanza) checkInFlight() error {
+	if c.Fuzz > 0 {
+		return fmt.Errorf("Parse error in 'client' stanza: 'in-flight' cannot be used with 'fuzz'")
+	}
+	for _, step := range c.Steps {
+		if step.Request.noRequestID {
+			return fmt.Errorf("Parse error in 'client' stanza: 'in-flight' cannot be used with -no-request-id")
+		}
+		for _, exp := range step.Expectations {
+			if len(exp.captures) > 0 {
+				return fmt.Errorf("Parse error in 'client' stanza: 'capture' cannot be used with 'in-flight', got %s", exp)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPipeline returns an error if the client cannot pipeline its requests:
+// those are written before any response is read, and must all be plain
+// HTTP/1.1 requests sent on the same connection
+func (c ClientStanza) checkPipeline() error {
+	if len(c.Steps) < 2 {
+		return fmt.Errorf("Parse error in 'client' stanza: 'pipeline' needs at least two 'tx' commands")
+	}
+	if c.Burst > 0 || c.Fuzz > 0 {
+		return fmt.Errorf("Parse error in 'client' stanza: 'pipeline' cannot be used with 'burst' or 'fuzz'")
+	}
+	for i, step := range c.Steps {
+		r := step.Request
+		if step.Wait > 0 || step.RotateCert {
+			return fmt.Errorf("Parse error in 'client' stanza: 'pipeline' cannot be used with 'wait' or 'rotate-cert'")
+		}
+		if r.tls || r.grpc || r.absolute() || r.followRedirects || r.proto == http10 || r.noKeepAlive || r.sendBodyRate > 0 || r.readRate > 0 || r.abort {
+			return fmt.Errorf("Parse error in 'client' stanza: 'pipeline' cannot be used with -tls, -grpc, -forward, -tunnel, -follow-redirects, -proto \"HTTP/1.0\", -no-keepalive, -send-body-rate, -read-rate or -abort-after")
+		}
+		if i > 0 && (r.bind != nil || r.proxyProtocol > 0) {
+			return fmt.Errorf("Parse error in 'client' stanza: with 'pipeline', -bind and -proxy-protocol can only be given to the first 'tx' command")
+		}
+		for _, exp := range step.Expectations {
+			if exp.within > 0 || len(exp.captures) > 0 || exp.field == EXPECT_RAWHEADERS || exp.field == EXPECT_CONN_END {
+				return fmt.Errorf("Parse error in 'client' stanza: 'within', 'capture', resp.rawheaders and resp.conn.end cannot be used with 'pipeline', got %s", exp)
+			}
+		}
+	}
+	return nil
+}
+
+// parseGlobalExpect parses an expect command regarding the whole run, written
+// either outside of stanzas or in an assert stanza. pos is the position of the
+// expect keyword
+func parseGlobalExpect(s *scanner, pos position) (Expect, error) {
+	exp := Expect{pos: pos}
+	if err := exp.Parse(s); err != nil {
+		return exp, newParseError(s.last, err)
+	}
+	if !exp.global() {
+		return exp, newParseError(exp.pos, fmt.Errorf("Parse error: %s can only be used inside of 'handle' and 'client' stanzas", exp))
+	}
+	if exp.within > 0 {
+		return exp, newParseError(exp.pos, fmt.Errorf("Parse error: 'within' can only be used in 'client' stanzas, got %s", exp))
+	}
+	if len(exp.captures) > 0 {
+		return exp, newParseError(exp.pos, fmt.Errorf("Parse error: 'capture' can only be used in 'client' stanzas, got %s", exp))
+	}
+	return exp, nil
+}
+
+// parseAssert parses an assert stanza, grouping expectations regarding the
+// whole run. Eg:
+//
+//	assert {
+//	    expect origin["/endpoint/1"].hits eq 1
+//	    expect client["nemo"].resp.status eq 200
+//	}
+func parseAssert(s *scanner) ([]Expect, error) {
+	var expectations []Expect
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		return nil, newParseError(token.pos, fmt.Errorf("Parse error in 'assert' stanza: expecting '{', got %q", token))
+	}
+
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case CLOSE_CURLY:
+			return expectations, nil
+		case NEWLINE:
+		case EXPECT:
+			exp, err := parseGlobalExpect(s, token.pos)
+			if err != nil {
+				return nil, err
+			}
+			if exp.cache() {
+				return nil, newParseError(token.pos, fmt.Errorf("Parse error in 'assert' stanza: %s can only be used outside of stanzas", exp))
+			}
+			expectations = append(expectations, exp)
+		default:
+			return nil, newParseError(token.pos, fmt.Errorf("Parse error in 'assert' stanza: expecting 'expect' or '}', got %q", token))
+		}
+	}
+}
+
+// parseWait parses the duration following the wait keyword, eg: wait "3s"
+func parseWait(s *scanner) (time.Duration, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING && token.typ != DURATION {
+		return 0, fmt.Errorf("Parse error in 'wait' command: expecting a duration, got %q", token)
+	}
+
+	d, err := time.ParseDuration(token.val)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Parse error in 'wait' command: expecting a positive duration, got %q", token)
+	}
+	return d, nil
+}
+
+// parseBurst parses the count and the optional duration following the burst
+// keyword, eg: burst 20 within "1s"
+func parseBurst(s *scanner) (int, time.Duration, error) {
+	token := s.ScanUseful()
+	n, err := strconv.Atoi(token.val)
+	if token.typ != INTEGER || err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("Parse error in 'burst' directive: expecting a positive number of requests, got %q", token)
+	}
+
+	token = s.ScanUseful()
+	if token.typ != WITHIN {
+		s.unscan(token)
+		return n, 0, nil
+	}
+
+	token = s.ScanUseful()
+	if token.typ != STRING && token.typ != DURATION {
+		return 0, 0, fmt.Errorf("Parse error in 'burst' directive: expecting a duration after 'within', got %q", token)
+	}
+	d, err := time.ParseDuration(token.val)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("Parse error in 'burst' directive: expecting a positive duration after 'within', got %q", token)
+	}
+	return n, d, nil
+}
+
+// parseFuzz parses the count following the fuzz keyword, eg: fuzz 1000
+func parseFuzz(s *scanner) (int, error) {
+	token := s.ScanUseful()
+	n, err := strconv.Atoi(token.val)
+	if token.typ != INTEGER || err != nil || n <= 0 {
+		return 0, fmt.Errorf("Parse error in 'fuzz' directive: expecting a positive number of requests, got %q", token)
+	}
+	return n, nil
+}
+
+// parseTimeout parses the duration following the timeout keyword, eg:
+// timeout "30s"
+func parseTimeout(s *scanner) (time.Duration, error) {
+	token := s.ScanUseful()
+	if token.typ != STRING && token.typ != DURATION {
+		return 0, fmt.Errorf("Parse error in 'timeout' directive: expecting a duration, got %q", token)
+	}
+
+	d, err := time.ParseDuration(token.val)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Parse error in 'timeout' directive: expecting a positive duration, got %q", token)
+	}
+	return d, nil
+}
+
+// Parse returns the handlers, clients and expectations upon successful parsing
+// of the given HTC program passed as a io.Reader
+func Parse(r io.Reader) (Program, error) {
+	var p Program
 
 	s := newScanner(r)
+	// restart and reload are the position of the restart-proxy directive
+	// and the reload-proxy-config stanza applying to the next client
+	// stanza, if any. reloaded is the stanza
+	var restart, reload *position
+	var reloaded *ConfigReload
+	// topology is the position of the topology stanza, if any
+	var topology position
 
 	for {
 		token := s.ScanUseful()
@@ -148,29 +836,454 @@ func Parse(r io.Reader) ([]HandleStanza, []ClientStanza, error) {
 			break
 		}
 		if token.typ == ILLEGAL {
-			return h, c, fmt.Errorf("Parse error: %s", token)
+			return p, newParseError(token.pos, fmt.Errorf("Parse error: %s", token))
 		}
 		if token.typ == HANDLE {
 			hs, err := parseHandle(s)
 			if err != nil {
-				return h, c, err
+				return p, newParseError(s.last, err)
+			}
+			for _, other := range p.Handlers {
+				if other.pattern() == hs.pattern() && other.Method == hs.Method {
+					return p, newParseError(token.pos, fmt.Errorf("Parse error: %s already defined", hs))
+				}
+			}
+			if hs.Signed != "" {
+				key, ok := p.SigningKeys[hs.Signed]
+				if !ok {
+					return p, newParseError(token.pos, fmt.Errorf("Parse error: %s refers to a signing key not defined before", hs))
+				}
+				hs.signingKey = &key
+			}
+
+			p.Handlers = append(p.Handlers, hs)
+		}
+		if token.typ == CLIENT || token.typ == REWRITE {
+			var cs ClientStanza
+			var err error
+			if token.typ == CLIENT {
+				cs, err = parseClient(s)
+			} else {
+				var r HeaderRewrite
+				cs, r, err = parseHeaderRewrite(s, fmt.Sprintf("header-rewrite-%d", len(p.HeaderRewrite)+1))
+				p.HeaderRewrite = append(p.HeaderRewrite, r)
+			}
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			if p.hasClient(cs.Name) {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q already defined", cs.Name))
+			}
+			for i, step := range cs.Steps {
+				if g := step.Request.signing; g != nil {
+					key, ok := p.SigningKeys[g.name]
+					if !ok {
+						return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q refers to signing key %q, not defined before", cs.Name, g.name))
+					}
+					g.key = key
+				}
+				for _, name := range step.Request.references() {
+					if client, index, _, ok := parseRespReference(name); ok && client == "" {
+						if index >= i {
+							return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q refers to %q, not the response to a previous 'tx' command", cs.Name, name))
+						}
+						if cs.Pipeline {
+							return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q refers to %q, but 'pipeline' sends all requests before reading any response", cs.Name, name))
+						}
+					} else if ok {
+						previous := slices.IndexFunc(p.Clients, func(c ClientStanza) bool { return c.Name == client })
+						if previous < 0 {
+							return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q refers to %q, not the response of a previous client", cs.Name, name))
+						}
+						if p.Clients[previous].InFlight {
+							return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q refers to %q, the response of an 'in-flight' client", cs.Name, name))
+						}
+					} else if !p.captures(name) && !captured(cs.Steps[:i], name) {
+						return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q refers to variable %q, not captured by any previous client or tx command", cs.Name, name))
+					}
+				}
+			}
+
+			cs.RestartProxy, restart = restart != nil, nil
+			cs.ReloadConfig, reload, reloaded = reloaded, nil, nil
+			p.Clients = append(p.Clients, cs)
+		}
+		if token.typ == RELOAD {
+			if reload != nil {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'reload-proxy-config' must be followed by a 'client' stanza, got another 'reload-proxy-config'"))
+			}
+			r, err := parseReloadConfig(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			reload, reloaded = &token.pos, &r
+		}
+		if token.typ == RESTART {
+			if restart != nil {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'restart-proxy' must be followed by a 'client' stanza, got another 'restart-proxy'"))
+			}
+			restart = &token.pos
+		}
+		if token.typ == EXPECT {
+			exp, err := parseGlobalExpect(s, token.pos)
+			if err != nil {
+				return p, err
 			}
 
-			h = append(h, hs)
+			// Cache persistence and negative caching are checked by
+			// clients of their own, following any restart-proxy and
+			// reload-proxy-config
+			if exp.cache() {
+				if p.hasClient(exp.clients[0]) {
+					return p, newParseError(token.pos, fmt.Errorf("Parse error: %s already defined", exp))
+				}
+				clients := exp.cacheClients()
+				clients[0].RestartProxy, restart = restart != nil, nil
+				clients[0].ReloadConfig, reload, reloaded = reloaded, nil, nil
+				p.Clients = append(p.Clients, clients...)
+			}
+			p.Expectations = append(p.Expectations, exp)
+		}
+		if token.typ == INVALIDATE || token.typ == INVALIDTAG {
+			var exps []Expect
+			var clients []ClientStanza
+			var err error
+			if token.typ == INVALIDATE {
+				var exp Expect
+				exp, clients, err = parseInvalidate(s, token.pos)
+				exps = []Expect{exp}
+			} else {
+				exps, clients, err = parseInvalidateTag(s, token.pos, p.Handlers)
+			}
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			for _, cs := range clients {
+				if p.hasClient(cs.Name) {
+					return p, newParseError(token.pos, fmt.Errorf("Parse error: client %q already defined", cs.Name))
+				}
+			}
+			clients[0].RestartProxy, restart = restart != nil, nil
+			clients[0].ReloadConfig, reload, reloaded = reloaded, nil, nil
+			p.Clients = append(p.Clients, clients...)
+			p.Expectations = append(p.Expectations, exps...)
+		}
+		if token.typ == ASSERT {
+			expectations, err := parseAssert(s)
+			if err != nil {
+				return p, err
+			}
+
+			p.Expectations = append(p.Expectations, expectations...)
+		}
+		if token.typ == SKIPIF || token.typ == ONLYIF {
+			c, err := parseCondition(s, token)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.Conditions = append(p.Conditions, c)
+		}
+		if token.typ == CLIENTCERTS {
+			if p.ClientCerts != "" {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'client-certs' can only be set once"))
+			}
+			level, err := parseClientCerts(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.ClientCerts = level
+		}
+		if token.typ == PARENT {
+			if p.Parents != nil {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'parent-proxy' can only be set once"))
+			}
+			pp, err := parseParentProxy(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.Parents = &pp
+		}
+		if token.typ == TOPOLOGY {
+			if p.Topology != nil {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'topology' can only be set once"))
+			}
+			t, err := parseTopology(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.Topology, topology = t, token.pos
+		}
+		if token.typ == NETWORK {
+			if p.Network.enabled() {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'network' can only be set once"))
+			}
+			n, err := parseNetwork(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.Network = n
+		}
+		if token.typ == DEFAULTS {
+			if p.Defaults != nil {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'defaults' can only be set once"))
+			}
+			d, err := parseDefaults(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			d.pos = token.pos
+			p.Defaults = &d
 		}
-		if token.typ == CLIENT {
-			cs, err := parseClient(s)
+		if token.typ == TIMEOUT {
+			if p.Timeout != 0 {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'timeout' can only be set once"))
+			}
+			d, err := parseTimeout(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.Timeout = d
+		}
+		if token.typ == SIGNINGKEY {
+			name, key, err := parseSigningKey(s)
 			if err != nil {
-				return h, c, err
+				return p, newParseError(s.last, err)
+			}
+			if _, ok := p.SigningKeys[name]; ok {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: signing key %q already defined", name))
+			}
+			if p.SigningKeys == nil {
+				p.SigningKeys = make(map[string]SigningKey)
+			}
+			p.SigningKeys[name] = key
+		}
+		if token.typ == NEGCACHING {
+			if p.NegativeCaching != nil {
+				return p, newParseError(token.pos, fmt.Errorf("Parse error: 'negative-caching' can only be set once"))
+			}
+			n, err := parseNegativeCaching(s)
+			if err != nil {
+				return p, newParseError(s.last, err)
+			}
+			p.NegativeCaching = &n
+		}
+	}
+
+	if restart != nil {
+		return p, newParseError(*restart, fmt.Errorf("Parse error: 'restart-proxy' must be followed by a 'client' stanza"))
+	}
+	if reload != nil {
+		return p, newParseError(*reload, fmt.Errorf("Parse error: 'reload-proxy-config' must be followed by a 'client' stanza"))
+	}
+	if len(p.Handlers) == 0 && len(p.Clients) == 0 {
+		return p, newParseError(position{1, 1}, fmt.Errorf("Parse error: at least one of 'handle' or 'client' stanza are needed"))
+	}
+
+	// Defaults apply to all clients, wherever the stanza is, so the requests
+	// are checked again with them
+	if p.Defaults != nil {
+		for i := range p.Clients {
+			c := &p.Clients[i]
+			for j := range c.Steps {
+				step := &c.Steps[j]
+				step.Request = p.Defaults.apply(step.Request)
+				if err := step.Request.check(); err != nil {
+					return p, newParseError(p.Defaults.pos, fmt.Errorf("%w, with the defaults given to client %q (see -no-defaults)", err, c.Name))
+				}
+			}
+			if c.Pipeline {
+				if err := c.checkPipeline(); err != nil {
+					return p, newParseError(p.Defaults.pos, fmt.Errorf("%w, with the defaults given to client %q (see -no-defaults)", err, c.Name))
+				}
+			}
+		}
+	}
+
+	// Requests sent with -tls go to the proxy directly, see TxReq.server,
+	// which would skip the hops preceding it
+	if before, _ := p.Topology.split(); len(before) > 0 {
+		for _, c := range p.Clients {
+			for _, step := range c.Steps {
+				if step.Request.tls {
+					return p, newParseError(topology, fmt.Errorf("Parse error: client %q uses -tls, which cannot be used with hops preceding 'hop \"ats\"' in the 'topology' stanza", c.Name))
+				}
+			}
+		}
+	}
+
+	// Expectations on origin handlers and clients must refer to existing ones
+	for _, exp := range p.Expectations {
+		if (exp.field == EXPECT_HITS || exp.originRequest()) && !p.hasHandler(exp.path) {
+			return p, newParseError(exp.pos, fmt.Errorf("Parse error: %s refers to a non-existing 'handle' stanza", exp))
+		}
+		if exp.client != "" && !p.hasClient(exp.client) {
+			return p, newParseError(exp.pos, fmt.Errorf("Parse error: %s refers to a non-existing 'client' stanza", exp))
+		}
+		if exp.field == EXPECT_ORDER && (!p.hasClient(exp.clients[0]) || !p.hasClient(exp.clients[1])) {
+			return p, newParseError(exp.pos, fmt.Errorf("Parse error: %s refers to a non-existing 'client' stanza", exp))
+		}
+	}
+
+	return p, nil
+}
+
+// hosts returns the virtual hosts handled by the program, or requested by
+// clients using the proxy as a forward proxy, sorted
+func (p Program) hosts() []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for _, hs := range p.Handlers {
+		add(hs.Host)
+	}
+	for _, cs := range p.Clients {
+		for _, step := range cs.Steps {
+			if step.Request.forward {
+				if u, err := url.Parse(step.Request.uri); err == nil {
+					add(u.Host)
+				}
 			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
 
-			c = append(c, cs)
+// loadFiles reads the files referenced by the program, such as those given with
+// -body-file. Relative paths are interpreted relative to dir, usually the
+// directory of the HTC file. Files larger than maxBufferedBody are left on
+// disk, to be streamed when sending: variables are not expanded in them, and
+// they cannot be framed as gRPC messages
+func (p Program) loadFiles(dir string) error {
+	read := func(arg *fileArg, grpc bool) ([]byte, error) {
+		if !filepath.IsAbs(arg.path) {
+			arg.path = filepath.Join(dir, arg.path)
+		}
+		info, err := os.Stat(arg.path)
+		if err != nil {
+			return nil, newParseError(arg.pos, fmt.Errorf("Cannot read body file: %s", err))
+		}
+		if info.Size() > maxBufferedBody {
+			if grpc {
+				return nil, newParseError(arg.pos, fmt.Errorf("Body files used with -grpc cannot be larger than %d bytes, got %d", maxBufferedBody, info.Size()))
+			}
+			arg.size = info.Size()
+			return nil, nil
 		}
+		data, err := ioutil.ReadFile(arg.path)
+		if err != nil {
+			return nil, newParseError(arg.pos, fmt.Errorf("Cannot read body file: %s", err))
+		}
+		return data, nil
 	}
 
-	if len(h) == 0 && len(c) == 0 {
-		return h, c, fmt.Errorf("Parse error: at least one of 'handle' or 'client' stanza are needed")
+	var err error
+	for i := range p.Handlers {
+		responses := []*TxResp{&p.Handlers[i].Response}
+		for j := range p.Handlers[i].Branches {
+			responses = append(responses, &p.Handlers[i].Branches[j].Response)
+		}
+		for _, r := range responses {
+			if r.bodyFile.path == "" {
+				continue
+			}
+			if r.body, err = read(&r.bodyFile, r.grpc); err != nil {
+				return err
+			}
+			// Hashing the file once rather than for each request
+			if r.bodyFile.streamed() && r.etagAuto {
+				if r.etag, err = r.bodyFile.entityTag(); err != nil {
+					return newParseError(r.bodyFile.pos, fmt.Errorf("Cannot read body file: %s", err))
+				}
+				r.etagAuto = false
+			}
+			if r.bodyFile.streamed() && len(r.digests) > 0 {
+				file, err := r.bodyFile.open()
+				if err != nil {
+					return newParseError(r.bodyFile.pos, fmt.Errorf("Cannot read body file: %s", err))
+				}
+				r.fileDigests, err = digestHeaders(r.digests, file)
+				file.Close()
+				if err != nil {
+					return newParseError(r.bodyFile.pos, fmt.Errorf("Cannot read body file: %s", err))
+				}
+			}
+		}
+	}
+	for i := range p.Clients {
+		for j := range p.Clients[i].Steps {
+			if r := &p.Clients[i].Steps[j].Request; r.bodyFile.path != "" {
+				if r.body, err = read(&r.bodyFile, r.grpc); err != nil {
+					return err
+				}
+			}
+		}
 	}
+	return nil
+}
+
+// hasClient returns true if the program has a client stanza with the given
+// name
+func (p Program) hasClient(name string) bool {
+	for _, cs := range p.Clients {
+		if cs.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	return h, c, nil
+// captures returns true if the variable with the given name is captured by
+// an expectation of any of the clients
+func (p Program) captures(name string) bool {
+	for _, cs := range p.Clients {
+		if captured(cs.Steps, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocol returns true if any of the clients starts connections with
+// a PROXY protocol header
+func (p Program) proxyProtocol() bool {
+	for _, cs := range p.Clients {
+		for _, step := range cs.Steps {
+			if step.Request.proxyProtocol > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// captured returns true if the variable with the given name is captured by an
+// expectation of any of the given steps
+func captured(steps []ClientStep, name string) bool {
+	for _, step := range steps {
+		for _, exp := range step.Expectations {
+			for _, capture := range exp.captures {
+				if capture == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hasHandler returns true if the program has a handle stanza for the given
+// URI path, preceded by the host if any
+func (p Program) hasHandler(path string) bool {
+	for _, hs := range p.Handlers {
+		if hs.pattern() == path {
+			return true
+		}
+	}
+	return false
 }
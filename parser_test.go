@@ -0,0 +1,629 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	input := `handle "/endpoint/1" {
+    expect req.method eq "GET"
+    tx -body "Hello world!" -status 200
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+    expect resp.status eq 200
+}
+
+expect origin["/endpoint/1"].hits eq 1`
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(p.Handlers))
+	assert.Equal(t, 1, len(p.Clients))
+	assert.Equal(t, 1, len(p.Expectations))
+	assert.Equal(t, "/endpoint/1", p.Expectations[0].path)
+	assert.Equal(t, time.Duration(0), p.Timeout)
+
+	p, err = Parse(strings.NewReader("timeout \"30s\"\n" + input))
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, p.Timeout)
+}
+
+func TestParseAssert(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/endpoint/1" {
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+}
+
+assert {
+    expect origin["/endpoint/1"].hits eq 1
+
+    expect client["nemo"].resp.status eq 200
+}
+
+expect order client "nemo" before client "nemo"`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(p.Expectations))
+	assert.Equal(t, "nemo", p.Expectations[1].client)
+	assert.Equal(t, EXPECT_STATUS, p.Expectations[1].field)
+	assert.Equal(t, `client[nemo].resp.status eq "200"`, p.Expectations[1].verbatim)
+	assert.Equal(t, 12, p.Expectations[1].pos.line)
+}
+
+func TestParseTrailingComments(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/endpoint/1" { # origin
+    expect req.method eq "GET" # note
+    expect req.method ne "POST"
+    tx -status 200 # ok
+}
+
+client "nemo" {
+    tx -url "/endpoint/1" # first
+    expect resp.status eq 200 # note
+    expect resp.status eq 200 within "1s" # retried
+    expect resp.status ne 404
+}`))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Handlers, 1) {
+		assert.Len(t, p.Handlers[0].Expectations, 2)
+		assert.Equal(t, 200, p.Handlers[0].Response.statusCode)
+	}
+	if assert.Len(t, p.Clients, 1) && assert.Len(t, p.Clients[0].Steps, 1) {
+		assert.Len(t, p.Clients[0].Steps[0].Expectations, 3)
+	}
+}
+
+func TestParseFail(t *testing.T) {
+	inputs := []string{
+		// No stanzas
+		"",
+		// Origin expectations are only allowed outside of stanzas
+		`client "nemo" {
+    tx -url "/"
+    expect origin["/"].hits eq 1
+}`,
+		// ...and request/response ones only inside of stanzas
+		`handle "/" {
+    tx -status 200
+}
+expect resp.status eq 200`,
+		// Unknown handler
+		`handle "/" {
+    tx -status 200
+}
+expect origin["/banana"].hits eq 1`,
+		// Unknown client
+		`client "a" {
+    tx -url "/"
+}
+expect order client "a" before client "b"`,
+		`client "a" {
+    tx -url "/"
+}
+assert {
+    expect client["b"].resp.status eq 200
+}`,
+		// Assert stanzas only hold expectations regarding the whole run
+		`client "a" {
+    tx -url "/"
+}
+assert {
+    expect resp.status eq 200
+}`,
+		`client "a" {
+    tx -url "/"
+}
+assert {
+    tx -url "/"
+}`,
+		`client "a" {
+    tx -url "/"
+    expect client["a"].resp.status eq 200
+}`,
+		`client "a" {
+    tx -url "/"
+}
+expect client["a"].req.method eq "GET"`,
+		// Retrying is only possible in client stanzas
+		`handle "/" {
+    expect req.method eq "GET" within "1s"
+    tx -status 200
+}`,
+		`client "a" {
+    tx -url "/"
+}
+expect origin["/"].hits eq 1 within "1s"`,
+		// Capturing is only possible in client stanzas, with ~ and as many
+		// variables as groups at most
+		`handle "/" {
+    expect req.headers["Host"] ~ "(.*)" capture $host
+    tx -status 200
+}`,
+		`client "a" {
+    tx -url "/"
+    expect resp.status eq 200 capture $status
+}`,
+		`client "a" {
+    tx -url "/"
+    expect resp.headers["X-Cache"] ~ "hit-(\w+)" capture $dc $node
+}`,
+		`client "a" {
+    tx -url "/"
+    expect resp.headers["X-Cache"] ~ "hit-(\w+)" capture
+}`,
+		// Variables must be captured by previous clients
+		`client "a" {
+    tx -url "/${dc}"
+}
+client "b" {
+    tx -url "/"
+    expect resp.headers["X-Cache"] ~ "hit-(\w+)" capture $dc
+}`,
+		// Responses must be received by previous tx commands or clients
+		`client "a" {
+    tx -url "${resp[0].headers[Location]}"
+}`,
+		`client "a" {
+    tx -url "/"
+    tx -url "${resp[1].headers[Location]}"
+}`,
+		`client "a" {
+    pipeline
+    tx -url "/"
+    tx -url "${resp[0].headers[Location]}"
+}`,
+		`client "a" {
+    tx -url "/"
+}
+client "b" {
+    tx -url "${resp[0].status}"
+}`,
+		`client "a" {
+    tx -url "/"
+}
+client "b" {
+    tx -url "${client[c].resp.status}"
+}`,
+		`client "a" {
+    tx -url "/"
+}
+client "b" {
+    tx -url "${client[a].resp.banana}"
+}`,
+		// Invalid timeouts
+		`timeout "banana"
+client "a" {
+    tx -url "/"
+}`,
+		`timeout "-1s"
+client "a" {
+    tx -url "/"
+}`,
+		`timeout 1s
+timeout 2s
+client "a" {
+    tx -url "/"
+}`,
+		// Clients with the same name
+		`client "a" {
+    tx -url "/a"
+}
+client "a" {
+    tx -url "/b"
+}`,
+		`handle "/object" {
+    tx -header "Cache-Control: max-age=60"
+}
+expect cache persists "/object"
+client "cache-fill /object" {
+    tx -url "/object"
+}`,
+	}
+
+	for _, input := range inputs {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "www.example.org/a" {
+    tx -status 200
+}
+handle "/a" {
+    tx -status 200
+}
+handle "static.example.org/b" {
+    tx -status 200
+}
+handle "www.example.org/c" {
+    tx -status 200
+}
+client "forward" {
+    tx -url "http://forward.example.org/a" -forward
+}
+client "tunnel" {
+    tx -url "http://localhost/a" -tunnel
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "www.example.org", p.Handlers[0].Host)
+	assert.Equal(t, "/a", p.Handlers[0].URIPath)
+	assert.Equal(t, "", p.Handlers[1].Host)
+	assert.Equal(t, []string{"forward.example.org", "static.example.org", "www.example.org"}, p.hosts())
+	assert.True(t, p.hasHandler("www.example.org/a"))
+
+	for _, input := range []string{
+		`handle "www.example.org" {
+    tx -status 200
+}`,
+		`handle "www example/" {
+    tx -status 200
+}`,
+		`handle ~ "^/(api" {
+    tx -status 200
+}`,
+		`handle "/a" {
+    tx -status 200
+}
+handle "/a" {
+    tx -status 404
+}`,
+		`handle "/a" -method "POST" {
+    tx -status 200
+}
+handle "/a" -method "POST" {
+    tx -status 404
+}`,
+		`handle "/a" -method {
+    tx -status 200
+}`,
+		`handle "/a" -method "GET /a" {
+    tx -status 200
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseWait(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "nemo" {
+    wait "3s"
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3*time.Second, p.Clients[0].Steps[0].Wait)
+
+	for _, input := range []string{
+		`client "nemo" {
+    wait "banana"
+    tx -url "/"
+}`,
+		`client "nemo" {
+    tx -url "/"
+    wait "3s"
+}`,
+		`client "nemo" {
+    wait "3s"
+}`,
+		`client "nemo" {
+    wait "3s"
+    tx -url "/1"
+    tx -url "/2"
+    wait "3s"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+
+	// wait applies to the tx command following it
+	p, err = Parse(strings.NewReader(`client "nemo" {
+    tx -url "/1"
+    wait "3s"
+    tx -url "/2"
+}`))
+	assert.Nil(t, err)
+	assert.Zero(t, p.Clients[0].Steps[0].Wait)
+	assert.Equal(t, 3*time.Second, p.Clients[0].Steps[1].Wait)
+}
+
+func TestParseHandleBranches(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/" {
+    expect req.method eq "GET"
+    if hits eq 1 {
+        tx -status 200 -body "first"
+    } else if hits lt 4 {
+        tx -status 304
+    } else {
+        tx -status 503
+    }
+}
+
+handle "/retry" {
+    if hits gt 2 { tx -status 200 }
+}
+
+client "nemo" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+
+	h := p.Handlers[0]
+	assert.Len(t, h.Branches, 2)
+	for hits, status := range map[int]int{1: 200, 2: 304, 3: 304, 4: 503, 10: 503} {
+		assert.Equal(t, status, h.response(hits).statusCode, hits)
+	}
+	assert.Equal(t, "first", string(h.response(1).body))
+
+	// Without else, an empty 200
+	h = p.Handlers[1]
+	assert.Equal(t, 200, h.response(3).statusCode)
+	assert.Equal(t, 200, h.response(1).statusCode)
+	assert.Nil(t, h.response(1).body)
+
+	for _, input := range []string{
+		`handle "/" {
+    if status eq 1 { tx -status 200 }
+}`,
+		`handle "/" {
+    if hits ~ 1 { tx -status 200 }
+}`,
+		`handle "/" {
+    if hits eq "banana" { tx -status 200 }
+}`,
+		`handle "/" {
+    if hits eq 1 tx -status 200
+}`,
+		`handle "/" {
+    if hits eq 1 { }
+}`,
+		`handle "/" {
+    if hits eq 1 { tx -status 200 } else
+}`,
+		`handle "/" {
+    if hits eq 1 { tx -status 200 }
+    tx -status 500
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseCookies(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "nemo" {
+    cookies
+    tx -url "/"
+}
+
+client "dory" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.True(t, p.Clients[0].Cookies)
+	assert.False(t, p.Clients[1].Cookies)
+}
+
+func TestParseSteps(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "nemo" {
+    tx -url "/login" -method "POST"
+    expect resp.status eq 200
+    expect resp.headers["X-Token"] ~ "(.+)" capture $token
+    wait "1s"
+    tx -url "/account" -header "X-Token: ${token}"
+    expect resp.status eq 200
+    tx -url "/logout"
+}`))
+	assert.Nil(t, err)
+
+	steps := p.Clients[0].Steps
+	assert.Len(t, steps, 3)
+	assert.Equal(t, "/login", steps[0].Request.uri)
+	assert.Len(t, steps[0].Expectations, 2)
+	assert.Equal(t, time.Second, steps[1].Wait)
+	assert.Len(t, steps[1].Expectations, 1)
+	assert.Equal(t, time.Duration(0), steps[2].Wait)
+	assert.Len(t, steps[2].Expectations, 0)
+	assert.Len(t, p.Clients[0].expectations(), 3)
+
+	for _, input := range []string{
+		`client "nemo" {
+    expect resp.status eq 200
+    tx -url "/"
+}`,
+		`client "nemo" {
+    tx -url "/"
+    wait "1s"
+    expect resp.status eq 200
+    tx -url "/"
+}`,
+		`client "nemo" {
+    tx -url "/"
+    tx -url "/"
+    burst 5
+}`,
+		`client "nemo" {
+    tx -url "/"
+    tx -url "/"
+    fuzz 5
+}`,
+		`client "nemo" {
+    tx -url "/${token}"
+    expect resp.headers["X-Token"] ~ "(.+)" capture $token
+}`,
+		`client "nemo" {
+    tx -url "/"
+    expect resp[1].status eq 200
+    tx -url "/"
+}`,
+		`client "nemo" {
+    tx -url "/"
+    tx -url "/"
+    expect resp[0].status eq 200 within "1s"
+}`,
+		`client "nemo" {
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseBurst(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "nemo" {
+    tx -url "/"
+    burst 20 within "1s"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, p.Clients[0].Burst)
+	assert.Equal(t, time.Second, p.Clients[0].BurstWithin)
+
+	// The line following burst is not lost
+	p, err = Parse(strings.NewReader(`client "nemo" {
+    tx -url "/"
+    burst 5 # comment
+    expect resp.status eq 200
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, p.Clients[0].Burst)
+	assert.Len(t, p.Clients[0].Steps[0].Expectations, 1)
+
+	for _, input := range []string{
+		`client "nemo" {
+    tx -url "/"
+    burst 0
+}`,
+		`client "nemo" {
+    tx -url "/"
+    burst 5 within "banana"
+}`,
+		`client "nemo" {
+    tx -url "/"
+    expect resp.status eq 200 within "1s"
+    burst 5
+}`,
+		`client "nemo" {
+    tx -url "/"
+    expect resp.statuses["banana"] eq 1
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseFuzz(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "nemo" {
+    fuzz 1000
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, p.Clients[0].Fuzz)
+	assert.Equal(t, 2, p.Clients[0].fuzzPos.line)
+	assert.Equal(t, "GET", p.Clients[0].Steps[0].Request.method)
+	assert.NotNil(t, p.Clients[0].Steps[0].Request.headers)
+
+	for _, input := range []string{
+		`client "nemo" {
+    fuzz 0
+}`,
+		`client "nemo" {
+    fuzz "many"
+}`,
+		`client "nemo" {
+    tx -url "/"
+    fuzz 10
+    burst 5
+}`,
+		`client "nemo" {
+    fuzz 10
+    expect resp.status eq 200
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseBodyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httptester")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	payload := []byte("\x00binary \"payload\"\n")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "payload.bin"), payload, 0644))
+
+	input := `handle "/upload" {
+    expect req.body eq "ok"
+    tx -status 200 -body-file "payload.bin"
+}
+
+client "nemo" {
+    tx -url "/upload" -method "POST" -body-file "payload.bin"
+}`
+	filename := filepath.Join(dir, "upload.htc")
+	assert.Nil(t, ioutil.WriteFile(filename, []byte(input), 0644))
+
+	p, err := parseFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, p.Handlers[0].Response.body)
+	assert.Equal(t, payload, p.Clients[0].Steps[0].Request.body)
+
+	// Missing files are reported where they are referenced
+	assert.Nil(t, os.Remove(filepath.Join(dir, "payload.bin")))
+	_, err = parseFile(filename)
+	perr, ok := err.(*ParseError)
+	assert.True(t, ok)
+	assert.Equal(t, 3, perr.Line)
+	assert.Equal(t, 31, perr.Column)
+	// Prefixed with the file, as printed when a run cannot start
+	assert.True(t, strings.HasPrefix(err.Error(), filename+":3:31: "), err)
+
+	// -body and -body-file are mutually exclusive
+	_, err = Parse(strings.NewReader(`client "nemo" {
+    tx -url "/" -body "a" -body-file "payload.bin"
+}`))
+	assert.Error(t, err)
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/" -banana
+}`
+
+	_, err := Parse(strings.NewReader(input))
+	perr, ok := err.(*ParseError)
+	assert.True(t, ok)
+	assert.Equal(t, 6, perr.Line)
+	assert.Equal(t, 17, perr.Column)
+	assert.Equal(t, "6:17: "+perr.Err.Error(), perr.Error())
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Checking that the proxy keeps objects in its disk cache across restarts,
+// eg:
+//
+//	expect cache persists "/object"
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// persistsCondition is what expectations about cache persistence require
+const persistsCondition = "served from the cache after restarting the proxy"
+
+// parseCache parses the part of an expect command following 'cache', eg:
+// persists "/object" or negative "/missing"
+func (e *Expect) parseCache(s *scanner) error {
+	token := s.ScanUseful()
+	e.verbatim += " " + token.val
+	switch token.typ {
+	case PERSISTS:
+		e.field = EXPECT_CACHE_PERSISTS
+	case NEGATIVE:
+		e.field = EXPECT_CACHE_NEGATIVE
+	default:
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'cache persists $path' or 'cache negative $path', got %q", token)
+	}
+	e.subject = e.verbatim
+	kind := token.val
+
+	token = s.ScanUseful()
+	e.verbatim += fmt.Sprintf(" %q", token.val)
+	if token.typ != STRING || len(token.val) == 0 || token.val[0] != '/' {
+		return fmt.Errorf("Parse error in 'expect' command: expecting 'cache %s $path', got %q", kind, token)
+	}
+	e.path = token.val
+
+	// Names of the clients filling the cache and fetching the object
+	// again, see cacheClients
+	e.clients = []string{"cache-fill " + e.path, "cache-hit " + e.path}
+	if e.field == EXPECT_CACHE_NEGATIVE {
+		e.clients = []string{"negative-fill " + e.path, "negative-hit " + e.path}
+	}
+	return nil
+}
+
+// cache returns true if the expectation is checked by clients of its own,
+// filling the cache and fetching the object again
+func (e Expect) cache() bool {
+	return e.field == EXPECT_CACHE_PERSISTS || e.field == EXPECT_CACHE_NEGATIVE
+}
+
+// cacheClients returns the clients of an expectation about the cache: the
+// first one fetches the object, the second one fetches it again, after
+// restarting the proxy if the expectation is about cache persistence
+func (e Expect) cacheClients() []ClientStanza {
+	clients := make([]ClientStanza, len(e.clients))
+	for i, name := range e.clients {
+		req := TxReq{method: "GET", uri: e.path, headers: make(map[string]string)}
+		clients[i] = ClientStanza{Name: name, Steps: []ClientStep{{Request: req}}}
+	}
+	clients[1].RestartProxy = e.field == EXPECT_CACHE_PERSISTS
+	return clients
+}
+
+// CachePersists checks an expectation about cache persistence, once all
+// clients are done: the object fetched again after restarting the proxy must
+// be the same, without the request reaching the origin. As the memory cache
+// does not survive restarts, it was then served from the disk cache. ids and
+// responses map client names to the IDs of the requests they sent and to the
+// responses they received
+func (e Expect) CachePersists(o *Origin, ids map[string]string, responses map[string]*ClientResponse) Evaluation {
+	ev := e.newEvaluation()
+	ev.Expected = e.condition()
+
+	fill, hit := responses[e.clients[0]], responses[e.clients[1]]
+	switch {
+	case fill == nil || hit == nil:
+		ev.Reason = "the proxy sent no response"
+	case fill.StatusCode >= http.StatusInternalServerError:
+		ev.Actual = fmt.Sprintf("status %d before restarting the proxy", fill.StatusCode)
+	case len(o.hits.caused(ids[e.clients[1]])) > 0:
+		ev.Actual = "fetched from the origin after restarting the proxy"
+	case hit.StatusCode != fill.StatusCode:
+		ev.Actual = fmt.Sprintf("status %d after restarting the proxy, was %d", hit.StatusCode, fill.StatusCode)
+	case !bytes.Equal(hit.body, fill.body):
+		ev.Actual = "different body after restarting the proxy"
+	default:
+		ev.Actual, ev.Passed = persistsCondition, true
+	}
+	return ev
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCachePersists(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/object" {
+    tx -header "Cache-Control: max-age=60" -body "Hello world!"
+}
+
+reload-proxy-config {
+    set "proxy.config.cache.ram_cache.size" "0"
+}
+
+expect cache persists "/object"`))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Clients, 2) {
+		assert.Equal(t, "cache-fill /object", p.Clients[0].Name)
+		assert.NotNil(t, p.Clients[0].ReloadConfig)
+		assert.False(t, p.Clients[0].RestartProxy)
+		assert.Equal(t, "cache-hit /object", p.Clients[1].Name)
+		assert.True(t, p.Clients[1].RestartProxy)
+		assert.Equal(t, "/object", p.Clients[1].Steps[0].Request.uri)
+	}
+	if assert.Len(t, p.Expectations, 1) {
+		assert.Equal(t, EXPECT_CACHE_PERSISTS, p.Expectations[0].field)
+	}
+
+	for _, input := range []string{
+		`expect cache persists`,
+		`expect cache persists "object"`,
+		`expect cache "/object"`,
+		`expect cache persists "/object"
+expect cache persists "/object"`,
+		`assert {
+    expect cache persists "/object"
+}`,
+		`client "a" {
+    tx -url "/object"
+    expect cache persists "/object"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+// cachingProxy is a reverse proxy to the given origin caching all responses
+// in memory, unless emptied
+type cachingProxy struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	proxy   *httputil.ReverseProxy
+}
+
+func (c *cachingProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	body, ok := c.objects[req.URL.Path]
+	c.mu.Unlock()
+	if ok {
+		w.Write(body)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	c.proxy.ServeHTTP(rec, req)
+	c.mu.Lock()
+	c.objects[req.URL.Path] = rec.Body.Bytes()
+	c.mu.Unlock()
+	w.Write(rec.Body.Bytes())
+}
+
+func TestRunCachePersists(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/object" {
+    tx -body "Hello world!"
+}
+
+expect cache persists "/object"`))
+	assert.Nil(t, err)
+
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	proxy := &cachingProxy{objects: make(map[string][]byte), proxy: httputil.NewSingleHostReverseProxy(u)}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+	addr := strings.TrimPrefix(front.URL, "http://")
+
+	restart := func(empty bool) Report {
+		restarted := &fakeProxy{restartFunc: func(context.Context) error {
+			if empty {
+				proxy.mu.Lock()
+				clear(proxy.objects)
+				proxy.mu.Unlock()
+			}
+			return nil
+		}}
+		report, err := run(t.Context(), p, origin, addr, restarted)
+		assert.Nil(t, err)
+		return report
+	}
+
+	report := restart(false)
+	assert.False(t, report.Failed(), report.Failures)
+
+	// The cache does not survive the restart
+	proxy.objects = make(map[string][]byte)
+	report = restart(true)
+	if assert.Len(t, report.Failures, 1) {
+		assert.Equal(t, "expect cache persists \"/object\"", report.Failures[0].Expect)
+		assert.Equal(t, "\"fetched from the origin after restarting the proxy\"", report.Failures[0].Actual)
+	}
+}
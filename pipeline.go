@@ -0,0 +1,155 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// longestTimeout returns the request with the longest -timeout among reqs,
+// which sets the time allowed for all responses to pipelined requests
+func longestTimeout(reqs []TxReq) TxReq {
+	longest := reqs[0]
+	for _, r := range reqs[1:] {
+		if r.timeout > longest.timeout {
+			longest = r
+		}
+	}
+	return longest
+}
+
+// sendPipeline writes reqs back-to-back on a single connection to the proxy
+// listening on server, and only then reads the responses, in order. Requests
+// the proxy did not answer before closing the connection get a response with
+// status 0, see ClientResponse.unanswered
+func sendPipeline(ctx context.Context, reqs []TxReq, server string) ([]*ClientResponse, error) {
+	parent := ctx
+	timeout := longestTimeout(reqs).timeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// fail tells a client timeout apart from ctx being done
+	fail := func(err error) ([]*ClientResponse, error) {
+		if timeout > 0 && ctx.Err() != nil && parent.Err() == nil {
+			return nil, errClientTimeout
+		}
+		return nil, err
+	}
+
+	var sent []*http.Request
+	for _, r := range reqs {
+		req, err := http.NewRequestWithContext(ctx, r.method, fmt.Sprintf("http://%s%s", server, r.uri), bytes.NewReader(r.body))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range r.headers {
+			req.Header.Add(key, value)
+		}
+		if r.host != "" {
+			req.Host = r.host
+		}
+		if err := r.setFileBody(req); err != nil {
+			return nil, err
+		}
+		if r.chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		if r.jar != nil {
+			for _, c := range r.jar.Cookies(req.URL) {
+				req.AddCookie(c)
+			}
+		}
+		sent = append(sent, req)
+	}
+
+	start := time.Now()
+	conn, err := reqs[0].dialer(server)(ctx, "tcp", server)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	// Unblock reads and writes once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	w := bufio.NewWriter(conn)
+	for _, req := range sent {
+		if err := req.Write(w); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	var responses []*ClientResponse
+	br := bufio.NewReader(conn)
+	for i, req := range sent {
+		hints := make(http.Header)
+		resp, err := http.ReadResponse(br, req)
+		// Interim responses come before the final one
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if resp.StatusCode == http.StatusEarlyHints {
+				for key, values := range resp.Header {
+					hints[key] = append(hints[key], values...)
+				}
+			}
+			resp, err = http.ReadResponse(br, req)
+		}
+		if err != nil && ctx.Err() != nil {
+			return fail(err)
+		}
+		if err != nil {
+			// The proxy closed the connection, or sent garbage: the
+			// requests left are not answered
+			for _, r := range reqs[i:] {
+				responses = append(responses, &ClientResponse{unanswered: true, requests: 1, url: r.uri})
+			}
+			break
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fail(err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if reqs[i].jar != nil {
+			reqs[i].jar.SetCookies(req.URL, resp.Cookies())
+		}
+
+		responses = append(responses, &ClientResponse{
+			Response:   *resp,
+			body:       body,
+			connReused: i > 0,
+			requests:   1,
+			url:        reqs[i].uri,
+			hints:      hints,
+			timing:     timing{total: time.Since(start)},
+		})
+	}
+	return responses, nil
+}
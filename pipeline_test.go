@@ -0,0 +1,117 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipeline(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "a" {
+    pipeline
+    tx -url "/1"
+    tx -url "/2"
+    expect resp.status eq 200
+}`))
+	assert.Nil(t, err)
+	assert.True(t, p.Clients[0].Pipeline)
+
+	for _, input := range []string{
+		`pipeline
+    tx -url "/1"`,
+		`pipeline
+    burst 2 within 1s
+    tx -url "/1"`,
+		`pipeline
+    tx -url "/1"
+    wait 1s
+    tx -url "/2"`,
+		`pipeline
+    tx -url "/1"
+    tx -url "/2" -tls`,
+		`pipeline
+    tx -url "/1"
+    tx -url "/2" -bind "127.0.0.1"`,
+		`pipeline
+    tx -url "/1"
+    tx -url "/2"
+    expect resp.status eq 200 within 1s`,
+		`pipeline
+    tx -url "/1"
+    tx -url "/2"
+    expect resp.headers["X-Fish"] ~ "(.*)" capture $fish`,
+	} {
+		_, err := Parse(strings.NewReader("client \"a\" {\n    " + input + "\n}"))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	report := runDirect(t, `handle "/1" {
+    tx -body "one"
+}
+
+handle "/2" {
+    expect req.method eq "POST"
+    expect req.body eq "ping"
+    tx -body "two"
+}
+
+client "a" {
+    pipeline
+    tx -url "/1"
+    expect resp.body eq "one"
+    expect resp.conn.reused eq "false"
+    tx -url "/2" -method "POST" -body "ping"
+    expect resp.body eq "two"
+    expect resp.conn.reused eq "true"
+    tx -url "/1" -method "HEAD"
+    expect resp.status eq 200
+    expect resp.body eq ""
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+
+	// Requests left unanswered when the connection is closed
+	report = runDirect(t, `handle "/1" {
+    tx -body "one" -header "Connection: close"
+}
+
+client "a" {
+    pipeline
+    tx -url "/1"
+    expect resp.body eq "one"
+    tx -url "/1"
+    expect resp.status eq 0
+    tx -url "/1"
+    expect resp.status eq 0
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+
+	report = runDirect(t, `handle "/1" {
+    tx -body "one" -header "Connection: close"
+}
+
+client "a" {
+    pipeline
+    tx -url "/1"
+    tx -url "/1"
+    expect resp.status eq 200
+}`)
+	assert.True(t, report.Failed())
+	assert.Equal(t, "No response, the proxy closed the connection\n", report.Clients[0].Response)
+}
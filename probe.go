@@ -0,0 +1,160 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Readiness probes, telling when the origin and the proxy are up
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Backoff between attempts of waitReady
+const (
+	probeInitialBackoff = 50 * time.Millisecond
+	probeMaxBackoff     = 2 * time.Second
+)
+
+// probe checks whether a service is ready to serve requests
+type probe interface {
+	// check returns nil if the service is ready
+	check(ctx context.Context) error
+	// String describes what is being checked, eg: the URL requested
+	String() string
+}
+
+// httpProbe expects a GET request to url to return 200
+type httpProbe struct {
+	url string
+}
+
+func (p httpProbe) check(ctx context.Context) error {
+	req, err := http.NewRequest("GET", p.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected status code received from url %s: %d", p.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (p httpProbe) String() string {
+	return p.url
+}
+
+// tcpProbe expects connections to addr to be accepted, which is useful for
+// proxies rejecting requests to unknown hosts
+type tcpProbe struct {
+	addr string
+}
+
+func (p tcpProbe) check(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p tcpProbe) String() string {
+	return p.addr
+}
+
+// commandProbe expects a command to succeed, eg: traffic_ctl server status
+type commandProbe struct {
+	args []string
+}
+
+func (p commandProbe) check(ctx context.Context) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.args[0], p.args[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func (p commandProbe) String() string {
+	return strings.Join(p.args, " ")
+}
+
+// probeKinds are the probes that can be chosen with -probe
+var probeKinds = []string{"http", "tcp", "traffic_ctl"}
+
+// validProbe returns an error if the given kind of probe cannot be used with
+// the proxy being tested
+func validProbe(kind string, ingress bool) error {
+	if ingress && kind == "traffic_ctl" {
+		return fmt.Errorf("-probe traffic_ctl cannot be used with -ingress")
+	}
+	for _, k := range probeKinds {
+		if k == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown probe %q, expecting one of %s", kind, strings.Join(probeKinds, ", "))
+}
+
+// waitReady checks p until it passes, backing off exponentially between
+// attempts. It gives up once timeout elapses, if positive, or ctx is done
+func waitReady(ctx context.Context, p probe, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	backoff := probeInitialBackoff
+	var err error
+	for {
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+			return timeoutError(ctx, ctx.Err(), "while waiting for %s: %s", p, err)
+		case <-time.After(backoff):
+		}
+
+		if err = p.check(ctx); err == nil {
+			break
+		}
+
+		if backoff *= 2; backoff > probeMaxBackoff {
+			backoff = probeMaxBackoff
+		}
+	}
+
+	slog.Debug("Finished waiting", "probe", p.String())
+	return nil
+}
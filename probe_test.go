@@ -0,0 +1,72 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitReadyTimeout(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	// Not found is retried until the startup timeout elapses
+	err := waitReady(context.Background(), httpProbe{server.URL}, 300*time.Millisecond)
+	assert.EqualError(t, err, "Timeout exceeded while waiting for "+server.URL+": Unexpected status code received from url "+server.URL+": 404")
+
+	// The TCP probe passes instead
+	addr := strings.TrimPrefix(server.URL, "http://")
+	assert.Nil(t, waitReady(context.Background(), tcpProbe{addr}, time.Second))
+
+	server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err = waitReady(ctx, tcpProbe{addr}, 0)
+	assert.Contains(t, err.Error(), "Timeout exceeded while waiting for "+addr+": ")
+}
+
+func TestWaitReadyBecomesReady(t *testing.T) {
+	ready := time.Now().Add(200 * time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if time.Now().Before(ready) {
+			w.WriteHeader(403)
+		}
+	}))
+	defer server.Close()
+
+	assert.Nil(t, waitReady(context.Background(), httpProbe{server.URL}, 5*time.Second))
+}
+
+func TestCommandProbe(t *testing.T) {
+	assert.Nil(t, commandProbe{[]string{"true"}}.check(context.Background()))
+
+	err := commandProbe{[]string{"sh", "-c", "echo not running; exit 1"}}.check(context.Background())
+	assert.EqualError(t, err, "exit status 1: not running")
+}
+
+func TestValidProbe(t *testing.T) {
+	assert.Nil(t, validProbe("http", false))
+	assert.Nil(t, validProbe("traffic_ctl", false))
+	assert.Nil(t, validProbe("tcp", true))
+	assert.Error(t, validProbe("traffic_ctl", true))
+	assert.EqualError(t, validProbe("ping", false), `Unknown probe "ping", expecting one of http, tcp, traffic_ctl`)
+}
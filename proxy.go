@@ -15,40 +15,162 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-type Proxy struct {
-	port       int
-	originPort int
-	cmd        *exec.Cmd
-	tmpDir     string
+// proxyVersionRegexp matches the version printed by ATS programs, eg:
+// Apache Traffic Server - traffic_layout - 9.2.3 - (build # ...)
+var proxyVersionRegexp = regexp.MustCompile(` - ([0-9]+)\.[0-9]+\.[0-9]+`)
+
+// proxyInstall is an ATS installation
+type proxyInstall struct {
+	// dir is the directory holding the ATS programs
+	dir string
+	// version is the major version of ATS, which determines the format of
+	// the configuration files and how the proxy is started
+	version int
+	// bin is the program starting the proxy if given with -proxy-bin, eg: a
+	// debug build of traffic_server, run instead of the one in dir
+	bin string
 }
 
-func NewProxy(port, originPort int) Proxy {
-	return Proxy{port: port, originPort: originPort}
+// server returns the program starting the proxy: traffic_manager was removed
+// in ATS 10, where traffic_server is run directly
+func (i proxyInstall) server() string {
+	if i.version >= 10 {
+		return "traffic_server"
+	}
+	return "traffic_manager"
 }
 
-func writeStringToFile(s string, filename string) {
-	file, err := os.Create(filename)
+// findProxy returns the ATS installation in dir or, if dir is empty, the one
+// found in $PATH. If version is 0, it is detected by running traffic_layout.
+// bin overrides the program starting the proxy, if not empty. The error lists
+// the programs that are missing
+func findProxy(dir, bin string, version int) (proxyInstall, error) {
+	notFound := func(missing ...string) error {
+		where := "$PATH"
+		if dir != "" {
+			where = dir
+		}
+		return fmt.Errorf("Apache Traffic Server not found: %s missing from %s, use -ats-path to give its location", strings.Join(missing, ", "), where)
+	}
+
+	// The other programs must come from the same installation as
+	// traffic_layout
+	layout := filepath.Join(dir, "traffic_layout")
+	if dir == "" {
+		layout = "traffic_layout"
+	}
+	layout, err := exec.LookPath(layout)
 	if err != nil {
-		log.Fatal(err)
+		return proxyInstall{}, notFound("traffic_layout")
+	}
+	install := proxyInstall{dir: filepath.Dir(layout), version: version}
+
+	if install.version == 0 {
+		out, err := exec.Command(layout, "--version").CombinedOutput()
+		if err != nil {
+			return proxyInstall{}, fmt.Errorf("Detecting the version of Apache Traffic Server failed: %s", err)
+		}
+		if install.version, err = parseProxyVersion(string(out)); err != nil {
+			return proxyInstall{}, err
+		}
+	}
+	if install.version != 9 && install.version != 10 {
+		return proxyInstall{}, fmt.Errorf("Unsupported proxy version %d, expecting 9 or 10", install.version)
+	}
+
+	if bin != "" {
+		if install.bin, err = exec.LookPath(bin); err != nil {
+			return proxyInstall{}, fmt.Errorf("Proxy program %q given with -proxy-bin not found: %s", bin, err)
+		}
+		if install.bin, err = filepath.Abs(install.bin); err != nil {
+			return proxyInstall{}, err
+		}
+	} else if _, err := exec.LookPath(filepath.Join(install.dir, install.server())); err != nil {
+		return proxyInstall{}, notFound(install.server())
+	}
+	return install, nil
+}
+
+// parseProxyVersion returns the major version found in the output of an ATS
+// program run with --version
+func parseProxyVersion(out string) (int, error) {
+	m := proxyVersionRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("Cannot find the version of Apache Traffic Server in %q, use -proxy-version to give it", strings.TrimSpace(out))
 	}
-	defer file.Close()
+	return strconv.Atoi(m[1])
+}
+
+type Proxy struct {
+	port int
+	// tlsPort accepts TLS connections, presenting self-signed
+	// certificates, see writeCerts. startProxy always picks one: it is 0
+	// only for proxies made with NewProxy, configured without TLS
+	tlsPort int
+	// clientCerts is the client-certs level of the program, making the
+	// proxy ask clients for certificates issued by clientCA
+	clientCerts string
+	// proxyProtocol makes the ports of the proxy accept PROXY protocol
+	// headers, see Program.proxyProtocol
+	proxyProtocol bool
+	// rotations is how many times the certificates were replaced, see
+	// rotateCert
+	rotations  int
+	originPort int
+	// hosts are the virtual hosts handled by the origin, see
+	// Program.hosts. Requests for them are forwarded with the original
+	// Host header
+	hosts   []string
+	install proxyInstall
+	// name is the name of the proxy in the Via headers it adds, eg:
+	// parent-1. The default one if empty
+	name string
+	// parents are those the proxy forwards all requests to, if any
+	parents *ParentProxies
+	// headerRewrite are the rules of the header_rewrite plugin, if any, see
+	// the header-rewrite stanza
+	headerRewrite []HeaderRewrite
+	// negativeCaching makes the proxy cache error responses, nil if
+	// disabled, see the negative-caching stanza
+	negativeCaching *NegativeCaching
+	cmd             *exec.Cmd
+	// exited is closed once cmd exits
+	exited chan struct{}
+	tmpDir string
+}
 
-	file.WriteString(s)
+func NewProxy(port, originPort int, hosts []string) Proxy {
+	return Proxy{port: port, originPort: originPort, hosts: hosts}
 }
 
-func (p *Proxy) start() {
+func writeStringToFile(s string, filename string) error {
+	return ioutil.WriteFile(filename, []byte(s), 0644)
+}
+
+// start sets up and starts the proxy, returning once it is up or ctx is done
+func (p *Proxy) start(ctx context.Context) error {
 	// Create temporary directory
-	dir, err := ioutil.TempDir("/tmp", "runroot")
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(*workDir, "runroot")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	p.tmpDir = dir
 
@@ -70,44 +192,411 @@ localstatedir: %s/var
 runtimedir: %s/var/run
 logdir: %s/var/log
 cachedir: %s`
-	writeStringToFile(fmt.Sprintf(t, dir, dir, dir, dir, dir, cacheDir, dir, dir, dir, dir, dir, dir, cacheDir), fname)
+	if err := writeStringToFile(fmt.Sprintf(t, dir, dir, dir, dir, dir, cacheDir, dir, dir, dir, dir, dir, dir, cacheDir), fname); err != nil {
+		return err
+	}
 
 	// Create ATS layout directory
-	cmd := exec.Command("traffic_layout", "init", "-f", "-p", dir, "-l", fname, "--copy-style=soft")
+	cmd := exec.CommandContext(ctx, filepath.Join(p.install.dir, "traffic_layout"), "init", "-f", "-p", dir, "-l", fname, "--copy-style=soft")
 
 	err = cmd.Run()
 	if err != nil {
-		log.Fatal(err)
+		return timeoutError(ctx, err, "while creating the proxy layout")
+	}
+
+	// Create remap.config, plugin.config and storage.config, then
+	// records.config or records.yaml and ip_allow.config or ip_allow.yaml
+	recordsName, records := p.recordsConfig()
+	ipAllowName, ipAllow := p.ipAllowConfig()
+	configs := [][2]string{
+		{"remap.config", p.remapConfig()},
+		{"plugin.config", "xdebug.so\n"},
+		{"storage.config", fmt.Sprintf("%s/ 1M\n", cacheDir)},
+		{recordsName, records},
+		{ipAllowName, ipAllow},
+	}
+	if p.parents != nil {
+		configs = append(configs, [2]string{"parent.config", p.parentConfig()})
+	}
+	for _, r := range p.headerRewrite {
+		configs = append(configs, [2]string{r.config(), r.Rule})
+	}
+	if p.tlsPort > 0 {
+		if err := p.writeCerts("proxy"); err != nil {
+			return err
+		}
+	}
+	if p.clientCerts != "" {
+		ca, err := clientCA()
+		if err != nil {
+			return err
+		}
+		configs = append(configs, [2]string{"client-ca.pem", string(ca.certPEM())})
+	}
+	for _, c := range configs {
+		if err := writeStringToFile(c[1], path.Join(dir, "etc", c[0])); err != nil {
+			return err
+		}
+	}
+
+	return p.launch(ctx)
+}
+
+// launch runs the proxy in its runroot, returning once it is up or ctx is done
+func (p *Proxy) launch(ctx context.Context) error {
+	// Start traffic_manager, or traffic_server for ATS 10, unless given
+	// another program with -proxy-bin
+	server := path.Join(p.tmpDir, "bin", p.install.server())
+	if p.install.bin != "" {
+		server = p.install.bin
+	}
+	p.cmd = exec.Command(server, "--run-root="+path.Join(p.tmpDir, "runroot.yaml"))
+
+	err := p.cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Stop waiting if the proxy exits, for instance because its port was
+	// taken after being chosen
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd, exited := p.cmd, make(chan struct{})
+	p.exited = exited
+	go func() {
+		cmd.Wait()
+		close(exited)
+		cancel()
+	}()
+
+	err = waitReady(waitCtx, p.probe(*probeKind), *startupTimeout)
+	select {
+	case <-exited:
+		return fmt.Errorf("The proxy exited while starting on port %d: %s", p.port, cmd.ProcessState)
+	default:
+		return err
+	}
+}
+
+// proxyControl acts on the proxy under test on behalf of the program: it is
+// restarted by restart-proxy, reloaded by reload-proxy-config, its
+// certificates replaced by rotate-cert, its metrics checked by proxy.metric
+// expectations, and requests using -tls sent to its TLS port. Proxy
+// implements it. It is nil when the proxy is not run by httptester, eg: when
+// testing an ingress controller
+type proxyControl interface {
+	restart(ctx context.Context) error
+	reload(r ConfigReload) error
+	rotateCert() error
+	metric(name string) (string, error)
+	tlsAddr() string
+}
+
+// proxyStopTimeout is how long the proxy is given to exit gracefully when
+// restarted, before being killed
+const proxyStopTimeout = 30 * time.Second
+
+// restart stops the proxy gracefully and starts it again in the same runroot,
+// so that its cache and configuration are kept. It returns once the proxy is
+// up again or ctx is done
+func (p *Proxy) restart(ctx context.Context) error {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return fmt.Errorf("The proxy was never started")
+	}
+
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(proxyStopTimeout):
+		slog.Warn("The proxy did not exit gracefully, killing it", "timeout", proxyStopTimeout)
+		p.cmd.Process.Kill()
+		<-p.exited
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return p.launch(ctx)
+}
+
+// probe returns the readiness probe of the given kind, see -probe
+func (p Proxy) probe(kind string) probe {
+	switch kind {
+	case "tcp":
+		return tcpProbe{fmt.Sprintf("localhost:%d", p.port)}
+	case "traffic_ctl":
+		return commandProbe{[]string{path.Join(p.tmpDir, "bin", "traffic_ctl"), "--run-root=" + path.Join(p.tmpDir, "runroot.yaml"), "server", "status"}}
+	}
+	return httpProbe{fmt.Sprintf("http://localhost:%d/httpTesterInternalCheck", p.port)}
+}
+
+// trafficCtl runs traffic_ctl with the given arguments, returning its output
+func (p Proxy) trafficCtl(args ...string) (string, error) {
+	args = append([]string{"--run-root=" + path.Join(p.tmpDir, "runroot.yaml")}, args...)
+	out, err := exec.Command(path.Join(p.tmpDir, "bin", "traffic_ctl"), args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("traffic_ctl %s: %s: %s", strings.Join(args[1:], " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// tlsAddr returns the address of the TLS port of the proxy
+func (p Proxy) tlsAddr() string {
+	return fmt.Sprintf("127.0.0.1:%d", p.tlsPort)
+}
+
+// metric returns the current value of the given metric, as reported by
+// traffic_ctl, eg: 3 for proxy.process.http.cache_hit_fresh
+func (p Proxy) metric(name string) (string, error) {
+	out, err := p.trafficCtl("metric", "get", name)
+	if err != nil {
+		return "", err
+	}
+	return parseMetric(out, name)
+}
+
+// writeCerts generates new certificates for the proxy, see newProxyCerts,
+// writing them along with their keys to the configuration directory with the
+// given prefix, eg: proxy.pem and proxy.www.example.org.pem. They are listed
+// in ssl_multicert.config, the default one last, and become proxyCerts
+func (p Proxy) writeCerts(prefix string) error {
+	certs, err := newProxyCerts(p.hosts)
+	if err != nil {
+		return err
+	}
+
+	// Copied not to append to p.hosts, which may list localhost already
+	names := make([]string, 0, len(p.hosts)+1)
+	for _, host := range p.hosts {
+		if host != defaultCertName {
+			names = append(names, host)
+		}
+	}
+	names = append(names, defaultCertName)
+
+	etc := path.Join(p.tmpDir, "etc")
+	var multicert string
+	for _, name := range names {
+		cert := certs[name]
+		base := prefix
+		if name != defaultCertName {
+			base += "." + name
+		}
+		key, err := cert.keyPEM()
+		if err != nil {
+			return err
+		}
+		if err := writeStringToFile(string(cert.certPEM()), path.Join(etc, base+".pem")); err != nil {
+			return err
+		}
+		if err := writeStringToFile(string(key), path.Join(etc, base+".key")); err != nil {
+			return err
+		}
+
+		if name == defaultCertName {
+			multicert += "dest_ip=* "
+		}
+		multicert += fmt.Sprintf("ssl_cert_name=%s.pem ssl_key_name=%s.key\n", base, base)
+	}
+	if err := writeStringToFile(multicert, path.Join(etc, "ssl_multicert.config")); err != nil {
+		return err
+	}
+
+	setProxyCerts(certs)
+	return nil
+}
+
+// rotateCert replaces the certificates of the proxy with new ones, and asks
+// the proxy to reload its configuration. The new certificates are presented
+// once the proxy is done reloading, which happens in the background
+func (p *Proxy) rotateCert() error {
+	p.rotations++
+	if err := p.writeCerts(fmt.Sprintf("proxy-%d", p.rotations)); err != nil {
+		return err
 	}
+	_, err := p.trafficCtl("config", "reload")
+	return err
+}
+
+// parseMetric returns the value of the given metric in the output of
+// traffic_ctl metric get, eg: "proxy.process.http.cache_hit_fresh 3"
+func parseMetric(out, name string) (string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == name {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("Metric %s not found in %q", name, strings.TrimSpace(out))
+}
 
-	// Create remap.config
-	writeStringToFile(fmt.Sprintf("map / http://localhost:%d\n", p.originPort), path.Join(dir, "etc", "remap.config"))
+// proxyStartAttempts is how many times starting the proxy is tried, each time
+// on a different port
+const proxyStartAttempts = 3
 
-	// Create plugin.config
-	writeStringToFile(fmt.Sprintf("xdebug.so\n"), path.Join(dir, "etc", "plugin.config"))
+// startProxy starts a proxy configured like template on a free port,
+// forwarding requests to the origin listening on template.originPort. Unlike
+// the origin, the proxy binds the port by itself: another process might take
+// it in the meantime, especially when running multiple tests in parallel,
+// hence starting is retried on a new port if it fails. The last proxy tried
+// is returned, so that it can be stopped and its temporary directory
+// inspected
+func startProxy(ctx context.Context, template Proxy) (Proxy, error) {
+	var proxy Proxy
+	var err error
+
+	for i := 0; i < proxyStartAttempts; i++ {
+		if i > 0 {
+			proxy.stop()
+			proxy.cleanup()
+			slog.Warn("Starting the proxy failed, retrying on another port", "err", err)
+		}
+
+		port, perr := freePort()
+		if perr != nil {
+			return proxy, perr
+		}
+		tlsPort, perr := freePort()
+		if perr != nil {
+			return proxy, perr
+		}
+		proxy = template
+		proxy.port, proxy.tlsPort = port, tlsPort
+		if err = proxy.start(ctx); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return proxy, err
+}
+
+// serverPorts returns the ports the proxy listens on, in the format of
+// proxy.config.http.server_ports
+func (p Proxy) serverPorts() string {
+	pp := ""
+	if p.proxyProtocol {
+		pp = ":pp"
+	}
+	ports := fmt.Sprintf("%d%s %d%s:ipv6", p.port, pp, p.port, pp)
+	if p.tlsPort > 0 {
+		ports += fmt.Sprintf(" %d:ssl%s %d:ssl%s:ipv6", p.tlsPort, pp, p.tlsPort, pp)
+	}
+	return ports
+}
 
-	// Create storage.config
-	writeStringToFile(fmt.Sprintf("%s/ 1M\n", cacheDir), path.Join(dir, "etc", "storage.config"))
+// recordsConfig returns the name and the contents of the main configuration
+// file: records.yaml since ATS 10, records.config before. Certificates are
+// looked up in the configuration directory
+func (p Proxy) recordsConfig() (string, string) {
+	etc := path.Join(p.tmpDir, "etc")
+	if p.install.version >= 10 {
+		config := fmt.Sprintf(`records:
+  diags:
+    debug:
+      enabled: 1
+  http:
+    server_ports: "%s"
+    connect_ports: "1-65535"
+%s  ssl:
+    server:
+      cert:
+        path: "%s"
+      private_key:
+        path: "%s"
+`, p.serverPorts(), p.negativeCaching.records(true), etc, etc)
+		if p.clientCerts != "" {
+			config += fmt.Sprintf(`    client:
+      certification_level: %d
+    CA:
+      cert:
+        path: "%s"
+        filename: client-ca.pem
+`, clientCertLevels[p.clientCerts], etc)
+		}
+		if p.name != "" {
+			config += fmt.Sprintf("  proxy_name: %q\n", p.name)
+		}
+		return "records.yaml", config
+	}
 
-	// Create records.config
-	writeStringToFile(fmt.Sprintf(`CONFIG proxy.config.http.server_ports STRING %d %d:ipv6
+	config := fmt.Sprintf(`CONFIG proxy.config.http.server_ports STRING %s
 #CONFIG proxy.config.http.wait_for_cache INT 2
 CONFIG proxy.config.diags.debug.enabled INT 1
-`, p.port, p.port), path.Join(dir, "etc", "records.config"))
+CONFIG proxy.config.http.connect_ports STRING 1-65535
+CONFIG proxy.config.ssl.server.cert.path STRING %s
+CONFIG proxy.config.ssl.server.private_key.path STRING %s
+`, p.serverPorts(), etc, etc)
+	if p.clientCerts != "" {
+		config += fmt.Sprintf(`CONFIG proxy.config.ssl.client.certification_level INT %d
+CONFIG proxy.config.ssl.CA.cert.path STRING %s
+CONFIG proxy.config.ssl.CA.cert.filename STRING client-ca.pem
+`, clientCertLevels[p.clientCerts], etc)
+	}
+	if p.name != "" {
+		config += fmt.Sprintf("CONFIG proxy.config.proxy_name STRING %s\n", p.name)
+	}
+	config += p.negativeCaching.records(false)
+	return "records.config", config
+}
 
-	// Create ip_allow.config
-	writeStringToFile("src_ip=127.0.0.1 action=ip_allow method=ALL\nsrc_ip=::1 action=ip_allow method=ALL\n", path.Join(dir, "etc", "ip_allow.config"))
+// ipAllowConfig returns the name and the contents of the access control
+// configuration file, allowing the whole loopback network, used by clients
+// binding to other local addresses with -bind
+func (p Proxy) ipAllowConfig() (string, string) {
+	if p.install.version >= 10 {
+		return "ip_allow.yaml", `ip_allow:
+  - apply: in
+    ip_addrs: [127.0.0.0/8, "::1"]
+    action: allow
+    methods: ALL
+`
+	}
 
-	// Start traffic_manager
-	trafficManager := path.Join(dir, "bin", "traffic_manager")
-	p.cmd = exec.Command(trafficManager, "--run-root="+path.Join(dir, "runroot.yaml"))
+	return "ip_allow.config", "src_ip=127.0.0.0-127.255.255.255 action=ip_allow method=ALL\nsrc_ip=::1 action=ip_allow method=ALL\n"
+}
 
-	err = p.cmd.Start()
-	if err != nil {
-		log.Fatal(err)
+// remapConfig returns the contents of remap.config: all requests go to the
+// origin, and those for virtual hosts keep their Host header so that the
+// origin can route them
+func (p Proxy) remapConfig() string {
+	var config string
+	for _, host := range p.hosts {
+		config += fmt.Sprintf("map http://%s/ http://localhost:%d/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1\n", host, p.originPort)
+		if p.tlsPort > 0 {
+			config += fmt.Sprintf("map https://%s/ http://localhost:%d/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1\n", host, p.originPort)
+		}
 	}
+	config += p.headerRewriteRemap()
+	return config + fmt.Sprintf("map / http://localhost:%d\n", p.originPort)
+}
+
+// artifactFiles are the files and directories of the runroot useful to
+// investigate failures: the generated configuration and the logs
+var artifactFiles = []string{
+	"atslayout.yaml",
+	"etc/records.config",
+	"etc/records.yaml",
+	"etc/remap.config",
+	"etc/plugin.config",
+	"etc/storage.config",
+	"etc/ip_allow.config",
+	"etc/ip_allow.yaml",
+	"etc/ssl_multicert.config",
+	"etc/parent.config",
+	"etc/header-rewrite-*.config",
+	"var/log",
+}
 
-	waitForGET(fmt.Sprintf("http://localhost:%d/httpTesterInternalCheck", p.port))
+// artifacts returns the paths of the artifacts found in the runroot
+func (p Proxy) artifacts() []string {
+	var paths []string
+	for _, name := range artifactFiles {
+		// Patterns match the files of header-rewrite stanzas
+		matches, _ := filepath.Glob(path.Join(p.tmpDir, name))
+		paths = append(paths, matches...)
+	}
+	return paths
 }
 
 func (p Proxy) cleanup() {
@@ -115,9 +604,14 @@ func (p Proxy) cleanup() {
 }
 
 func (p Proxy) stop() {
+	if p.cmd == nil || p.cmd.Process == nil {
+		// Never started
+		return
+	}
+
 	// Done, shoot ATS
 	err := p.cmd.Process.Kill()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Stopping the proxy failed", "err", err)
 	}
 }
@@ -0,0 +1,236 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemapConfig(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	assert.Equal(t, "map / http://localhost:8000\n", p.remapConfig())
+
+	p = NewProxy(8080, 8000, []string{"www.example.org"})
+	assert.Equal(t, `map http://www.example.org/ http://localhost:8000/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1
+map / http://localhost:8000
+`, p.remapConfig())
+}
+
+func TestProxyArtifacts(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	p.tmpDir = t.TempDir()
+	assert.Nil(t, p.artifacts())
+
+	assert.Nil(t, os.MkdirAll(path.Join(p.tmpDir, "etc"), 0755))
+	assert.Nil(t, os.MkdirAll(path.Join(p.tmpDir, "var", "log"), 0755))
+	assert.Nil(t, os.WriteFile(path.Join(p.tmpDir, "etc", "remap.config"), []byte(p.remapConfig()), 0644))
+	assert.Equal(t, []string{
+		path.Join(p.tmpDir, "etc", "remap.config"),
+		path.Join(p.tmpDir, "var", "log"),
+	}, p.artifacts())
+}
+
+func TestRotateCert(t *testing.T) {
+	defer setProxyCerts(nil)
+
+	p := NewProxy(8080, 8000, []string{"www.example.org"})
+	p.tmpDir = t.TempDir()
+	for _, dir := range []string{"bin", "etc"} {
+		assert.Nil(t, os.MkdirAll(path.Join(p.tmpDir, dir), 0755))
+	}
+	// Fake traffic_ctl recording its arguments
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\n", path.Join(p.tmpDir, "args"))
+	assert.Nil(t, os.WriteFile(path.Join(p.tmpDir, "bin", "traffic_ctl"), []byte(script), 0755))
+
+	assert.Nil(t, p.writeCerts("proxy"))
+	first := currentProxyCerts()
+	assert.Len(t, first, 2)
+	assert.Equal(t, []string{"www.example.org"}, first["www.example.org"].cert.DNSNames)
+	assert.Equal(t, []string{"localhost"}, first["localhost"].cert.DNSNames)
+	config, err := os.ReadFile(path.Join(p.tmpDir, "etc", "ssl_multicert.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, `ssl_cert_name=proxy.www.example.org.pem ssl_key_name=proxy.www.example.org.key
+dest_ip=* ssl_cert_name=proxy.pem ssl_key_name=proxy.key
+`, string(config))
+
+	assert.Nil(t, p.rotateCert())
+	assert.False(t, isProxyCert(first["localhost"].cert))
+	assert.True(t, isProxyCert(currentProxyCerts()["localhost"].cert))
+	config, err = os.ReadFile(path.Join(p.tmpDir, "etc", "ssl_multicert.config"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(config), "dest_ip=* ssl_cert_name=proxy-1.pem ssl_key_name=proxy-1.key\n")
+	assert.FileExists(t, path.Join(p.tmpDir, "etc", "proxy-1.www.example.org.key"))
+
+	args, err := os.ReadFile(path.Join(p.tmpDir, "args"))
+	assert.Nil(t, err)
+	assert.Equal(t, "--run-root="+path.Join(p.tmpDir, "runroot.yaml")+" config reload\n", string(args))
+
+	// Virtual hosts named localhost get the default certificate, and the
+	// hosts of the proxy are left alone
+	hosts := append(make([]string, 0, 3), "localhost", "www.example.org")
+	p.hosts = hosts
+	assert.Nil(t, p.writeCerts("proxy"))
+	assert.Len(t, currentProxyCerts(), 2)
+	assert.Equal(t, "", hosts[:3][2])
+	config, err = os.ReadFile(path.Join(p.tmpDir, "etc", "ssl_multicert.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, `ssl_cert_name=proxy.www.example.org.pem ssl_key_name=proxy.www.example.org.key
+dest_ip=* ssl_cert_name=proxy.pem ssl_key_name=proxy.key
+`, string(config))
+}
+
+func TestFindProxy(t *testing.T) {
+	// writeProgram writes a fake ATS program printing the given version
+	writeProgram := func(dir, name, version string) {
+		script := fmt.Sprintf("#!/bin/sh\necho 'Apache Traffic Server - %s - %s - (build # 1)'\n", name, version)
+		assert.Nil(t, os.WriteFile(path.Join(dir, name), []byte(script), 0755))
+	}
+
+	dir := t.TempDir()
+	_, err := findProxy(dir, "", 0)
+	assert.EqualError(t, err, "Apache Traffic Server not found: traffic_layout missing from "+dir+", use -ats-path to give its location")
+
+	writeProgram(dir, "traffic_layout", "9.2.3")
+	_, err = findProxy(dir, "", 0)
+	assert.EqualError(t, err, "Apache Traffic Server not found: traffic_manager missing from "+dir+", use -ats-path to give its location")
+
+	writeProgram(dir, "traffic_manager", "9.2.3")
+	install, err := findProxy(dir, "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, proxyInstall{dir: dir, version: 9}, install)
+	assert.Equal(t, "traffic_manager", install.server())
+
+	// Forcing version 10 requires traffic_server
+	_, err = findProxy(dir, "", 10)
+	assert.EqualError(t, err, "Apache Traffic Server not found: traffic_server missing from "+dir+", use -ats-path to give its location")
+
+	// Found in $PATH
+	dir = t.TempDir()
+	writeProgram(dir, "traffic_layout", "10.0.2")
+	writeProgram(dir, "traffic_server", "10.0.2")
+	t.Setenv("PATH", dir)
+	install, err = findProxy("", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, proxyInstall{dir: dir, version: 10}, install)
+	assert.Equal(t, "traffic_server", install.server())
+
+	_, err = findProxy("", "", 8)
+	assert.Error(t, err)
+
+	// Another program can start the proxy, wherever it is
+	bin := t.TempDir()
+	writeProgram(bin, "traffic_server.debug", "10.0.2")
+	install, err = findProxy("", path.Join(bin, "traffic_server.debug"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, proxyInstall{dir: dir, version: 10, bin: path.Join(bin, "traffic_server.debug")}, install)
+	_, err = findProxy("", path.Join(bin, "traffic_server.missing"), 0)
+	assert.Error(t, err)
+
+	t.Setenv("PATH", t.TempDir())
+	_, err = findProxy("", "", 0)
+	assert.EqualError(t, err, "Apache Traffic Server not found: traffic_layout missing from $PATH, use -ats-path to give its location")
+}
+
+func TestParseProxyVersion(t *testing.T) {
+	version, err := parseProxyVersion("Apache Traffic Server - traffic_layout - 9.2.3 - (build # 110 on Jan 10 2024 at 10:00:00)\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 9, version)
+
+	_, err = parseProxyVersion("traffic_layout: unrecognized option\n")
+	assert.Error(t, err)
+}
+
+func TestRecordsConfig(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	name, config := p.recordsConfig()
+	assert.Equal(t, "records.config", name)
+	assert.Contains(t, config, "CONFIG proxy.config.http.server_ports STRING 8080 8080:ipv6\n")
+	name, _ = p.ipAllowConfig()
+	assert.Equal(t, "ip_allow.config", name)
+
+	p.install.version = 10
+	name, config = p.recordsConfig()
+	assert.Equal(t, "records.yaml", name)
+	assert.Contains(t, config, "    server_ports: \"8080 8080:ipv6\"\n")
+	name, _ = p.ipAllowConfig()
+	assert.Equal(t, "ip_allow.yaml", name)
+
+	p.tlsPort = 8443
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "    server_ports: \"8080 8080:ipv6 8443:ssl 8443:ssl:ipv6\"\n")
+	p.install.version = 9
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "CONFIG proxy.config.http.server_ports STRING 8080 8080:ipv6 8443:ssl 8443:ssl:ipv6\n")
+	assert.NotContains(t, config, "certification_level")
+
+	p.proxyProtocol = true
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "CONFIG proxy.config.http.server_ports STRING 8080:pp 8080:pp:ipv6 8443:ssl:pp 8443:ssl:pp:ipv6\n")
+	p.proxyProtocol = false
+
+	p.clientCerts = "required"
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "CONFIG proxy.config.ssl.client.certification_level INT 2\n")
+	assert.Contains(t, config, "CONFIG proxy.config.ssl.CA.cert.filename STRING client-ca.pem\n")
+	p.install.version = 10
+	_, config = p.recordsConfig()
+	assert.Contains(t, config, "      certification_level: 2\n")
+}
+
+func TestParseMetric(t *testing.T) {
+	value, err := parseMetric("proxy.process.http.cache_hit_fresh 3\n", "proxy.process.http.cache_hit_fresh")
+	assert.Nil(t, err)
+	assert.Equal(t, "3", value)
+
+	_, err = parseMetric("proxy.process.http.cache_miss_cold 1\n", "proxy.process.http.cache_hit_fresh")
+	assert.Error(t, err)
+}
+
+func TestProxyRestart(t *testing.T) {
+	defer func(kind string) { *probeKind = kind }(*probeKind)
+	*probeKind = "tcp"
+
+	// The proxy is ready once its port accepts connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	p := NewProxy(l.Addr().(*net.TCPAddr).Port, 8000, nil)
+	p.install.version = 10
+	p.tmpDir = t.TempDir()
+	assert.Nil(t, os.MkdirAll(path.Join(p.tmpDir, "bin"), 0755))
+	// Fake traffic_server logging when it starts and stops
+	log := path.Join(p.tmpDir, "log")
+	script := fmt.Sprintf("#!/bin/sh\necho start >> %s\ntrap 'echo stop >> %s; exit 0' TERM\nwhile true; do sleep 0.1; done\n", log, log)
+	assert.Nil(t, os.WriteFile(path.Join(p.tmpDir, "bin", "traffic_server"), []byte(script), 0755))
+
+	assert.NotNil(t, p.restart(t.Context()))
+	assert.Nil(t, p.launch(t.Context()))
+	defer func() { p.stop() }()
+	// Wait for the trap to be installed
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, p.restart(t.Context()))
+
+	out, err := os.ReadFile(log)
+	assert.Nil(t, err)
+	assert.Equal(t, "start\nstop\nstart\n", string(out))
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// PROXY protocol v1 and v2 headers, sent by clients and understood by the
+// origin. See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyV2Signature starts all PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// dialFunc is the signature of http.Transport.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyHeader returns the PROXY protocol header of the given version for a
+// TCP connection from src to dst
+func proxyHeader(version int, src, dst *net.TCPAddr) []byte {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	v4 := srcIP != nil && dstIP != nil
+	if !v4 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	if version == 1 {
+		proto, format := "TCP4", func(ip net.IP) string { return ip.String() }
+		if !v4 {
+			// Both addresses must be IPv6 ones, IPv4-mapped if needed
+			proto, format = "TCP6", func(ip net.IP) string {
+				if ip.To4() != nil {
+					return "::ffff:" + ip.To4().String()
+				}
+				return ip.String()
+			}
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, format(srcIP), format(dstIP), src.Port, dst.Port))
+	}
+
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	// Version 2, PROXY command
+	b.WriteByte(0x21)
+	if v4 {
+		// TCP over IPv4
+		b.WriteByte(0x11)
+	} else {
+		// TCP over IPv6
+		b.WriteByte(0x21)
+	}
+	binary.Write(&b, binary.BigEndian, uint16(2*len(srcIP)+4))
+	b.Write(srcIP)
+	b.Write(dstIP)
+	binary.Write(&b, binary.BigEndian, uint16(src.Port))
+	binary.Write(&b, binary.BigEndian, uint16(dst.Port))
+	return b.Bytes()
+}
+
+// readProxyHeader reads a PROXY protocol header from r, if there is one, and
+// returns the source address it advertises. A nil address is returned for
+// connections without a header, or with a header not advertising addresses
+func readProxyHeader(r *bufio.Reader) (*net.TCPAddr, error) {
+	prefix, err := r.Peek(5)
+	if err != nil {
+		// Let the HTTP server deal with short reads
+		return nil, nil
+	}
+
+	if string(prefix) == "PROXY" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+			return nil, nil
+		}
+		if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+			return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.Atoi(fields[4])
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	if !bytes.Equal(prefix, proxyV2Signature[:5]) {
+		return nil, nil
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol v2 header")
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, or addresses other than TCP over IPv4 or IPv6
+	size := map[byte]int{0x11: 4, 0x21: 16}[header[13]]
+	if header[12]&0x0f != 1 || size == 0 {
+		return nil, nil
+	}
+	if len(addrs) < 2*size+4 {
+		return nil, fmt.Errorf("truncated PROXY protocol v2 addresses")
+	}
+	port := binary.BigEndian.Uint16(addrs[2*size:])
+	return &net.TCPAddr{IP: net.IP(addrs[:size]), Port: int(port)}, nil
+}
+
+// proxyProtocolDialer returns a function dialing with dial and sending a
+// PROXY protocol header of the given version first. The header advertises
+// the local address of the connection as source, unless src is given
+func proxyProtocolDialer(dial dialFunc, version int, src net.IP) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		local, _ := conn.LocalAddr().(*net.TCPAddr)
+		remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if local == nil || remote == nil {
+			conn.Close()
+			return nil, fmt.Errorf("PROXY protocol needs a TCP connection")
+		}
+		if src != nil {
+			local = &net.TCPAddr{IP: src, Port: local.Port}
+		}
+
+		if _, err := conn.Write(proxyHeader(version, local, remote)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// proxyListener accepts connections optionally starting with a PROXY
+// protocol header
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY protocol header, if any, before the first read
+type proxyConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	// src is the source address advertised by the header
+	src *net.TCPAddr
+	err error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		c.src, c.err = readProxyHeader(c.r)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// proxyConnKey is the context key of the *proxyConn a request was received on
+type proxyConnKey struct{}
+
+// proxyConnContext is used as http.Server.ConnContext, so that handlers can
+// find the source address advertised with the PROXY protocol
+func proxyConnContext(ctx context.Context, c net.Conn) context.Context {
+	if pc, ok := c.(*proxyConn); ok {
+		return context.WithValue(ctx, proxyConnKey{}, pc)
+	}
+	return ctx
+}
+
+// proxySource returns the IP address advertised with the PROXY protocol on
+// the connection the given request was received on, or ""
+func proxySource(ctx context.Context) string {
+	if pc, ok := ctx.Value(proxyConnKey{}).(*proxyConn); ok && pc.src != nil {
+		return pc.src.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	dst := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 80}
+	assert.Equal(t, "PROXY TCP4 203.0.113.7 127.0.0.1 4242 80\r\n", string(proxyHeader(1, src, dst)))
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242}
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 4242 80\r\n", string(proxyHeader(1, src6, dst)))
+
+	for _, version := range []int{1, 2} {
+		for _, addr := range []*net.TCPAddr{src, src6} {
+			r := bufio.NewReader(bytes.NewReader(append(proxyHeader(version, addr, dst), "GET / HTTP/1.1\r\n"...)))
+			got, err := readProxyHeader(r)
+			assert.Nil(t, err)
+			assert.True(t, addr.IP.Equal(got.IP), "v%d %s", version, addr)
+			assert.Equal(t, addr.Port, got.Port)
+
+			// The request follows
+			rest, _ := ioutil.ReadAll(r)
+			assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, input := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY UNKNOWN\r\n",
+		// LOCAL command
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+		"GET",
+	} {
+		got, err := readProxyHeader(bufio.NewReader(strings.NewReader(input)))
+		assert.Nil(t, err, input)
+		assert.Nil(t, got, input)
+	}
+
+	for _, input := range []string{
+		"PROXY TCP4 banana 127.0.0.1 4242 80\r\n",
+		"PROXY TCP4 203.0.113.7\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\x01",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x02\x01\x02",
+	} {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(input)))
+		assert.Error(t, err, input)
+	}
+}
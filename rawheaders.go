@@ -0,0 +1,116 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+)
+
+// maxRawHeaders is the maximum number of bytes of a response recorded for
+// resp.rawheaders. Header blocks longer than that are truncated
+const maxRawHeaders = 64 << 10
+
+// rawRecorder keeps the bytes received by a client, as they were sent by the
+// proxy, so that header names can be checked before Go canonicalizes them and
+// merges duplicates, and bodies can be found where Go discards them
+type rawRecorder struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// reset discards what was received so far, called before every request sent
+// when following redirects
+func (r *rawRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = nil
+}
+
+func (r *rawRecorder) write(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := maxRawHeaders - len(r.buf); n > 0 {
+		r.buf = append(r.buf, p[:min(n, len(p))]...)
+	}
+}
+
+// headers returns the status line and headers of the final response
+// received, 1xx responses other than 101 skipped, up to and including the
+// empty line ending them
+func (r *rawRecorder) headers() []byte {
+	head, _ := r.split()
+	return head
+}
+
+// body returns the bytes received after the headers of the final response,
+// for empty-for-head
+func (r *rawRecorder) body() []byte {
+	_, rest := r.split()
+	return rest
+}
+
+// split returns the header block of the final response received, see
+// headers, and what was received after it
+func (r *rawRecorder) split() ([]byte, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buf := r.buf
+	for {
+		end := bytes.Index(buf, []byte("\r\n\r\n"))
+		if end < 0 {
+			return buf, nil
+		}
+		head := buf[:end+4]
+		if !interim(head) {
+			return head, buf[end+4:]
+		}
+		buf = buf[end+4:]
+	}
+}
+
+// interim returns true if the given header block is that of an interim
+// response, eg: 103 Early Hints
+func interim(head []byte) bool {
+	_, rest, ok := bytes.Cut(head, []byte(" "))
+	return ok && len(rest) > 3 && rest[0] == '1' && !bytes.HasPrefix(rest, []byte("101"))
+}
+
+// dial returns a function opening connections with dial, whose reads are
+// recorded
+func (r *rawRecorder) dial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &recordingConn{Conn: conn, r: r}, nil
+	}
+}
+
+// recordingConn is a net.Conn whose reads are recorded by a rawRecorder
+type recordingConn struct {
+	net.Conn
+	r *rawRecorder
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.r.write(p[:n])
+	return n, err
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawRecorderHeaders(t *testing.T) {
+	var r rawRecorder
+	r.write([]byte("HTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\n"))
+	r.write([]byte("HTTP/1.1 200 OK\r\ncontent-length: 2\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\nok"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 2\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n", string(r.headers()))
+	assert.Equal(t, "ok", string(r.body()))
+
+	r.reset()
+	r.write([]byte("HTTP/1.1 200 OK\r\nX-Trunc"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nX-Trunc", string(r.headers()))
+	assert.Nil(t, r.body())
+
+	r.reset()
+	r.write(make([]byte, maxRawHeaders+10))
+	assert.Len(t, r.headers(), maxRawHeaders)
+}
+
+func TestParseRawHeaders(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "a" {
+    tx -url "/"
+    tx -url "/other"
+    expect resp[0].rawheaders ~ "\r\ncontent-length:"
+}`))
+	assert.Nil(t, err)
+	assert.True(t, p.Clients[0].Steps[0].Request.rawHeaders)
+	assert.False(t, p.Clients[0].Steps[1].Request.rawHeaders)
+
+	for _, input := range []string{
+		`client "a" {
+    tx -url "/" -tls
+    expect resp.rawheaders ~ "X-Fish"
+}`,
+		`client "a" {
+    tx -url "/" -grpc
+    expect resp.rawheaders ~ "X-Fish"
+}`,
+		`client "a" {
+    tx -url "/"
+}
+expect client["a"].resp.rawheaders ~ "X-Fish"`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestRunRawHeaders(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    tx -body "Hello" -header "X-Fish: nemo"
+}
+
+client "a" {
+    tx -url "/"
+    expect resp.rawheaders ~ "^HTTP/1.1 200 OK\r\n"
+    expect resp.rawheaders ~ "\r\nContent-Length: 5\r\n"
+    expect resp.rawheaders ~ "\r\nX-Fish: nemo\r\n"
+    expect resp.rawheaders ~ "\r\n\r\n$"
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+
+	report = runDirect(t, `handle "/" {
+    tx -body "Hello"
+}
+
+client "a" {
+    tx -url "/"
+    expect resp.rawheaders ~ "\r\ncontent-length:"
+}`)
+	assert.True(t, report.Failed())
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Record mode: a reverse proxy capturing live traffic and turning it into an
+// HTC program
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+// exchange is a request/response pair captured by the Recorder
+type exchange struct {
+	method      string
+	uri         string
+	path        string
+	reqHeaders  http.Header
+	reqBody     []byte
+	status      int
+	respHeaders http.Header
+	respBody    []byte
+}
+
+// skippedHeaders are not recorded, either because they are hop-by-hop or
+// because they are set automatically when replaying
+var skippedHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// Recorder is a reverse proxy recording all exchanges with the upstream
+// server, which can then be written out as an HTC program with WriteHTC
+type Recorder struct {
+	mu        sync.Mutex
+	exchanges []exchange
+	proxy     *httputil.ReverseProxy
+}
+
+func NewRecorder(upstream *url.URL) *Recorder {
+	return &Recorder{proxy: httputil.NewSingleHostReverseProxy(upstream)}
+}
+
+// captureWriter is an http.ResponseWriter keeping a copy of the status code
+// and body written through it
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// limit is how many bytes of the body are kept, all of them if zero. The
+	// recorder keeps whole bodies, written out in the HTC program
+	limit int
+	// err is the first error writing the body, eg: because the connection
+	// was closed
+	err error
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController flush the response, see streamBody
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.limit == 0 {
+		w.body.Write(b)
+	} else if keep := w.limit - w.body.Len(); keep > 0 {
+		w.body.Write(b[:min(keep, len(b))])
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	ex := exchange{
+		method:     req.Method,
+		uri:        req.URL.RequestURI(),
+		path:       req.URL.Path,
+		reqHeaders: cloneHeader(req.Header),
+		reqBody:    body,
+	}
+
+	cw := &captureWriter{ResponseWriter: w}
+	r.proxy.ServeHTTP(cw, req)
+
+	ex.status = cw.status
+	ex.respHeaders = cloneHeader(w.Header())
+	ex.respBody = cw.body.Bytes()
+
+	r.mu.Lock()
+	r.exchanges = append(r.exchanges, ex)
+	r.mu.Unlock()
+}
+
+// cloneHeader returns a deep copy of the given headers
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for name, values := range h {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// writeHeaders writes the given headers as '-header' arguments, sorted by name
+// for the sake of reproducibility
+func writeHeaders(w io.Writer, headers http.Header) {
+	var names []string
+	for name := range headers {
+		if !skippedHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, " -header %s", quote(fmt.Sprintf("%s: %s", name, headers.Get(name))))
+	}
+}
+
+// writeBody writes the given body as '-body' argument, or as '-body-base64' if
+// it is binary
+func writeBody(w io.Writer, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	if utf8.Valid(body) {
+		fmt.Fprintf(w, " -body %s", quote(string(body)))
+	} else {
+		fmt.Fprintf(w, " -body-base64 %s", quote(base64.StdEncoding.EncodeToString(body)))
+	}
+}
+
+// WriteHTC writes an HTC program reproducing the recorded exchanges: a handle
+// stanza for each method and path, returning the first response recorded for
+// them, and a client stanza for each request
+func (r *Recorder) WriteHTC(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.exchanges) == 0 {
+		return fmt.Errorf("No requests recorded")
+	}
+
+	fmt.Fprintln(w, "# Recorded by httptester")
+
+	handled := make(map[string]bool)
+	for _, ex := range r.exchanges {
+		key := ex.method + " " + ex.path
+		if handled[key] {
+			continue
+		}
+		handled[key] = true
+
+		fmt.Fprintf(w, "\nhandle %s -method %s {\n", quote(ex.path), quote(ex.method))
+		fmt.Fprintf(w, "    tx -status %d", ex.status)
+		writeHeaders(w, ex.respHeaders)
+		writeBody(w, ex.respBody)
+		fmt.Fprintln(w, "\n}")
+	}
+
+	for i, ex := range r.exchanges {
+		fmt.Fprintf(w, "\nclient \"client-%d\" {\n", i+1)
+		fmt.Fprintf(w, "    tx -url %s -method %s", quote(ex.uri), quote(ex.method))
+		writeHeaders(w, ex.reqHeaders)
+		writeBody(w, ex.reqBody)
+		fmt.Fprintf(w, "\n    expect resp.status eq %d\n", ex.status)
+		fmt.Fprintln(w, "}")
+	}
+
+	return nil
+}
+
+// runRecord implements the 'record' subcommand: proxy requests to the upstream
+// server until interrupted, then write the recorded HTC program
+func runRecord(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:8080", "address to listen on")
+	upstream := fs.String("upstream", "", "URL of the upstream server to record, eg: http://localhost:8000")
+	output := fs.String("o", "", "write the HTC program to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s record [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *upstream == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(*upstream)
+	if err != nil {
+		slog.Error("Recording failed", "err", err)
+		os.Exit(1)
+	}
+
+	recorder := NewRecorder(u)
+	server := &http.Server{Addr: *listen, Handler: recorder}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		server.Close()
+	}()
+
+	slog.Info("Recording requests, interrupt to stop", "upstream", *upstream, "listen", *listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		slog.Error("Recording failed", "err", err)
+		os.Exit(1)
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		w, err = os.Create(*output)
+		if err != nil {
+			slog.Error("Recording failed", "err", err)
+			os.Exit(1)
+		}
+		defer w.Close()
+	}
+
+	if err := recorder.WriteHTC(w); err != nil {
+		slog.Error("Recording failed", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureWriter(t *testing.T) {
+	// Bodies are kept whole unless limited, as for the origin
+	w := &captureWriter{ResponseWriter: httptest.NewRecorder()}
+	w.Write([]byte("Hello "))
+	w.Write([]byte("world!"))
+	assert.Equal(t, http.StatusOK, w.status)
+	assert.Equal(t, "Hello world!", w.body.String())
+
+	w = &captureWriter{ResponseWriter: httptest.NewRecorder(), limit: 8}
+	w.Write([]byte("Hello "))
+	w.Write([]byte("world!"))
+	assert.Equal(t, "Hello wo", w.body.String())
+}
+
+func TestRecorder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(201)
+		fmt.Fprintf(w, "Hello \"world\"!\n")
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	recorder := NewRecorder(u)
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	var buf bytes.Buffer
+	assert.Error(t, recorder.WriteHTC(&buf))
+
+	for _, uri := range []string{"/endpoint/1?a=b", "/endpoint/1", "/endpoint/2"} {
+		req, _ := http.NewRequest("POST", server.URL+uri, strings.NewReader("payload"))
+		req.Header.Set("X-Debug", "x-cache")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Nil(t, recorder.WriteHTC(&buf))
+	htc := buf.String()
+	assert.Contains(t, htc, `tx -status 201 -header "Cache-Control: max-age=60"`)
+	assert.Contains(t, htc, `-body "Hello \"world\"!\n"`)
+	assert.Contains(t, htc, `tx -url "/endpoint/1?a=b" -method "POST"`)
+	assert.Contains(t, htc, `-header "X-Debug: x-cache" -body "payload"`)
+
+	// The recorded program must be valid HTC
+	p, err := Parse(strings.NewReader(htc))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(p.Handlers))
+	assert.Equal(t, 3, len(p.Clients))
+}
+
+func TestRecorderMethods(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			w.WriteHeader(201)
+		}
+		fmt.Fprintf(w, "%s\n", req.Method)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	recorder := NewRecorder(u)
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	for _, method := range []string{"GET", "POST", "GET"} {
+		req, _ := http.NewRequest(method, server.URL+"/p", nil)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, recorder.WriteHTC(&buf))
+
+	// Replaying the program, each method gets its own response
+	report := runDirect(t, buf.String())
+	assert.False(t, report.Failed(), buf.String())
+	p, err := Parse(strings.NewReader(buf.String()))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Handlers, 2) {
+		assert.Equal(t, "GET", p.Handlers[0].Method)
+		assert.Equal(t, "POST", p.Handlers[1].Method)
+	}
+}
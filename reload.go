@@ -0,0 +1,106 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Configuration changes applied to the running proxy between clients, eg:
+//
+//	reload-proxy-config {
+//	    set "proxy.config.http.cache.http" "0"
+//	    file "remap.config" """
+//	map / http://${origin}
+//	"""
+//	}
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConfigReload are the changes made to the configuration of the proxy by a
+// reload-proxy-config stanza, before asking the proxy to reload it
+type ConfigReload struct {
+	// Records are the names and values of the records set, in order
+	Records [][2]string
+	// Files are the contents of the configuration files replaced, by name.
+	// ${origin} is replaced by the address of the origin
+	Files map[string]string
+}
+
+// parseReloadConfig parses the block following the reload-proxy-config
+// keyword
+func parseReloadConfig(s *scanner) (ConfigReload, error) {
+	r := ConfigReload{Files: make(map[string]string)}
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting '{', got %q", token)
+	}
+
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case NEWLINE:
+		case CLOSE_CURLY:
+			if len(r.Records) == 0 && len(r.Files) == 0 {
+				return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting at least one 'set' or 'file'")
+			}
+			return r, nil
+		case SET:
+			name := s.ScanUseful()
+			if name.typ != STRING || !strings.HasPrefix(name.val, "proxy.config.") {
+				return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting a record like \"proxy.config.http.cache.http\" after 'set', got %q", name)
+			}
+			value := s.ScanUseful()
+			if value.typ != STRING && value.typ != INTEGER {
+				return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting the value of %s, got %q", name.val, value)
+			}
+			r.Records = append(r.Records, [2]string{name.val, value.val})
+		case FILE:
+			name := s.ScanUseful()
+			if name.typ != STRING || name.val == "" || name.val == "." || name.val == ".." || strings.ContainsAny(name.val, "/\\") {
+				return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting the name of a file in the configuration directory after 'file', got %q", name)
+			}
+			contents := s.ScanUseful()
+			if contents.typ != STRING {
+				return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting the contents of %s, got %q", name.val, contents)
+			}
+			r.Files[name.val] = contents.val
+		default:
+			return r, fmt.Errorf("Parse error in 'reload-proxy-config' stanza: expecting 'set', 'file' or '}', got %q", token)
+		}
+	}
+}
+
+// reload writes the files and sets the records of the given changes, then
+// asks the proxy to reload its configuration. The new configuration is used
+// once the proxy is done reloading, which happens in the background
+func (p *Proxy) reload(r ConfigReload) error {
+	origin := fmt.Sprintf("localhost:%d", p.originPort)
+	for name, contents := range r.Files {
+		contents = strings.ReplaceAll(contents, "${origin}", origin)
+		if err := os.WriteFile(path.Join(p.tmpDir, "etc", name), []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+	for _, record := range r.Records {
+		if _, err := p.trafficCtl("config", "set", record[0], record[1]); err != nil {
+			return err
+		}
+	}
+	_, err := p.trafficCtl("config", "reload")
+	return err
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReloadConfig(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "before" {
+    tx -url "/"
+}
+
+reload-proxy-config {
+    set "proxy.config.http.cache.http" 0
+    set "proxy.config.http.insert_age_in_response" "1"
+    file "remap.config" """
+map / http://${origin}
+"""
+}
+
+client "after" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Nil(t, p.Clients[0].ReloadConfig)
+	assert.Equal(t, &ConfigReload{
+		Records: [][2]string{
+			{"proxy.config.http.cache.http", "0"},
+			{"proxy.config.http.insert_age_in_response", "1"},
+		},
+		Files: map[string]string{"remap.config": "map / http://${origin}\n"},
+	}, p.Clients[1].ReloadConfig)
+
+	for _, input := range []string{
+		`reload-proxy-config {
+}`,
+		`reload-proxy-config {
+    set "http.cache.http" "0"
+}`,
+		`reload-proxy-config {
+    set "proxy.config.http.cache.http"
+}`,
+		`reload-proxy-config {
+    file "../remap.config" "map / http://${origin}"
+}`,
+		`reload-proxy-config {
+    restart
+}`,
+		`reload-proxy-config {
+    set "proxy.config.http.cache.http" "0"
+}
+reload-proxy-config {
+    set "proxy.config.http.cache.http" "1"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.NotNil(t, err, input)
+	}
+
+	_, err = Parse(strings.NewReader(`client "a" {
+    tx -url "/"
+}
+reload-proxy-config {
+    set "proxy.config.http.cache.http" "0"
+}`))
+	assert.NotNil(t, err)
+}
+
+func TestProxyReload(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	p.tmpDir = t.TempDir()
+	for _, dir := range []string{"bin", "etc"} {
+		assert.Nil(t, os.MkdirAll(path.Join(p.tmpDir, dir), 0755))
+	}
+	// Fake traffic_ctl recording its arguments
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", path.Join(p.tmpDir, "args"))
+	assert.Nil(t, os.WriteFile(path.Join(p.tmpDir, "bin", "traffic_ctl"), []byte(script), 0755))
+
+	assert.Nil(t, p.reload(ConfigReload{
+		Records: [][2]string{{"proxy.config.http.cache.http", "0"}},
+		Files:   map[string]string{"remap.config": "map / http://${origin}\n"},
+	}))
+
+	remap, err := os.ReadFile(path.Join(p.tmpDir, "etc", "remap.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, "map / http://localhost:8000\n", string(remap))
+
+	runRoot := "--run-root=" + path.Join(p.tmpDir, "runroot.yaml")
+	args, err := os.ReadFile(path.Join(p.tmpDir, "args"))
+	assert.Nil(t, err)
+	assert.Equal(t, runRoot+" config set proxy.config.http.cache.http 0\n"+runRoot+" config reload\n", string(args))
+}
+
+func TestRunReloadConfig(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200
+}
+
+reload-proxy-config {
+    set "proxy.config.http.cache.http" "0"
+}
+
+client "a" {
+    tx -url "/"
+    expect resp.status eq 200
+}`
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+
+	// Without a proxy run by httptester, there is nothing to reload
+	_, err = run(t.Context(), p, NewOrigin(0), "127.0.0.1:1", nil)
+	assert.Error(t, err)
+
+	var reloaded []ConfigReload
+	report := runControlled(t, input, &fakeProxy{reloadFunc: func(r ConfigReload) error {
+		reloaded = append(reloaded, r)
+		return nil
+	}})
+	assert.False(t, report.Failed(), report.Clients)
+	assert.Equal(t, []ConfigReload{*p.Clients[0].ReloadConfig}, reloaded)
+}
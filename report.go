@@ -0,0 +1,406 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ANSI escape sequences used to color failures
+const (
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorBold  = "\033[1m"
+	colorReset = "\033[0m"
+)
+
+// Failure is an expectation that was not met
+type Failure struct {
+	// Context is where the expectation was evaluated, eg: handle "/"
+	Context string `json:"context,omitempty"`
+	// Expect is the expect command as written in the HTC program
+	Expect   string `json:"expect"`
+	Line     int    `json:"line,omitempty"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	// Subject, Operator and Value detail the expect command, eg:
+	// resp.status, eq and 200
+	Subject  string `json:"subject,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// Reason explains the failure when the actual value alone does not tell,
+	// see Evaluation.Reason
+	Reason string `json:"reason,omitempty"`
+	// Error is set when the expectation could not be evaluated, eg: because
+	// the proxy metric could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// newFailure returns the Failure of exp, evaluated in the given context
+func newFailure(context string, exp Expect, ev Evaluation) Failure {
+	f := Failure{
+		Context:  context,
+		Expect:   "expect " + exp.verbatim,
+		Line:     exp.pos.line,
+		Expected: exp.condition(),
+		Actual:   fmt.Sprintf("%q", ev.Actual),
+		Subject:  ev.Subject,
+		Operator: ev.Operator,
+		Value:    ev.Expected,
+		Reason:   ev.Reason,
+	}
+	if ev.Err != nil {
+		f.Actual, f.Error = "", ev.Err.Error()
+	}
+	return f
+}
+
+// Fprint writes the failure in diff style: the expected condition is shown
+// as removed, the actual value as added. file is used to point to the failing
+// expect command
+func (f Failure) Fprint(w io.Writer, file string, color bool) {
+	red, green, bold, reset := colorRed, colorGreen, colorBold, colorReset
+	if !color {
+		red, green, bold, reset = "", "", "", ""
+	}
+
+	where := file
+	if f.Line > 0 {
+		where = fmt.Sprintf("%s:%d", file, f.Line)
+	}
+	if f.Context != "" {
+		where += " (" + f.Context + ")"
+	}
+
+	fmt.Fprintf(w, "%s--- FAILED %s%s\n", bold, where, reset)
+	fmt.Fprintf(w, "    %s\n", f.Expect)
+	fmt.Fprintf(w, "%s-   expected: %s%s\n", red, f.Expected, reset)
+	if f.Error != "" {
+		fmt.Fprintf(w, "%s+   error:    %s%s\n", green, f.Error, reset)
+	} else {
+		fmt.Fprintf(w, "%s+   actual:   %s%s\n", green, f.Actual, reset)
+	}
+	if f.Reason != "" {
+		fmt.Fprintf(w, "    reason:   %s\n", f.Reason)
+	}
+}
+
+// Result is the outcome of an expectation, met or not, along with how long it
+// took to evaluate it. Retries are included for expectations using 'within'
+type Result struct {
+	Expect   string        `json:"expect"`
+	Line     int           `json:"line,omitempty"`
+	Passed   bool          `json:"passed"`
+	Duration time.Duration `json:"duration"`
+	// Submatches is set by passing expectations using ~, see
+	// Evaluation.Submatches
+	Submatches []string `json:"submatches,omitempty"`
+}
+
+// newResult returns the Result of exp, evaluated since start
+func newResult(exp Expect, ev Evaluation, start time.Time) Result {
+	return Result{
+		Expect:     "expect " + exp.verbatim,
+		Line:       exp.pos.line,
+		Passed:     ev.Passed,
+		Duration:   time.Since(start),
+		Submatches: ev.Submatches,
+	}
+}
+
+// indentLines prefixes every line of s with the given indentation
+func indentLines(s, indent string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return indent + strings.Join(lines, "\n"+indent) + "\n"
+}
+
+// ClientReport is the outcome of a client stanza. It holds both the failures
+// detected by the client when checking the response, and those detected by
+// the origin when handling the request sent by the client
+type ClientReport struct {
+	Name           string    `json:"name"`
+	RequestID      string    `json:"request_id"`
+	Request        string    `json:"request"`
+	Response       string    `json:"response,omitempty"`
+	ClientFailures []Failure `json:"client_failures,omitempty"`
+	OriginFailures []Failure `json:"origin_failures,omitempty"`
+	// OriginHits are the handlers hit by the requests of the client, in
+	// order, as told by its request ID. Unknown if the client sent none, see
+	// -no-request-id
+	OriginHits []string `json:"origin_hits,omitempty"`
+	// Duration is how long it took to send the requests and receive the
+	// responses of all steps, bursts included
+	Duration time.Duration `json:"duration"`
+	// Results holds the outcome of all expectations of the client
+	Results []Result `json:"results,omitempty"`
+
+	// capture is the exchange between the client and the proxy
+	capture capture
+}
+
+// Failed returns true if any expectation of the client, or of the handler
+// that served its request, was not met
+func (c ClientReport) Failed() bool {
+	return len(c.ClientFailures) > 0 || len(c.OriginFailures) > 0
+}
+
+// Report is the outcome of running a whole HTC program
+type Report struct {
+	File    string         `json:"file"`
+	Clients []ClientReport `json:"clients"`
+	// OriginFailures holds the failures detected by the origin for requests
+	// that cannot be associated with any client
+	OriginFailures []Failure `json:"origin_failures,omitempty"`
+	// Failures holds the failures of expectations evaluated once all clients
+	// are done, such as those about origin hits
+	Failures []Failure `json:"failures,omitempty"`
+	// Results holds the outcome of all expectations evaluated once all
+	// clients are done
+	Results []Result `json:"results,omitempty"`
+	// Error is set when the run could not complete, for instance because of
+	// parse errors
+	Error string `json:"error,omitempty"`
+	// Skipped is the skip-if or only-if directive which prevented the
+	// program from running, if any
+	Skipped string `json:"skipped,omitempty"`
+	// Seed is the seed of the random requests sent, if any, see -seed
+	Seed int64 `json:"seed,omitempty"`
+
+	// originCaptures are the exchanges between the proxy and the origin, by
+	// request ID
+	originCaptures map[string][]capture
+}
+
+// NewReport builds a Report out of the given client reports, pairing them
+// with the failures detected by the origin
+func NewReport(clients []ClientReport, originFailures map[string][]Failure) Report {
+	var r Report
+
+	seen := make(map[string]bool)
+	for _, c := range clients {
+		if c.RequestID != "" {
+			c.OriginFailures = append(c.OriginFailures, originFailures[c.RequestID]...)
+			seen[c.RequestID] = true
+		}
+		r.Clients = append(r.Clients, c)
+	}
+
+	// Sorted by request ID, so that reports of the same run compare equal
+	for _, id := range slices.Sorted(maps.Keys(originFailures)) {
+		if !seen[id] {
+			r.OriginFailures = append(r.OriginFailures, originFailures[id]...)
+		}
+	}
+
+	return r
+}
+
+// Failed returns true if any expectation was not met, or if the run could not
+// complete
+func (r Report) Failed() bool {
+	if r.Error != "" || len(r.OriginFailures) > 0 || len(r.Failures) > 0 {
+		return true
+	}
+	for _, c := range r.Clients {
+		if c.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// useColor returns true if failures written to stderr should be colored: it
+// must be a terminal and NO_COLOR must not be set
+func useColor() bool {
+	if *noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Print writes all failures to stderr, see Fprint
+func (r Report) Print() {
+	r.Fprint(os.Stderr, useColor())
+}
+
+// Fprint writes all failures to w, grouped by the client that triggered them
+// and along with the request sent and the response received
+func (r Report) Fprint(w io.Writer, color bool) {
+	if r.Error != "" {
+		fmt.Fprintf(w, "%s: %s\n", r.File, r.Error)
+	}
+
+	for _, c := range r.Clients {
+		if !c.Failed() {
+			continue
+		}
+
+		if c.RequestID == "" {
+			fmt.Fprintf(w, "Client %q:\n", c.Name)
+		} else {
+			fmt.Fprintf(w, "Client %q (request id %s):\n", c.Name, c.RequestID)
+		}
+		fmt.Fprint(w, indentLines(c.Request, "  > "))
+		if len(c.ClientFailures) > 0 {
+			fmt.Fprint(w, indentLines(c.Response, "  < "))
+		}
+		if c.RequestID != "" {
+			fmt.Fprintf(w, "  origin hits: %s\n", c.originHits())
+		}
+		for _, f := range c.ClientFailures {
+			f.Fprint(w, r.File, color)
+		}
+		for _, f := range c.OriginFailures {
+			f.Fprint(w, r.File, color)
+		}
+	}
+
+	for _, f := range r.OriginFailures {
+		f.Fprint(w, r.File, color)
+	}
+
+	for _, f := range r.Failures {
+		f.Fprint(w, r.File, color)
+	}
+}
+
+// originHits describes the handlers hit by the request of the client, eg:
+// "/endpoint/1" (2 times)
+func (c ClientReport) originHits() string {
+	if len(c.OriginHits) == 0 {
+		return "none, the request did not reach the origin"
+	}
+
+	var hits []string
+	count := make(map[string]int)
+	for _, path := range c.OriginHits {
+		if count[path] == 0 {
+			hits = append(hits, path)
+		}
+		count[path]++
+	}
+	for i, path := range hits {
+		hits[i] = fmt.Sprintf("%q", path)
+		if count[path] > 1 {
+			hits[i] += fmt.Sprintf(" (%d times)", count[path])
+		}
+	}
+	return strings.Join(hits, ", ")
+}
+
+// requestLine returns the first line of the request sent by the client, eg:
+// GET /endpoint/1
+func (c ClientReport) requestLine() string {
+	return strings.SplitN(c.Request, "\n", 2)[0]
+}
+
+// Summary writes a table with the outcome and duration of each request and
+// expectation, including those of handle stanzas that failed, followed by the
+// number of expectations met and not met
+func (r Report) Summary(w io.Writer) {
+	if r.Skipped != "" {
+		fmt.Fprintf(w, "%s skipped (%s)\n", r.File, r.Skipped)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tREQUEST/EXPECTATION\tRESULT\tTIME")
+
+	passed, failed := 0, 0
+	row := func(client string, res Result) {
+		outcome := "PASS"
+		if res.Passed {
+			passed++
+		} else {
+			outcome = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t  %s\t%s\t%s\n", client, res.Expect, outcome, res.Duration.Round(time.Microsecond))
+	}
+	// Failures detected by the origin are not timed, and are preceded by
+	// the handle stanza detecting them
+	originRow := func(client string, f Failure) {
+		failed++
+		expect := f.Expect
+		if f.Context != "" {
+			expect = f.Context + ": " + expect
+		}
+		fmt.Fprintf(tw, "%s\t  %s\tFAIL\t\n", client, expect)
+	}
+
+	for _, c := range r.Clients {
+		fmt.Fprintf(tw, "%s\t%s\t\t%s\n", c.Name, c.requestLine(), c.Duration.Round(time.Microsecond))
+		for _, res := range c.Results {
+			row(c.Name, res)
+		}
+		for _, f := range c.OriginFailures {
+			originRow(c.Name, f)
+		}
+	}
+	for _, res := range r.Results {
+		row("-", res)
+	}
+	for _, f := range r.OriginFailures {
+		originRow("-", f)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d passed, %d failed\n", passed, failed)
+	if r.Seed != 0 {
+		fmt.Fprintf(w, "seed %d, run with -seed %d to reproduce\n", r.Seed, r.Seed)
+	}
+}
+
+// notification is the JSON document POSTed to the URL given with -notify-url
+type notification struct {
+	Passed bool   `json:"passed"`
+	Report Report `json:"report"`
+}
+
+// notifyTimeout is how long webhooks are given to respond, so that the run
+// ends and the proxy is stopped even if they hang
+var notifyTimeout = 10 * time.Second
+
+// Notify POSTs the report as JSON to the given webhook URL
+func (r Report) Notify(url string) error {
+	body, err := json.Marshal(notification{Passed: !r.Failed(), Report: r})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status code received from webhook %s: %d", url, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReport(t *testing.T) {
+	clients := []ClientReport{
+		{Name: "nemo", RequestID: "nemo-0"},
+		{Name: "dory", RequestID: "dory-1"},
+	}
+	originFailures := map[string][]Failure{
+		"dory-1": {{Expect: `expect req.method eq "POST"`}},
+		"":       {{Expect: "unknown request"}},
+	}
+
+	r := NewReport(clients, originFailures)
+	assert.True(t, r.Failed())
+	assert.False(t, r.Clients[0].Failed())
+	assert.True(t, r.Clients[1].Failed())
+	assert.Equal(t, 1, len(r.Clients[1].OriginFailures))
+	assert.Equal(t, []Failure{{Expect: "unknown request"}}, r.OriginFailures)
+
+	r = NewReport(clients[:1], map[string][]Failure{})
+	assert.False(t, r.Failed())
+}
+
+func TestReportNotify(t *testing.T) {
+	var received notification
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	r := Report{
+		File:    "simple.htc",
+		Clients: []ClientReport{{Name: "nemo", RequestID: "nemo-0", ClientFailures: []Failure{{Expect: "FAILED"}}}},
+	}
+	assert.Nil(t, r.Notify(server.URL))
+	assert.False(t, received.Passed)
+	assert.Equal(t, "simple.htc", received.Report.File)
+	assert.Equal(t, "nemo", received.Report.Clients[0].Name)
+
+	server.Config.Handler = http.NotFoundHandler()
+	assert.Error(t, r.Notify(server.URL))
+
+	// Webhooks not responding in time fail
+	defer func(d time.Duration) { notifyTimeout = d }(notifyTimeout)
+	notifyTimeout = 10 * time.Millisecond
+	hang := make(chan struct{})
+	defer close(hang)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	})
+	assert.Error(t, r.Notify(server.URL))
+}
+
+func TestReportFprint(t *testing.T) {
+	r := Report{
+		File: "simple.htc",
+		Clients: []ClientReport{{
+			Name:       "nemo",
+			RequestID:  "nemo-0",
+			Request:    "GET /endpoint/1 HTTP/1.1\nHost: localhost\n",
+			Response:   "HTTP 404\nContent-Length: 0\n",
+			OriginHits: []string{"/endpoint/1"},
+			ClientFailures: []Failure{{
+				Expect:   `expect resp.status eq 200`,
+				Line:     9,
+				Expected: `eq "200"`,
+				Actual:   `"404"`,
+			}},
+		}},
+		Failures: []Failure{{
+			Expect:   `expect origin["/endpoint/1"].hits eq 2`,
+			Line:     12,
+			Expected: `eq "2"`,
+			Actual:   `"1"`,
+		}},
+	}
+
+	var out bytes.Buffer
+	r.Fprint(&out, false)
+	assert.Equal(t, `Client "nemo" (request id nemo-0):
+  > GET /endpoint/1 HTTP/1.1
+  > Host: localhost
+  < HTTP 404
+  < Content-Length: 0
+  origin hits: "/endpoint/1"
+--- FAILED simple.htc:9
+    expect resp.status eq 200
+-   expected: eq "200"
++   actual:   "404"
+--- FAILED simple.htc:12
+    expect origin["/endpoint/1"].hits eq 2
+-   expected: eq "2"
++   actual:   "1"
+`, out.String())
+
+	out.Reset()
+	r.Fprint(&out, true)
+	assert.Contains(t, out.String(), colorRed+`-   expected: eq "200"`+colorReset)
+	assert.Contains(t, out.String(), colorGreen+`+   actual:   "404"`+colorReset)
+}
+
+func TestReportOriginHits(t *testing.T) {
+	failed := []Failure{{Expect: "FAILED"}}
+	r := Report{
+		Clients: []ClientReport{
+			{Name: "nemo", RequestID: "nemo-0", OriginHits: []string{"/", "/retry", "/retry"}, ClientFailures: failed},
+			{Name: "dory", RequestID: "dory-1", ClientFailures: failed},
+			{Name: "marlin", ClientFailures: failed},
+		},
+	}
+
+	var out bytes.Buffer
+	r.Fprint(&out, false)
+	assert.Contains(t, out.String(), `Client "nemo" (request id nemo-0):`)
+	assert.Contains(t, out.String(), `  origin hits: "/", "/retry" (2 times)`)
+	assert.Contains(t, out.String(), "  origin hits: none, the request did not reach the origin\n")
+	assert.Contains(t, out.String(), "Client \"marlin\":\n")
+	assert.Equal(t, 2, strings.Count(out.String(), "origin hits"))
+}
+
+// Origin failures of requests sent without ID are not blamed on clients
+// sending none
+func TestNewReportNoRequestID(t *testing.T) {
+	r := NewReport([]ClientReport{{Name: "nemo"}}, map[string][]Failure{"": {{Expect: "FAILED"}}})
+	assert.Empty(t, r.Clients[0].OriginFailures)
+	assert.Len(t, r.OriginFailures, 1)
+
+	// Failures of unknown requests are sorted by request ID
+	originFailures := map[string][]Failure{
+		"dory-1":   {{Line: 1}, {Line: 2}},
+		"":         {{Line: 3}},
+		"marlin-2": {{Line: 4}},
+		"bruce-3":  {{Line: 5}},
+	}
+	for range 10 {
+		r = NewReport(nil, originFailures)
+		assert.Equal(t, []Failure{{Line: 3}, {Line: 5}, {Line: 1}, {Line: 2}, {Line: 4}}, r.OriginFailures)
+	}
+}
+
+func TestFailureError(t *testing.T) {
+	exp := Expect{verbatim: `proxy.metric[proxy.process.http.cache_hit_fresh] gt 0`, operator: GREATER, expected: "0"}
+	f := newFailure("", exp, exp.evaluate("", fmt.Errorf("proxy metrics are not available")))
+	assert.Equal(t, "", f.Actual)
+	assert.Equal(t, "proxy metrics are not available", f.Error)
+
+	var out bytes.Buffer
+	f.Fprint(&out, "metric.htc", false)
+	assert.Contains(t, out.String(), "+   error:    proxy metrics are not available\n")
+	assert.NotContains(t, out.String(), "actual:")
+}
+
+func TestReportSummary(t *testing.T) {
+	r := Report{
+		Clients: []ClientReport{{
+			Name:     "nemo",
+			Request:  "GET /endpoint/1\nHost: localhost\n",
+			Duration: 1500 * time.Microsecond,
+			Results: []Result{
+				{Expect: `expect resp.status eq "200"`, Passed: true, Duration: 2 * time.Microsecond},
+				{Expect: `expect resp.body eq "Hello"`, Duration: 3 * time.Microsecond},
+			},
+		}},
+		Results: []Result{{Expect: `expect origin[/endpoint/1].hits eq "1"`, Passed: true, Duration: time.Microsecond}},
+	}
+
+	var out bytes.Buffer
+	r.Summary(&out)
+	assert.Equal(t, `CLIENT  REQUEST/EXPECTATION                       RESULT  TIME
+nemo    GET /endpoint/1                                   1.5ms
+nemo      expect resp.status eq "200"             PASS    2µs
+nemo      expect resp.body eq "Hello"             FAIL    3µs
+-         expect origin[/endpoint/1].hits eq "1"  PASS    1µs
+2 passed, 1 failed
+`, out.String())
+
+	r.Seed = 42
+	out.Reset()
+	r.Summary(&out)
+	assert.True(t, strings.HasSuffix(out.String(), "2 passed, 1 failed\nseed 42, run with -seed 42 to reproduce\n"), out.String())
+}
+
+func TestReportSummaryOriginFailures(t *testing.T) {
+	r := runDirect(t, `
+handle "/endpoint/1" {
+    expect req.method eq "POST"
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+    expect resp.status eq 200
+}`)
+	assert.True(t, r.Failed())
+
+	var out bytes.Buffer
+	r.Summary(&out)
+	assert.Regexp(t, `\nnemo +handle "/endpoint/1": expect req.method eq "POST" +FAIL *\n`, out.String())
+	assert.True(t, strings.HasSuffix(out.String(), "1 passed, 1 failed\n"), out.String())
+
+	r.Clients[0].OriginFailures, r.OriginFailures = nil, r.Clients[0].OriginFailures
+	out.Reset()
+	r.Summary(&out)
+	assert.Regexp(t, `\n- +handle "/endpoint/1": expect req.method eq "POST" +FAIL *\n`, out.String())
+}
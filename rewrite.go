@@ -0,0 +1,96 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Testing header_rewrite rules next to the requests exercising them, eg:
+//
+//	header-rewrite "cache-status" """
+//	cond %{SEND_RESPONSE_HDR_HOOK}
+//	set-header X-Cache-Status "%{CACHE}"
+//	""" {
+//	    tx -url "/"
+//	    expect resp.headers["X-Cache-Status"] ne ""
+//	}
+//
+// installs the rule in the proxy, then runs the block as a client stanza.
+// Each rule is only applied to the requests of its own block, sent for a
+// virtual host of their own
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HeaderRewrite is a rule of the header_rewrite plugin, applied by the proxy
+// to the requests for Host, which are those of its header-rewrite stanza
+type HeaderRewrite struct {
+	Host string
+	Rule string
+}
+
+// config returns the name of the configuration file holding the rule
+func (r HeaderRewrite) config() string {
+	return r.Host + ".config"
+}
+
+// parseHeaderRewrite parses a header-rewrite stanza: the name of the client,
+// the rule, and the block of the client sending the requests checking it.
+// Those are sent for host, the virtual host the rule applies to
+func parseHeaderRewrite(s *scanner, host string) (ClientStanza, HeaderRewrite, error) {
+	var c ClientStanza
+	r := HeaderRewrite{Host: host}
+
+	token := s.ScanUseful()
+	if token.typ != STRING {
+		return c, r, fmt.Errorf("Parse error in 'header-rewrite' stanza: expecting a name for the client, got %q", token)
+	}
+	c.Name = token.val
+
+	rule := s.ScanUseful()
+	if rule.typ != STRING || strings.TrimSpace(rule.val) == "" {
+		return c, r, fmt.Errorf("Parse error in 'header-rewrite' stanza: expecting the header_rewrite rule, got %q", rule)
+	}
+	r.Rule = strings.TrimSpace(rule.val) + "\n"
+
+	c, err := parseClientBlock(s, c)
+	if err != nil {
+		return c, r, err
+	}
+	for i := range c.Steps {
+		req := &c.Steps[i].Request
+		if req.host != "" || req.absolute() {
+			return c, r, fmt.Errorf("Parse error in 'header-rewrite' stanza: -host, -forward and -tunnel cannot be used, the requests being sent for the host the rule applies to")
+		}
+		req.host = host
+	}
+	return c, r, nil
+}
+
+// headerRewriteRemap returns the lines of remap.config applying the rules to
+// the requests for their hosts only, forwarded to the origin like those of
+// the other virtual hosts
+func (p Proxy) headerRewriteRemap() string {
+	var config string
+	for _, r := range p.headerRewrite {
+		schemes := []string{"http"}
+		if p.tlsPort > 0 {
+			schemes = append(schemes, "https")
+		}
+		for _, scheme := range schemes {
+			config += fmt.Sprintf("map %s://%s/ http://localhost:%d/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1 @plugin=header_rewrite.so @pparam=%s\n", scheme, r.Host, p.originPort, r.config())
+		}
+	}
+	return config
+}
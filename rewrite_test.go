@@ -0,0 +1,96 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeaderRewrite(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/" {
+    tx -status 200
+}
+
+header-rewrite "cache-status" """
+cond %{SEND_RESPONSE_HDR_HOOK}
+set-header X-Cache-Status "%{CACHE}"
+""" {
+    tx -url "/"
+    expect resp.headers["X-Cache-Status"] ne ""
+}
+
+client "plain" {
+    tx -url "/"
+}
+
+header-rewrite "origin" """
+cond %{SEND_REQUEST_HDR_HOOK}
+rm-header Cookie
+""" {
+    tx -url "/" -header "Cookie: a=1"
+}
+
+expect origin["/"].request[1].headers["Cookie"] eq ""`))
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderRewrite{
+		{"header-rewrite-1", "cond %{SEND_RESPONSE_HDR_HOOK}\nset-header X-Cache-Status \"%{CACHE}\"\n"},
+		{"header-rewrite-2", "cond %{SEND_REQUEST_HDR_HOOK}\nrm-header Cookie\n"},
+	}, p.HeaderRewrite)
+	// The blocks are clients like the others, sending their requests for the
+	// host of their rule
+	if assert.Len(t, p.Clients, 3) {
+		assert.Equal(t, "cache-status", p.Clients[0].Name)
+		assert.Len(t, p.Clients[0].Steps[0].Expectations, 1)
+		assert.Equal(t, "header-rewrite-1", p.Clients[0].Steps[0].Request.host)
+		assert.Equal(t, "", p.Clients[1].Steps[0].Request.host)
+		assert.Equal(t, "origin", p.Clients[2].Name)
+		assert.Equal(t, "header-rewrite-2", p.Clients[2].Steps[0].Request.host)
+	}
+
+	for _, input := range []string{
+		`header-rewrite "a" {
+    tx -url "/"
+}`,
+		`header-rewrite "a" "" {
+    tx -url "/"
+}`,
+		`header-rewrite "cond %{SEND_RESPONSE_HDR_HOOK}" {
+    tx -url "/"
+}`,
+		`header-rewrite "a" "cond %{SEND_RESPONSE_HDR_HOOK}"`,
+		`header-rewrite "a" "cond %{SEND_RESPONSE_HDR_HOOK}" {
+    tx -url "/" -host "www.example.org"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestHeaderRewriteRemap(t *testing.T) {
+	p := NewProxy(8080, 8000, nil)
+	p.headerRewrite = []HeaderRewrite{{"header-rewrite-1", "cond %{SEND_RESPONSE_HDR_HOOK}\nrm-header Server\n"}}
+	assert.Equal(t, `map http://header-rewrite-1/ http://localhost:8000/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1 @plugin=header_rewrite.so @pparam=header-rewrite-1.config
+map / http://localhost:8000
+`, p.remapConfig())
+
+	p.tlsPort = 8443
+	assert.Equal(t, `map http://header-rewrite-1/ http://localhost:8000/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1 @plugin=header_rewrite.so @pparam=header-rewrite-1.config
+map https://header-rewrite-1/ http://localhost:8000/ @plugin=conf_remap.so @pparam=proxy.config.url_remap.pristine_host_hdr=1 @plugin=header_rewrite.so @pparam=header-rewrite-1.config
+`, p.headerRewriteRemap())
+}
@@ -0,0 +1,562 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"time"
+)
+
+// programContext returns a context expiring after the timeout set by the
+// given program, if any
+func programContext(ctx context.Context, p Program) (context.Context, context.CancelFunc) {
+	if p.Timeout > 0 {
+		return context.WithTimeout(ctx, p.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// timeoutError returns an error explaining what was being done when ctx
+// expired, or err if ctx did not expire
+func timeoutError(ctx context.Context, err error, format string, a ...interface{}) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timeout exceeded "+format, a...)
+	}
+	return err
+}
+
+// timeoutFailure returns the failure of a client not receiving a response
+// within the time set with -timeout
+func (r TxReq) timeoutFailure() Failure {
+	return Failure{
+		Expect:   fmt.Sprintf("tx -timeout %q", r.timeout),
+		Line:     r.timeoutPos.line,
+		Expected: fmt.Sprintf("a response within %s", r.timeout),
+		Actual:   "timeout",
+	}
+}
+
+// timedOut records that the client did not receive a response to req within
+// the time set with -timeout, waiting since start
+func (c *ClientReport) timedOut(req TxReq, start time.Time) {
+	f := req.timeoutFailure()
+	c.ClientFailures = append(c.ClientFailures, f)
+	c.Results = append(c.Results, Result{Expect: f.Expect, Line: f.Line, Duration: time.Since(start)})
+}
+
+// retryInterval is how long to wait before sending a request again when an
+// expectation using 'within' is not met
+const retryInterval = 100 * time.Millisecond
+
+// retry sends req to addr again until exp is met or exp.within elapses,
+// starting from the given response. The last response received is returned,
+// and later expectations of the client are checked against it
+func retry(ctx context.Context, req TxReq, addr string, exp Expect, resp *ClientResponse) (*ClientResponse, error) {
+	deadline := time.Now().Add(exp.within)
+
+	for {
+		if ev := exp.Response(*resp); ev.Passed || ev.Err != nil {
+			break
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		if wait > retryInterval {
+			wait = retryInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		slog.Debug("Retrying", "expect", exp.String())
+
+		next, err := req.Send(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		next.requests += resp.requests
+		next.retries = resp.retries + 1
+		resp = next
+	}
+
+	return resp, nil
+}
+
+// sendBurst sends req, the request of the given client, cs.Burst times,
+// evenly spread over cs.BurstWithin. The last response is returned, counting
+// the responses received for each status code
+func sendBurst(ctx context.Context, cs ClientStanza, req TxReq, addr string) (*ClientResponse, error) {
+	start := time.Now()
+	statuses := make(map[int]int)
+	requests := 0
+
+	var resp *ClientResponse
+	for i := 0; i < cs.Burst; i++ {
+		next := start.Add(cs.BurstWithin * time.Duration(i) / time.Duration(cs.Burst))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+
+		var err error
+		if resp, err = req.Send(ctx, addr); err != nil {
+			return nil, err
+		}
+		statuses[resp.StatusCode]++
+		requests += resp.requests
+	}
+
+	resp.statuses, resp.requests = statuses, requests
+	return resp, nil
+}
+
+// restart restarts the proxy if the given client was preceded by
+// restart-proxy, then reloads its configuration if the client was preceded by
+// reload-proxy-config
+func restart(ctx context.Context, cs ClientStanza, proxy proxyControl) error {
+	if cs.RestartProxy {
+		if proxy == nil {
+			return fmt.Errorf("the proxy cannot be restarted before client %q, it is not run by httptester", cs.Name)
+		}
+		slog.Debug("Restarting the proxy", "client", cs.Name)
+		if err := proxy.restart(ctx); err != nil {
+			return timeoutError(ctx, fmt.Errorf("restarting the proxy before client %q failed: %s", cs.Name, err), "while restarting the proxy before client %q", cs.Name)
+		}
+	}
+
+	if cs.ReloadConfig != nil {
+		if proxy == nil {
+			return fmt.Errorf("the configuration of the proxy cannot be reloaded before client %q, it is not run by httptester", cs.Name)
+		}
+		slog.Debug("Reloading the configuration of the proxy", "client", cs.Name)
+		if err := proxy.reload(*cs.ReloadConfig); err != nil {
+			return fmt.Errorf("reloading the configuration of the proxy before client %q failed: %s", cs.Name, err)
+		}
+	}
+	return nil
+}
+
+// requestID returns the ID of the requests of the i-th client of a program,
+// empty if the client sends them without ID
+func requestID(cs ClientStanza, i int) string {
+	for _, step := range cs.Steps {
+		if !step.Request.noRequestID {
+			return fmt.Sprintf("%s-%d", cs.Name, i)
+		}
+	}
+	return ""
+}
+
+// runClient sends the requests of cs, the i-th client of p, to the proxy
+// listening on addr, controlled with proxy, and checks the expectations about the responses, some of
+// which need what origin saw. The report of the client is returned, along
+// with its last response if any. The returned error is non-nil if the client
+// could not complete
+func runClient(ctx context.Context, p Program, i int, cs ClientStanza, sc *scope, rng *rand.Rand, origin *Origin, addr string, proxy proxyControl) (ClientReport, *ClientResponse, error) {
+	// All requests of the client share its request ID and cookie jar
+	cr := ClientReport{Name: cs.Name, RequestID: requestID(cs, i)}
+	var jar http.CookieJar
+	if cs.Cookies {
+		jar, _ = cookiejar.New(nil)
+	}
+	span := tracer.start("client "+cs.Name, spanKindClient, nil)
+	if span != nil {
+		span.setAttr("http.request.method", cs.Steps[0].Request.method)
+		span.setAttr("url.full", cs.Steps[0].Request.uri)
+		span.setAttr("httptester.request_id", cr.RequestID)
+	}
+
+	// done returns the outcome of the client, and its last response if
+	// any
+	var resp *ClientResponse
+	done := func() (ClientReport, *ClientResponse, error) {
+		if cr.Failed() {
+			span.fail()
+		}
+		span.finish()
+		return cr, resp, nil
+	}
+
+	// responses and prepared hold the last response to each step so
+	// far, and the request sent
+	var responses []*ClientResponse
+	var prepared []TxReq
+
+	// prepare returns the request of the given step, ready to be sent.
+	// References are expanded right before sending, so that they can
+	// refer to values captured and responses received by the previous
+	// steps
+	prepare := func(step ClientStep) TxReq {
+		req := step.Request.expand(sc.with(responses))
+		if req.signing != nil {
+			req.uri = req.signing.sign(req.uri, time.Now())
+		}
+		req.jar = jar
+		if !req.noRequestID {
+			req.headers[requestIDHeader] = cr.RequestID
+		}
+		if span != nil {
+			req.headers[traceparentHeader] = span.traceparent()
+		}
+		return req
+	}
+
+	if cs.Fuzz > 0 {
+		var err error
+		start := time.Now()
+		req := prepare(cs.Steps[0])
+		cr.Request = req.String()
+		server, err := req.server(addr, proxy)
+		if err != nil {
+			return cr, nil, err
+		}
+		if cr.ClientFailures, err = fuzz(ctx, newFuzzer(rng, p.Handlers), cs, req, server); err != nil {
+			return cr, nil, timeoutError(ctx, err, "while fuzzing client %q", cs.Name)
+		}
+		cr.Duration = time.Since(start)
+		cr.Results = append(cr.Results, Result{
+			Expect:   fmt.Sprintf("fuzz %d", cs.Fuzz),
+			Line:     cs.fuzzPos.line,
+			Passed:   len(cr.ClientFailures) == 0,
+			Duration: cr.Duration,
+		})
+		return done()
+	}
+
+	// Pipelined requests are all sent before the first response is
+	// read, and their responses checked in order below
+	var pipelined []*ClientResponse
+	if cs.Pipeline {
+		var reqs []TxReq
+		for _, step := range cs.Steps {
+			reqs = append(reqs, prepare(step))
+		}
+		var err error
+		start := time.Now()
+		pipelined, err = sendPipeline(ctx, reqs, addr)
+		cr.Duration = time.Since(start)
+		if err == errClientTimeout {
+			cr.Request = reqs[0].String()
+			cr.timedOut(longestTimeout(reqs), start)
+			return done()
+		}
+		if err != nil {
+			return cr, nil, timeoutError(ctx, err, "while sending the requests of client %q", cs.Name)
+		}
+	}
+
+	for i, step := range cs.Steps {
+		req := prepare(step)
+		prepared = append(prepared, req)
+		// The request shown in the report is that of the first failing
+		// step, if any
+		if !cr.Failed() {
+			cr.Request = req.String()
+		}
+
+		if step.Wait > 0 {
+			slog.Debug("Waiting before sending the request", "client", cs.Name, "duration", step.Wait)
+			select {
+			case <-ctx.Done():
+				return cr, nil, timeoutError(ctx, ctx.Err(), "while client %q was waiting", cs.Name)
+			case <-time.After(step.Wait):
+			}
+		}
+
+		if step.RotateCert {
+			if proxy == nil {
+				return cr, nil, fmt.Errorf("client %q cannot rotate the certificate, the proxy is not run by httptester", cs.Name)
+			}
+			slog.Debug("Rotating the certificate of the proxy", "client", cs.Name)
+			if err := proxy.rotateCert(); err != nil {
+				return cr, nil, fmt.Errorf("client %q failed to rotate the certificate: %s", cs.Name, err)
+			}
+		}
+
+		server, err := req.server(addr, proxy)
+		if err != nil {
+			return cr, nil, err
+		}
+		start := time.Now()
+		if pipelined != nil {
+			resp = pipelined[i]
+		} else if cs.Burst > 0 {
+			resp, err = sendBurst(ctx, cs, req, server)
+		} else if resp, err = req.Send(ctx, server); err == nil {
+			resp.originLastChunk = origin.streams.take(cr.RequestID)
+			resp.originSent = origin.sent.take(cr.RequestID)
+		}
+		cr.Duration += time.Since(start)
+
+		if err == errClientTimeout {
+			cr.timedOut(req, start)
+			break
+		}
+		if err != nil {
+			return cr, nil, timeoutError(ctx, err, "while sending the request of client %q", cs.Name)
+		}
+		span.setAttr("http.response.status_code", strconv.Itoa(resp.StatusCode))
+		responses = append(responses, resp)
+
+		for _, exp := range step.Expectations {
+			if exp.bench() {
+				continue
+			}
+			start := time.Now()
+			if exp.within > 0 {
+				resp, err = retry(ctx, req, server, exp, resp)
+				if err == errClientTimeout {
+					break
+				}
+				if err != nil {
+					return cr, nil, timeoutError(ctx, err, "while sending the request of client %q again", cs.Name)
+				}
+				responses[len(responses)-1] = resp
+			}
+			// Expectations about the response to a previous step are
+			// checked against it, eg: resp[0].status
+			checked, checkedReq := resp, req
+			if exp.indexed {
+				checked, checkedReq = responses[exp.step], prepared[exp.step]
+			}
+			ev := exp.Response(*checked)
+			exp.capture(ev, sc)
+			if !ev.Passed {
+				if len(cr.ClientFailures) == 0 {
+					cr.Request, cr.Response = checkedReq.String(), checked.String()
+				}
+				cr.ClientFailures = append(cr.ClientFailures, newFailure("", exp, ev))
+			}
+			cr.Results = append(cr.Results, newResult(exp, ev, start))
+		}
+
+		if err == errClientTimeout {
+			cr.timedOut(req, start)
+			break
+		}
+		cr.capture = captureClient(resp, req.body)
+	}
+	return done()
+}
+
+// clientResult is the outcome of the i-th client of a program, see runClient
+type clientResult struct {
+	i      int
+	report ClientReport
+	resp   *ClientResponse
+	err    error
+}
+
+// inFlightPoll is how often the origin is checked for the request of an
+// in-flight client
+const inFlightPoll = 10 * time.Millisecond
+
+// startInFlight runs cs, the i-th client of p, in the background, returning
+// once its request reached the origin or the client is done. The outcome of
+// the client is sent to the returned channel. The client uses a copy of sc,
+// as it runs along with the following ones
+func startInFlight(ctx context.Context, p Program, i int, cs ClientStanza, sc *scope, origin *Origin, addr string, proxy proxyControl) (<-chan clientResult, error) {
+	ch := make(chan clientResult, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := clientResult{i: i}
+		r.report, r.resp, r.err = runClient(ctx, p, i, cs, sc.clone(), nil, origin, addr, proxy)
+		ch <- r
+	}()
+
+	id := requestID(cs, i)
+	for origin.hits.seq(id) == 0 {
+		select {
+		case <-done:
+			return ch, nil
+		case <-ctx.Done():
+			return nil, timeoutError(ctx, ctx.Err(), "while waiting for the request of client %q to reach the origin", cs.Name)
+		case <-time.After(inFlightPoll):
+		}
+	}
+	slog.Debug("Request in flight", "client", cs.Name)
+	return ch, nil
+}
+
+// run installs the handlers of the given program on the origin, sends the
+// requests of all clients to the proxy listening on addr, controlled with
+// proxy, and checks all expectations. The returned error is non-nil if the run could not complete,
+// for instance because ctx or the timeout set by the program expired
+func run(ctx context.Context, p Program, origin *Origin, addr string, proxy proxyControl) (Report, error) {
+	if c, skip := p.skipped(); skip {
+		return Report{Skipped: c.String()}, nil
+	}
+
+	ctx, cancel := programContext(ctx, p)
+	defer cancel()
+
+	origin.reset()
+
+	// Iterate over HandleStanzas
+	for _, hs := range p.Handlers {
+		origin.addHandler(hs)
+	}
+
+	// Start clients, keeping track of the variables they capture and of the
+	// responses they receive
+	clients := make([]ClientReport, len(p.Clients))
+	sc := newScope()
+	last := make([]*ClientResponse, len(p.Clients))
+	rng, seed := newRand()
+	// In-flight clients run in the background, while the proxy is
+	// restarted or reloaded for instance. They are waited for before
+	// checking the expectations regarding the whole run
+	var inFlight []<-chan clientResult
+	for i, cs := range p.Clients {
+		if err := restart(ctx, cs, proxy); err != nil {
+			return Report{}, err
+		}
+
+		if cs.InFlight {
+			ch, err := startInFlight(ctx, p, i, cs, sc, origin, addr, proxy)
+			if err != nil {
+				return Report{}, err
+			}
+			inFlight = append(inFlight, ch)
+			continue
+		}
+
+		cr, resp, err := runClient(ctx, p, i, cs, sc, rng, origin, addr, proxy)
+		if err != nil {
+			return Report{}, err
+		}
+		clients[i], last[i] = cr, resp
+		sc.responses[cs.Name] = resp
+	}
+	for _, ch := range inFlight {
+		r := <-ch
+		if r.err != nil {
+			return Report{}, r.err
+		}
+		clients[r.i], last[r.i] = r.report, r.resp
+	}
+
+	// Evaluate expectations regarding the whole run
+	ids := make(map[string]string)
+	responses := make(map[string]*ClientResponse)
+	for i, cr := range clients {
+		if _, ok := ids[cr.Name]; !ok {
+			ids[cr.Name] = cr.RequestID
+			responses[cr.Name] = last[i]
+		}
+	}
+
+	var failures []Failure
+	var results []Result
+	for _, exp := range p.Expectations {
+		start := time.Now()
+		var ev Evaluation
+		if exp.client != "" {
+			ev = exp.Client(responses[exp.client])
+		} else if exp.field == EXPECT_CACHE_PERSISTS {
+			ev = exp.CachePersists(origin, ids, responses)
+		} else if exp.field == EXPECT_CACHE_NEGATIVE {
+			ev = exp.CacheNegative(p.NegativeCaching, origin, ids, responses)
+		} else if exp.field == EXPECT_CACHE_INVALIDATED {
+			ev = exp.CacheInvalidated(origin, ids, responses)
+		} else if exp.field == EXPECT_PROXY_METRIC {
+			ev = exp.Proxy(proxy)
+		} else {
+			ev = exp.Origin(origin, ids)
+		}
+		if !ev.Passed {
+			failures = append(failures, newFailure("", exp, ev))
+		}
+		results = append(results, newResult(exp, ev, start))
+	}
+
+	for i := range clients {
+		clients[i].OriginHits = origin.hits.caused(clients[i].RequestID)
+	}
+	report := NewReport(clients, origin.failures.all())
+	for i, cs := range p.Clients {
+		// Handler expectations do not hold for fuzzed requests
+		if cs.Fuzz > 0 {
+			report.Clients[i].OriginFailures = nil
+		}
+	}
+	report.Failures = failures
+	report.Results = results
+	report.originCaptures = origin.captures.all()
+	if p.random() {
+		report.Seed = seed
+	}
+	return report, nil
+}
+
+// runBench installs the handlers of the given program on the origin and
+// benchmarks all clients against the proxy listening on addr, controlled with
+// proxy, checking the
+// expectations about latencies. The returned error is non-nil if ctx or the
+// timeout set by the program expired
+func runBench(ctx context.Context, p Program, origin *Origin, addr string, proxy proxyControl) (Report, error) {
+	if c, skip := p.skipped(); skip {
+		return Report{Skipped: c.String()}, nil
+	}
+
+	ctx, cancel := programContext(ctx, p)
+	defer cancel()
+
+	origin.reset()
+
+	for _, hs := range p.Handlers {
+		origin.addHandler(hs)
+	}
+
+	var failures []Failure
+	for _, cs := range p.Clients {
+		if err := restart(ctx, cs, proxy); err != nil {
+			return Report{}, err
+		}
+		if cs.Fuzz > 0 {
+			continue
+		}
+		slog.Debug("Benchmarking", "client", cs.Name)
+		b := Bench(ctx, cs, addr, proxy, *benchRate, *benchConcurrency, *benchWarmup, *benchDuration)
+		if err := timeoutError(ctx, nil, "while benchmarking client %q", cs.Name); err != nil {
+			return Report{}, err
+		}
+		b.Print()
+
+		for _, exp := range cs.expectations() {
+			if !exp.bench() {
+				continue
+			}
+			if ev := exp.Bench(b); !ev.Passed {
+				failures = append(failures, newFailure(fmt.Sprintf("client %q", cs.Name), exp, ev))
+			}
+		}
+	}
+
+	return Report{Failures: failures}, nil
+}
@@ -0,0 +1,1386 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProxy controls a proxy with the given functions, failing for those not
+// set. addr is the address of its TLS port
+type fakeProxy struct {
+	restartFunc    func(context.Context) error
+	reloadFunc     func(ConfigReload) error
+	rotateCertFunc func() error
+	metricFunc     func(name string) (string, error)
+	addr           string
+}
+
+var errFakeProxy = errors.New("not supported by the fake proxy")
+
+func (p *fakeProxy) restart(ctx context.Context) error {
+	if p.restartFunc == nil {
+		return errFakeProxy
+	}
+	return p.restartFunc(ctx)
+}
+
+func (p *fakeProxy) reload(r ConfigReload) error {
+	if p.reloadFunc == nil {
+		return errFakeProxy
+	}
+	return p.reloadFunc(r)
+}
+
+func (p *fakeProxy) rotateCert() error {
+	if p.rotateCertFunc == nil {
+		return errFakeProxy
+	}
+	return p.rotateCertFunc()
+}
+
+func (p *fakeProxy) metric(name string) (string, error) {
+	if p.metricFunc == nil {
+		return "", errFakeProxy
+	}
+	return p.metricFunc(name)
+}
+
+func (p *fakeProxy) tlsAddr() string {
+	return p.addr
+}
+
+// runDirect runs the given HTC program with clients talking directly to the
+// origin, without any proxy in between
+func runDirect(t *testing.T, input string) Report {
+	return runControlled(t, input, nil)
+}
+
+// runControlled is like runDirect, acting on the proxy with the given
+// proxyControl
+func runControlled(t *testing.T, input string, proxy proxyControl) Report {
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Listener = proxyListener{server.Listener}
+	server.Start()
+	defer server.Close()
+
+	report, err := run(context.Background(), p, origin, strings.TrimPrefix(server.URL, "http://"), proxy)
+	assert.Nil(t, err)
+	return report
+}
+
+func TestRun(t *testing.T) {
+	report := runDirect(t, `handle "/endpoint/1" {
+    expect req.method eq "GET"
+    tx -body "Hello world!" -status 200
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+    expect resp.status eq 200
+    expect resp.body eq "Hello world!"
+}
+
+client "dory" {
+    tx -url "/endpoint/1" -method "POST"
+    expect resp.status eq 404
+}
+
+expect origin["/endpoint/1"].hits eq 2
+expect order client "nemo" before client "dory"`)
+
+	assert.True(t, report.Failed())
+	assert.Equal(t, 0, len(report.Failures))
+	assert.False(t, report.Clients[0].Failed())
+
+	// dory's POST is reported by the origin, and its status was 200
+	assert.Equal(t, 1, len(report.Clients[1].OriginFailures))
+	assert.Equal(t, 1, len(report.Clients[1].ClientFailures))
+
+	f := report.Clients[1].ClientFailures[0]
+	assert.Equal(t, `expect resp.status eq "404"`, f.Expect)
+	assert.Equal(t, 14, f.Line)
+	assert.Equal(t, `eq "404"`, f.Expected)
+	assert.Equal(t, `"200"`, f.Actual)
+
+	f = report.Clients[1].OriginFailures[0]
+	assert.Equal(t, `handle "/endpoint/1"`, f.Context)
+	assert.Equal(t, 2, f.Line)
+
+	// Outcomes of client and global expectations
+	assert.Equal(t, 2, len(report.Clients[0].Results))
+	assert.True(t, report.Clients[0].Results[0].Passed)
+	assert.Equal(t, 8, report.Clients[0].Results[0].Line)
+	assert.False(t, report.Clients[1].Results[0].Passed)
+	assert.Equal(t, 2, len(report.Results))
+	assert.True(t, report.Results[1].Passed)
+}
+
+func TestRunVirtualHosts(t *testing.T) {
+	report := runDirect(t, `handle "www.example.org/" {
+    tx -body "www"
+}
+
+handle "/" {
+    tx -body "default"
+}
+
+client "www" {
+    tx -url "/" -host "www.example.org"
+    expect resp.body eq "www"
+}
+
+client "default" {
+    tx -url "/" -host "static.example.org"
+    expect resp.body eq "default"
+}
+
+expect origin["www.example.org/"].hits eq 1
+expect origin["/"].hits eq 1`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunOriginRequest(t *testing.T) {
+	report := runDirect(t, `handle "/search" {
+    tx -body "results"
+}
+
+client "first" {
+    tx -url "/search?q=nemo" -host "www.example.org" -header "X-Fish: clown"
+}
+
+client "second" {
+    tx -url "/search?q=dory" -method "POST"
+}
+
+expect origin["/search"].request[0].url eq "/search?q=nemo"
+expect origin["/search"].request[0].headers["Host"] eq "www.example.org"
+expect origin["/search"].request[0].headers["X-Fish"] eq "clown"
+expect origin["/search"].request[1].method eq "POST"
+expect origin["/search"].request[2].method eq "GET"`)
+
+	assert.True(t, report.Failed())
+	assert.Equal(t, 1, len(report.Failures))
+	assert.Equal(t, `expect origin[/search].request[2].method eq "GET"`, report.Failures[0].Expect)
+	assert.Equal(t, `""`, report.Failures[0].Actual)
+}
+
+func TestRunChunked(t *testing.T) {
+	report := runDirect(t, `handle "/upload" {
+    expect req.headers["Transfer-Encoding"] eq "chunked"
+    expect req.body eq "Hello world!"
+    tx -status 201
+}
+
+handle "/plain" {
+    expect req.headers["Content-Length"] eq "12"
+    tx -status 201
+}
+
+client "chunked" {
+    tx -url "/upload" -method "POST" -body "Hello world!" -chunked -send-body-rate 40
+    expect resp.status eq 201
+}
+
+client "plain" {
+    tx -url "/plain" -method "POST" -body "Hello world!"
+    expect resp.status eq 201
+}
+
+client "empty" {
+    tx -url "/upload" -method "POST" -chunked
+}
+
+expect origin["/upload"].request[0].headers["Transfer-Encoding"] eq "chunked"
+expect origin["/upload"].request[0].received eq 12
+expect origin["/plain"].request[0].headers["Transfer-Encoding"] eq ""
+expect origin["/plain"].request[0].received eq 12
+expect origin["/upload"].request[1].received eq 0`)
+	assert.Len(t, report.Failures, 0, report.Failures)
+	assert.False(t, report.Clients[0].Failed(), report.Clients[0])
+	assert.False(t, report.Clients[1].Failed(), report.Clients[1])
+	// The empty body fails the handler expectation only
+	if assert.Len(t, report.Clients[2].OriginFailures, 1) {
+		assert.Equal(t, `expect req.body eq "Hello world!"`, report.Clients[2].OriginFailures[0].Expect)
+	}
+
+	for _, input := range []string{
+		`-url "/" -chunked -tls`,
+		`-url "/" -chunked -grpc`,
+		`-url "/" -chunked -proto "HTTP/1.0"`,
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestRunMaxConns(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    tx -status 200
+}
+
+client "first" {
+    tx -url "/"
+}
+
+client "second" {
+    tx -url "/"
+}
+
+expect origin.maxconns eq 1`)
+
+	assert.False(t, report.Failed(), report.Failures)
+}
+
+func TestRunRequestID(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    expect req.method eq "GET"
+    tx -status 200
+}
+
+client "tagged" {
+    tx -url "/" -method "POST"
+}
+
+client "anonymous" {
+    tx -url "/" -method "POST" -no-request-id
+}
+
+client "missing" {
+    tx -url "/missing"
+}
+
+expect order client "anonymous" after client "tagged"`)
+
+	assert.True(t, report.Failed())
+	assert.Equal(t, "tagged-0", report.Clients[0].RequestID)
+	assert.Equal(t, []string{"/"}, report.Clients[0].OriginHits)
+	assert.Len(t, report.Clients[0].OriginFailures, 1)
+
+	// Failures caused by the request without ID cannot be told apart
+	assert.Equal(t, "", report.Clients[1].RequestID)
+	assert.Empty(t, report.Clients[1].OriginHits)
+	assert.Empty(t, report.Clients[1].OriginFailures)
+	assert.Len(t, report.OriginFailures, 1)
+	assert.NotContains(t, report.Clients[1].Request, requestIDHeader)
+
+	assert.Equal(t, "missing-2", report.Clients[2].RequestID)
+	assert.Empty(t, report.Clients[2].OriginHits)
+
+	assert.Len(t, report.Failures, 1)
+	assert.Equal(t, `client "anonymous" never reached the origin`, report.Failures[0].Reason)
+}
+
+func TestRunForward(t *testing.T) {
+	report := runDirect(t, `handle "www.example.org/a" {
+    tx -body "www"
+}
+
+client "forward" {
+    tx -url "http://www.example.org/a?x=1" -forward
+    expect resp.body eq "www"
+    expect resp.url eq "http://www.example.org/a?x=1"
+}
+
+expect origin["www.example.org/a"].hits eq 1`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunTrailers(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    tx -body "Hello" -trailer "X-Checksum: 42"
+}
+
+client "nemo" {
+    tx -url "/"
+    expect resp.proto eq "HTTP/1.1"
+    expect resp.trailers["X-Checksum"] eq "42"
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunEarlyHints(t *testing.T) {
+	report := runDirect(t, `handle "/hints" {
+    tx -early-hint "Link: </style.css>; rel=preload" -header "X-Final: yes"
+}
+
+handle "/none" {
+    tx -status 200
+}
+
+client "hints" {
+    tx -url "/hints"
+    expect resp.status eq 200
+    expect resp.hints["Link"] eq "</style.css>; rel=preload"
+    expect resp.headers["Link"] eq ""
+    expect resp.headers["X-Final"] eq "yes"
+}
+
+client "none" {
+    tx -url "/none"
+    expect resp.hints["Link"] eq ""
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunProxyProtocol(t *testing.T) {
+	report := runDirect(t, `handle "/v1" {
+    expect req.proxy.ip eq "127.0.0.1"
+    tx -status 200
+}
+
+handle "/v2" {
+    expect req.proxy.ip eq "2001:db8::1"
+    tx -status 200
+}
+
+handle "/none" {
+    expect req.proxy.ip eq ""
+    tx -status 200
+}
+
+client "v1" {
+    tx -url "/v1" -proxy-protocol 1
+}
+
+client "v2" {
+    tx -url "/v2" -proxy-protocol 2 -proxy-src "2001:db8::1"
+}
+
+client "none" {
+    tx -url "/none"
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunETag(t *testing.T) {
+	sum := sha256.Sum256([]byte("Hello"))
+	etag := fmt.Sprintf(`\"%x\"`, sum[:8])
+
+	report := runDirect(t, `handle "/auto" {
+    tx -etag auto -body "Hello"
+}
+
+handle "/v1" {
+    expect req.conditional eq "true"
+    tx -etag "v1" -body "Hello"
+}
+
+client "fetch" {
+    tx -url "/auto"
+    expect resp.status eq 200
+    expect resp.headers["ETag"] eq "`+etag+`"
+    expect resp.body eq "Hello"
+}
+
+client "revalidate" {
+    tx -url "/auto" -header "If-None-Match: W/`+etag+`"
+    expect resp.status eq 304
+    expect resp.headers["ETag"] eq "`+etag+`"
+    expect resp.body eq ""
+}
+
+client "changed" {
+    tx -url "/v1" -header "If-None-Match: \"v0\""
+    expect resp.status eq 200
+    expect resp.headers["ETag"] eq "\"v1\""
+}
+
+client "any" {
+    tx -url "/v1" -header "If-None-Match: *"
+    expect resp.status eq 304
+}`)
+
+	assert.False(t, report.Failed())
+
+	report = runDirect(t, `handle "/" {
+    expect req.conditional eq "true"
+    tx -status 200
+}
+
+client "unconditional" {
+    tx -url "/"
+}`)
+
+	assert.True(t, report.Failed())
+}
+
+func TestRunBurst(t *testing.T) {
+	start := time.Now()
+	report := runDirect(t, `handle "/limited" {
+    tx -status 429
+}
+
+handle "/" {
+    tx -status 200
+}
+
+client "limited" {
+    tx -url "/limited"
+    burst 5 within "200ms"
+    expect resp.statuses["429"] eq 5
+    expect resp.statuses["4xx"] eq 5
+    expect resp.statuses["200"] eq 0
+    expect resp.requests eq 5
+}
+
+client "single" {
+    tx -url "/"
+    expect resp.statuses["2xx"] eq 1
+}
+
+expect origin["/limited"].hits eq 5`)
+
+	assert.False(t, report.Failed())
+	// The last request is sent after 4/5 of the duration
+	assert.True(t, time.Since(start) >= 160*time.Millisecond)
+}
+
+func TestRunFuzz(t *testing.T) {
+	report := runDirect(t, `handle "/static/*" {
+    expect req.headers["X-Never"] eq "sent"
+    tx -status 200
+}
+
+client "fuzzer" {
+    tx -method "POST" -header "X-Fuzz: yes"
+    fuzz 50
+}`)
+
+	// Handler expectations are not checked against fuzzed requests
+	assert.False(t, report.Failed())
+	assert.Equal(t, []Result{{Expect: "fuzz 50", Line: 8, Passed: true, Duration: report.Clients[0].Duration}}, report.Clients[0].Results)
+	assert.NotEqual(t, int64(0), report.Seed)
+
+	report = runDirect(t, `handle "/" {
+    tx -status 503
+}
+
+client "fuzzer" {
+    fuzz 50
+}`)
+	assert.True(t, report.Failed())
+	assert.Len(t, report.Clients[0].ClientFailures, maxFuzzFailures)
+	f := report.Clients[0].ClientFailures[0]
+	assert.Equal(t, "fuzz 50", f.Expect)
+	assert.Equal(t, 6, f.Line)
+	assert.Equal(t, `"503 Service Unavailable"`, f.Actual)
+	assert.True(t, strings.HasPrefix(f.Context, "GET /"), f.Context)
+
+	// Programs without randomness have no seed
+	report = runDirect(t, `handle "/" {
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/"
+}`)
+	assert.Equal(t, int64(0), report.Seed)
+}
+
+func TestRunBind(t *testing.T) {
+	report := runDirect(t, `handle "/alias" {
+    expect req.remote.ip eq "127.0.0.2"
+    tx -status 200
+}
+
+handle "/default" {
+    expect req.remote.ip eq "127.0.0.1"
+    tx -status 200
+}
+
+client "alias" {
+    tx -url "/alias" -bind "127.0.0.2"
+}
+
+client "default" {
+    tx -url "/default"
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunForwarded(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    expect req.xff.chain eq "203.0.113.7, 127.0.0.1"
+    expect req.xff.last eq "127.0.0.1"
+    expect req.forwarded.chain eq "203.0.113.7, 127.0.0.1"
+    expect req.forwarded.last eq "127.0.0.1"
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/" -header "X-Forwarded-For: 203.0.113.7, 127.0.0.1" -header "Forwarded: for=203.0.113.7, for=\"127.0.0.1:4242\""
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunGRPC(t *testing.T) {
+	report := runDirect(t, `handle "/echo.Echo/Say" {
+    expect req.proto eq "HTTP/2.0"
+    expect req.headers["Content-Type"] eq "application/grpc"
+    tx -grpc
+}
+
+handle "/echo.Echo/Fail" {
+    tx -grpc -trailer "grpc-status: 14" -trailer "grpc-message: unavailable"
+}
+
+client "echo" {
+    tx -url "/echo.Echo/Say" -grpc -body "hello"
+    expect resp.proto eq "HTTP/2.0"
+    expect resp.body eq "hello"
+    expect resp.trailers["grpc-status"] eq "0"
+}
+
+client "fail" {
+    tx -url "/echo.Echo/Fail" -grpc
+    expect resp.status eq 200
+    expect resp.body eq ""
+    expect resp.trailers["grpc-status"] eq "14"
+    expect resp.trailers["grpc-message"] eq "unavailable"
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunHandlePatterns(t *testing.T) {
+	report := runDirect(t, `handle ~ "^/api/v[0-9]+/items" {
+    tx -body "items"
+}
+
+handle "/api/v1/items/special" {
+    tx -body "special"
+}
+
+handle "/static/*.css" {
+    tx -body "css"
+}
+
+client "items" {
+    tx -url "/api/v2/items/42"
+    expect resp.body eq "items"
+}
+
+client "special" {
+    tx -url "/api/v1/items/special"
+    expect resp.body eq "special"
+}
+
+client "css" {
+    tx -url "/static/themes/dark.css"
+    expect resp.body eq "css"
+}
+
+client "not-found" {
+    tx -url "/static/dark.js"
+    expect resp.status eq 404
+}
+
+expect origin["^/api/v[0-9]+/items"].hits eq 1
+expect origin["/static/*.css"].hits eq 1`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunHandleMethods(t *testing.T) {
+	report := runDirect(t, `handle "/endpoint" -method "POST" {
+    expect req.body eq "payload"
+    tx -status 201
+}
+
+handle "/endpoint" -method "PURGE" {
+    tx -status 200
+}
+
+handle "/endpoint" {
+    tx -header "Cache-Control: max-age=60" -status 200
+}
+
+client "get" {
+    tx -url "/endpoint"
+    expect resp.headers["Cache-Control"] eq "max-age=60"
+}
+
+client "post" {
+    tx -url "/endpoint" -method "POST" -body "payload"
+    expect resp.status eq 201
+}
+
+client "purge" {
+    tx -url "/endpoint" -method "PURGE"
+    expect resp.headers["Cache-Control"] eq ""
+}
+
+expect origin["/endpoint"].hits eq 3`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunAuth(t *testing.T) {
+	report := runDirect(t, `handle "/basic" {
+    expect req.auth.user eq "nemo"
+    expect req.auth.password eq "s3cr:et"
+    expect req.auth.bearer eq ""
+    tx -status 200
+}
+
+handle "/bearer" {
+    expect req.auth.bearer eq "abc.def"
+    expect req.auth.user eq ""
+    tx -status 200
+}
+
+client "basic" {
+    tx -url "/basic" -basic-auth "nemo:s3cr:et"
+}
+
+client "bearer" {
+    tx -url "/bearer" -bearer "abc.def"
+}`)
+
+	assert.False(t, report.Failed())
+
+	report = runDirect(t, `handle "/" {
+    expect req.auth.bearer eq "abc.def"
+    tx -status 200
+}
+
+client "anonymous" {
+    tx -url "/"
+}`)
+
+	assert.True(t, report.Failed())
+}
+
+func TestRunDefaultHandler(t *testing.T) {
+	report := runDirect(t, `handle "/endpoint/1" {
+    tx -body "endpoint"
+}
+
+handle default {
+    tx -status 410
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+    expect resp.body eq "endpoint"
+}
+
+client "dory" {
+    tx -url "/elsewhere"
+    expect resp.status eq 410
+}
+
+expect origin["default"].hits eq 1`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunStrict(t *testing.T) {
+	input := `handle "/endpoint/1" {
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+}
+
+client "dory" {
+    tx -url "/unexpected?a=b"
+    expect resp.status eq 404
+}`
+
+	// Unexpected requests go unnoticed by default
+	assert.False(t, runDirect(t, input).Failed())
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+
+	origin := NewOrigin(0)
+	origin.strict = true
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	report, err := run(context.Background(), p, origin, strings.TrimPrefix(server.URL, "http://"), nil)
+	assert.Nil(t, err)
+	assert.True(t, report.Failed())
+	assert.False(t, report.Clients[0].Failed())
+	assert.Equal(t, []Failure{{
+		Context:  "strict mode",
+		Expect:   "GET /unexpected?a=b",
+		Expected: "a handle stanza serving the request",
+		Actual:   "none",
+	}}, report.Clients[1].OriginFailures)
+}
+
+func TestRunBinaryBody(t *testing.T) {
+	report := runDirect(t, `handle "/binary" {
+    expect req.body eq "\x00\x01\xfe\xff"
+    tx -body-hex "fffe0100"
+}
+
+client "nemo" {
+    tx -url "/binary" -method "POST" -body-base64 "AAH+/w=="
+    expect resp.body eq "\xff\xfe\x01\x00"
+}`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	p, err := Parse(strings.NewReader(`timeout "50ms"
+client "nemo" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = run(context.Background(), p, NewOrigin(0), strings.TrimPrefix(server.URL, "http://"), nil)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	assert.EqualError(t, err, `Timeout exceeded while sending the request of client "nemo"`)
+}
+
+func TestRunWait(t *testing.T) {
+	start := time.Now()
+	report := runDirect(t, `handle "/" {
+    tx -status 200
+}
+
+client "first" {
+    tx -url "/"
+}
+
+client "second" {
+    wait "100ms"
+    tx -url "/"
+}
+
+expect origin["/"].hits eq 2`)
+	assert.False(t, report.Failed())
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	p, err := Parse(strings.NewReader(`timeout "50ms"
+client "nemo" {
+    wait "1s"
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+
+	_, err = run(context.Background(), p, NewOrigin(0), "localhost:0", nil)
+	assert.EqualError(t, err, `Timeout exceeded while client "nemo" was waiting`)
+}
+
+func TestRunClientTimeout(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    expect req.body eq "hello"
+    tx -status 200
+}
+
+client "slow" {
+    tx -url "/" -method "POST" -body "hello" -send-body-rate 50
+    expect resp.status eq 200
+    expect resp.time.total gt 80ms
+}
+
+client "timeout" {
+    tx -url "/" -method "POST" -body "hello world!" -send-body-rate 10 -timeout "200ms"
+    expect resp.status eq 200
+}
+
+client "after" {
+    tx -url "/" -method "POST" -body "hello"
+}
+
+client "slow-reader" {
+    tx -url "/bytes/100" -read-rate 500
+    expect resp.status eq 200
+    expect resp.time.total gt 180ms
+}
+
+client "slow-reader-timeout" {
+    tx -url "/bytes/100" -read-rate 100 -timeout "200ms"
+}`)
+
+	assert.True(t, report.Failed())
+	assert.Equal(t, 5, len(report.Clients))
+	assert.Empty(t, report.Clients[0].ClientFailures)
+	assert.Equal(t, []Failure{{
+		Expect:   `tx -timeout "200ms"`,
+		Line:     13,
+		Expected: "a response within 200ms",
+		Actual:   "timeout",
+	}}, report.Clients[1].ClientFailures)
+	assert.Empty(t, report.Clients[2].ClientFailures)
+	assert.Empty(t, report.Clients[3].ClientFailures)
+	if assert.Len(t, report.Clients[4].ClientFailures, 1) {
+		assert.Equal(t, "timeout", report.Clients[4].ClientFailures[0].Actual)
+	}
+}
+
+func TestRunWithin(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Succeed from the third request on
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	p, err := Parse(strings.NewReader(`client "nemo" {
+    tx -url "/"
+    expect resp.status eq 200 within "2s"
+    expect resp.retries eq 2
+    expect resp.requests eq 3
+}`))
+	assert.Nil(t, err)
+
+	report, err := run(context.Background(), p, NewOrigin(0), addr, nil)
+	assert.Nil(t, err)
+	assert.False(t, report.Failed())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// Give up once the window expires
+	p, err = Parse(strings.NewReader(`client "nemo" {
+    tx -url "/"
+    expect resp.status eq 404 within "300ms"
+}`))
+	assert.Nil(t, err)
+
+	report, err = run(context.Background(), p, NewOrigin(0), addr, nil)
+	assert.Nil(t, err)
+	assert.True(t, report.Failed())
+	assert.Equal(t, `eq "404" within 300ms`, report.Clients[0].ClientFailures[0].Expected)
+}
+
+func TestOriginReset(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/"
+}
+
+expect origin["/"].hits eq 1`
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+
+	origin := NewOrigin(0)
+	server := httptest.NewServer(origin)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	// Handlers can be installed again, and hits start from 0 on each run
+	for i := 0; i < 2; i++ {
+		report, err := run(context.Background(), p, origin, addr, nil)
+		assert.Nil(t, err)
+		assert.False(t, report.Failed())
+	}
+}
+
+func TestRunCapture(t *testing.T) {
+	report := runDirect(t, `handle "/first" {
+    tx -header "X-Cache: hit-fra"
+}
+
+handle "/datacenters/fra" {
+    expect req.headers["X-Dc"] eq "fra"
+    tx -body "Frankfurt"
+}
+
+client "first" {
+    tx -url "/first"
+    expect resp.headers["X-Cache"] ~ "hit-(\\w+)" capture $dc
+}
+
+client "second" {
+    tx -url "/datacenters/${dc}" -header "X-Dc: ${dc}"
+    expect resp.body eq "Frankfurt"
+}`)
+
+	assert.False(t, report.Failed())
+	assert.Equal(t, []string{"hit-fra", "fra"}, report.Clients[0].Results[0].Submatches)
+}
+
+func TestRunHandleTemplate(t *testing.T) {
+	report := runDirect(t, `handle "/echo/*" {
+    tx -header "X-Echo-Path: ${req.path}" -body "${req.headers[X-Request-Id]}" -etag auto
+}
+
+client "first" {
+    tx -url "/echo/1" -header "X-Request-Id: abc"
+    expect resp.headers["X-Echo-Path"] eq "/echo/1"
+    expect resp.body eq "abc"
+    expect resp.headers["ETag"] ne ""
+}
+
+client "second" {
+    tx -url "/echo/2" -header "X-Request-Id: def"
+    expect resp.headers["X-Echo-Path"] eq "/echo/2"
+    expect resp.body eq "def"
+}`)
+
+	assert.False(t, report.Failed(), report.Clients)
+}
+
+func TestRunHandleBranches(t *testing.T) {
+	report := runDirect(t, `handle "/retry" {
+    if hits lt 3 {
+        tx -status 503
+    } else {
+        tx -status 200 -body "ok"
+    }
+}
+
+client "first" {
+    tx -url "/retry"
+    expect resp.status eq 503
+}
+
+client "second" {
+    wait "100ms"
+    tx -url "/retry"
+    expect resp.status eq 503
+}
+
+client "third" {
+    wait "200ms"
+    tx -url "/retry"
+    expect resp.status eq 200
+    expect resp.body eq "ok"
+}`)
+
+	assert.False(t, report.Failed(), report.Clients)
+}
+
+func TestRunCookies(t *testing.T) {
+	report := runDirect(t, `handle "/login" {
+    tx -status 302 -header "Location: /account" -header "Set-Cookie: session=abc; Path=/"
+}
+
+handle "/account" {
+    script """
+    resp.status = 401
+    if req.headers["Cookie"] == "session=abc":
+        resp.status = 200
+    """
+}
+
+client "session" {
+    cookies
+    tx -url "/login" -follow-redirects
+    expect resp.status eq 200
+}
+
+client "other" {
+    cookies
+    tx -url "/account"
+    expect resp.status eq 401
+}
+
+client "no-jar" {
+    tx -url "/login" -follow-redirects
+    expect resp.status eq 401
+}`)
+
+	assert.False(t, report.Failed(), report.Clients)
+}
+
+func TestRunSteps(t *testing.T) {
+	report := runDirect(t, `handle "/login" {
+    tx -header "Set-Cookie: session=abc" -header "X-Token: t0k3n"
+}
+
+handle "/account" {
+    expect req.headers["Cookie"] eq "session=abc"
+    expect req.headers["X-Token"] eq "t0k3n"
+    tx -body "welcome"
+}
+
+client "nemo" {
+    cookies
+    tx -url "/login"
+    expect resp.status eq 200
+    expect resp.headers["X-Token"] ~ "(.+)" capture $token
+    wait "10ms"
+    tx -url "/account" -header "X-Token: ${token}"
+    expect resp.body eq "welcome"
+}
+
+expect origin["/login"].hits eq 1
+expect origin["/account"].hits eq 1`)
+
+	assert.False(t, report.Failed(), report.Clients)
+	assert.Len(t, report.Clients, 1)
+	assert.Len(t, report.Clients[0].Results, 3)
+	assert.Equal(t, []string{"/login", "/account"}, report.Clients[0].OriginHits)
+
+	// Expectations are checked against the response of the preceding tx,
+	// and the report shows the request of the first failing step
+	report = runDirect(t, `handle "/a" {
+    tx -status 200
+}
+
+handle "/b" {
+    tx -status 404
+}
+
+client "nemo" {
+    tx -url "/a"
+    expect resp.status eq 200
+    tx -url "/b"
+    expect resp.status eq 200
+    tx -url "/a"
+    expect resp.status eq 200
+}`)
+
+	assert.True(t, report.Failed())
+	cr := report.Clients[0]
+	assert.Len(t, cr.ClientFailures, 1)
+	assert.Len(t, cr.Results, 3)
+	assert.Contains(t, cr.Request, "/b")
+	assert.Contains(t, cr.Response, "404")
+}
+
+func TestRunStepsIndexed(t *testing.T) {
+	report := runDirect(t, `handle "/" {
+    if hits eq 1 {
+        tx -header "X-Cache: miss"
+    } else {
+        tx -header "X-Cache: hit"
+    }
+}
+
+client "nemo" {
+    tx -url "/"
+    tx -url "/"
+    expect resp[0].headers["X-Cache"] eq "miss"
+    expect resp[1].headers["X-Cache"] eq "hit"
+    expect resp.headers["X-Cache"] eq "hit"
+}`)
+
+	assert.False(t, report.Failed(), report.Clients)
+
+	report = runDirect(t, `handle "/a" {
+    tx -status 404
+}
+
+client "nemo" {
+    tx -url "/a"
+    tx -url "/b"
+    expect resp[0].status eq 200
+}`)
+
+	assert.True(t, report.Failed())
+	assert.Contains(t, report.Clients[0].Request, "/a")
+}
+
+func TestRunHead(t *testing.T) {
+	body := strings.Repeat("x", 5000)
+	report := runDirect(t, `handle "/big" -method "GET" {
+    tx -body "`+body+`" -header "X-Handler: get"
+}
+
+handle "/both" -method "GET" {
+    tx -header "X-Handler: get"
+}
+
+handle "/both" -method "HEAD" {
+    tx -header "X-Handler: head"
+}
+
+client "head" {
+    tx -url "/big" -method "HEAD"
+    expect resp.status eq 200
+    expect resp.body empty-for-head
+    expect resp.headers["Content-Length"] eq "5000"
+    expect resp.headers["X-Handler"] eq "get"
+    tx -url "/big"
+    expect resp.body empty-for-head
+}
+
+client "both" {
+    tx -url "/both" -method "HEAD"
+    expect resp.headers["X-Handler"] eq "head"
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+}
+
+// headBodyProxy answers all requests with a body, even HEAD ones, whose
+// Content-Length is that of the body of GET ones on /body and is not on
+// /length
+func headBodyProxy(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					resp := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+					if req.Method == "HEAD" && req.URL.Path == "/length" {
+						resp = "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"
+					}
+					conn.Write([]byte(resp))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRunHeadOnTheWire(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client "body" {
+    tx -url "/body" -method "HEAD"
+    expect resp.body empty-for-head
+}
+
+client "length" {
+    tx -url "/length" -method "HEAD"
+    expect resp.body empty-for-head
+}`))
+	assert.Nil(t, err)
+	report, err := run(t.Context(), p, NewOrigin(0), headBodyProxy(t), nil)
+	assert.Nil(t, err)
+	if assert.Len(t, report.Clients, 2) && assert.Len(t, report.Clients[0].ClientFailures, 1) && assert.Len(t, report.Clients[1].ClientFailures, 1) {
+		assert.Equal(t, `"5 bytes"`, report.Clients[0].ClientFailures[0].Actual)
+		assert.Equal(t, "HEAD response with status 200 must have no body", report.Clients[0].ClientFailures[0].Reason)
+		assert.Equal(t, `"Content-Length 10"`, report.Clients[1].ClientFailures[0].Actual)
+		assert.Equal(t, "the body of the response to GET has 5 bytes", report.Clients[1].ClientFailures[0].Reason)
+	}
+}
+
+func TestRunChained(t *testing.T) {
+	report := runDirect(t, `handle "/old" {
+    tx -status 301 -header "Location: http://www.example.org/new?x=1" -header "X-Token: abc"
+}
+
+handle "www.example.org/new" {
+    expect req.headers["Authorization"] eq "Bearer abc"
+    tx -status 200
+}
+
+client "redirected" {
+    tx -url "/old"
+    expect resp.status eq 301
+}
+
+client "follower" {
+    tx -url "${client[redirected].resp.headers[Location]}" -header "Authorization: Bearer ${client[redirected].resp.headers[X-Token]}"
+    expect resp.status eq 200
+}
+
+client "steps" {
+    tx -url "/old"
+    tx -url "${resp[0].headers[Location]}" -header "Authorization: Bearer ${resp[0].headers[X-Token]}"
+    expect resp.status eq 200
+    expect resp[0].status eq 301
+}
+
+expect origin["www.example.org/new"].request[0].url eq "/new?x=1"`)
+
+	assert.False(t, report.Failed())
+}
+
+func TestRunAssert(t *testing.T) {
+	report := runDirect(t, `handle "/endpoint/1" {
+    tx -status 200 -header "X-Cache: miss"
+}
+
+client "nemo" {
+    tx -url "/endpoint/1"
+}
+
+client "timeout" {
+    tx -url "/endpoint/1" -timeout 1ns
+}
+
+assert {
+    expect origin["/endpoint/1"].hits gt 0
+    expect client["nemo"].resp.status eq 200
+    expect client["nemo"].resp.headers["X-Cache"] eq "hit"
+    expect client["timeout"].resp.status eq ""
+}`)
+
+	assert.True(t, report.Failed())
+	assert.Equal(t, 2, len(report.Failures))
+	assert.Equal(t, `"miss"`, report.Failures[0].Actual)
+	assert.Equal(t, `client "timeout" received no response`, report.Failures[1].Reason)
+	assert.Equal(t, 4, len(report.Results))
+}
+
+func TestRunRestartProxy(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200
+}
+
+client "before" {
+    tx -url "/"
+}
+
+restart-proxy
+
+client "after" {
+    tx -url "/"
+    expect resp.status eq 200
+}`
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.False(t, p.Clients[0].RestartProxy)
+	assert.True(t, p.Clients[1].RestartProxy)
+
+	// Without a proxy run by httptester, there is nothing to restart
+	_, err = run(t.Context(), p, NewOrigin(0), "127.0.0.1:1", nil)
+	assert.Error(t, err)
+
+	restarts := 0
+	report := runControlled(t, input, &fakeProxy{restartFunc: func(context.Context) error {
+		restarts++
+		return nil
+	}})
+	assert.False(t, report.Failed(), report.Clients)
+	assert.Equal(t, 1, restarts)
+
+	for _, input := range []string{
+		`client "a" {
+    tx -url "/"
+}
+restart-proxy`,
+		`restart-proxy
+restart-proxy
+client "a" {
+    tx -url "/"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestRunInFlight(t *testing.T) {
+	input := `client "long" {
+    in-flight
+    tx -url "/delay/300ms"
+    expect resp.status eq 200
+}
+
+restart-proxy
+
+client "after" {
+    tx -url "/echo"
+    expect resp.status eq 200
+}`
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.True(t, p.Clients[0].InFlight)
+	assert.False(t, p.Clients[1].InFlight)
+
+	// The proxy is restarted while the request of the first client is
+	// being served
+	var elapsed time.Duration
+	start := time.Now()
+	proxy := &fakeProxy{restartFunc: func(context.Context) error {
+		elapsed = time.Since(start)
+		return nil
+	}}
+	report := runControlled(t, input, proxy)
+	assert.False(t, report.Failed(), report.Clients)
+	assert.True(t, elapsed < 300*time.Millisecond, elapsed)
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	assert.Equal(t, "long", report.Clients[0].Name)
+
+	// Failures of in-flight clients fail the run
+	report = runDirect(t, `client "long" {
+    in-flight
+    tx -url "/delay/100ms"
+    expect resp.status eq 503
+}
+
+client "after" {
+    tx -url "/echo"
+}`)
+	assert.True(t, report.Failed())
+
+	for _, input := range []string{
+		`client "a" {
+    in-flight
+    fuzz 10
+}`,
+		`client "a" {
+    in-flight
+    tx -url "/" -no-request-id
+}`,
+		`client "a" {
+    in-flight
+    tx -url "/"
+    expect resp.headers["ETag"] ~ "(.+)" capture $etag
+}`,
+		`client "a" {
+    in-flight
+    tx -url "/"
+}
+client "b" {
+    tx -url "/${client[a].resp.status}"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		if assert.NotNil(t, err, input) {
+			assert.Contains(t, err.Error(), "in-flight", input)
+		}
+	}
+}
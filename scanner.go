@@ -25,6 +25,9 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type tokenType int
@@ -35,10 +38,14 @@ const (
 	EOF
 	WS
 	NEWLINE
+	COMMENT // only returned by scanners preserving comments
 
 	// Literals
-	STRING  // header names and values, method names, ...
-	INTEGER // status codes, Content-Length, ...
+	STRING   // header names and values, method names, ...
+	INTEGER  // status codes, Content-Length, ...
+	DURATION // timings, eg: 100ms
+	SIZE     // amounts of data, eg: 64KB
+	VARIABLE // variables set by capture, eg: $dc
 
 	// Misc characters
 	DOT           // .
@@ -47,15 +54,24 @@ const (
 	CLOSE_BRACKET // ]
 	OPEN_CURLY    // {
 	CLOSE_CURLY   // }
+	OPEN_PAREN    // (
+	CLOSE_PAREN   // )
+	COMMA         // ,
 
 	// Operators
 	EQUAL    // eq
 	NOTEQUAL // ne
 	TILDE    // ~
+	LESS     // lt
+	GREATER  // gt
 
 	// Keywords
 	HANDLE // handle
 	CLIENT // client
+	ASSERT // assert
+	SKIPIF // skip-if
+	ONLYIF // only-if
+	ENV    // env
 	EXPECT // expect
 	TX     // tx
 	// Request/response HTTP info like eg: resp.status, req.headers
@@ -65,19 +81,169 @@ const (
 	STATUS  // status
 	HEADERS // headers
 	BODY    // body
+	ORIGIN  // origin
+	HITS    // hits
+	REQUEST // request
+	ORDER   // order
+	BEFORE  // before
+	AFTER   // after
+	CONN    // conn
+	REUSED  // reused
+	TIME    // time
+	DNS     // dns
+	CONNECT // connect
+	TTFB    // ttfb
+	TOTAL   // total
+	TLS     // tls
+	VERSION // version
+	CIPHER  // cipher
+	ALPN    // alpn
+	CERT    // cert
+	CN      // cn
+	ISSUER  // issuer
+	SAN     // san
+	SERIAL  // serial
+	CURRENT // current
+	// Latency percentiles in bench mode, eg: p99
+	PERCENTILE
+	TIMEOUT     // timeout
+	WITHIN      // within
+	HANDSHAKE   // handshake
+	CLIENTCERTS // client-certs
+	ROTATECERT  // rotate-cert
+	NETWORK     // network
+	LATENCY     // latency
+	BANDWIDTH   // bandwidth
+	RESETAFTER  // reset-after
+	MAXCONNS    // maxconns
+	SCRIPT      // script
+	IF          // if
+	ELSE        // else
+	COOKIES     // cookies
+	DEFAULTS    // defaults
+	HEADER      // header
+	FOLLOW      // follow-redirects
+	EMPTYHEAD   // empty-for-head
+	PREFLIGHT   // preflight
+	CORS        // cors
+	RAWHEADERS  // rawheaders
+	PIPELINE    // pipeline
+	END         // end
+	RESTART     // restart-proxy
+	RELOAD      // reload-proxy-config
+	SET         // set
+	FILE        // file
+	INFLIGHT    // in-flight
+	CACHE       // cache
+	PERSISTS    // persists
+	PARENT      // parent-proxy
+	PARENTS     // parents
+	TOPOLOGY    // topology
+	HOP         // hop
+	STREAMED    // streamed
+	OUTCOME     // outcome
+	RECEIVED    // received
+	DIGEST      // digest
+	ENCODING    // encoding
+	TRANSFORM   // transform
+	VARY        // vary
+	REWRITE     // header-rewrite
+	NEGATIVE    // negative
+	NEGCACHING  // negative-caching
+	LIFETIME    // lifetime
+	INVALIDATE  // invalidate
+	INVALIDTAG  // invalidate-tag
+	SIGNINGKEY  // signing-key
+	SIGN        // sign
+	DEFAULT     // default
+	REDIRECTS   // redirects
+	REQUESTS    // requests
+	RETRIES     // retries
+	URL         // url
+	AUTH        // auth
+	USER        // user
+	PASSWORD    // password
+	BEARER      // bearer
+	TRAILERS    // trailers
+	PROTO       // proto
+	HINTS       // hints
+	PROXY       // proxy
+	IP          // ip
+	FORWARDED   // forwarded
+	XFF         // xff
+	CHAIN       // chain
+	LAST        // last
+	REMOTE      // remote
+	BURST       // burst
+	FUZZ        // fuzz
+	STATUSES    // statuses
+	WAIT        // wait
+	CONDITIONAL // conditional
+	METRIC      // metric
+	CAPTURE     // capture
+	AUTO        // auto
 
 	// Arguments
-	BODY_ARG   // -body
-	STATUS_ARG // -status
-	HEADER_ARG // -header
-	URL_ARG    // -url
-	METHOD_ARG // -method
+	BODY_ARG       // -body
+	BODYFILE_ARG   // -body-file
+	BODYBASE64_ARG // -body-base64
+	BODYHEX_ARG    // -body-hex
+	STATUS_ARG     // -status
+	HEADER_ARG     // -header
+	URL_ARG        // -url
+	HOST_ARG       // -host
+	METHOD_ARG     // -method
+
+	NOKEEPALIVE_ARG     // -no-keepalive
+	NOREQUESTID_ARG     // -no-request-id
+	NODEFAULTS_ARG      // -no-defaults
+	FOLLOWREDIRECTS_ARG // -follow-redirects
+	BASICAUTH_ARG       // -basic-auth
+	BEARER_ARG          // -bearer
+	FORWARD_ARG         // -forward
+	TUNNEL_ARG          // -tunnel
+	TRAILER_ARG         // -trailer
+	GRPC_ARG            // -grpc
+	EARLYHINT_ARG       // -early-hint
+	TIMEOUT_ARG         // -timeout
+	SENDBODYRATE_ARG    // -send-body-rate
+	PROXYPROTOCOL_ARG   // -proxy-protocol
+	PROXYSRC_ARG        // -proxy-src
+	BIND_ARG            // -bind
+	TLS_ARG             // -tls
+	TLSMIN_ARG          // -tls-min
+	TLSMAX_ARG          // -tls-max
+	SNI_ARG             // -sni
+	CLIENTCERT_ARG      // -client-cert
+	DATEOFFSET_ARG      // -date-offset
+	EXPIRESOFFSET_ARG   // -expires-offset
+	ETAG_ARG            // -etag
+	ORIGIN_ARG          // -origin
+	REQUESTMETHOD_ARG   // -request-method
+	REQUESTHEADERS_ARG  // -request-headers
+	PROTO_ARG           // -proto
+	READRATE_ARG        // -read-rate
+	ABORTAFTER_ARG      // -abort-after
+	CHUNKED_ARG         // -chunked
+	DIGEST_ARG          // -digest
+	SIGNED_ARG          // -signed
+	SCHEME_ARG          // -scheme
 )
 
 // token represents a lexical token. eg: {typ:STATUS val:"200"}
 type token struct {
 	typ tokenType
 	val string
+	// pos is where the token starts, set by the scanner
+	pos position
+	// raw is the source text of STRING tokens, quotes and escapes included
+	raw string
+}
+
+// position is a location in an HTC program. Lines and columns start from 1
+type position struct {
+	line int
+	col  int
 }
 
 func newToken(t tokenType, v string) token {
@@ -93,6 +259,12 @@ func (t token) String() string {
 		return fmt.Sprintf("STRING: %s", t.val)
 	case INTEGER:
 		return fmt.Sprintf("INTEGER: %s", t.val)
+	case DURATION:
+		return fmt.Sprintf("DURATION: %s", t.val)
+	case SIZE:
+		return fmt.Sprintf("SIZE: %s", t.val)
+	case VARIABLE:
+		return fmt.Sprintf("VARIABLE: %s", t.val)
 	case NEWLINE:
 		return "\\n"
 	case EOF:
@@ -105,14 +277,45 @@ func (t token) String() string {
 // Scanner represents a lexical scanner
 type scanner struct {
 	r *bufio.Reader
+	// comments makes the scanner return COMMENT tokens, followed by NEWLINE,
+	// rather than skipping comments altogether
+	comments bool
+	// pos is the position of the next rune, prevPos that of the last one read
+	pos     position
+	prevPos position
+	// last is the position of the last non-whitespace token scanned, used to
+	// report parse errors
+	last position
+	// unscanned is the token put back by unscan, if any, returned again by
+	// the next call to ScanUseful
+	unscanned *token
 }
 
 func newScanner(r io.Reader) *scanner {
-	return &scanner{r: bufio.NewReader(r)}
+	return &scanner{r: bufio.NewReader(r), pos: position{1, 1}}
+}
+
+// newCommentScanner returns a scanner preserving comments, as needed to
+// reformat HTC programs
+func newCommentScanner(r io.Reader) *scanner {
+	s := newScanner(r)
+	s.comments = true
+	return s
 }
 
-// scan returns the next token
+// scan returns the next token, along with its position
 func (s *scanner) scan() token {
+	pos := s.pos
+	t := s.scanToken()
+	t.pos = pos
+	if t.typ != WS {
+		s.last = pos
+	}
+	return t
+}
+
+// scanToken returns the next token
+func (s *scanner) scanToken() token {
 	// Read the next rune
 	ch := s.read()
 
@@ -127,11 +330,17 @@ func (s *scanner) scan() token {
 	} else if ch == '"' {
 		// Quoted string, read till closing '#'
 		return s.scanQuotedString()
+	} else if ch == '$' {
+		return s.scanVariable()
+	} else if ch == '#' && s.comments {
+		return s.scanComment()
 	} else if ch == '#' {
-		// comment, read till newline or EOF
+		// comment, read till newline or EOF. The newline is left unread,
+		// as it still ends the line
 		for {
 			ch = s.read()
 			if ch == '\n' {
+				s.unread()
 				return newToken(HASH, "#")
 			}
 
@@ -157,6 +366,12 @@ func (s *scanner) scan() token {
 		return newToken(OPEN_CURLY, string(ch))
 	case '}':
 		return newToken(CLOSE_CURLY, string(ch))
+	case '(':
+		return newToken(OPEN_PAREN, string(ch))
+	case ')':
+		return newToken(CLOSE_PAREN, string(ch))
+	case ',':
+		return newToken(COMMA, string(ch))
 	case '~':
 		return newToken(TILDE, string(ch))
 	}
@@ -166,6 +381,11 @@ func (s *scanner) scan() token {
 
 // ScanUseful returns the next non-whitespace, non-comment token
 func (s *scanner) ScanUseful() token {
+	if t := s.unscanned; t != nil {
+		s.unscanned = nil
+		s.last = t.pos
+		return *t
+	}
 	for {
 		t := s.scan()
 		if t.typ != WS && t.typ != HASH {
@@ -174,6 +394,12 @@ func (s *scanner) ScanUseful() token {
 	}
 }
 
+// unscan puts back t, the last token returned by ScanUseful, when looking
+// ahead for optional parts of a command. Only one token can be put back
+func (s *scanner) unscan(t token) {
+	s.unscanned = &t
+}
+
 // scanWhitespace consumes the current rune and all contiguous whitespace
 func (s *scanner) scanWhitespace() token {
 	for {
@@ -190,22 +416,197 @@ func (s *scanner) scanWhitespace() token {
 	return newToken(WS, " ")
 }
 
-func (s *scanner) scanQuotedString() token {
+// scanComment consumes a comment till newline or EOF, leaving the newline
+// unread
+func (s *scanner) scanComment() token {
 	var buf bytes.Buffer
+	buf.WriteRune('#')
+
+	for {
+		if ch := s.read(); ch == eof {
+			break
+		} else if ch == '\n' {
+			s.unread()
+			break
+		} else {
+			buf.WriteRune(ch)
+		}
+	}
+
+	return newToken(COMMENT, strings.TrimRight(buf.String(), " \t"))
+}
+
+// scanQuotedString consumes a string after its opening quote. Strings are
+// either enclosed in " and support escape sequences, or enclosed in """ and
+// taken literally, possibly spanning multiple lines
+func (s *scanner) scanQuotedString() token {
+	if b, err := s.r.Peek(1); err == nil && b[0] == '"' {
+		s.read()
+		if b, err := s.r.Peek(1); err == nil && b[0] == '"' {
+			s.read()
+			return s.scanMultilineString()
+		}
+		// Just an empty string
+		t := newToken(STRING, "")
+		t.raw = `""`
+		return t
+	}
+
+	var buf, raw bytes.Buffer
+	raw.WriteRune('"')
 
 	// Read every subsequent character into the buffer, and stop as soon as a
 	// closing " is found. EOF will cause the loop to exit.
 	for {
-		if ch := s.read(); ch == eof {
+		ch := s.read()
+		if ch == eof {
+			break
+		}
+		raw.WriteRune(ch)
+
+		if ch == '"' {
+			break
+		} else if ch != '\\' {
+			buf.WriteRune(ch)
+			continue
+		}
+
+		// Escape sequence
+		ch = s.read()
+		switch ch {
+		case '"', '\\':
+			buf.WriteRune(ch)
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'x':
+			hex := []rune{s.read(), s.read()}
+			raw.WriteString("x" + string(hex))
+			n, err := strconv.ParseUint(string(hex), 16, 8)
+			if err != nil {
+				return newToken(ILLEGAL, raw.String())
+			}
+			buf.WriteByte(byte(n))
+			continue
+		case eof:
+			buf.WriteRune('\\')
+			continue
+		default:
+			// Not an escape sequence, keep the backslash. This way regular
+			// expressions such as "[0-9]\.[0-9]" keep working
+			buf.WriteRune('\\')
+			buf.WriteRune(ch)
+		}
+		raw.WriteRune(ch)
+	}
+
+	t := newToken(STRING, buf.String())
+	t.raw = raw.String()
+	return t
+}
+
+// scanMultilineString consumes a string enclosed in """, after the opening
+// quotes. A newline right after the opening quotes is not part of the string
+func (s *scanner) scanMultilineString() token {
+	var buf bytes.Buffer
+	raw := `"""`
+
+	if ch := s.read(); ch == '\n' {
+		raw += "\n"
+	} else if ch != eof {
+		s.unread()
+	}
+
+	quotes := 0
+	for quotes < 3 {
+		ch := s.read()
+		if ch == eof {
 			break
 		} else if ch == '"' {
+			quotes++
+		} else {
+			quotes = 0
+		}
+		buf.WriteRune(ch)
+	}
+
+	raw += buf.String()
+	if quotes == 3 {
+		buf.Truncate(buf.Len() - 3)
+	}
+
+	t := newToken(STRING, buf.String())
+	t.raw = raw
+	return t
+}
+
+// quote returns s as an HTC quoted string, using escape sequences for quotes,
+// control characters and invalid UTF-8. Backslashes are only escaped when
+// they would otherwise start an escape sequence
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			b.WriteString(`\"`)
+		case c == '\\':
+			if i+1 == len(s) || strings.IndexByte(`"\ntrx`, s[i+1]) >= 0 {
+				b.WriteString(`\\`)
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteString(s[i : i+size])
+				i += size - 1
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	b.WriteByte('"')
+	return b.String()
+}
+
+// scanVariable consumes the name of a variable after its '$'. Names are made
+// of letters, digits and underscores
+func (s *scanner) scanVariable() token {
+	var buf bytes.Buffer
+	buf.WriteRune('$')
+
+	for {
+		if ch := s.read(); ch == eof {
+			break
+		} else if !isLetter(ch) && !isDigit(ch) && ch != '_' {
+			s.unread()
 			break
 		} else {
 			buf.WriteRune(ch)
 		}
 	}
 
-	return newToken(STRING, buf.String())
+	if buf.Len() == 1 {
+		return newToken(ILLEGAL, buf.String())
+	}
+	return newToken(VARIABLE, buf.String())
 }
 
 // scanIdent consumes the current rune and all contiguous ident runes
@@ -235,10 +636,24 @@ func (s *scanner) scanIdent() token {
 		return newToken(EQUAL, str)
 	case "ne":
 		return newToken(NOTEQUAL, str)
+	case "lt":
+		return newToken(LESS, str)
+	case "gt":
+		return newToken(GREATER, str)
 	case "handle":
 		return newToken(HANDLE, str)
 	case "client":
 		return newToken(CLIENT, str)
+	case "assert":
+		return newToken(ASSERT, str)
+	case "skip-if":
+		return newToken(SKIPIF, str)
+	case "only-if":
+		return newToken(ONLYIF, str)
+	case "env":
+		return newToken(ENV, str)
+	case "client-certs":
+		return newToken(CLIENTCERTS, str)
 	case "expect":
 		return newToken(EXPECT, str)
 	case "req":
@@ -254,11 +669,213 @@ func (s *scanner) scanIdent() token {
 		return newToken(BODY, str)
 	case "status":
 		return newToken(STATUS, str)
+	case "origin":
+		return newToken(ORIGIN, str)
+	case "hits":
+		return newToken(HITS, str)
+	case "maxconns":
+		return newToken(MAXCONNS, str)
+	case "script":
+		return newToken(SCRIPT, str)
+	case "if":
+		return newToken(IF, str)
+	case "else":
+		return newToken(ELSE, str)
+	case "cookies":
+		return newToken(COOKIES, str)
+	case "defaults":
+		return newToken(DEFAULTS, str)
+	case "header":
+		return newToken(HEADER, str)
+	case "follow-redirects":
+		return newToken(FOLLOW, str)
+	case "empty-for-head":
+		return newToken(EMPTYHEAD, str)
+	case "preflight":
+		return newToken(PREFLIGHT, str)
+	case "cors":
+		return newToken(CORS, str)
+	case "rawheaders":
+		return newToken(RAWHEADERS, str)
+	case "pipeline":
+		return newToken(PIPELINE, str)
+	case "end":
+		return newToken(END, str)
+	case "restart-proxy":
+		return newToken(RESTART, str)
+	case "reload-proxy-config":
+		return newToken(RELOAD, str)
+	case "set":
+		return newToken(SET, str)
+	case "file":
+		return newToken(FILE, str)
+	case "in-flight":
+		return newToken(INFLIGHT, str)
+	case "cache":
+		return newToken(CACHE, str)
+	case "persists":
+		return newToken(PERSISTS, str)
+	case "parent-proxy":
+		return newToken(PARENT, str)
+	case "parents":
+		return newToken(PARENTS, str)
+	case "topology":
+		return newToken(TOPOLOGY, str)
+	case "hop":
+		return newToken(HOP, str)
+	case "streamed":
+		return newToken(STREAMED, str)
+	case "outcome":
+		return newToken(OUTCOME, str)
+	case "received":
+		return newToken(RECEIVED, str)
+	case "digest":
+		return newToken(DIGEST, str)
+	case "encoding":
+		return newToken(ENCODING, str)
+	case "transform":
+		return newToken(TRANSFORM, str)
+	case "vary":
+		return newToken(VARY, str)
+	case "header-rewrite":
+		return newToken(REWRITE, str)
+	case "negative":
+		return newToken(NEGATIVE, str)
+	case "negative-caching":
+		return newToken(NEGCACHING, str)
+	case "lifetime":
+		return newToken(LIFETIME, str)
+	case "invalidate":
+		return newToken(INVALIDATE, str)
+	case "invalidate-tag":
+		return newToken(INVALIDTAG, str)
+	case "signing-key":
+		return newToken(SIGNINGKEY, str)
+	case "sign":
+		return newToken(SIGN, str)
+	case "request":
+		return newToken(REQUEST, str)
+	case "order":
+		return newToken(ORDER, str)
+	case "before":
+		return newToken(BEFORE, str)
+	case "after":
+		return newToken(AFTER, str)
+	case "conn":
+		return newToken(CONN, str)
+	case "reused":
+		return newToken(REUSED, str)
+	case "time":
+		return newToken(TIME, str)
+	case "dns":
+		return newToken(DNS, str)
+	case "connect":
+		return newToken(CONNECT, str)
+	case "ttfb":
+		return newToken(TTFB, str)
+	case "total":
+		return newToken(TOTAL, str)
+	case "tls":
+		return newToken(TLS, str)
+	case "version":
+		return newToken(VERSION, str)
+	case "cipher":
+		return newToken(CIPHER, str)
+	case "alpn":
+		return newToken(ALPN, str)
+	case "cert":
+		return newToken(CERT, str)
+	case "cn":
+		return newToken(CN, str)
+	case "issuer":
+		return newToken(ISSUER, str)
+	case "san":
+		return newToken(SAN, str)
+	case "serial":
+		return newToken(SERIAL, str)
+	case "current":
+		return newToken(CURRENT, str)
+	case "handshake":
+		return newToken(HANDSHAKE, str)
+	case "rotate-cert":
+		return newToken(ROTATECERT, str)
+	case "network":
+		return newToken(NETWORK, str)
+	case "latency":
+		return newToken(LATENCY, str)
+	case "bandwidth":
+		return newToken(BANDWIDTH, str)
+	case "reset-after":
+		return newToken(RESETAFTER, str)
+	case "timeout":
+		return newToken(TIMEOUT, str)
+	case "within":
+		return newToken(WITHIN, str)
+	case "default":
+		return newToken(DEFAULT, str)
+	case "redirects":
+		return newToken(REDIRECTS, str)
+	case "requests":
+		return newToken(REQUESTS, str)
+	case "retries":
+		return newToken(RETRIES, str)
+	case "url":
+		return newToken(URL, str)
+	case "auth":
+		return newToken(AUTH, str)
+	case "user":
+		return newToken(USER, str)
+	case "password":
+		return newToken(PASSWORD, str)
+	case "bearer":
+		return newToken(BEARER, str)
+	case "trailers":
+		return newToken(TRAILERS, str)
+	case "proto":
+		return newToken(PROTO, str)
+	case "hints":
+		return newToken(HINTS, str)
+	case "proxy":
+		return newToken(PROXY, str)
+	case "metric":
+		return newToken(METRIC, str)
+	case "capture":
+		return newToken(CAPTURE, str)
+	case "ip":
+		return newToken(IP, str)
+	case "forwarded":
+		return newToken(FORWARDED, str)
+	case "xff":
+		return newToken(XFF, str)
+	case "chain":
+		return newToken(CHAIN, str)
+	case "last":
+		return newToken(LAST, str)
+	case "remote":
+		return newToken(REMOTE, str)
+	case "burst":
+		return newToken(BURST, str)
+	case "fuzz":
+		return newToken(FUZZ, str)
+	case "statuses":
+		return newToken(STATUSES, str)
+	case "wait":
+		return newToken(WAIT, str)
+	case "conditional":
+		return newToken(CONDITIONAL, str)
+	case "auto":
+		return newToken(AUTO, str)
 	case "tx":
 		return newToken(TX, str)
 		// tx arguments follow
 	case "-body":
 		return newToken(BODY_ARG, str)
+	case "-body-file":
+		return newToken(BODYFILE_ARG, str)
+	case "-body-base64":
+		return newToken(BODYBASE64_ARG, str)
+	case "-body-hex":
+		return newToken(BODYHEX_ARG, str)
 	case "-status":
 		return newToken(STATUS_ARG, str)
 	case "-header":
@@ -267,6 +884,76 @@ func (s *scanner) scanIdent() token {
 		return newToken(METHOD_ARG, str)
 	case "-url":
 		return newToken(URL_ARG, str)
+	case "-host":
+		return newToken(HOST_ARG, str)
+	case "-no-keepalive":
+		return newToken(NOKEEPALIVE_ARG, str)
+	case "-no-request-id":
+		return newToken(NOREQUESTID_ARG, str)
+	case "-no-defaults":
+		return newToken(NODEFAULTS_ARG, str)
+	case "-follow-redirects":
+		return newToken(FOLLOWREDIRECTS_ARG, str)
+	case "-basic-auth":
+		return newToken(BASICAUTH_ARG, str)
+	case "-bearer":
+		return newToken(BEARER_ARG, str)
+	case "-forward":
+		return newToken(FORWARD_ARG, str)
+	case "-tunnel":
+		return newToken(TUNNEL_ARG, str)
+	case "-trailer":
+		return newToken(TRAILER_ARG, str)
+	case "-grpc":
+		return newToken(GRPC_ARG, str)
+	case "-early-hint":
+		return newToken(EARLYHINT_ARG, str)
+	case "-timeout":
+		return newToken(TIMEOUT_ARG, str)
+	case "-send-body-rate":
+		return newToken(SENDBODYRATE_ARG, str)
+	case "-read-rate":
+		return newToken(READRATE_ARG, str)
+	case "-abort-after":
+		return newToken(ABORTAFTER_ARG, str)
+	case "-chunked":
+		return newToken(CHUNKED_ARG, str)
+	case "-digest":
+		return newToken(DIGEST_ARG, str)
+	case "-signed":
+		return newToken(SIGNED_ARG, str)
+	case "-scheme":
+		return newToken(SCHEME_ARG, str)
+	case "-proxy-protocol":
+		return newToken(PROXYPROTOCOL_ARG, str)
+	case "-proxy-src":
+		return newToken(PROXYSRC_ARG, str)
+	case "-bind":
+		return newToken(BIND_ARG, str)
+	case "-tls":
+		return newToken(TLS_ARG, str)
+	case "-tls-min":
+		return newToken(TLSMIN_ARG, str)
+	case "-tls-max":
+		return newToken(TLSMAX_ARG, str)
+	case "-sni":
+		return newToken(SNI_ARG, str)
+	case "-client-cert":
+		return newToken(CLIENTCERT_ARG, str)
+	case "-date-offset":
+		return newToken(DATEOFFSET_ARG, str)
+	case "-expires-offset":
+		return newToken(EXPIRESOFFSET_ARG, str)
+	case "-etag":
+		return newToken(ETAG_ARG, str)
+	case "-origin":
+		return newToken(ORIGIN_ARG, str)
+	case "-request-method":
+		return newToken(REQUESTMETHOD_ARG, str)
+	case "-request-headers":
+		return newToken(REQUESTHEADERS_ARG, str)
+	case "-proto":
+		return newToken(PROTO_ARG, str)
 	}
 
 	if _, err := strconv.Atoi(str); err == nil {
@@ -274,6 +961,23 @@ func (s *scanner) scanIdent() token {
 		return newToken(INTEGER, str)
 	}
 
+	if len(str) > 1 && str[0] == 'p' {
+		if n, err := strconv.Atoi(str[1:]); err == nil && n >= 0 && n <= 100 {
+			// Looks like a percentile, eg: p99
+			return newToken(PERCENTILE, str)
+		}
+	}
+
+	if _, err := time.ParseDuration(str); err == nil {
+		// Looks like a duration, eg: 100ms
+		return newToken(DURATION, str)
+	}
+
+	if _, ok := parseSize(str); ok {
+		// Looks like a size, eg: 64KB
+		return newToken(SIZE, str)
+	}
+
 	// Otherwise assume this is illegal
 	return newToken(ILLEGAL, str)
 }
@@ -281,15 +985,27 @@ func (s *scanner) scanIdent() token {
 // read reads the next rune from the buffered reader.
 // Returns the rune(0) if an error occurs (or io.EOF is returned).
 func (s *scanner) read() rune {
+	s.prevPos = s.pos
+
 	ch, _, err := s.r.ReadRune()
 	if err != nil {
 		return eof
 	}
+
+	if ch == '\n' {
+		s.pos.line++
+		s.pos.col = 1
+	} else {
+		s.pos.col++
+	}
 	return ch
 }
 
 // unread places the previously read rune back on the reader.
-func (s *scanner) unread() { _ = s.r.UnreadRune() }
+func (s *scanner) unread() {
+	_ = s.r.UnreadRune()
+	s.pos = s.prevPos
+}
 
 // isWhitespace returns true if the rune is a space or a tab
 func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' }
@@ -71,14 +71,63 @@ func TestScanUseful(t *testing.T) {
 		newScanTest("]", CLOSE_BRACKET, "]"),
 		newScanTest("{", OPEN_CURLY, "{"),
 		newScanTest("}", CLOSE_CURLY, "}"),
+		newScanTest("(", OPEN_PAREN, "("),
+		newScanTest(")", CLOSE_PAREN, ")"),
+		newScanTest(",", COMMA, ","),
 		newScanTest("~", TILDE, "~"),
 		newScanTest("$", ILLEGAL, "$"),
 		newScanTest("# banana potato\n  \n\n handle", NEWLINE, "\n"),
-		newScanTest("# banana potato\n\"ciao\"", STRING, "ciao"),
+		newScanTest("# banana potato\n\"ciao\"", NEWLINE, "\n"),
 		newScanTest("# banana", EOF, ""),
 		newScanTest("     ", EOF, ""),
 		newScanTest("\"", STRING, ""),
 		newScanTest("-status-code", ILLEGAL, "-status-code"),
+		newScanTest("100ms", DURATION, "100ms"),
+		newScanTest("64KB", SIZE, "64KB"),
+		newScanTest("64kb", ILLEGAL, "64kb"),
+		newScanTest("reset-after", RESETAFTER, "reset-after"),
+		newScanTest("script", SCRIPT, "script"),
+		newScanTest("cookies", COOKIES, "cookies"),
+		newScanTest("defaults", DEFAULTS, "defaults"),
+		newScanTest("follow-redirects", FOLLOW, "follow-redirects"),
+		newScanTest("empty-for-head", EMPTYHEAD, "empty-for-head"),
+		newScanTest("preflight", PREFLIGHT, "preflight"),
+		newScanTest("rawheaders", RAWHEADERS, "rawheaders"),
+		newScanTest("-proto", PROTO_ARG, "-proto"),
+		newScanTest("pipeline", PIPELINE, "pipeline"),
+		newScanTest("end", END, "end"),
+		newScanTest("restart-proxy", RESTART, "restart-proxy"),
+		newScanTest("reload-proxy-config", RELOAD, "reload-proxy-config"),
+		newScanTest("in-flight", INFLIGHT, "in-flight"),
+		newScanTest("cache", CACHE, "cache"),
+		newScanTest("persists", PERSISTS, "persists"),
+		newScanTest("parent-proxy", PARENT, "parent-proxy"),
+		newScanTest("parents", PARENTS, "parents"),
+		newScanTest("topology", TOPOLOGY, "topology"),
+		newScanTest("hop", HOP, "hop"),
+		newScanTest("streamed", STREAMED, "streamed"),
+		newScanTest("outcome", OUTCOME, "outcome"),
+		newScanTest("received", RECEIVED, "received"),
+		newScanTest("digest", DIGEST, "digest"),
+		newScanTest("encoding", ENCODING, "encoding"),
+		newScanTest("transform", TRANSFORM, "transform"),
+		newScanTest("vary", VARY, "vary"),
+		newScanTest("header-rewrite", REWRITE, "header-rewrite"),
+		newScanTest("negative", NEGATIVE, "negative"),
+		newScanTest("negative-caching", NEGCACHING, "negative-caching"),
+		newScanTest("lifetime", LIFETIME, "lifetime"),
+		newScanTest("invalidate", INVALIDATE, "invalidate"),
+		newScanTest("invalidate-tag", INVALIDTAG, "invalidate-tag"),
+		newScanTest("signing-key", SIGNINGKEY, "signing-key"),
+		newScanTest("sign", SIGN, "sign"),
+		newScanTest("-request-method", REQUESTMETHOD_ARG, "-request-method"),
+		newScanTest("lt", LESS, "lt"),
+		newScanTest("gt", GREATER, "gt"),
+		newScanTest("p99", PERCENTILE, "p99"),
+		newScanTest("p101", ILLEGAL, "p101"),
+		newScanTest("timeout", TIMEOUT, "timeout"),
+		newScanTest("within", WITHIN, "within"),
+		newScanTest("-body-file", BODYFILE_ARG, "-body-file"),
 	}
 
 	for _, test := range tests {
@@ -114,5 +163,79 @@ client "nemo" {
 		i++
 	}
 
-	assert.Equal(t, 81, i)
+	assert.Equal(t, 82, i)
+}
+
+func TestScanPosition(t *testing.T) {
+	s := newScanner(strings.NewReader("# comment\nhandle \"/\" {\n\ttx -status 200\n}"))
+
+	// Comments end their line
+	expected := []position{{1, 10}, {2, 1}, {2, 8}, {2, 12}, {2, 13}, {3, 2}, {3, 5}, {3, 13}, {3, 16}, {4, 1}, {4, 2}}
+	for _, pos := range expected {
+		tok := s.ScanUseful()
+		assert.Equal(t, pos, tok.pos, tok.String())
+	}
+	assert.Equal(t, EOF, s.ScanUseful().typ)
+
+	// unscan puts back a whole token
+	s = newScanner(strings.NewReader("within \"1s\""))
+	tok := s.ScanUseful()
+	s.unscan(tok)
+	assert.Equal(t, tok, s.ScanUseful())
+	assert.Equal(t, STRING, s.ScanUseful().typ)
+
+	// unread goes back to the previous position
+	s = newScanner(strings.NewReader("ab"))
+	s.read()
+	s.read()
+	s.unread()
+	assert.Equal(t, position{1, 2}, s.pos)
+}
+
+func TestScanQuotedString(t *testing.T) {
+	tests := []scanTest{
+		newScanTest(`"say \"hi\""`, STRING, `say "hi"`),
+		newScanTest(`"a\nb\tc\rd"`, STRING, "a\nb\tc\rd"),
+		newScanTest(`"\x00\xff\\"`, STRING, "\x00\xff\\"),
+		newScanTest(`"^ATS/[0-9]\.[0-9]$"`, STRING, `^ATS/[0-9]\.[0-9]$`),
+		newScanTest(`"\xzz"`, ILLEGAL, `"\xzz`),
+		newScanTest(`""`, STRING, ""),
+		newScanTest("\"\"\"\n{\"a\": \"b\"}\nsecond line\n\"\"\"", STRING, "{\"a\": \"b\"}\nsecond line\n"),
+		newScanTest(`"""one "quoted" line"""`, STRING, `one "quoted" line`),
+	}
+
+	for _, test := range tests {
+		s := newScanner(strings.NewReader(test.input))
+		tok := s.ScanUseful()
+		assert.Equal(t, test.expectedToken, tok.typ, test.input)
+		assert.Equal(t, test.expectedValue, tok.val, test.input)
+		if tok.typ == STRING {
+			assert.Equal(t, test.input, tok.raw)
+		}
+	}
+
+	// Positions account for multi-line strings
+	s := newScanner(strings.NewReader("\"\"\"\na\nb\"\"\" tx"))
+	s.ScanUseful()
+	assert.Equal(t, position{3, 6}, s.ScanUseful().pos)
+}
+
+func TestQuote(t *testing.T) {
+	for _, str := range []string{
+		"hello",
+		`say "hi"`,
+		"two\nlines\twith\rcontrol\x00chars",
+		"\xff\xfe invalid UTF-8, valid UTF-8: àè",
+		`^ATS/[0-9]\.[0-9]$`,
+		`trailing backslash \`,
+		`\n is not a newline`,
+	} {
+		q := quote(str)
+		tok := newScanner(strings.NewReader(q)).ScanUseful()
+		assert.Equal(t, STRING, tok.typ, q)
+		assert.Equal(t, str, tok.val, q)
+	}
+
+	assert.Equal(t, `"[0-9]\.[0-9]"`, quote(`[0-9]\.[0-9]`))
+	assert.Equal(t, `"say \"hi\"\n"`, quote("say \"hi\"\n"))
 }
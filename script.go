@@ -0,0 +1,267 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Scripts computing the responses of handlers from the requests they receive,
+// for behaviors that tx alone cannot express. Eg:
+//
+//	handle "/flaky" {
+//	    script """
+//	    if hits % 2 == 0:
+//	        resp.status = 500
+//	    resp.headers["X-Body-Hash"] = sha256(req.body)
+//	    """
+//	}
+//
+// Scripts are written in Starlark, a dialect of Python, with if statements
+// and for loops allowed outside of functions. The request is available as
+// req, the number of requests received by the handler as hits, and the
+// response as resp, initialized by tx if any
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// scriptOptions are the Starlark dialect of scripts, which are not made of
+// function definitions only and may thus need statements at the top level
+var scriptOptions = &syntax.FileOptions{Set: true, GlobalReassign: true, TopLevelControl: true}
+
+// scriptFuncs are the functions available to scripts, besides the built-in
+// ones of Starlark such as len, str and int
+var scriptFuncs = starlark.StringDict{
+	"base64": stringFunc("base64", func(s ...string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s[0]))
+	}, 1),
+	"md5": stringFunc("md5", func(s ...string) string {
+		sum := md5.Sum([]byte(s[0]))
+		return hex.EncodeToString(sum[:])
+	}, 1),
+	"sha256": stringFunc("sha256", func(s ...string) string {
+		sum := sha256.Sum256([]byte(s[0]))
+		return hex.EncodeToString(sum[:])
+	}, 1),
+	"hmac_sha256": stringFunc("hmac_sha256", func(s ...string) string {
+		mac := hmac.New(sha256.New, []byte(s[0]))
+		mac.Write([]byte(s[1]))
+		return hex.EncodeToString(mac.Sum(nil))
+	}, 2),
+}
+
+// stringFunc returns a Starlark function named name, calling f with its n
+// arguments, which must be strings
+func stringFunc(name string, f func(s ...string) string, n int) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := make([]string, n)
+		vars := make([]any, n)
+		for i := range s {
+			vars[i] = &s[i]
+		}
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, n, vars...); err != nil {
+			return nil, err
+		}
+		return starlark.String(f(s...)), nil
+	})
+}
+
+// script is a compiled script, run for every request received by its handler
+type script struct {
+	prog *starlark.Program
+}
+
+// parseScript compiles the source of a script. Scripts are usually indented
+// along with the handle stanza they are in, which Starlark does not allow, so
+// the indentation common to all lines is removed first
+func parseScript(src string) (*script, error) {
+	_, prog, err := starlark.SourceProgramOptions(scriptOptions, "script", dedent(src), func(name string) bool {
+		return name == "req" || name == "hits" || name == "resp" || scriptFuncs.Has(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &script{prog: prog}, nil
+}
+
+// dedent removes the indentation common to all the lines of src which are not
+// blank
+func dedent(src string) string {
+	lines := strings.Split(src, "\n")
+	var prefix string
+	found := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			prefix, found = indent, true
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// scriptValues are the headers or the query parameters of the request, as
+// req.headers and req.query. Missing names are empty, and header names are
+// case insensitive
+type scriptValues struct {
+	values map[string][]string
+	key    func(string) string
+}
+
+func (v scriptValues) String() string        { return fmt.Sprint(v.values) }
+func (v scriptValues) Type() string          { return "values" }
+func (v scriptValues) Freeze()               {}
+func (v scriptValues) Truth() starlark.Bool  { return len(v.values) > 0 }
+func (v scriptValues) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: values") }
+
+// Get returns the first value with the given name
+func (v scriptValues) Get(k starlark.Value) (starlark.Value, bool, error) {
+	name, ok := starlark.AsString(k)
+	if !ok {
+		return nil, false, fmt.Errorf("expecting a string index, got %s", k.Type())
+	}
+	if values := v.values[v.key(name)]; len(values) > 0 {
+		return starlark.String(values[0]), true, nil
+	}
+	return starlark.String(""), true, nil
+}
+
+// scriptRequest returns the request as req, whose body was already read
+func scriptRequest(req *http.Request, body []byte) *starlarkstruct.Struct {
+	identity := func(name string) string { return name }
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"method":  starlark.String(req.Method),
+		"path":    starlark.String(req.URL.Path),
+		"url":     starlark.String(req.URL.RequestURI()),
+		"host":    starlark.String(req.Host),
+		"body":    starlark.String(body),
+		"headers": scriptValues{req.Header, http.CanonicalHeaderKey},
+		"query":   scriptValues{req.URL.Query(), identity},
+	})
+}
+
+// scriptResponse is the response computed by a script, as resp, whose status
+// and body can be set, and whose headers can be changed
+type scriptResponse struct {
+	status  int
+	body    string
+	headers *starlark.Dict
+}
+
+func (r *scriptResponse) String() string        { return fmt.Sprintf("<response %d>", r.status) }
+func (r *scriptResponse) Type() string          { return "response" }
+func (r *scriptResponse) Freeze()               { r.headers.Freeze() }
+func (r *scriptResponse) Truth() starlark.Bool  { return true }
+func (r *scriptResponse) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: response") }
+func (r *scriptResponse) AttrNames() []string   { return []string{"body", "headers", "status"} }
+
+func (r *scriptResponse) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "status":
+		return starlark.MakeInt(r.status), nil
+	case "body":
+		return starlark.String(r.body), nil
+	case "headers":
+		return r.headers, nil
+	}
+	return nil, nil
+}
+
+func (r *scriptResponse) SetField(name string, v starlark.Value) error {
+	switch name {
+	case "status":
+		code, err := starlark.AsInt32(v)
+		if _, ok := v.(starlark.Int); !ok || err != nil || code < 100 || code > 999 {
+			return fmt.Errorf("resp.status must be set to a status code, got %s", v)
+		}
+		r.status = code
+	case "body":
+		body, ok := starlark.AsString(v)
+		if !ok {
+			return fmt.Errorf("resp.body must be set to a string, got %s", v.Type())
+		}
+		r.body = body
+	default:
+		return starlark.NoSuchAttrError(fmt.Sprintf("resp has no field %q to set", name))
+	}
+	return nil
+}
+
+// run executes the script for the given request, whose body was already
+// read, returning resp updated with the status, body and headers set by the
+// script. hits is the number of requests received by the handler so far,
+// this one included
+func (s *script) run(resp TxResp, req *http.Request, body []byte, hits int) (TxResp, error) {
+	if resp.statusCode == 0 {
+		resp.statusCode = http.StatusOK
+	}
+	r := &scriptResponse{status: resp.statusCode, body: string(resp.body), headers: starlark.NewDict(len(resp.headers))}
+	for name, value := range resp.headers {
+		r.headers.SetKey(starlark.String(name), starlark.String(value))
+	}
+
+	predeclared := starlark.StringDict{"req": scriptRequest(req, body), "hits": starlark.MakeInt(hits), "resp": r}
+	for name, fn := range scriptFuncs {
+		predeclared[name] = fn
+	}
+	thread := &starlark.Thread{Name: "script"}
+	if _, err := s.prog.Init(thread, predeclared); err != nil {
+		// The position in the script of the innermost call failing, rather
+		// than a whole traceback
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			for i := range evalErr.CallStack {
+				if pos := evalErr.CallStack.At(i).Pos; pos.Filename() == "script" {
+					return resp, fmt.Errorf("%s: %s", pos, evalErr.Msg)
+				}
+			}
+		}
+		return resp, err
+	}
+
+	headers := make(map[string]string, r.headers.Len())
+	for _, item := range r.headers.Items() {
+		name, nameOK := starlark.AsString(item[0])
+		value, valueOK := starlark.AsString(item[1])
+		if !nameOK || !valueOK {
+			return resp, fmt.Errorf("resp.headers must map strings to strings, got %s: %s", item[0], item[1])
+		}
+		headers[name] = value
+	}
+
+	resp.statusCode = r.status
+	// Bodies streamed from large files are only replaced if set
+	if r.body != string(resp.body) {
+		resp.body = []byte(r.body)
+		resp.bodyFile = fileArg{}
+	}
+	resp.headers = headers
+	return resp, nil
+}
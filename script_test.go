@@ -0,0 +1,199 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScript(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`resp.status = 500`,
+		`resp.status = 200; resp.body = "ok"`,
+		`
+    # comment
+    if hits % 2 == 0 and req.method != "HEAD":
+        resp.status = 500
+    elif hits > 10:
+        resp.status = 503 # comment
+    else:
+        resp.headers["X-Hits"] = str(hits)
+    `,
+		`resp.body = sha256(req.body) + "\n"`,
+		`x = -(1 + 2) * 3; resp.status = 200 + x`,
+		`for i in range(3): resp.headers["X-%d" % i] = str(i)`,
+	} {
+		_, err := parseScript(src)
+		assert.Nil(t, err, src)
+	}
+
+	for _, src := range []string{
+		`resp.status = `,
+		`resp.status 500`,
+		`resp.status = 500 resp.body = "a"`,
+		`if True: resp.status = 500
+  resp.body = "a"`,
+		`if True resp.status = 500`,
+		`resp.status = banana(1)`,
+		`resp.body = "unterminated`,
+		`resp.status = 1 @ 2`,
+		`while True: pass`,
+		`x = undefined`,
+	} {
+		_, err := parseScript(src)
+		assert.Error(t, err, src)
+	}
+}
+
+func TestDedent(t *testing.T) {
+	assert.Equal(t, "\nif True:\n    x = 1\n\ny = 2\n", dedent("\n    if True:\n        x = 1\n\n    y = 2\n"))
+	assert.Equal(t, "x = 1\n y = 2", dedent("\tx = 1\n\t y = 2"))
+	// Blank lines do not count, whatever their indentation
+	assert.Equal(t, "x = 1\n  \ny = 2\n  ", dedent("    x = 1\n  \n    y = 2\n  "))
+}
+
+func TestParseHandleScript(t *testing.T) {
+	p, err := Parse(strings.NewReader(`handle "/" {
+    script """
+    resp.status = 503
+    """
+    tx -status 200
+}
+
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, p.Handlers[0].Script)
+	assert.Equal(t, 200, p.Handlers[0].Response.statusCode)
+
+	for _, input := range []string{
+		`handle "/" {
+    script
+}`,
+		`handle "/" {
+    script "resp.status = "
+}`,
+		`handle "/" {
+    script "resp.status = 200"
+    script "resp.status = 500"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestScriptRun(t *testing.T) {
+	run := func(src string, hits int) (TxResp, error) {
+		sc, err := parseScript(src)
+		assert.Nil(t, err, src)
+		req := httptest.NewRequest("POST", "/sign?key=secret", strings.NewReader("ping"))
+		req.Header.Set("X-Fish", "nemo")
+		return sc.run(TxResp{statusCode: 201, body: []byte("tx"), headers: map[string]string{"X-Tx": "1"}}, req, []byte("ping"), hits)
+	}
+
+	// The response given with tx is kept, unless changed
+	resp, err := run(``, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, TxResp{statusCode: 201, body: []byte("tx"), headers: map[string]string{"X-Tx": "1"}}, resp)
+
+	flaky := `resp.status = 500 if hits % 2 == 0 else 200`
+	resp, err = run(flaky, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.statusCode)
+	resp, err = run(flaky, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, resp.statusCode)
+
+	resp, err = run(`resp.body = req.method + " " + req.path + " " + req.query["key"] + " " + req.headers["x-fish"].upper() + " " + str(len(req.body)) + req.headers["X-Missing"]
+resp.headers["X-Tx"] = resp.headers["X-Tx"] + "2"
+resp.headers["X-Sum"] = sha256(req.body)
+resp.headers["X-Mac"] = hmac_sha256(req.query["key"], req.body)`, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "POST /sign secret NEMO 4", string(resp.body))
+	assert.Equal(t, map[string]string{
+		"X-Tx":  "12",
+		"X-Sum": "758d61f26a44448384e5c4468a0dcb7a2abe456067b0f7b505bc28b9411fe931",
+		"X-Mac": "6731b226e7fde8e1e3a4ce7adada71afb5ace634bf717d65f7ebeb9cf2b7fef1",
+	}, resp.headers)
+
+	for _, src := range []string{
+		`resp.status = "500"`,
+		`resp.status = 42`,
+		`resp.status = True`,
+		`resp.body = 1`,
+		`resp.banana = 1`,
+		`resp.status = 1 // 0`,
+		`resp.status = 1 + "a"`,
+		`x = req.banana`,
+		`x = int("abc")`,
+		`x = sha256(1)`,
+		`resp.headers["X"] = 1`,
+		`req.headers["X"] = "a"`,
+		"def f(): return f()\nx = f()",
+	} {
+		_, err := run(src, 1)
+		assert.Error(t, err, src)
+	}
+
+	// Errors tell where they happened
+	_, err = run("x = 1\nx = int(\"abc\")", 1)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "script:2:"), err.Error())
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	report := runDirect(t, `handle "/flaky" {
+    script """
+    if hits % 2 == 0:
+        resp.status = 500
+    resp.body = "hit " + str(hits)
+    """
+}
+
+client "first" {
+    tx -url "/flaky"
+    expect resp.status eq 200
+    expect resp.body eq "hit 1"
+}
+
+client "second" {
+    wait "100ms"
+    tx -url "/flaky"
+    expect resp.status eq 500
+    expect resp.body eq "hit 2"
+}`)
+	assert.False(t, report.Failed(), report.Clients)
+
+	// Runtime errors fail the test
+	report = runDirect(t, `handle "/" {
+    script """
+    resp.status = int(req.headers["X-Status"])
+    """
+}
+
+client "a" {
+    tx -url "/"
+    expect resp.status eq 500
+}`)
+	assert.True(t, report.Failed())
+}
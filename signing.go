@@ -0,0 +1,297 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Signed URLs, which origin handlers can require to test proxies validating
+// or passing tokens, eg:
+//
+//	signing-key "cdn" "s3cret"
+//
+//	handle "/video/*" -signed "cdn" {
+//	    tx -body "segment"
+//	}
+//
+// Clients sign URLs with the sign function, given the path, the name of the
+// key and how long the URL is valid for, negative for expired URLs:
+//
+//	tx -url sign("/video/seg1.ts", "cdn", 1h)
+//
+// By default, the token is made of the last two parameters of the query
+// string:
+//
+//	/video/seg1.ts?expires=1767225600&signature=...
+//
+// where expires is the expiry time as a Unix timestamp, and signature is the
+// unpadded base64url encoding of the HMAC-SHA256 of the URL up to expires
+// included. Keys given -scheme "url_sig" use the tokens of the url_sig
+// plugin of ATS instead, see verifyURLSig
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors of verifySignedURL, sent in the body of 401 responses
+var (
+	errTokenMissing   = errors.New("missing token")
+	errTokenExpired   = errors.New("expired token")
+	errTokenSignature = errors.New("invalid signature")
+)
+
+// Schemes of signed URLs, set with the -scheme argument of signing-key
+const (
+	// hmacScheme appends the expires and signature parameters, see
+	// verifySignedURL
+	hmacScheme = "hmac-sha256"
+	// urlSigScheme appends the parameters of the url_sig plugin of ATS, see
+	// verifyURLSig
+	urlSigScheme = "url_sig"
+)
+
+// urlSigParts is the P parameter of the URLs signed for url_sig: the host is
+// left out of the signature, as proxies may rewrite it, and the whole path is
+// signed
+const urlSigParts = "01"
+
+// urlSigAlgorithms are the hash functions of the HMAC of url_sig, by their A
+// parameter
+var urlSigAlgorithms = map[string]func() hash.Hash{
+	"1": sha1.New,
+	"2": md5.New,
+}
+
+// SigningKey is a key signing URLs, set with the signing-key directive
+type SigningKey struct {
+	// Scheme is how URLs are signed, hmacScheme or urlSigScheme
+	Scheme string
+	Secret string
+}
+
+// parseSigningKey parses the signing-key directive, returning the name of the
+// key and the key itself
+func parseSigningKey(s *scanner) (string, SigningKey, error) {
+	k := SigningKey{Scheme: hmacScheme}
+
+	token := s.ScanUseful()
+	if token.typ == SCHEME_ARG {
+		token = s.ScanUseful()
+		if token.typ != STRING || (token.val != hmacScheme && token.val != urlSigScheme) {
+			return "", k, fmt.Errorf("Parse error in 'signing-key' directive: expecting %q or %q after -scheme, got %q", hmacScheme, urlSigScheme, token)
+		}
+		k.Scheme = token.val
+		token = s.ScanUseful()
+	}
+	if token.typ != STRING || token.val == "" {
+		return "", k, fmt.Errorf("Parse error in 'signing-key' directive: expecting a name, got %q", token)
+	}
+	name := token.val
+
+	token = s.ScanUseful()
+	if token.typ != STRING || token.val == "" {
+		return "", k, fmt.Errorf("Parse error in 'signing-key' directive: expecting a secret after %q, got %q", name, token)
+	}
+	k.Secret = token.val
+	return name, k, nil
+}
+
+// sign returns uri with a token of k valid until expires
+func (k SigningKey) sign(uri string, expires time.Time) string {
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	if k.Scheme == urlSigScheme {
+		uri += fmt.Sprintf("%sE=%d&A=1&K=0&P=%s&S=", sep, expires.Unix(), urlSigParts)
+		return uri + urlSigSignature(sha1.New, []byte(k.Secret), urlSigMessage("", uri, urlSigParts))
+	}
+	uri += fmt.Sprintf("%sexpires=%d", sep, expires.Unix())
+	return uri + "&signature=" + urlSignature([]byte(k.Secret), uri)
+}
+
+// verify returns nil if u, requested for the given host, carries a token of
+// k not expired at now
+func (k SigningKey) verify(host string, u *url.URL, now time.Time) error {
+	if k.Scheme == urlSigScheme {
+		return verifyURLSig(host, u, []byte(k.Secret), now)
+	}
+	return verifySignedURL(u, []byte(k.Secret), now)
+}
+
+// urlSignature returns the signature of the given URL, up to expires
+// included
+func urlSignature(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// urlSigMessage returns what url_sig signs of uri, requested for the given
+// host, up to the S parameter included: the parts of the host and of the path
+// selected by parts, the P parameter, then the query string. Each character
+// of parts, 0 or 1, tells whether to sign the part at the same position, the
+// last one applying to the remaining parts
+func urlSigMessage(host, uri, parts string) string {
+	path, query, _ := strings.Cut(uri, "?")
+	var selected []string
+	signed := false
+	for i, part := range strings.Split(host+path, "/") {
+		if i < len(parts) {
+			signed = parts[i] == '1'
+		}
+		if signed {
+			selected = append(selected, part)
+		}
+	}
+	return strings.Join(selected, "/") + "?" + query
+}
+
+// urlSigSignature returns the hex encoded HMAC of message, as in the S
+// parameter of url_sig
+func urlSigSignature(h func() hash.Hash, key []byte, message string) string {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// urlSigning is how the URL of a request is signed, see sign
+type urlSigning struct {
+	// name is the name of the signing key, and key the key itself, set by
+	// Parse once it is known
+	name string
+	key  SigningKey
+	// expiry is how long the URL is valid for from when the request is
+	// sent. Negative for expired URLs
+	expiry time.Duration
+}
+
+// parseSign parses the arguments of the sign function following -url,
+// returning the URL to sign and how, eg: ("/video/seg1.ts", "cdn", 1h)
+func parseSign(s *scanner) (string, *urlSigning, error) {
+	form := `sign("/path", "key", 1h)`
+	var args []token
+	for _, typ := range []tokenType{OPEN_PAREN, STRING, COMMA, STRING, COMMA, DURATION, CLOSE_PAREN} {
+		token := s.ScanUseful()
+		if token.typ != typ && (typ != DURATION || token.typ != STRING) {
+			return "", nil, fmt.Errorf("Parse error in 'tx' command: expecting %s, got %q", form, token)
+		}
+		args = append(args, token)
+	}
+
+	uri, key := args[1].val, args[3].val
+	if uri == "" || uri[0] != '/' {
+		return "", nil, fmt.Errorf("Parse error in 'tx' command: expecting a path to sign, got %q", args[1])
+	}
+	expiry, err := time.ParseDuration(args[5].val)
+	if err != nil {
+		return "", nil, fmt.Errorf("Parse error in 'tx' command: expecting a duration after the signing key, got %q", args[5])
+	}
+	return uri, &urlSigning{name: key, expiry: expiry}, nil
+}
+
+// sign returns uri with a token valid until the expiry of g from now
+func (g urlSigning) sign(uri string, now time.Time) string {
+	return g.key.sign(uri, now.Add(g.expiry))
+}
+
+// verifySignedURL returns nil if u carries a token of hmacScheme signed with
+// key and not expired at now
+func verifySignedURL(u *url.URL, key []byte, now time.Time) error {
+	uri := u.RequestURI()
+	i := strings.LastIndex(uri, "signature=")
+	if i <= 0 || (uri[i-1] != '&' && uri[i-1] != '?') {
+		return errTokenMissing
+	}
+	signed, signature := uri[:i-1], uri[i+len("signature="):]
+
+	// expires must be signed, and thus come right before signature
+	j := strings.LastIndexAny(signed, "?&")
+	if j < 0 || !strings.HasPrefix(signed[j+1:], "expires=") {
+		return errTokenMissing
+	}
+	expires, err := strconv.ParseInt(signed[j+1+len("expires="):], 10, 64)
+	if err != nil {
+		return errTokenMissing
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(urlSignature(key, signed))) {
+		return errTokenSignature
+	}
+	if now.Unix() >= expires {
+		return errTokenExpired
+	}
+	return nil
+}
+
+// verifyURLSig returns nil if u, requested for the given host, carries a
+// token of url_sig signed with key and not expired at now. The token is made
+// of the last parameters of the query string, eg:
+//
+//	/video/seg1.ts?E=1767225600&A=1&K=0&P=01&S=...
+//
+// where E is the expiry time as a Unix timestamp, A the hash function of the
+// HMAC, 1 for SHA-1 and 2 for MD5, K the index of the key in the
+// configuration of url_sig, P the parts of the URL signed, see urlSigMessage,
+// and S the hex encoded HMAC. The optional C parameter, the address of the
+// client, is signed as any other parameter, and not checked
+func verifyURLSig(host string, u *url.URL, key []byte, now time.Time) error {
+	uri := u.RequestURI()
+	i := strings.LastIndex(uri, "S=")
+	if i <= 0 || (uri[i-1] != '&' && uri[i-1] != '?') {
+		return errTokenMissing
+	}
+	signed, signature := uri[:i+len("S=")], uri[i+len("S="):]
+
+	_, query, _ := strings.Cut(signed, "?")
+	params, _ := url.ParseQuery(strings.TrimSuffix(query, "S="))
+	expires, err := strconv.ParseInt(params.Get("E"), 10, 64)
+	h, ok := urlSigAlgorithms[params.Get("A")]
+	parts := params.Get("P")
+	if err != nil || !ok || parts == "" || strings.Trim(parts, "01") != "" {
+		return errTokenMissing
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(urlSigSignature(h, key, urlSigMessage(host, signed, parts)))) {
+		return errTokenSignature
+	}
+	if now.Unix() >= expires {
+		return errTokenExpired
+	}
+	return nil
+}
+
+// rejectUnsigned sends a 401 response to requests for the URLs of a signed
+// handler without a valid token, returning true if it did
+func (h HandleStanza) rejectUnsigned(w http.ResponseWriter, req *http.Request) bool {
+	if h.signingKey == nil {
+		return false
+	}
+	if err := h.signingKey.verify(req.Host, req.URL, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSigningKey(t *testing.T) {
+	p, err := Parse(strings.NewReader(`signing-key "cdn" "s3cret"
+
+handle "/video/*" -signed "cdn" {
+    tx -body "segment"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]SigningKey{"cdn": {Scheme: hmacScheme, Secret: "s3cret"}}, p.SigningKeys)
+	if assert.Len(t, p.Handlers, 1) {
+		assert.Equal(t, "cdn", p.Handlers[0].Signed)
+		assert.Equal(t, &SigningKey{Scheme: hmacScheme, Secret: "s3cret"}, p.Handlers[0].signingKey)
+		assert.Equal(t, `handle "/video/*" -signed "cdn"`, p.Handlers[0].String())
+	}
+
+	for _, input := range []string{
+		`signing-key`,
+		`signing-key "cdn"`,
+		`signing-key "cdn" ""`,
+		`signing-key -scheme "cdn" "s3cret"`,
+		`signing-key -scheme "akamai" "cdn" "s3cret"`,
+		`signing-key "cdn" "s3cret"
+signing-key "cdn" "other"`,
+		`handle "/video/*" -signed {
+    tx -body "segment"
+}`,
+		`handle "/video/*" -signed "cdn" {
+    tx -body "segment"
+}
+
+signing-key "cdn" "s3cret"`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\n\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestVerifySignedURL(t *testing.T) {
+	key := []byte("s3cret")
+	now := time.Unix(1767225600, 0)
+	sign := func(uri string) string {
+		return uri + "&signature=" + urlSignature(key, uri)
+	}
+
+	for uri, want := range map[string]error{
+		sign("/video/seg1.ts?expires=1767225660"):            nil,
+		sign("/video/seg1.ts?quality=hd&expires=1767225660"): nil,
+		sign("/video/seg1.ts?expires=1767225600"):            errTokenExpired,
+		sign("/video/seg2.ts?expires=1767225660"):            nil,
+		"/video/seg1.ts":                                                              errTokenMissing,
+		"/video/seg1.ts?expires=1767225660":                                           errTokenMissing,
+		"/video/seg1.ts?signature=abc":                                                errTokenMissing,
+		"/video/seg1.ts?expires=soon&signature=abc":                                   errTokenMissing,
+		"/video/seg1.ts?expires=1767225660&signature=abc":                             errTokenSignature,
+		strings.Replace(sign("/video/seg1.ts?expires=1767225660"), "seg1", "seg2", 1): errTokenSignature,
+		strings.Replace(sign("/video/seg1.ts?expires=1767225660"), "660", "999", 1):   errTokenSignature,
+	} {
+		u, err := url.Parse(uri)
+		assert.Nil(t, err)
+		assert.Equal(t, want, verifySignedURL(u, key, now), uri)
+	}
+}
+
+func TestVerifyURLSig(t *testing.T) {
+	key := []byte("s3cret")
+	now := time.Unix(1767225600, 0)
+	// As computed by the sign.pl script of url_sig
+	sign := func(uri string) string {
+		return uri + urlSigSignature(sha1.New, key, urlSigMessage("cdn.example.org", uri, "01"))
+	}
+
+	for uri, want := range map[string]error{
+		sign("/video/seg1.ts?E=1767225660&A=1&K=0&P=01&S="):             nil,
+		sign("/video/seg1.ts?quality=hd&E=1767225660&A=1&K=0&P=01&S="):  nil,
+		sign("/video/seg1.ts?C=127.0.0.1&E=1767225660&A=1&K=0&P=01&S="): nil,
+		sign("/video/seg1.ts?E=1767225600&A=1&K=0&P=01&S="):             errTokenExpired,
+		"/video/seg1.ts": errTokenMissing,
+		"/video/seg1.ts?E=1767225660&A=1&K=0&P=01":                                              errTokenMissing,
+		"/video/seg1.ts?E=1767225660&A=3&K=0&P=01&S=abc":                                        errTokenMissing,
+		"/video/seg1.ts?E=1767225660&A=1&K=0&P=2&S=abc":                                         errTokenMissing,
+		"/video/seg1.ts?E=soon&A=1&K=0&P=01&S=abc":                                              errTokenMissing,
+		"/video/seg1.ts?E=1767225660&A=1&K=0&P=01&S=abc":                                        errTokenSignature,
+		strings.Replace(sign("/video/seg1.ts?E=1767225660&A=1&K=0&P=01&S="), "seg1", "seg2", 1): errTokenSignature,
+		strings.Replace(sign("/video/seg1.ts?E=1767225660&A=1&K=0&P=01&S="), "660", "999", 1):   errTokenSignature,
+	} {
+		u, err := url.Parse(uri)
+		assert.Nil(t, err)
+		assert.Equal(t, want, verifyURLSig("www.example.org", u, key, now), uri)
+	}
+
+	// P=1 signs the host too
+	uri := "/video/seg1.ts?E=1767225660&A=2&K=0&P=1&S="
+	u, _ := url.Parse(uri + urlSigSignature(md5.New, key, "cdn.example.org/video/seg1.ts?E=1767225660&A=2&K=0&P=1&S="))
+	assert.Nil(t, verifyURLSig("cdn.example.org", u, key, now))
+	assert.Equal(t, errTokenSignature, verifyURLSig("www.example.org", u, key, now))
+}
+
+func TestURLSigMessage(t *testing.T) {
+	uri := "/video/hd/seg1.ts?E=1&A=1&K=0&P=01&S="
+	assert.Equal(t, "video/hd/seg1.ts?E=1&A=1&K=0&P=01&S=", urlSigMessage("cdn.example.org", uri, "01"))
+	assert.Equal(t, "cdn.example.org/video/hd/seg1.ts?E=1&A=1&K=0&P=01&S=", urlSigMessage("cdn.example.org", uri, "1"))
+	assert.Equal(t, "video/seg1.ts?E=1&A=1&K=0&P=01&S=", urlSigMessage("cdn.example.org", uri, "01011"))
+	assert.Equal(t, "?E=1&A=1&K=0&P=01&S=", urlSigMessage("cdn.example.org", uri, "0"))
+}
+
+func TestRunSigned(t *testing.T) {
+	uri := fmt.Sprintf("/video/seg1.ts?expires=%d", time.Now().Add(time.Hour).Unix())
+	signed := uri + "&signature=" + urlSignature([]byte("s3cret"), uri)
+
+	report := runDirect(t, `signing-key "cdn" "s3cret"
+
+handle "/video/*" -signed "cdn" {
+    expect req.headers["X-Signed"] eq "yes"
+    tx -body "segment"
+}
+
+client "signed" {
+    tx -url "`+signed+`" -header "X-Signed: yes"
+    expect resp.status eq 200
+    expect resp.body eq "segment"
+}
+
+client "unsigned" {
+    tx -url "/video/seg1.ts"
+    expect resp.status eq 401
+    expect resp.body eq "missing token\n"
+}
+
+client "tampered" {
+    tx -url "`+strings.Replace(signed, "seg1", "seg2", 1)+`"
+    expect resp.status eq 401
+    expect resp.body eq "invalid signature\n"
+}
+
+expect origin["/video/*"].hits eq 3`)
+	// The expectations of the handler are not checked upon 401 responses
+	assert.False(t, report.Failed(), report)
+}
+
+func TestParseSign(t *testing.T) {
+	p, err := Parse(strings.NewReader(`signing-key "cdn" "s3cret"
+
+client "a" {
+    tx -url sign("/video/seg1.ts?quality=hd", "cdn", 1h) -method "GET"
+    tx -url sign("/video/seg2.ts", "cdn", "-30s")
+}`))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Clients, 1) && assert.Len(t, p.Clients[0].Steps, 2) {
+		req := p.Clients[0].Steps[0].Request
+		assert.Equal(t, "/video/seg1.ts?quality=hd", req.uri)
+		assert.Equal(t, "GET", req.method)
+		assert.Equal(t, &urlSigning{name: "cdn", key: SigningKey{Scheme: hmacScheme, Secret: "s3cret"}, expiry: time.Hour}, req.signing)
+		assert.Equal(t, -30*time.Second, p.Clients[0].Steps[1].Request.signing.expiry)
+	}
+
+	for _, input := range []string{
+		`tx -url sign`,
+		`tx -url sign("/video/seg1.ts", "cdn")`,
+		`tx -url sign("/video/seg1.ts", "cdn", 1h`,
+		`tx -url sign("/video/seg1.ts" "cdn" 1h)`,
+		`tx -url sign("video/seg1.ts", "cdn", 1h)`,
+		`tx -url sign("/video/seg1.ts", "cdn", "soon")`,
+		`tx -url sign("/video/seg1.ts", "other", 1h)`,
+	} {
+		_, err := Parse(strings.NewReader("signing-key \"cdn\" \"s3cret\"\n\nclient \"a\" {\n    " + input + "\n}"))
+		assert.NotNil(t, err, input)
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, Format(strings.NewReader(`signing-key "cdn" "s3cret"
+client "a" {
+    tx -url sign( "/video/seg1.ts" ,"cdn",1h )
+}
+`), &out))
+	assert.Equal(t, `signing-key "cdn" "s3cret"
+client "a" {
+    tx -url sign("/video/seg1.ts", "cdn", 1h)
+}
+`, out.String())
+}
+
+func TestSign(t *testing.T) {
+	now := time.Unix(1767225600, 0)
+	g := urlSigning{name: "cdn", key: SigningKey{Scheme: hmacScheme, Secret: "s3cret"}, expiry: time.Minute}
+	uri := g.sign("/video/seg1.ts", now)
+	assert.True(t, strings.HasPrefix(uri, "/video/seg1.ts?expires=1767225660&signature="), uri)
+	u, _ := url.Parse(uri)
+	assert.Nil(t, g.key.verify("", u, now))
+	assert.Equal(t, errTokenExpired, g.key.verify("", u, now.Add(time.Minute)))
+
+	u, _ = url.Parse(g.sign("/video/seg1.ts?quality=hd", now))
+	assert.Equal(t, "hd", u.Query().Get("quality"))
+	assert.Nil(t, g.key.verify("", u, now))
+
+	g.expiry = -time.Minute
+	u, _ = url.Parse(g.sign("/video/seg1.ts", now))
+	assert.Equal(t, errTokenExpired, g.key.verify("", u, now))
+
+	g.key.Scheme, g.expiry = urlSigScheme, time.Minute
+	uri = g.sign("/video/seg1.ts?quality=hd", now)
+	assert.True(t, strings.HasPrefix(uri, "/video/seg1.ts?quality=hd&E=1767225660&A=1&K=0&P=01&S="), uri)
+	u, _ = url.Parse(uri)
+	assert.Nil(t, g.key.verify("cdn.example.org", u, now))
+	assert.Equal(t, errTokenExpired, g.key.verify("cdn.example.org", u, now.Add(time.Minute)))
+	assert.Equal(t, errTokenMissing, SigningKey{Scheme: hmacScheme, Secret: "s3cret"}.verify("", u, now))
+}
+
+func TestRunSign(t *testing.T) {
+	report := runDirect(t, `signing-key "cdn" "s3cret"
+signing-key "other" "0ther"
+signing-key -scheme "url_sig" "ats" "s3cret"
+
+handle "/ats/*" -signed "ats" {
+    tx -body "segment"
+}
+
+client "url_sig" {
+    tx -url sign("/ats/seg1.ts", "ats", 1h)
+    expect resp.status eq 200
+    tx -url sign("/ats/seg1.ts", "cdn", 1h)
+    expect resp.status eq 401
+    expect resp.body eq "missing token\n"
+}
+
+handle "/video/*" -signed "cdn" {
+    tx -body "segment"
+}
+
+client "signed" {
+    tx -url sign("/video/seg1.ts", "cdn", 1h)
+    expect resp.status eq 200
+}
+
+client "expired" {
+    tx -url sign("/video/seg1.ts", "cdn", -30s)
+    expect resp.status eq 401
+    expect resp.body eq "expired token\n"
+}
+
+client "wrong key" {
+    tx -url sign("/video/seg1.ts", "other", 1h)
+    expect resp.status eq 401
+    expect resp.body eq "invalid signature\n"
+}`)
+	assert.False(t, report.Failed(), report)
+}
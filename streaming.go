@@ -0,0 +1,113 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Checking that the proxy streams responses to clients as the origin sends
+// them, rather than buffering them whole
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamInterval is how often the origin writes a chunk of the body of
+// responses sent with -send-body-rate
+const streamInterval = 100 * time.Millisecond
+
+// streamLog records, by request ID, when the origin started writing the last
+// chunk of the bodies it streamed, see -send-body-rate
+type streamLog struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newStreamLog() *streamLog {
+	return &streamLog{last: make(map[string]time.Time)}
+}
+
+// add records that the origin starts writing the last chunk of the response
+// to the request with the given ID. Requests sent with -no-request-id are
+// left out
+func (l *streamLog) add(requestID string) {
+	if requestID == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last[requestID] = time.Now()
+}
+
+// take returns when the origin started writing the last chunk of the
+// response to the request with the given ID, and forgets it so that the next
+// request with the same ID is not mistaken for this one. The zero time is
+// returned if the origin did not stream the response, or if the request has
+// no ID
+func (l *streamLog) take(requestID string) time.Time {
+	if requestID == "" {
+		return time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.last[requestID]
+	delete(l.last, requestID)
+	return t
+}
+
+// streamBody writes the size bytes of body to w at most rate bytes per
+// second, flushing each chunk, in at least two chunks so that streaming can
+// be told from buffering. last is called right before writing the last
+// chunk. Writing stops if the client goes away
+func streamBody(w http.ResponseWriter, body io.Reader, size int64, rate int, last func()) {
+	chunk := int64(max(rate*int(streamInterval)/int(time.Second), 1))
+	if size > 1 {
+		chunk = min(chunk, size/2)
+	}
+	buf := make([]byte, chunk)
+	rc := http.NewResponseController(w)
+
+	for size > 0 {
+		n := min(chunk, size)
+		if n == size && last != nil {
+			last()
+		}
+		if _, err := io.ReadFull(body, buf[:n]); err != nil {
+			return
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		rc.Flush()
+		if size -= n; size > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(rate))
+		}
+	}
+}
+
+// firstByteReader records when the first byte of the body read from r is
+// received
+type firstByteReader struct {
+	r  io.Reader
+	at time.Time
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.at.IsZero() {
+		f.at = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamBody(t *testing.T) {
+	w := httptest.NewRecorder()
+	var written int
+	streamBody(w, strings.NewReader("0123456789"), 10, 1000, func() { written = w.Body.Len() })
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.True(t, w.Flushed)
+	// Bodies smaller than a chunk are still sent in two
+	assert.Equal(t, 5, written)
+
+	// 2 bytes every 100ms
+	w = httptest.NewRecorder()
+	start := time.Now()
+	streamBody(w, strings.NewReader("0123456789"), 10, 20, func() { written = w.Body.Len() })
+	assert.Equal(t, 8, written)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestRunStreamed(t *testing.T) {
+	input := fmt.Sprintf(`handle "/stream" {
+    tx -body "%s" -send-body-rate 2000
+}
+
+handle "/buffer" {
+    tx -body "Hello world!"
+}
+
+client "stream" {
+    tx -url "/stream"
+    expect resp.streamed eq "true"
+}
+
+client "buffer" {
+    tx -url "/buffer"
+    expect resp.streamed eq "false"
+}`, strings.Repeat("a", 1000))
+	report := runDirect(t, input)
+	assert.False(t, report.Clients[0].Failed(), report.Clients[0])
+	// The origin did not stream the response
+	if assert.Len(t, report.Clients[1].ClientFailures, 1) {
+		assert.Contains(t, report.Clients[1].ClientFailures[0].Error, "did not stream")
+	}
+
+	// A proxy buffering whole responses
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	proxy := httptest.NewServer(&cachingProxy{objects: make(map[string][]byte), proxy: httputil.NewSingleHostReverseProxy(u)})
+	defer proxy.Close()
+
+	report, err = run(t.Context(), p, origin, strings.TrimPrefix(proxy.URL, "http://"), nil)
+	assert.Nil(t, err)
+	if assert.Len(t, report.Clients[0].ClientFailures, 1) {
+		assert.Equal(t, `"false"`, report.Clients[0].ClientFailures[0].Actual)
+	}
+
+	for _, input := range []string{
+		`handle "/" {
+    tx -grpc -send-body-rate 100
+}`,
+		`handle "/" {
+    tx -send-body-rate 0
+}`,
+		`client "a" {
+    tx -url "/"
+    expect resp.streamed eq "true" within "1s"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.NotNil(t, err, input)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tagging objects with the Surrogate-Key header of origin responses, and
+// invalidating all the objects with a given tag, eg:
+//
+//	handle "/news/1" {
+//	    tx -header "Surrogate-Key: news sports" -body "Hello world!"
+//	}
+//
+//	invalidate-tag "news"
+//
+// ATS has no built-in way of invalidating objects by tag: the request
+// carrying the tag must be handled by a plugin or by the backend in front of
+// the cache, which is why its method, path and header can be changed
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// surrogateKeys returns the tags of the responses of the handler, given with
+// the Surrogate-Key header. Handlers of families of paths have none, as the
+// objects they serve are not known in advance, and so do those of methods
+// other than GET
+func (h HandleStanza) surrogateKeys() []string {
+	if h.Default || h.match != nil || (h.Method != "" && h.Method != "GET") {
+		return nil
+	}
+	for name, value := range h.Response.headers {
+		if strings.EqualFold(name, "Surrogate-Key") {
+			return strings.Fields(value)
+		}
+	}
+	return nil
+}
+
+// Defaults of the tag invalidation request, which can be changed with the
+// -method, -url and -header arguments of invalidate-tag
+const (
+	defaultTagMethod = purgeMethod
+	defaultTagPath   = "/"
+	defaultTagHeader = "Surrogate-Key"
+)
+
+// parseInvalidateTag parses the invalidate-tag directive, returning an
+// expectation for each object tagged by the given handlers, see invalidation,
+// and the clients checking them: the objects are fetched twice, a single
+// request carrying the tag invalidates them all, then they are fetched again.
+// pos is the position of the directive
+func parseInvalidateTag(s *scanner, pos position, handlers []HandleStanza) ([]Expect, []ClientStanza, error) {
+	method, path, header := defaultTagMethod, defaultTagPath, defaultTagHeader
+
+	token := s.ScanUseful()
+	for ; token.typ == METHOD_ARG || token.typ == URL_ARG || token.typ == HEADER_ARG; token = s.ScanUseful() {
+		arg := token
+		token = s.ScanUseful()
+		switch {
+		case arg.typ == METHOD_ARG && token.typ == STRING && validToken(token.val):
+			method = token.val
+		case arg.typ == URL_ARG && token.typ == STRING && len(token.val) > 0 && token.val[0] == '/':
+			path = token.val
+		case arg.typ == HEADER_ARG && token.typ == STRING && validToken(token.val):
+			header = token.val
+		default:
+			return nil, nil, fmt.Errorf("Parse error in 'invalidate-tag' directive: invalid value for %s, got %q", arg.val, token)
+		}
+	}
+	if token.typ != STRING || len(strings.Fields(token.val)) != 1 || strings.TrimSpace(token.val) != token.val {
+		return nil, nil, fmt.Errorf("Parse error in 'invalidate-tag' directive: expecting a tag, got %q", token)
+	}
+	tag := token.val
+
+	purge := fetchClient("invalidate-tag "+tag, "", path, 1)
+	purge.Steps[0].Request.method = method
+	purge.Steps[0].Request.headers[header] = tag
+
+	var exps []Expect
+	var fill, refetch []ClientStanza
+	for _, h := range handlers {
+		if !slices.Contains(h.surrogateKeys(), tag) {
+			continue
+		}
+		suffix := " " + tag + " " + h.pattern()
+		e := invalidation(pos, h.Host, h.URIPath, []string{"fill-tag" + suffix, purge.Name, "refetch-tag" + suffix})
+		e.verbatim += fmt.Sprintf(" tag %q", tag)
+		exps = append(exps, e)
+		fill = append(fill, fetchClient(e.clients[0], h.Host, h.URIPath, 2))
+		refetch = append(refetch, fetchClient(e.clients[2], h.Host, h.URIPath, 1))
+	}
+	if len(exps) == 0 {
+		return nil, nil, fmt.Errorf("Parse error in 'invalidate-tag' directive: no preceding 'handle' stanza tags its responses with %q", tag)
+	}
+	return exps, append(append(fill, purge), refetch...), nil
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// taggedHandlers are handlers tagging their responses with Surrogate-Key
+const taggedHandlers = `handle "/news/1" {
+    tx -header "Surrogate-Key: news sports" -body "Hello world!"
+}
+
+handle "www.example.org/news/2" {
+    tx -header "surrogate-key: news" -body "Hello world!"
+}
+
+handle "/weather" {
+    tx -header "Surrogate-Key: weather" -body "Hello world!"
+}
+
+handle "/news/*" {
+    tx -header "Surrogate-Key: news" -body "Hello world!"
+}
+`
+
+func TestParseInvalidateTag(t *testing.T) {
+	p, err := Parse(strings.NewReader(taggedHandlers + `
+invalidate-tag "news"`))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Clients, 5) {
+		assert.Equal(t, "fill-tag news /news/1", p.Clients[0].Name)
+		assert.Len(t, p.Clients[0].Steps, 2)
+		assert.Equal(t, "fill-tag news www.example.org/news/2", p.Clients[1].Name)
+		assert.Equal(t, "/news/2", p.Clients[1].Steps[0].Request.uri)
+		assert.Equal(t, "www.example.org", p.Clients[1].Steps[0].Request.host)
+		assert.Equal(t, "invalidate-tag news", p.Clients[2].Name)
+		assert.Equal(t, "PURGE", p.Clients[2].Steps[0].Request.method)
+		assert.Equal(t, "/", p.Clients[2].Steps[0].Request.uri)
+		assert.Equal(t, map[string]string{"Surrogate-Key": "news"}, p.Clients[2].Steps[0].Request.headers)
+		assert.Equal(t, "refetch-tag news /news/1", p.Clients[3].Name)
+		assert.Equal(t, "GET", p.Clients[3].Steps[0].Request.method)
+		assert.Equal(t, "refetch-tag news www.example.org/news/2", p.Clients[4].Name)
+	}
+	if assert.Len(t, p.Expectations, 2) {
+		assert.Equal(t, EXPECT_CACHE_INVALIDATED, p.Expectations[0].field)
+		assert.Equal(t, `"cache invalidated \"/news/1\" tag \"news\""`, p.Expectations[0].String())
+		assert.Equal(t, []string{"fill-tag news /news/1", "invalidate-tag news", "refetch-tag news /news/1"}, p.Expectations[0].clients)
+	}
+
+	p, err = Parse(strings.NewReader(taggedHandlers + `
+invalidate-tag -method "BAN" -url "/tags" -header "Cache-Tag" "sports"`))
+	assert.Nil(t, err)
+	if assert.Len(t, p.Clients, 3) {
+		req := p.Clients[1].Steps[0].Request
+		assert.Equal(t, "BAN", req.method)
+		assert.Equal(t, "/tags", req.uri)
+		assert.Equal(t, map[string]string{"Cache-Tag": "sports"}, req.headers)
+	}
+
+	for _, input := range []string{
+		`invalidate-tag`,
+		`invalidate-tag ""`,
+		`invalidate-tag "news sports"`,
+		`invalidate-tag "politics"`,
+		`invalidate-tag -method "BAN"`,
+		`invalidate-tag -method "" "news"`,
+		`invalidate-tag -url "tags" "news"`,
+		`invalidate-tag -header "Cache Tag" "news"`,
+		`invalidate-tag "news"
+invalidate-tag "news"`,
+	} {
+		_, err := Parse(strings.NewReader(taggedHandlers + input))
+		assert.NotNil(t, err, input)
+	}
+}
+
+// tagPurgingProxy is a cachingProxy removing the objects tagged with the
+// Surrogate-Key header of PURGE requests from its cache
+type tagPurgingProxy struct {
+	*cachingProxy
+	paths map[string][]string // by tag
+}
+
+func newTagPurgingProxy(u *url.URL) tagPurgingProxy {
+	c := tagPurgingProxy{&cachingProxy{objects: make(map[string][]byte), proxy: httputil.NewSingleHostReverseProxy(u)}, make(map[string][]string)}
+	c.proxy.ModifyResponse = func(resp *http.Response) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, tag := range strings.Fields(resp.Header.Get("Surrogate-Key")) {
+			c.paths[tag] = append(c.paths[tag], resp.Request.URL.Path)
+		}
+		return nil
+	}
+	return c
+}
+
+func (c tagPurgingProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PURGE" {
+		c.cachingProxy.ServeHTTP(w, req)
+		return
+	}
+	tag := req.Header.Get("Surrogate-Key")
+	c.mu.Lock()
+	paths := c.paths[tag]
+	for _, path := range paths {
+		delete(c.objects, path)
+	}
+	delete(c.paths, tag)
+	c.mu.Unlock()
+	if len(paths) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRunInvalidateTag(t *testing.T) {
+	p, err := Parse(strings.NewReader(taggedHandlers + `
+invalidate-tag "news"`))
+	assert.Nil(t, err)
+
+	origin := NewOrigin(0)
+	server := httptest.NewUnstartedServer(origin)
+	server.Config = origin.newServer()
+	server.Start()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	for _, byTag := range []bool{true, false} {
+		var handler http.Handler = newTagPurgingProxy(u)
+		if !byTag {
+			handler = purgingProxy{&cachingProxy{objects: make(map[string][]byte), proxy: httputil.NewSingleHostReverseProxy(u)}}
+		}
+		front := httptest.NewServer(handler)
+		report, err := run(t.Context(), p, origin, strings.TrimPrefix(front.URL, "http://"), nil)
+		front.Close()
+		assert.Nil(t, err)
+
+		if byTag {
+			assert.False(t, report.Failed(), report.Failures)
+		} else if assert.Len(t, report.Failures, 2) {
+			// PURGE "/" finds nothing to invalidate
+			assert.Equal(t, `expect cache invalidated "/news/1" tag "news"`, report.Failures[0].Expect)
+			assert.Equal(t, `"status 404 to the invalidation request"`, report.Failures[1].Actual)
+		}
+	}
+}
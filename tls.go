@@ -0,0 +1,342 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// TLS connections between clients and the proxy, which presents self-signed
+// certificates generated by httptester: one for each virtual host, picked
+// based on SNI, and a default one. Clients using -tls can check the outcome of
+// the handshake, eg:
+//
+//	expect resp.tls.alpn eq "h2"
+//	expect resp.tls.cert.cn eq "www.example.org"
+//
+// Clients can present certificates too, issued by a certificate authority
+// that the proxy trusts if the program sets client-certs
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCertName is the common name of the certificate presented by the
+// proxy to clients sending no server name, or one without certificate
+const defaultCertName = "localhost"
+
+// proxyCerts are the certificates last configured on the proxy by server
+// name, see newProxyCerts. The proxy presents them unless a rotation is still
+// pending. proxyCertsMu guards it
+var (
+	proxyCerts   map[string]*keyPair
+	proxyCertsMu sync.Mutex
+)
+
+func setProxyCerts(certs map[string]*keyPair) {
+	proxyCertsMu.Lock()
+	defer proxyCertsMu.Unlock()
+	proxyCerts = certs
+}
+
+func currentProxyCerts() map[string]*keyPair {
+	proxyCertsMu.Lock()
+	defer proxyCertsMu.Unlock()
+	return proxyCerts
+}
+
+// isProxyCert returns true if cert is among the certificates last configured
+// on the proxy
+func isProxyCert(cert *x509.Certificate) bool {
+	for _, kp := range currentProxyCerts() {
+		if bytes.Equal(kp.cert.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoTLS is returned by TxReq.server for requests using -tls when the
+// proxy is not run by httptester, which then does not know its TLS port
+var errNoTLS = errors.New("-tls cannot be used, the proxy is not run by httptester")
+
+// server returns the address the request is sent to: that of the TLS port of
+// the proxy for requests using -tls, addr otherwise
+func (r TxReq) server(addr string, proxy proxyControl) (string, error) {
+	if !r.tls {
+		return addr, nil
+	}
+	if proxy == nil {
+		return "", errNoTLS
+	}
+	return proxy.tlsAddr(), nil
+}
+
+// tlsVersions are the TLS versions that can be given with -tls-min and
+// -tls-max, and the values of resp.tls.version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses the version following -tls-min or -tls-max, eg: "1.2"
+func parseTLSVersion(s *scanner, arg token) (uint16, error) {
+	token := s.ScanUseful()
+	if v, ok := tlsVersions[token.val]; ok && token.typ == STRING {
+		return v, nil
+	}
+	return 0, fmt.Errorf("Parse error in 'tx' command: expecting a TLS version like \"1.2\" after %s, got %q", arg.val, token)
+}
+
+// tlsVersionName returns the name of the given version, as in tlsVersions
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// tlsConfig returns the configuration of TLS connections to the proxy. The
+// server name sent is the one given with -sni, or the virtual host given with
+// -host
+func (r TxReq) tlsConfig() *tls.Config {
+	name := r.sni
+	if name == "" && r.host != "" {
+		name = r.host
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+	}
+
+	config := &tls.Config{
+		// The certificate of the proxy is self-signed, and checked with
+		// resp.tls.cert if need be
+		InsecureSkipVerify: true,
+		ServerName:         name,
+		MinVersion:         r.tlsMin,
+		MaxVersion:         r.tlsMax,
+	}
+	if r.clientCert != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := clientCert(r.clientCert)
+			return &cert, err
+		}
+	}
+	return config
+}
+
+// actualTLS returns the value of the resp.tls expectation among the details
+// of the given TLS connection, nil if the request was sent without TLS
+func (e Expect) actualTLS(state *tls.ConnectionState) (string, error) {
+	if e.field == EXPECT_TLS_HANDSHAKE {
+		// Failed handshakes are caught by ActualResponse
+		return "ok", nil
+	}
+	if state == nil {
+		return "", fmt.Errorf("the request was not sent over TLS, see -tls")
+	}
+
+	switch e.field {
+	case EXPECT_TLS_VERSION:
+		return tlsVersionName(state.Version), nil
+	case EXPECT_TLS_CIPHER:
+		return tls.CipherSuiteName(state.CipherSuite), nil
+	case EXPECT_TLS_ALPN:
+		return state.NegotiatedProtocol, nil
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("the proxy presented no certificate")
+	}
+	cert := state.PeerCertificates[0]
+	switch e.field {
+	case EXPECT_TLS_CERT_CN:
+		return cert.Subject.CommonName, nil
+	case EXPECT_TLS_CERT_ISSUER:
+		return cert.Issuer.CommonName, nil
+	case EXPECT_TLS_CERT_SAN:
+		names := append([]string{}, cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		return strings.Join(names, ", "), nil
+	case EXPECT_TLS_CERT_SERIAL:
+		return fmt.Sprintf("%x", cert.SerialNumber), nil
+	case EXPECT_TLS_CERT_CURRENT:
+		return strconv.FormatBool(isProxyCert(cert)), nil
+	}
+	return "", nil
+}
+
+// keyPair is a certificate along with its private key
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newKeyPair returns a new key along with a certificate for it, based on
+// template and signed by issuer, or self-signed if issuer is nil
+func newKeyPair(template x509.Certificate, issuer *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, err
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	template.BasicConstraintsValid = true
+
+	parent, parentKey := &template, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, key: key}, nil
+}
+
+// certPEM returns the certificate, PEM encoded
+func (kp *keyPair) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kp.cert.Raw})
+}
+
+// keyPEM returns the private key, PEM encoded
+func (kp *keyPair) keyPEM() ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(kp.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// tlsCertificate returns the key pair in the form used by tls.Config
+func (kp *keyPair) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{kp.cert.Raw}, PrivateKey: kp.key, Leaf: kp.cert}
+}
+
+// selfSignedCert returns a certificate for the given server name. The
+// default certificate is valid for the loopback addresses too
+func selfSignedCert(name string) (*keyPair, error) {
+	template := x509.Certificate{
+		Subject:     pkix.Name{CommonName: name, Organization: []string{"httptester"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{name},
+	}
+	if name == defaultCertName {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	return newKeyPair(template, nil)
+}
+
+// newProxyCerts returns the certificates presented by the proxy, by server
+// name: one for each of the given virtual hosts, so that the proxy picks them
+// based on SNI, and the default one
+func newProxyCerts(hosts []string) (map[string]*keyPair, error) {
+	certs := make(map[string]*keyPair)
+	for _, name := range append([]string{defaultCertName}, hosts...) {
+		if certs[name] != nil {
+			continue
+		}
+		cert, err := selfSignedCert(name)
+		if err != nil {
+			return nil, err
+		}
+		certs[name] = cert
+	}
+	return certs, nil
+}
+
+// clientCA returns the certificate authority issuing the certificates
+// presented by clients using -client-cert, which the proxy trusts when
+// client-certs is set. It is the same for the whole run
+var clientCA = sync.OnceValues(func() (*keyPair, error) {
+	return newKeyPair(x509.Certificate{
+		Subject:  pkix.Name{CommonName: "httptester client CA", Organization: []string{"httptester"}},
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IsCA:     true,
+	}, nil)
+})
+
+// clientCert returns a certificate for the given common name, issued by
+// clientCA, eg: for tx -tls -client-cert "nemo"
+func clientCert(cn string) (tls.Certificate, error) {
+	ca, err := clientCA()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	kp, err := newKeyPair(x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn, Organization: []string{"httptester"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return kp.tlsCertificate(), nil
+}
+
+// clientCertLevels are the values of the client-certs directive, and the
+// corresponding proxy.config.ssl.client.certification_level of ATS
+var clientCertLevels = map[string]int{
+	"optional": 1,
+	"required": 2,
+}
+
+// parseClientCerts parses the level following the client-certs keyword, eg:
+// client-certs "required"
+func parseClientCerts(s *scanner) (string, error) {
+	token := s.ScanUseful()
+	if _, ok := clientCertLevels[token.val]; !ok || token.typ != STRING {
+		return "", fmt.Errorf("Parse error in 'client-certs' directive: expecting \"optional\" or \"required\", got %q", token)
+	}
+	return token.val, nil
+}
+
+// handshakeFailed returns true if err is a TLS alert sent by the proxy, eg:
+// because the client presented no certificate, or a response which is not
+// TLS at all
+func handshakeFailed(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &recordErr)
+}
@@ -0,0 +1,361 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxParseTLS(t *testing.T) {
+	req := TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-tls -tls-min "1.2" -tls-max "1.3" -sni "www.example.org"`))))
+	assert.True(t, req.tls)
+	assert.Equal(t, uint16(tls.VersionTLS12), req.tlsMin)
+	assert.Equal(t, uint16(tls.VersionTLS13), req.tlsMax)
+	assert.Equal(t, "www.example.org", req.sni)
+
+	req = TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-tls -client-cert "nemo"`))))
+	assert.Equal(t, "nemo", req.clientCert)
+
+	for _, input := range []string{
+		`-tls-min "1.2"`,
+		`-sni "www.example.org"`,
+		`-tls -tls-min "1.4"`,
+		`-tls -tls-max 1`,
+		`-tls -tls-min "1.3" -tls-max "1.2"`,
+		`-tls -sni ""`,
+		`-client-cert "nemo"`,
+		`-tls -client-cert ""`,
+		`-tls -grpc`,
+		`-tls -url "http://www.example.org/" -forward`,
+	} {
+		req := TxReq{}
+		assert.Error(t, req.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestExpectParseTLS(t *testing.T) {
+	for input, field := range map[string]ExpectField{
+		`resp.tls.version eq "1.3"`:             EXPECT_TLS_VERSION,
+		`resp.tls.cipher ~ "AES"`:               EXPECT_TLS_CIPHER,
+		`resp.tls.alpn eq "h2"`:                 EXPECT_TLS_ALPN,
+		`resp.tls.cert.cn eq "localhost"`:       EXPECT_TLS_CERT_CN,
+		`resp.tls.cert.issuer eq "localhost"`:   EXPECT_TLS_CERT_ISSUER,
+		`resp.tls.cert.san ~ "www.example.org"`: EXPECT_TLS_CERT_SAN,
+		`client["nemo"].resp.tls.alpn eq "h2"`:  EXPECT_TLS_ALPN,
+	} {
+		exp := Expect{}
+		assert.Nil(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+		assert.Equal(t, field, exp.field, input)
+	}
+
+	for _, input := range []string{
+		`req.tls.alpn eq "h2"`,
+		`resp.tls eq "h2"`,
+		`resp.tls.cert eq "localhost"`,
+		`resp.tls.cert.alpn eq "h2"`,
+	} {
+		exp := Expect{}
+		assert.Error(t, exp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	assert.Equal(t, "", TxReq{}.tlsConfig().ServerName)
+	assert.Equal(t, "www.example.org", TxReq{host: "www.example.org:8080"}.tlsConfig().ServerName)
+	assert.Equal(t, "sni.example.org", TxReq{host: "www.example.org", sni: "sni.example.org"}.tlsConfig().ServerName)
+
+	// Without a TLS port, eg: when testing an ingress controller
+	_, err := TxReq{method: "GET", tls: true}.server("127.0.0.1:1", nil)
+	assert.Equal(t, errNoTLS, err)
+	server, err := TxReq{method: "GET", tls: true}.server("127.0.0.1:1", &fakeProxy{addr: "127.0.0.1:2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:2", server)
+	server, err = TxReq{method: "GET"}.server("127.0.0.1:1", &fakeProxy{addr: "127.0.0.1:2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:1", server)
+}
+
+func TestExpectResponseTLS(t *testing.T) {
+	exp := Expect{field: EXPECT_TLS_ALPN, operator: EQUAL, expected: "h2"}
+	ev := exp.Response(ClientResponse{})
+	assert.False(t, ev.Passed)
+	assert.EqualError(t, ev.Err, "the request was not sent over TLS, see -tls")
+}
+
+// startTLSProxy starts a TLS server in front of the given origin, acting as
+// the TLS port of the returned proxy until the returned function is called. Client
+// certificates issued by clientCA are verified if given. Like the proxy, the
+// server picks certificates based on SNI, and takes a while to present
+// rotated ones
+func startTLSProxy(t *testing.T, origin *Origin, hosts []string, clientAuth tls.ClientAuthType) (*fakeProxy, func()) {
+	certs, err := newProxyCerts(hosts)
+	assert.Nil(t, err)
+	setProxyCerts(certs)
+	var presented atomic.Pointer[map[string]*keyPair]
+	presented.Store(&certs)
+
+	ca, err := clientCA()
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(origin)
+	server.TLS = &tls.Config{}
+	server.TLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		certs := *presented.Load()
+		cert, ok := certs[hello.ServerName]
+		if !ok {
+			cert = certs[defaultCertName]
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert.tlsCertificate()},
+			NextProtos:   server.TLS.NextProtos,
+			ClientAuth:   clientAuth,
+			ClientCAs:    pool,
+		}, nil
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	proxy := &fakeProxy{addr: strings.TrimPrefix(server.URL, "https://")}
+	proxy.rotateCertFunc = func() error {
+		certs, err := newProxyCerts(hosts)
+		if err != nil {
+			return err
+		}
+		setProxyCerts(certs)
+		time.AfterFunc(100*time.Millisecond, func() { presented.Store(&certs) })
+		return nil
+	}
+	return proxy, func() {
+		setProxyCerts(nil)
+		server.Close()
+	}
+}
+
+func TestRunTLS(t *testing.T) {
+	input := `handle "www.example.org/" {
+    tx -status 200 -body "secure"
+}
+
+client "h2" {
+    tx -url "/" -host "www.example.org" -tls
+    expect resp.body eq "secure"
+    expect resp.proto eq "HTTP/2.0"
+    expect resp.tls.alpn eq "h2"
+    expect resp.tls.version eq "1.3"
+    expect resp.tls.cipher ~ "^TLS_"
+    expect resp.tls.cert.cn eq "www.example.org"
+    expect resp.tls.cert.issuer eq "www.example.org"
+    expect resp.tls.cert.san eq "www.example.org"
+}
+
+client "tls12" {
+    tx -url "/" -host "www.example.org" -tls -tls-max "1.2"
+    expect resp.tls.version eq "1.2"
+}
+
+client "plain" {
+    tx -url "/" -host "www.example.org"
+    expect resp.tls.alpn eq "h2"
+}`
+
+	origin := NewOrigin(0)
+	tlsProxy, stop := startTLSProxy(t, origin, []string{"www.example.org"}, tls.NoClientCert)
+	defer stop()
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	report, err := run(t.Context(), p, origin, strings.TrimPrefix(server.URL, "http://"), tlsProxy)
+	assert.Nil(t, err)
+	assert.False(t, report.Clients[0].Failed(), report.Clients[0].ClientFailures)
+	assert.False(t, report.Clients[1].Failed(), report.Clients[1].ClientFailures)
+	assert.Equal(t, "the request was not sent over TLS, see -tls", report.Clients[2].ClientFailures[0].Error)
+}
+
+func TestClientCert(t *testing.T) {
+	cert, err := clientCert("nemo")
+	assert.Nil(t, err)
+	assert.Equal(t, "nemo", cert.Leaf.Subject.CommonName)
+
+	ca, err := clientCA()
+	assert.Nil(t, err)
+	assert.Nil(t, cert.Leaf.CheckSignatureFrom(ca.cert))
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.Leaf.ExtKeyUsage)
+}
+
+func TestParseClientCerts(t *testing.T) {
+	p, err := Parse(strings.NewReader(`client-certs "required"
+
+client "nemo" {
+    tx -tls -client-cert "nemo"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "required", p.ClientCerts)
+
+	for _, input := range []string{
+		`client-certs "always"
+client "nemo" {
+    tx -tls
+}`,
+		`client-certs "optional"
+client-certs "required"
+client "nemo" {
+    tx -tls
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestRunClientCerts(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/" -tls -client-cert "nemo"
+    expect resp.tls.handshake eq "ok"
+    expect resp.status eq 200
+}
+
+client "anonymous" {
+    tx -url "/" -tls
+    expect resp.tls.handshake eq "failed"
+}
+
+client "mistaken" {
+    tx -url "/" -tls
+    expect resp.status eq 200
+}`
+
+	origin := NewOrigin(0)
+	tlsProxy, stop := startTLSProxy(t, origin, nil, tls.RequireAndVerifyClientCert)
+	defer stop()
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	report, err := run(t.Context(), p, origin, strings.TrimPrefix(server.URL, "http://"), tlsProxy)
+	assert.Nil(t, err)
+	assert.False(t, report.Clients[0].Failed(), report.Clients[0].ClientFailures)
+	assert.False(t, report.Clients[1].Failed(), report.Clients[1].ClientFailures)
+	assert.True(t, report.Clients[2].Failed())
+	assert.Contains(t, report.Clients[2].ClientFailures[0].Error, "the TLS handshake failed: remote error: tls:")
+	assert.Contains(t, report.Clients[2].Response, "TLS handshake failed")
+}
+
+func TestRunRotateCert(t *testing.T) {
+	input := `handle "/" {
+    tx -status 200
+}
+
+client "before" {
+    tx -url "/" -tls
+    expect resp.tls.cert.current eq "true"
+    expect resp.tls.cert.serial ~ "^[0-9a-f]+$"
+}
+
+client "rotated" {
+    rotate-cert
+    tx -url "/" -tls
+    expect resp.tls.cert.current eq "true" within "2s"
+    expect resp.retries gt 0
+}`
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.True(t, p.Clients[1].Steps[0].RotateCert)
+
+	// Without TLS, the certificate cannot be rotated
+	_, err = run(t.Context(), p, NewOrigin(0), "127.0.0.1:1", nil)
+	assert.Error(t, err)
+
+	origin := NewOrigin(0)
+	tlsProxy, stop := startTLSProxy(t, origin, nil, tls.NoClientCert)
+	defer stop()
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	report, err := run(t.Context(), p, origin, strings.TrimPrefix(server.URL, "http://"), tlsProxy)
+	assert.Nil(t, err)
+	assert.False(t, report.Failed(), report.Clients)
+
+	_, err = Parse(strings.NewReader(`client "late" {
+    tx -url "/" -tls
+    rotate-cert
+}`))
+	assert.Error(t, err)
+}
+
+func TestRunSNI(t *testing.T) {
+	input := `handle "www.example.org/" {
+    tx -status 200
+}
+
+handle "/" {
+    tx -status 200
+}
+
+client "virtual-host" {
+    tx -url "/" -host "www.example.org" -tls
+    expect resp.tls.cert.cn eq "www.example.org"
+}
+
+client "override" {
+    tx -url "/" -host "www.example.org" -tls -sni "localhost"
+    expect resp.tls.cert.cn eq "localhost"
+}
+
+client "unknown" {
+    tx -url "/" -tls -sni "unknown.example.org"
+    expect resp.tls.cert.cn eq "localhost"
+    expect resp.tls.cert.san eq "localhost, 127.0.0.1, ::1"
+}
+
+client "none" {
+    tx -url "/" -tls
+    expect resp.tls.cert.cn eq "localhost"
+}`
+
+	p, err := Parse(strings.NewReader(input))
+	assert.Nil(t, err)
+
+	origin := NewOrigin(0)
+	tlsProxy, stop := startTLSProxy(t, origin, p.hosts(), tls.NoClientCert)
+	defer stop()
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	report, err := run(t.Context(), p, origin, strings.TrimPrefix(server.URL, "http://"), tlsProxy)
+	assert.Nil(t, err)
+	assert.False(t, report.Failed(), report.Clients)
+}
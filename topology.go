@@ -0,0 +1,219 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Chains of heterogeneous proxies between clients and the origin, eg:
+//
+//	topology {
+//	    hop "nginx"
+//	    hop "ats"
+//	}
+//
+// reproduces an edge where nginx forwards requests to ATS, which forwards
+// them to the origin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// hopKinds are the proxies which can be hops of a topology. ats is the proxy
+// tested, started as usual
+var hopKinds = []string{"ats", "nginx"}
+
+// Topology are the hops requests go through, from clients to the origin, set
+// with the topology stanza. Eg: nginx, ats
+type Topology []string
+
+// parseTopology parses the block following the topology keyword
+func parseTopology(s *scanner) (Topology, error) {
+	var t Topology
+
+	token := s.ScanUseful()
+	if token.typ != OPEN_CURLY {
+		return t, fmt.Errorf("Parse error in 'topology' stanza: expecting '{', got %q", token)
+	}
+
+	for {
+		token = s.ScanUseful()
+		switch token.typ {
+		case NEWLINE:
+		case CLOSE_CURLY:
+			if t.count("ats") != 1 {
+				return t, fmt.Errorf("Parse error in 'topology' stanza: expecting exactly one 'hop \"ats\"', the proxy tested")
+			}
+			return t, nil
+		case HOP:
+			kind := s.ScanUseful()
+			if kind.typ != STRING || !validHop(kind.val) {
+				return t, fmt.Errorf("Parse error in 'topology' stanza: expecting one of %s after 'hop', got %q", strings.Join(hopKinds, ", "), kind)
+			}
+			t = append(t, kind.val)
+		default:
+			return t, fmt.Errorf("Parse error in 'topology' stanza: expecting 'hop' or '}', got %q", token)
+		}
+	}
+}
+
+// validHop returns true if kind is one of hopKinds
+func validHop(kind string) bool {
+	for _, k := range hopKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns how many hops of the given kind there are
+func (t Topology) count(kind string) int {
+	n := 0
+	for _, k := range t {
+		if k == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// split returns the hops preceding the proxy tested and those following it,
+// in the order requests go through them
+func (t Topology) split() (before, after []string) {
+	for i, kind := range t {
+		if kind == "ats" {
+			return t[:i], t[i+1:]
+		}
+	}
+	return t, nil
+}
+
+// Nginx is an nginx hop, forwarding all requests to the next hop
+type Nginx struct {
+	port int
+	// next is the port of the next hop, or of the origin
+	next   int
+	cmd    *exec.Cmd
+	tmpDir string
+}
+
+// config returns the contents of nginx.conf: nginx runs in the foreground
+// with all its files in its temporary directory, and forwards requests with
+// their Host header
+func (n Nginx) config() string {
+	return fmt.Sprintf(`daemon off;
+pid %s/nginx.pid;
+error_log %s/error.log;
+events {}
+http {
+    access_log %s/access.log;
+    server {
+        listen 127.0.0.1:%d;
+        location / {
+            proxy_pass http://127.0.0.1:%d;
+            proxy_http_version 1.1;
+            proxy_set_header Host $http_host;
+            proxy_set_header Connection "";
+        }
+    }
+}
+`, n.tmpDir, n.tmpDir, n.tmpDir, n.port, n.next)
+}
+
+// start writes the configuration of nginx and starts it, returning once it
+// accepts connections or ctx is done
+func (n *Nginx) start(ctx context.Context) error {
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(*workDir, "nginx")
+	if err != nil {
+		return err
+	}
+	n.tmpDir = dir
+
+	// nginx opens logs/error.log in its prefix before reading its
+	// configuration
+	if err := os.MkdirAll(path.Join(dir, "logs"), 0755); err != nil {
+		return err
+	}
+	conf := path.Join(dir, "nginx.conf")
+	if err := writeStringToFile(n.config(), conf); err != nil {
+		return err
+	}
+	n.cmd = exec.Command(*nginxPath, "-p", dir, "-c", conf)
+	if err := n.cmd.Start(); err != nil {
+		return err
+	}
+
+	// Stop waiting if nginx exits, for instance because of an invalid
+	// configuration
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd, exited := n.cmd, make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+		cancel()
+	}()
+
+	err = waitReady(waitCtx, tcpProbe{fmt.Sprintf("127.0.0.1:%d", n.port)}, *startupTimeout)
+	select {
+	case <-exited:
+		return fmt.Errorf("nginx exited while starting on port %d: %s, see %s", n.port, cmd.ProcessState, path.Join(dir, "error.log"))
+	default:
+		return err
+	}
+}
+
+func (n Nginx) stop() {
+	if n.cmd == nil || n.cmd.Process == nil {
+		// Never started
+		return
+	}
+	if err := n.cmd.Process.Kill(); err != nil {
+		slog.Error("Stopping nginx failed", "err", err)
+	}
+}
+
+func (n Nginx) cleanup() {
+	os.RemoveAll(n.tmpDir)
+}
+
+// startHops starts the given nginx hops, in reverse order so that each one
+// forwards requests to the following one, and the last one to next. The port
+// of the first one is returned, or next if there are no hops. The hops are
+// returned even on error, so that they can be stopped
+func startHops(ctx context.Context, kinds []string, next int) ([]Nginx, int, error) {
+	var hops []Nginx
+	for range kinds {
+		port, err := freePort()
+		if err != nil {
+			return hops, next, err
+		}
+		n := Nginx{port: port, next: next}
+		err = n.start(ctx)
+		hops = append(hops, n)
+		if err != nil {
+			return hops, next, fmt.Errorf("Starting nginx failed: %w", err)
+		}
+		next = port
+	}
+	return hops, next, nil
+}
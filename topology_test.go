@@ -0,0 +1,123 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTopology(t *testing.T) {
+	p, err := Parse(strings.NewReader(`topology {
+    hop "nginx"
+    hop "ats"
+    hop "nginx"
+}
+
+client "a" {
+    tx -url "/"
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Topology{"nginx", "ats", "nginx"}, p.Topology)
+	before, after := p.Topology.split()
+	assert.Equal(t, []string{"nginx"}, before)
+	assert.Equal(t, []string{"nginx"}, after)
+
+	before, after = Topology(nil).split()
+	assert.Empty(t, before)
+	assert.Empty(t, after)
+
+	// TLS requests skip the hops preceding the proxy, not those following it
+	_, err = Parse(strings.NewReader(`topology {
+    hop "ats"
+    hop "nginx"
+}
+
+client "a" {
+    tx -url "/" -tls
+}`))
+	assert.Nil(t, err)
+	_, err = Parse(strings.NewReader(`client "a" {
+    tx -url "/" -tls
+}
+
+topology {
+    hop "nginx"
+    hop "ats"
+}`))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, 5, err.(*ParseError).Line)
+	}
+
+	for _, input := range []string{
+		`topology {
+    hop "nginx"
+}`,
+		`topology {
+    hop "ats"
+    hop "ats"
+}`,
+		`topology {
+    hop "varnish"
+    hop "ats"
+}`,
+		`topology {
+    set "nginx"
+}`,
+		`topology "nginx"`,
+		`topology {
+    hop "ats"
+}
+topology {
+    hop "ats"
+}`,
+	} {
+		_, err := Parse(strings.NewReader(input + "\nclient \"a\" {\n    tx -url \"/\"\n}"))
+		assert.NotNil(t, err, input)
+	}
+}
+
+func TestNginxConfig(t *testing.T) {
+	n := Nginx{port: 8080, next: 8000, tmpDir: "/tmp/nginx"}
+	config := n.config()
+	assert.Contains(t, config, "daemon off;\n")
+	assert.Contains(t, config, "pid /tmp/nginx/nginx.pid;\n")
+	assert.Contains(t, config, "        listen 127.0.0.1:8080;\n")
+	assert.Contains(t, config, "            proxy_pass http://127.0.0.1:8000;\n")
+	assert.Contains(t, config, "            proxy_set_header Host $http_host;\n")
+}
+
+func TestStartHops(t *testing.T) {
+	defer func(p, dir string) { *nginxPath, *workDir = p, dir }(*nginxPath, *workDir)
+	*workDir = t.TempDir()
+
+	hops, next, err := startHops(t.Context(), nil, 8000)
+	assert.Nil(t, err)
+	assert.Empty(t, hops)
+	assert.Equal(t, 8000, next)
+
+	// nginx exiting right away, eg: because of an invalid configuration
+	*nginxPath = "false"
+	hops, next, err = startHops(t.Context(), []string{"nginx"}, 8000)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "nginx exited while starting")
+	}
+	assert.Len(t, hops, 1)
+	assert.Equal(t, 8000, next)
+	hops[0].stop()
+	hops[0].cleanup()
+}
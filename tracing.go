@@ -0,0 +1,281 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// OpenTelemetry traces of test runs, exported with OTLP over HTTP in JSON.
+// Client requests carry a W3C traceparent header, so that the spans emitted
+// by the proxy end up in the same trace
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// traceparentHeader propagates the trace context, see
+// https://www.w3.org/TR/trace-context/
+const traceparentHeader = "traceparent"
+
+// Span kinds, as defined by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// tracer is set with -otlp-endpoint, and nil otherwise. All methods of
+// Tracer and Span can be called on nil ones, doing nothing
+var tracer *Tracer
+
+// Tracer collects the spans of a run, all belonging to the same trace
+type Tracer struct {
+	endpoint string
+	traceID  [16]byte
+	// root is the parent of spans started without one
+	root *Span
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// Span is an operation of a run, such as starting the proxy or sending the
+// request of a client
+type Span struct {
+	tracer *Tracer
+	id     [8]byte
+	// parent is all zeroes for the root span
+	parent     [8]byte
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      map[string]string
+	failed     bool
+}
+
+// NewTracer returns a tracer exporting spans to the given OTLP endpoint, eg:
+// http://localhost:4318, with a root span of the given name
+func NewTracer(endpoint, name string) *Tracer {
+	t := &Tracer{endpoint: endpoint}
+	rand.Read(t.traceID[:])
+	t.root = t.start(name, spanKindInternal, nil)
+	return t
+}
+
+// start returns a new span. It is a child of parent, or of the root span if
+// parent is nil
+func (t *Tracer) start(name string, kind int, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	rand.Read(s.id[:])
+	if parent == nil {
+		parent = t.root
+	}
+	if parent != nil {
+		s.parent = parent.id
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// startRemote returns a new span, child of the one given in a traceparent
+// header if it belongs to the same trace, or of the root span otherwise
+func (t *Tracer) startRemote(name string, kind int, traceparent string) *Span {
+	s := t.start(name, kind, nil)
+	if s == nil {
+		return nil
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && parts[1] == hex.EncodeToString(t.traceID[:]) {
+		if id, err := hex.DecodeString(parts[2]); err == nil && len(id) == len(s.parent) {
+			copy(s.parent[:], id)
+		}
+	}
+	return s
+}
+
+// setAttr sets an attribute of the span, eg: http.request.method
+func (s *Span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// fail marks the span as failed
+func (s *Span) fail() {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.failed = true
+}
+
+// finish ends the span
+func (s *Span) finish() {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.end = time.Now()
+}
+
+// traceparent returns the traceparent header propagating the span
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.tracer.traceID[:]), hex.EncodeToString(s.id[:]))
+}
+
+// OTLP JSON encoding, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlp returns the spans collected so far in OTLP format. Spans not finished
+// yet end now
+func (t *Tracer) otlp() otlpTraces {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var scope otlpScopeSpans
+	scope.Scope.Name = "httptester"
+	now := time.Now()
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = now
+		}
+
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(t.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for key, value := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttribute{key, otlpValue{value}})
+		}
+		// Unset, or error
+		if s.failed {
+			span.Status.Code = 2
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue{"httptester"}}}
+	rs.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// export ends the root span and sends all spans to the OTLP endpoint
+func (t *Tracer) export() error {
+	if t == nil {
+		return nil
+	}
+	t.root.finish()
+
+	body, err := json.Marshal(t.otlp())
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(t.endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected status code received from OTLP endpoint %s: %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracerNil(t *testing.T) {
+	var tr *Tracer
+	span := tr.start("nothing", spanKindInternal, nil)
+	assert.Nil(t, span)
+	span.setAttr("a", "b")
+	span.fail()
+	span.finish()
+	assert.Nil(t, tr.startRemote("nothing", spanKindServer, ""))
+	assert.Nil(t, tr.export())
+}
+
+func TestRunTrace(t *testing.T) {
+	var received otlpTraces
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(&received))
+	}))
+	defer collector.Close()
+
+	tracer = NewTracer(collector.URL, "httptester test.htc")
+	defer func() { tracer = nil }()
+
+	report := runDirect(t, `handle "/" {
+    expect req.method eq "POST"
+    tx -status 200
+}
+
+client "nemo" {
+    tx -url "/"
+    expect resp.status eq 200
+}`)
+	assert.True(t, report.Failed())
+	assert.Nil(t, tracer.export())
+
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, 3, len(spans))
+	root, client, origin := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "httptester test.htc", root.Name)
+	assert.Equal(t, "", root.ParentSpanID)
+
+	assert.Equal(t, `client nemo`, client.Name)
+	assert.Equal(t, spanKindClient, client.Kind)
+	assert.Equal(t, root.SpanID, client.ParentSpanID)
+	assert.Equal(t, 0, client.Status.Code)
+	assert.Contains(t, client.Attributes, otlpAttribute{"http.response.status_code", otlpValue{"200"}})
+
+	// The origin continues the trace of the client, and fails
+	assert.Equal(t, `handle "/"`, origin.Name)
+	assert.Equal(t, spanKindServer, origin.Kind)
+	assert.Equal(t, client.SpanID, origin.ParentSpanID)
+	assert.Equal(t, 2, origin.Status.Code)
+	for _, span := range spans {
+		assert.Equal(t, root.TraceID, span.TraceID)
+	}
+
+	collector.Config.Handler = http.NotFoundHandler()
+	assert.Error(t, tracer.export())
+}
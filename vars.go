@@ -0,0 +1,301 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Variables set by client expectations and referenced by the requests of
+// later clients, eg:
+//
+//	expect resp.headers["X-Cache"] ~ "hit-(\w+)" capture $dc
+//	...
+//	tx -url "/datacenters/${dc}"
+//
+// Requests can also refer to the responses to the previous tx commands of
+// the same client, eg: ${resp[0].headers[Location]}, and to the responses
+// received by previous clients, eg: ${client["login"].resp.status}. The responses of handlers can refer to the
+// request received, eg: ${req.path} or ${req.headers[X-Request-Id]}
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// varReference matches references to variables in strings, eg: ${dc}
+var varReference = regexp.MustCompile(`\$\{([^{}]*)\}`)
+
+// references returns the names of the variables referenced in s
+func references(s string) []string {
+	var names []string
+	for _, m := range varReference.FindAllStringSubmatch(s, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// respReference matches references to responses: those to the tx commands
+// of the same client, given by their index, and those received by previous
+// clients, given by their name, quoted or not. Eg: resp[0].status or
+// client["login"].resp.headers[Location]
+var respReference = regexp.MustCompile(`^(?:resp\[([0-9]+)\]|client\[(?:"([^"]+)"|([^\[\]"]+))\]\.resp)\.(status|body|url|proto|(headers|trailers)\[([^\[\]]+)\])$`)
+
+// parseRespReference returns the name of the client referred to by name, or
+// the index of the step of the same client if client is empty, along with the
+// Expect whose actual value is the one referred to. ok is false if name does
+// not refer to a response
+func parseRespReference(name string) (client string, step int, exp Expect, ok bool) {
+	m := respReference.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, exp, false
+	}
+
+	client = m[2] + m[3]
+	if client == "" {
+		var err error
+		if step, err = strconv.Atoi(m[1]); err != nil {
+			return "", 0, exp, false
+		}
+	}
+
+	switch m[4] {
+	case "status":
+		exp.field = EXPECT_STATUS
+	case "body":
+		exp.field = EXPECT_BODY
+	case "url":
+		exp.field = EXPECT_URL
+	case "proto":
+		exp.field = EXPECT_PROTO
+	default:
+		exp.field = EXPECT_HEADERS
+		if m[5] == "trailers" {
+			exp.field = EXPECT_TRAILERS
+		}
+		exp.headerName = m[6]
+	}
+	return client, step, exp, true
+}
+
+// scope is what the requests of clients can refer to: the variables captured
+// and the responses received so far
+type scope struct {
+	vars map[string]string
+	// responses holds the last response received by each client by name, nil
+	// for clients which did not receive any
+	responses map[string]*ClientResponse
+	// steps holds the responses to the previous tx commands of the client
+	// sending the request, see with
+	steps []*ClientResponse
+}
+
+func newScope() *scope {
+	return &scope{vars: make(map[string]string), responses: make(map[string]*ClientResponse)}
+}
+
+// clone returns a copy of the scope, which can be used along with sc
+func (sc *scope) clone() *scope {
+	c := newScope()
+	for name, value := range sc.vars {
+		c.vars[name] = value
+	}
+	for name, resp := range sc.responses {
+		c.responses[name] = resp
+	}
+	return c
+}
+
+// with returns the scope of a request sent after steps, the responses to the
+// previous tx commands of the same client. It shares the variables and
+// responses of sc
+func (sc *scope) with(steps []*ClientResponse) *scope {
+	return &scope{vars: sc.vars, responses: sc.responses, steps: steps}
+}
+
+// lookup returns the value referred to by name. Variables not set, for
+// instance because the expectation capturing them failed, and responses not
+// received are empty
+func (sc *scope) lookup(name string) string {
+	if value, ok := sc.vars[name]; ok {
+		return value
+	}
+
+	client, step, exp, ok := parseRespReference(name)
+	if !ok {
+		return ""
+	}
+	resp := sc.responses[client]
+	if client == "" && step < len(sc.steps) {
+		resp = sc.steps[step]
+	}
+	if resp == nil {
+		return ""
+	}
+	value, _ := exp.ActualResponse(*resp)
+	return value
+}
+
+// expandVars replaces the references in s with the values they refer to
+func (sc *scope) expandVars(s string) string {
+	return varReference.ReplaceAllStringFunc(s, func(ref string) string {
+		return sc.lookup(ref[2 : len(ref)-1])
+	})
+}
+
+// references returns the names of the variables referenced by the request,
+// in its URL, host, headers and body
+func (r TxReq) references() []string {
+	names := append(references(r.uri), references(r.host)...)
+	for _, value := range r.headers {
+		names = append(names, references(value)...)
+	}
+	return append(names, references(string(r.body))...)
+}
+
+// expand returns a copy of the request where references are replaced by the
+// values they refer to. Absolute URLs, such as those found in Location
+// headers, are requested from the proxy for the host they name. The headers
+// are always copied, as the runner adds its own to those of the copy, which
+// must not change the program, eg: in watch mode
+func (r TxReq) expand(sc *scope) TxReq {
+	headers := make(map[string]string, len(r.headers))
+	for name, value := range r.headers {
+		headers[name] = value
+	}
+	if len(r.references()) == 0 {
+		r.headers = headers
+		return r
+	}
+
+	uri := r.uri
+	r.uri = sc.expandVars(r.uri)
+	r.host = sc.expandVars(r.host)
+	for name, value := range headers {
+		headers[name] = sc.expandVars(value)
+	}
+	r.headers = headers
+	if r.body != nil {
+		r.body = []byte(sc.expandVars(string(r.body)))
+	}
+
+	if u, err := url.Parse(r.uri); err == nil && u.IsAbs() && uri != r.uri && !r.absolute() {
+		r.uri = u.RequestURI()
+		if r.host == "" {
+			r.host = u.Host
+		}
+	}
+	return r
+}
+
+// capture stores the text matched by the groups of the regular expression
+// into the variables given with capture, if the expectation passed
+func (e Expect) capture(ev Evaluation, sc *scope) {
+	if !ev.Passed {
+		return
+	}
+	for i, name := range e.captures {
+		if i+1 < len(ev.Submatches) {
+			sc.vars[name] = ev.Submatches[i+1]
+		}
+	}
+}
+
+// reqReference matches references to the request received by a handler, eg:
+// req.path, req.headers[X-Request-Id] or req.query[q]
+var reqReference = regexp.MustCompile(`^req\.(method|path|url|host|body|(headers|query)\[([^\[\]]+)\])$`)
+
+// requestValue returns the value referred to by name in the given request,
+// whose body was already read. ok is false if name does not refer to the
+// request
+func requestValue(name string, req *http.Request, body []byte) (value string, ok bool) {
+	m := reqReference.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+
+	switch m[1] {
+	case "method":
+		return req.Method, true
+	case "path":
+		return req.URL.Path, true
+	case "url":
+		return req.URL.RequestURI(), true
+	case "host":
+		return req.Host, true
+	case "body":
+		return string(body), true
+	}
+	if m[2] == "headers" {
+		return req.Header.Get(m[3]), true
+	}
+	return req.URL.Query().Get(m[3]), true
+}
+
+// references returns the names of the variables referenced by the response,
+// in its headers, trailers, early hints and body
+func (r TxResp) references() []string {
+	var names []string
+	for _, m := range []map[string]string{r.headers, r.trailers, r.earlyHints} {
+		for _, value := range m {
+			names = append(names, references(value)...)
+		}
+	}
+	return append(names, references(string(r.body))...)
+}
+
+// checkReferences returns an error if the response refers to the request
+// received in a way not matched by reqReference, eg: ${req.header[Host]}
+func (r TxResp) checkReferences() error {
+	for _, name := range r.references() {
+		if strings.HasPrefix(name, "req.") && !reqReference.MatchString(name) {
+			return fmt.Errorf("Parse error in 'tx' command: invalid reference %q, expecting one of req.method, req.path, req.url, req.host, req.body, req.headers[$name] or req.query[$name]", name)
+		}
+	}
+	return nil
+}
+
+// expand returns a copy of the response where references to the request
+// received are replaced by its values. Other references are kept as they
+// are, for instance in body files
+func (r TxResp) expand(req *http.Request, body []byte) TxResp {
+	if len(r.references()) == 0 {
+		return r
+	}
+
+	expand := func(s string) string {
+		return varReference.ReplaceAllStringFunc(s, func(ref string) string {
+			if value, ok := requestValue(ref[2:len(ref)-1], req, body); ok {
+				return value
+			}
+			return ref
+		})
+	}
+	expandMap := func(m map[string]string) map[string]string {
+		expanded := make(map[string]string, len(m))
+		for name, value := range m {
+			expanded[name] = expand(value)
+		}
+		return expanded
+	}
+
+	r.headers = expandMap(r.headers)
+	r.trailers = expandMap(r.trailers)
+	r.earlyHints = expandMap(r.earlyHints)
+	if r.body != nil {
+		r.body = []byte(expand(string(r.body)))
+	}
+	return r
+}
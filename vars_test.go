@@ -0,0 +1,150 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandVars(t *testing.T) {
+	sc := newScope()
+	sc.vars["dc"], sc.vars["node"] = "fra", "cp1"
+
+	assert.Equal(t, []string{"dc", "node"}, references("/${dc}/${node}?x=${dc"))
+	assert.Equal(t, "/fra/cp1?x=${dc", sc.expandVars("/${dc}/${node}?x=${dc"))
+	assert.Equal(t, "/", sc.expandVars("/${missing}"))
+	assert.Equal(t, "$dc", sc.expandVars("$dc"))
+}
+
+func TestExpandResponses(t *testing.T) {
+	sc := newScope()
+	sc.responses["redirected"] = &ClientResponse{Response: http.Response{StatusCode: 301, Header: http.Header{"Location": {"http://www.example.org/new?x=1"}}}}
+	sc.responses["failed"] = nil
+
+	assert.Equal(t, "301", sc.expandVars(`${client["redirected"].resp.status}`))
+	assert.Equal(t, "301", sc.expandVars("${client[redirected].resp.status}"))
+	assert.Equal(t, "http://www.example.org/new?x=1", sc.expandVars(`${client["redirected"].resp.headers[Location]}`))
+	// Clients without a response, or not run yet
+	assert.Equal(t, "", sc.expandVars(`${client["failed"].resp.status}`))
+	assert.Equal(t, "", sc.expandVars(`${client["other"].resp.status}`))
+
+	// Steps of the same client
+	steps := sc.with([]*ClientResponse{{Response: http.Response{StatusCode: 200}}, nil})
+	assert.Equal(t, "200", steps.expandVars("${resp[0].status}"))
+	assert.Equal(t, "", steps.expandVars("${resp[1].status}"))
+	assert.Equal(t, "", steps.expandVars("${resp[2].status}"))
+	assert.Equal(t, "301", steps.expandVars(`${client["redirected"].resp.status}`))
+	assert.Equal(t, "", sc.expandVars("${resp[0].status}"))
+
+	client, step, _, ok := parseRespReference("resp[1].status")
+	assert.True(t, ok)
+	assert.Equal(t, "", client)
+	assert.Equal(t, 1, step)
+	client, _, _, ok = parseRespReference(`client["a b"].resp.trailers[X-Sum]`)
+	assert.True(t, ok)
+	assert.Equal(t, "a b", client)
+
+	for _, name := range []string{"resp[0]", "resp[a].status", "resp[0].headers", "resp[0].banana", "resp.status", `client["a"].status`, `client[].resp.status`, `client["a].resp.status`} {
+		_, _, _, ok := parseRespReference(name)
+		assert.False(t, ok, name)
+	}
+
+	// Absolute URLs are requested from the proxy
+	req := TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-url "${client[redirected].resp.headers[Location]}"`))))
+	req = req.expand(sc)
+	assert.Equal(t, "/new?x=1", req.uri)
+	assert.Equal(t, "www.example.org", req.host)
+}
+
+func TestTxReqExpand(t *testing.T) {
+	req := TxReq{}
+	assert.Nil(t, req.Parse(newScanner(strings.NewReader(`-url "/${dc}" -host "${node}.example.org" -header "X-Dc: ${dc}" -body "node=${node}"`))))
+	assert.ElementsMatch(t, []string{"dc", "node", "dc", "node"}, req.references())
+
+	sc := newScope()
+	sc.vars["dc"], sc.vars["node"] = "fra", "cp1"
+	expanded := req.expand(sc)
+	assert.Equal(t, "/fra", expanded.uri)
+	assert.Equal(t, "cp1.example.org", expanded.host)
+	assert.Equal(t, "fra", expanded.headers["X-Dc"])
+	assert.Equal(t, "node=cp1", string(expanded.body))
+
+	// The original request is left untouched
+	assert.Equal(t, "${dc}", req.headers["X-Dc"])
+
+	// Even without references, so that the headers added by the runner are
+	// not kept by the program
+	plain := TxReq{uri: "/", headers: map[string]string{"X-Dc": "fra"}}
+	expanded = plain.expand(sc)
+	expanded.headers[requestIDHeader] = "1"
+	assert.Equal(t, map[string]string{"X-Dc": "fra"}, plain.headers)
+}
+
+func TestTxRespExpand(t *testing.T) {
+	resp := TxResp{}
+	assert.Nil(t, resp.Parse(newScanner(strings.NewReader(`-header "X-Echo-Path: ${req.path}" -header "X-Echo-Id: ${req.headers[X-Request-Id]}" -trailer "X-Method: ${req.method}" -body "${req.host} ${req.url} q=${req.query[q]} ${req.body} ${dc}"`))))
+
+	req := httptest.NewRequest("POST", "/search?q=nemo", nil)
+	req.Host = "www.example.org"
+	req.Header.Set("X-Request-Id", "42")
+	expanded := resp.expand(req, []byte("ping"))
+	assert.Equal(t, "/search", expanded.headers["X-Echo-Path"])
+	assert.Equal(t, "42", expanded.headers["X-Echo-Id"])
+	assert.Equal(t, "POST", expanded.trailers["X-Method"])
+	// References to anything but the request are kept
+	assert.Equal(t, "www.example.org /search?q=nemo q=nemo ping ${dc}", string(expanded.body))
+
+	// The original response is left untouched
+	assert.Equal(t, "${req.path}", resp.headers["X-Echo-Path"])
+
+	for _, input := range []string{
+		`-header "X-Echo: ${req.header[Host]}"`,
+		`-body "${req.status}"`,
+		`-trailer "X-Echo: ${req.query}"`,
+	} {
+		resp := TxResp{}
+		assert.Error(t, resp.Parse(newScanner(strings.NewReader(input))), input)
+	}
+}
+
+func TestExpectCapture(t *testing.T) {
+	exp := Expect{}
+	assert.Nil(t, exp.Parse(newScanner(strings.NewReader(`resp.headers["X-Cache"] ~ "hit-(\\w+)-(\\w+)" within "1s" capture $dc $node`))))
+	assert.Equal(t, []string{"dc", "node"}, exp.captures)
+	assert.Equal(t, `resp.headers[X-Cache] ~ "hit-(\\w+)-(\\w+)" within "1s" capture $dc $node`, exp.verbatim)
+
+	sc := newScope()
+	resp := ClientResponse{Response: http.Response{Header: http.Header{"X-Cache": {"miss"}}}}
+	exp.capture(exp.Response(resp), sc)
+	assert.Empty(t, sc.vars)
+
+	resp.Header.Set("X-Cache", "hit-fra-cp1")
+	exp.capture(exp.Response(resp), sc)
+	assert.Equal(t, map[string]string{"dc": "fra", "node": "cp1"}, sc.vars)
+
+	// The command following the variables is not lost
+	s := newScanner(strings.NewReader("resp.body ~ \"(.+)\" capture $body # comment\nexpect"))
+	exp = Expect{}
+	assert.Nil(t, exp.Parse(s))
+	assert.Equal(t, []string{"body"}, exp.captures)
+	assert.Equal(t, NEWLINE, s.ScanUseful().typ)
+	assert.Equal(t, EXPECT, s.ScanUseful().typ)
+}
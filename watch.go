@@ -0,0 +1,123 @@
+// Copyright (C) 2020 Emanuele Rocca
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often the watched file is checked for changes
+const watchInterval = 500 * time.Millisecond
+
+// modTime returns the modification time of the given file, or the zero time
+// if it cannot be determined
+func modTime(filename string) time.Time {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// startFunc starts the deployment configured by a program, see
+// startDeployment
+type startFunc func(ctx context.Context, p Program) (deployment, error)
+
+// runOnce parses and runs the given file within the time given with
+// -timeout, logging the outcome. The deployment is restarted with start first
+// if the program configures it differently, or if it is not running, and the
+// network conditions of the program are applied to network
+func runOnce(filename string, origin *Origin, network *relay, d *deployment, start startFunc) {
+	p, err := parseFile(filename)
+	if err != nil {
+		slog.Error("Parsing failed", "err", err)
+		return
+	}
+
+	ctx, cancel := globalContext()
+	defer cancel()
+
+	if config := p.deploymentConfig(); d.addr == "" || !config.equal(d.config) {
+		if d.addr != "" {
+			slog.Info("Restarting the proxy with the new configuration")
+			d.stop(false)
+		}
+		if *d, err = start(ctx, p); err != nil {
+			slog.Error("Starting the proxy failed", "err", err)
+			return
+		}
+	}
+	network.set(p.Network)
+
+	var report Report
+	if *bench {
+		report, err = runBench(ctx, p, origin, d.addr, d.proxy)
+	} else {
+		report, err = run(ctx, p, origin, d.addr, d.proxy)
+	}
+	if err != nil {
+		slog.Error("Run failed", "err", err)
+		return
+	}
+
+	if !*bench {
+		report.Summary(os.Stdout)
+	}
+	if report.Failed() {
+		if !*quiet {
+			report.Print()
+		}
+		dump(report)
+		slog.Info("FAILED", "file", filename)
+	} else if report.Skipped != "" {
+		slog.Info("SKIPPED", "file", filename, "directive", report.Skipped)
+	} else {
+		slog.Info("PASSED", "file", filename)
+	}
+}
+
+// watchFile runs the given file against the deployment, and runs it again
+// whenever it changes, until interrupted. The origin and the relay the proxy
+// reaches it through are kept running in between, and so is the proxy unless
+// its configuration changes, see runOnce: the proxy cache is not cleared
+func watchFile(filename string, origin *Origin, network *relay, d *deployment, start startFunc) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	last := modTime(filename)
+	runOnce(filename, origin, network, d, start)
+	slog.Info("Watching for changes, interrupt to stop", "file", filename)
+
+	for {
+		select {
+		case <-sigs:
+			return
+		case <-ticker.C:
+			if mtime := modTime(filename); !mtime.Equal(last) {
+				last = mtime
+				runOnce(filename, origin, network, d, start)
+			}
+		}
+	}
+}